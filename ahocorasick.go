@@ -0,0 +1,114 @@
+package caddywaf
+
+// ahoCorasick is a case-insensitive (ASCII) multi-pattern matcher used by the "pm" and
+// "pmFromFile" operators. It is built once at rule load time and then tests a value
+// against every phrase in a single pass, regardless of how many phrases there are.
+type ahoCorasick struct {
+	nodes   []acNode
+	root    [256]int32 // Dense transition table for the root node, the hottest state
+	phrases []string
+}
+
+type acNode struct {
+	children map[byte]int32
+	fail     int32 // Longest proper suffix that is also a trie prefix
+	output   int32 // Index of a phrase ending here (directly or via a suffix), -1 if none
+}
+
+// newAhoCorasick builds the automaton for the given phrases. Empty phrases are ignored.
+func newAhoCorasick(phrases []string) *ahoCorasick {
+	ac := &ahoCorasick{
+		nodes:   []acNode{{children: map[byte]int32{}, output: -1}},
+		phrases: phrases,
+	}
+
+	// Build the trie of all phrases
+	for i, phrase := range phrases {
+		if phrase == "" {
+			continue
+		}
+		state := int32(0)
+		for j := 0; j < len(phrase); j++ {
+			c := asciiLower(phrase[j])
+			next, ok := ac.nodes[state].children[c]
+			if !ok {
+				next = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{children: map[byte]int32{}, output: -1})
+				ac.nodes[state].children[c] = next
+			}
+			state = next
+		}
+		if ac.nodes[state].output == -1 {
+			ac.nodes[state].output = int32(i)
+		}
+	}
+
+	// Compute failure links breadth-first, inheriting outputs along the way
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].children {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range ac.nodes[state].children {
+			fail := ac.nodes[state].fail
+			for {
+				if next, ok := ac.nodes[fail].children[c]; ok {
+					ac.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					ac.nodes[child].fail = 0
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			if ac.nodes[child].output == -1 {
+				ac.nodes[child].output = ac.nodes[ac.nodes[child].fail].output
+			}
+			queue = append(queue, child)
+		}
+	}
+
+	for c := 0; c < 256; c++ {
+		ac.root[c] = ac.nodes[0].children[byte(c)] // Missing children map to the root (0)
+	}
+	return ac
+}
+
+// Find returns the first phrase found in value and true, or "" and false when none matches.
+func (ac *ahoCorasick) Find(value string) (string, bool) {
+	state := int32(0)
+	for i := 0; i < len(value); i++ {
+		c := asciiLower(value[i])
+		for {
+			if state == 0 {
+				state = ac.root[c]
+				break
+			}
+			if next, ok := ac.nodes[state].children[c]; ok {
+				state = next
+				break
+			}
+			state = ac.nodes[state].fail
+		}
+		if out := ac.nodes[state].output; out >= 0 {
+			return ac.phrases[out], true
+		}
+	}
+	return "", false
+}
+
+// Match reports whether any phrase occurs in value.
+func (ac *ahoCorasick) Match(value string) bool {
+	_, found := ac.Find(value)
+	return found
+}
+
+func asciiLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
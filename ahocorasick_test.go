@@ -0,0 +1,145 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAhoCorasick_Find(t *testing.T) {
+	ac := newAhoCorasick([]string{"he", "she", "his", "hers", "", "C99.PHP"})
+
+	tests := []struct {
+		name   string
+		value  string
+		want   string
+		wantOK bool
+	}{
+		{"prefix phrase", "ahead", "he", true},
+		{"suffix via failure link", "ushers", "she", true},
+		{"inner phrase", "this", "his", true},
+		{"case insensitive phrase", "/uploads/c99.php?cmd=id", "C99.PHP", true},
+		{"case insensitive value", "USHERS", "she", true},
+		{"no match", "xyz", "", false},
+		{"empty value", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ac.Find(tt.value)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAhoCorasick_MatchesNaiveSearch(t *testing.T) {
+	phrases := []string{"select", "union", "sleep(", "benchmark(", "../", "etc/passwd", "onerror=", "<script"}
+	ac := newAhoCorasick(phrases)
+
+	values := []string{
+		"GET /index.php?id=1 UNION ALL SELECT", "/static/app.js", "q=hello world",
+		"file=..%2F..%2Fetc/passwd", "<img src=x OnError=alert(1)>", "1 AND SLEEP(5)", "sel ect",
+	}
+	for _, value := range values {
+		naive := false
+		for _, phrase := range phrases {
+			if strings.Contains(strings.ToLower(value), phrase) {
+				naive = true
+				break
+			}
+		}
+		assert.Equal(t, naive, ac.Match(value), "value %q", value)
+	}
+}
+
+func TestAhoCorasick_NoPhrases(t *testing.T) {
+	ac := newAhoCorasick(nil)
+	assert.False(t, ac.Match("anything"))
+}
+
+// benchmarkPhrases returns a large literal phrase list in the shape of scanner/webshell/path blocklists.
+func benchmarkPhrases(n int) []string {
+	phrases := []string{"nikto", "sqlmap", "acunetix", "nessus", "wpscan", "dirbuster", "c99.php", "r57.php", "/.git/config"}
+	for i := len(phrases); i < n; i++ {
+		phrases = append(phrases, fmt.Sprintf("/scanner-path-%d/probe.php", i))
+	}
+	return phrases
+}
+
+var benchmarkValue = strings.Repeat("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) ", 16) + "sqlmap/1.7"
+
+func BenchmarkPhraseMatch_AhoCorasick(b *testing.B) {
+	ac := newAhoCorasick(benchmarkPhrases(2000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ac.Match(benchmarkValue)
+	}
+}
+
+// BenchmarkPhraseMatch_RegexLoop mirrors one rule per phrase, evaluated one by one as handlePhase does.
+func BenchmarkPhraseMatch_RegexLoop(b *testing.B) {
+	phrases := benchmarkPhrases(2000)
+	regexes := make([]*regexp.Regexp, 0, len(phrases))
+	for _, phrase := range phrases {
+		regexes = append(regexes, regexp.MustCompile("(?i)"+regexp.QuoteMeta(phrase)))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, re := range regexes {
+			if re.MatchString(benchmarkValue) {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkPhraseMatch_RegexAlternation mirrors a single rule with one big alternation regex.
+func BenchmarkPhraseMatch_RegexAlternation(b *testing.B) {
+	phrases := benchmarkPhrases(2000)
+	quoted := make([]string, 0, len(phrases))
+	for _, phrase := range phrases {
+		quoted = append(quoted, regexp.QuoteMeta(phrase))
+	}
+	re := regexp.MustCompile("(?i)(?:" + strings.Join(quoted, "|") + ")")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		re.MatchString(benchmarkValue)
+	}
+}
+
+// BenchmarkBundledRules_RegexLoop measures the current per-rule regex loop over the bundled rule files.
+func BenchmarkBundledRules_RegexLoop(b *testing.B) {
+	var regexes []*regexp.Regexp
+	for _, file := range []string{"rules/vulnerability.json", "rules/spiderlabs.json"} {
+		content, err := os.ReadFile(filepath.FromSlash(file))
+		if err != nil {
+			b.Skipf("bundled rule file %s not available: %v", file, err)
+		}
+		var rules []Rule
+		if err := json.Unmarshal(content, &rules); err != nil {
+			b.Skipf("bundled rule file %s could not be parsed: %v", file, err)
+		}
+		for _, rule := range rules {
+			if re, err := regexp.Compile(rule.Pattern); err == nil {
+				regexes = append(regexes, re)
+			}
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, re := range regexes {
+			re.MatchString(benchmarkValue)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Scopes of the IP allowlist.
+const (
+	AllowlistScopeAll      = "all"       // Allowlisted clients bypass the WAF entirely
+	AllowlistScopeIPChecks = "ip_checks" // Allowlisted clients skip rate limiting, country blocking and the IP and DNS blacklists; the rules still run
+)
+
+// loadIPWhitelist builds the IP allowlist from ip_whitelist_file and allow_ips. It returns nil when
+// neither is configured.
+func (m *Middleware) loadIPWhitelist() (*CIDRTrie, error) {
+	if m.IPWhitelistFile == "" && len(m.AllowIPs) == 0 {
+		return nil, nil
+	}
+	whitelist := NewCIDRTrie()
+	if m.IPWhitelistFile != "" {
+		if err := m.loadIPBlacklist(m.IPWhitelistFile, whitelist); err != nil {
+			return nil, fmt.Errorf("failed to load IP whitelist: %w", err)
+		}
+	}
+	for _, entry := range m.AllowIPs {
+		if err := whitelist.InsertAddress(entry); err != nil {
+			return nil, fmt.Errorf("invalid allow_ips entry '%s': %w", entry, err)
+		}
+	}
+	return whitelist, nil
+}
+
+// isIPWhitelisted reports whether the client IP is on the allowlist.
+func (m *Middleware) isIPWhitelisted(ip string) bool {
+	m.mu.RLock()
+	whitelist := m.ipWhitelist
+	m.mu.RUnlock()
+	return whitelist != nil && whitelist.Contains(ip)
+}
+
+// checkIPWhitelist reports whether the request comes from an allowlisted client IP and bypasses the
+// WAF. With the ip_checks scope it only marks the request, so that handlePhase skips the IP-based checks.
+func (m *Middleware) checkIPWhitelist(r *http.Request, state *WAFState) bool {
+	ip := clientIP(r)
+	if !m.isIPWhitelisted(ip) {
+		return false
+	}
+	m.incrementIPWhitelistHitsMetric()
+	bypass := m.AllowlistScope != AllowlistScopeIPChecks
+	m.logger.Debug("Client IP is allowlisted",
+		zap.String("log_id", getLogID(r.Context())),
+		zap.String("client_ip", ip),
+		zap.Bool("bypass", bypass),
+	)
+	if !bypass {
+		state.IPAllowlisted = true
+	}
+	return bypass
+}
+
+func (m *Middleware) incrementIPWhitelistHitsMetric() {
+	m.muMetrics.Lock()
+	m.ipWhitelistHits++
+	m.muMetrics.Unlock()
+}
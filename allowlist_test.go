@@ -0,0 +1,150 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLoadIPWhitelist(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+	whitelist, err := m.loadIPWhitelist()
+	assert.NoError(t, err)
+	assert.Nil(t, whitelist, "no allowlist is configured")
+
+	file := filepath.Join(t.TempDir(), "whitelist.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("# office\n192.0.2.0/24\n198.51.100.7\n2001:db8::1\n"), 0644))
+	m = &Middleware{logger: zap.NewNop(), blacklistLoader: NewBlacklistLoader(nil), IPWhitelistFile: file, AllowIPs: []string{"203.0.113.0/28", "203.0.113.99"}}
+	whitelist, err = m.loadIPWhitelist()
+	assert.NoError(t, err)
+	for _, ip := range []string{"192.0.2.42", "198.51.100.7", "2001:db8::1", "203.0.113.15", "203.0.113.99"} {
+		assert.True(t, whitelist.Contains(ip), ip)
+	}
+	for _, ip := range []string{"198.51.100.8", "2001:db8::2", "203.0.113.16"} {
+		assert.False(t, whitelist.Contains(ip), ip)
+	}
+
+	_, err = (&Middleware{logger: zap.NewNop(), AllowIPs: []string{"not-an-ip"}}).loadIPWhitelist()
+	assert.Error(t, err)
+}
+
+func TestServeHTTP_IPWhitelist(t *testing.T) {
+	logger := zap.NewNop()
+	attack, err := compileOperator("contains", "attack", "")
+	assert.NoError(t, err)
+
+	newMiddleware := func(scope string) *Middleware {
+		rateLimiter, err := NewRateLimiter(RateLimit{Requests: 1, Window: time.Minute, CleanupInterval: time.Minute, MatchAllPaths: true})
+		assert.NoError(t, err)
+		m := &Middleware{
+			logger:           logger,
+			AnomalyThreshold: 5,
+			AllowIPs:         []string{"192.0.2.0/24"},
+			AllowlistScope:   scope,
+			Rules: map[int][]Rule{
+				2: {{ID: "attack", Phase: 2, Targets: []string{"URI"}, Score: 5, Action: ActionBlock, matcher: attack}},
+			},
+			rateLimiter:           rateLimiter,
+			ruleCache:             NewRuleCache(),
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+		}
+		m.ipWhitelist, err = m.loadIPWhitelist()
+		assert.NoError(t, err)
+		assert.NoError(t, m.ipBlacklist.Insert("192.0.2.0/25"))
+		return m
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	serve := func(m *Middleware, remoteAddr, uri string) int {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, req, next))
+		return w.Code
+	}
+
+	t.Run("scope all bypasses every phase", func(t *testing.T) {
+		m := newMiddleware("")
+		assert.Equal(t, http.StatusOK, serve(m, "192.0.2.1:4711", "/attack"))
+		assert.Equal(t, http.StatusOK, serve(m, "192.0.2.1:4711", "/attack"))
+		assert.Equal(t, int64(2), m.ipWhitelistHits)
+		assert.Equal(t, int64(0), m.blockedRequests)
+		assert.Equal(t, int64(2), m.allowedRequests)
+	})
+
+	t.Run("scope all still serves the metrics endpoint", func(t *testing.T) {
+		m := newMiddleware("")
+		m.MetricsEndpoint = "/waf_metrics"
+		req := httptest.NewRequest("GET", "/waf_metrics", nil)
+		req.RemoteAddr = "192.0.2.1:4711"
+		w := httptest.NewRecorder()
+		upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			_, err := w.Write([]byte("upstream"))
+			return err
+		})
+		assert.NoError(t, m.ServeHTTP(w, req, upstream))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Body.String(), `"total_requests"`)
+	})
+
+	t.Run("scope ip_checks still runs the rules", func(t *testing.T) {
+		m := newMiddleware(AllowlistScopeIPChecks)
+		assert.Equal(t, http.StatusOK, serve(m, "192.0.2.1:4711", "/"), "the blacklist is skipped")
+		assert.Equal(t, http.StatusOK, serve(m, "192.0.2.1:4711", "/"), "rate limiting is skipped")
+		assert.Equal(t, http.StatusForbidden, serve(m, "192.0.2.1:4711", "/attack"))
+		assert.Equal(t, int64(3), m.ipWhitelistHits)
+	})
+
+	t.Run("other clients are checked", func(t *testing.T) {
+		m := newMiddleware("")
+		assert.Equal(t, http.StatusOK, serve(m, "203.0.113.1:4711", "/"))
+		assert.Equal(t, http.StatusTooManyRequests, serve(m, "203.0.113.1:4711", "/"))
+		assert.Equal(t, http.StatusForbidden, serve(m, "203.0.113.2:4711", "/attack"))
+		assert.Equal(t, int64(0), m.ipWhitelistHits)
+	})
+}
+
+func TestReloadConfig_IPWhitelist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "whitelist.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("192.0.2.1\n"), 0644))
+	m := &Middleware{logger: zap.NewNop(), blacklistLoader: NewBlacklistLoader(nil), IPWhitelistFile: file, ruleCache: NewRuleCache()}
+	var err error
+	m.ipWhitelist, err = m.loadIPWhitelist()
+	assert.NoError(t, err)
+	assert.True(t, m.isIPWhitelisted("192.0.2.1"))
+
+	assert.NoError(t, os.WriteFile(file, []byte("192.0.2.2\n"), 0644))
+	assert.NoError(t, m.ReloadConfig())
+	assert.False(t, m.isIPWhitelisted("192.0.2.1"))
+	assert.True(t, m.isIPWhitelisted("192.0.2.2"))
+}
+
+func TestParseIPWhitelist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "whitelist.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("192.0.2.1\n"), 0644))
+
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n ip_whitelist_file " + file + "\n allow_ips 192.0.2.0/24 2001:db8::1\n allow_ips 198.51.100.7\n allowlist_scope ip_checks\n}")
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, file, m.IPWhitelistFile)
+	assert.Equal(t, []string{"192.0.2.0/24", "2001:db8::1", "198.51.100.7"}, m.AllowIPs)
+	assert.Equal(t, AllowlistScopeIPChecks, m.AllowlistScope)
+
+	for _, input := range []string{"ip_whitelist_file", "ip_whitelist_file /nonexistent/whitelist.txt", "allow_ips", "allow_ips 192.0.2.0/33", "allowlist_scope rules"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+}
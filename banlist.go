@@ -0,0 +1,468 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// banLists holds the ban lists with a state file, keyed by the file. On a config reload the new instance
+// shares the ban list of the old one instead of reading the file before the old one saved it, so that no
+// ban is lost and only one ban list writes the file.
+var banLists = caddy.NewUsagePool()
+
+// Defaults of the auto_ban policy.
+const (
+	defaultAutoBanWindow          = time.Minute
+	defaultAutoBanDuration        = 10 * time.Minute
+	defaultAutoBanMaxDuration     = 24 * time.Hour
+	defaultAutoBanEscalation      = 2.0
+	defaultAutoBanResetAfter      = 24 * time.Hour
+	defaultAutoBanCleanupInterval = time.Minute
+)
+
+// AutoBan configures the dynamic ban list: a client that gets Threshold requests blocked within Window
+// is banned for Duration, and for Escalation times longer on each repeat offense, up to MaxDuration.
+// Zero values fall back to the defaults; a zero Threshold disables the ban list.
+type AutoBan struct {
+	Threshold       int           `json:"threshold"`                  // Blocked requests within Window that trigger a ban
+	Window          time.Duration `json:"window,omitempty"`           // Period blocks are counted over
+	Duration        time.Duration `json:"duration,omitempty"`         // Length of the first ban
+	MaxDuration     time.Duration `json:"max_duration,omitempty"`     // Cap on escalated bans
+	Escalation      float64       `json:"escalation,omitempty"`       // Ban length multiplier per repeat offense
+	ResetAfter      time.Duration `json:"reset_after,omitempty"`      // Time after a ban expires until the offense is forgotten
+	IPv4Prefix      int           `json:"ipv4_prefix,omitempty"`      // Ban the /N around an IPv4 client (32: the address only)
+	IPv6Prefix      int           `json:"ipv6_prefix,omitempty"`      // Ban the /N around an IPv6 client (128: the address only)
+	StateFile       string        `json:"state_file,omitempty"`       // Bans are persisted here across restarts
+	CleanupInterval time.Duration `json:"cleanup_interval,omitempty"` // How often expired entries are dropped and the state file is written
+}
+
+// withDefaults returns the policy with zero values replaced by the defaults.
+func (c AutoBan) withDefaults() AutoBan {
+	if c.Window <= 0 {
+		c.Window = defaultAutoBanWindow
+	}
+	if c.Duration <= 0 {
+		c.Duration = defaultAutoBanDuration
+	}
+	if c.MaxDuration <= 0 {
+		c.MaxDuration = max(defaultAutoBanMaxDuration, c.Duration)
+	}
+	if c.Escalation <= 0 {
+		c.Escalation = defaultAutoBanEscalation
+	}
+	if c.ResetAfter <= 0 {
+		c.ResetAfter = defaultAutoBanResetAfter
+	}
+	if c.IPv4Prefix == 0 {
+		c.IPv4Prefix = 32
+	}
+	if c.IPv6Prefix == 0 {
+		c.IPv6Prefix = 128
+	}
+	if c.CleanupInterval <= 0 {
+		c.CleanupInterval = defaultAutoBanCleanupInterval
+	}
+	return c
+}
+
+// validate checks the policy after defaults have been applied.
+func (c AutoBan) validate() error {
+	if c.Threshold <= 0 {
+		return fmt.Errorf("auto_ban threshold must be positive")
+	}
+	if c.IPv4Prefix < 8 || c.IPv4Prefix > 32 {
+		return fmt.Errorf("auto_ban ipv4_prefix must be between 8 and 32, got %d", c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 16 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("auto_ban ipv6_prefix must be between 16 and 128, got %d", c.IPv6Prefix)
+	}
+	if c.Escalation < 1 {
+		return fmt.Errorf("auto_ban escalation must be at least 1, got %g", c.Escalation)
+	}
+	if c.MaxDuration < c.Duration {
+		return fmt.Errorf("auto_ban max_duration (%s) must not be shorter than duration (%s)", c.MaxDuration, c.Duration)
+	}
+	return nil
+}
+
+// banEntry tracks one offender, keyed by the banned prefix.
+type banEntry struct {
+	Prefix   string    `json:"prefix"`   // e.g. 192.0.2.7/32 or 2001:db8::/64
+	Until    time.Time `json:"until"`    // End of the current or last ban, zero if never banned
+	Offenses int       `json:"offenses"` // Bans issued so far, drives the escalation
+	blocks   []time.Time
+}
+
+// BanList holds the client IPs, or prefixes, banned by the auto_ban policy.
+type BanList struct {
+	sync.RWMutex
+	config         AutoBan
+	entries        map[string]*banEntry // Key: prefix
+	dirty          bool                 // Bans changed since the state file was written
+	logger         *zap.Logger
+	now            func() time.Time
+	stopCleanup    chan struct{}
+	bansIssued     int64        // Bans issued since startup
+	bannedRequests atomic.Int64 // Requests rejected because their client was banned; isBanned only holds the read lock
+}
+
+// NewBanList creates a ban list for the policy, applying the defaults.
+func NewBanList(config AutoBan, logger *zap.Logger) (*BanList, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &BanList{
+		config:      config,
+		entries:     make(map[string]*banEntry),
+		logger:      logger,
+		now:         time.Now,
+		stopCleanup: make(chan struct{}),
+	}, nil
+}
+
+// prefix returns the key a client IP is banned under, or "" if ip is not an IP address.
+// The caller holds the lock, since a reload may change the prefix lengths.
+func (bl *BanList) prefix(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := bl.config.IPv6Prefix
+	if addr.Is4() {
+		bits = bl.config.IPv4Prefix
+	}
+	return netip.PrefixFrom(addr, bits).Masked().String()
+}
+
+// isBanned reports whether the client IP is banned, and until when.
+func (bl *BanList) isBanned(ip string) (time.Time, bool) {
+	bl.RLock()
+	defer bl.RUnlock()
+	key := bl.prefix(ip)
+	if key == "" {
+		return time.Time{}, false
+	}
+	entry, ok := bl.entries[key]
+	if !ok || !entry.Until.After(bl.now()) {
+		return time.Time{}, false
+	}
+	bl.bannedRequests.Add(1)
+	return entry.Until, true
+}
+
+// recordBlock counts a blocked request against the client IP, and bans it once it reaches the threshold.
+// It returns the entry and true when a ban was issued.
+func (bl *BanList) recordBlock(ip string) (banEntry, bool) {
+	now := bl.now()
+	bl.Lock()
+	defer bl.Unlock()
+	key := bl.prefix(ip)
+	if key == "" {
+		return banEntry{}, false
+	}
+	entry, ok := bl.entries[key]
+	if !ok {
+		entry = &banEntry{Prefix: key}
+		bl.entries[key] = entry
+	}
+	if entry.Until.After(now) {
+		return banEntry{}, false // Already banned
+	}
+	if !entry.Until.IsZero() && now.Sub(entry.Until) > bl.config.ResetAfter {
+		entry.Offenses = 0 // The last ban is long over, start again from the first ban
+	}
+
+	entry.blocks = append(recentBlocks(entry.blocks, now.Add(-bl.config.Window)), now)
+	if len(entry.blocks) < bl.config.Threshold {
+		return banEntry{}, false
+	}
+	entry.Offenses++
+	entry.Until = now.Add(bl.banDuration(entry.Offenses))
+	entry.blocks = nil
+	bl.bansIssued++
+	bl.dirty = true
+	return *entry, true
+}
+
+// banDuration returns how long the nth ban of a client lasts.
+func (bl *BanList) banDuration(offenses int) time.Duration {
+	duration := float64(bl.config.Duration) * math.Pow(bl.config.Escalation, float64(offenses-1))
+	if duration > float64(bl.config.MaxDuration) {
+		return bl.config.MaxDuration
+	}
+	return time.Duration(duration)
+}
+
+// recentBlocks drops the block times before since.
+func recentBlocks(blocks []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(blocks) && !blocks[i].After(since) {
+		i++
+	}
+	return blocks[i:]
+}
+
+// activeBans returns the number of prefixes currently banned.
+func (bl *BanList) activeBans() int {
+	now := bl.now()
+	bl.RLock()
+	defer bl.RUnlock()
+	count := 0
+	for _, entry := range bl.entries {
+		if entry.Until.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// cleanupExpiredEntries forgets offenders that are neither banned nor blocked recently, and whose last
+// ban expired more than reset_after ago.
+func (bl *BanList) cleanupExpiredEntries() {
+	now := bl.now()
+	bl.Lock()
+	defer bl.Unlock()
+	for key, entry := range bl.entries {
+		entry.blocks = recentBlocks(entry.blocks, now.Add(-bl.config.Window))
+		if len(entry.blocks) > 0 || entry.Until.After(now) {
+			continue
+		}
+		if entry.Until.IsZero() || now.Sub(entry.Until) > bl.config.ResetAfter {
+			if !entry.Until.IsZero() {
+				bl.dirty = true
+			}
+			delete(bl.entries, key)
+		}
+	}
+}
+
+// load restores the bans saved in the state file. A missing file is not an error.
+func (bl *BanList) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ban state file: %w", err)
+	}
+	var saved []banEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse ban state file %s: %w", path, err)
+	}
+
+	now := bl.now()
+	bl.Lock()
+	defer bl.Unlock()
+	for _, entry := range saved {
+		prefix, err := netip.ParsePrefix(entry.Prefix)
+		if err != nil || entry.Offenses <= 0 || now.Sub(entry.Until) > bl.config.ResetAfter {
+			continue
+		}
+		entry.Prefix = prefix.Masked().String()
+		bl.entries[entry.Prefix] = &entry
+	}
+	return nil
+}
+
+// save writes the bans, and the offenses still remembered for escalation, to the state file. The file
+// is replaced atomically, so a crash never leaves it half written.
+func (bl *BanList) save(path string) error {
+	bl.Lock()
+	saved := make([]banEntry, 0, len(bl.entries))
+	for _, entry := range bl.entries {
+		if entry.Offenses > 0 {
+			saved = append(saved, banEntry{Prefix: entry.Prefix, Until: entry.Until, Offenses: entry.Offenses})
+		}
+	}
+	bl.dirty = false
+	bl.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode bans: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write ban state file: %w", err)
+	}
+	return nil
+}
+
+// saveIfChanged writes the state file if bans were issued or forgotten since it was last written.
+func (bl *BanList) saveIfChanged() {
+	bl.RLock()
+	stateFile, dirty := bl.config.StateFile, bl.dirty
+	bl.RUnlock()
+	if stateFile == "" || !dirty {
+		return
+	}
+	if err := bl.save(stateFile); err != nil {
+		bl.logger.Error("Failed to save bans", zap.String("file", stateFile), zap.Error(err))
+	}
+}
+
+// startCleanup starts the goroutine that periodically drops expired entries and saves the bans.
+func (bl *BanList) startCleanup() {
+	go func() {
+		interval := bl.cleanupInterval()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bl.cleanupExpiredEntries()
+				bl.saveIfChanged()
+				if changed := bl.cleanupInterval(); changed != interval { // Reconfigured by a reload
+					interval = changed
+					ticker.Reset(interval)
+				}
+			case <-bl.stopCleanup:
+				return
+			}
+		}
+	}()
+}
+
+// cleanupInterval returns how often expired entries are dropped and the bans saved.
+func (bl *BanList) cleanupInterval() time.Duration {
+	bl.RLock()
+	defer bl.RUnlock()
+	return bl.config.CleanupInterval
+}
+
+// reconfigure applies the policy of a reloaded config to a shared ban list. Its state file stays the same.
+func (bl *BanList) reconfigure(config AutoBan) {
+	bl.Lock()
+	defer bl.Unlock()
+	bl.config = config
+}
+
+// Destruct implements caddy.Destructor: once no config uses a shared ban list, its cleanup stops and
+// the bans are saved.
+func (bl *BanList) Destruct() error {
+	bl.signalStopCleanup()
+	return nil
+}
+
+// signalStopCleanup stops the cleanup goroutine and saves the bans a last time.
+func (bl *BanList) signalStopCleanup() {
+	bl.Lock()
+	select {
+	case <-bl.stopCleanup:
+		bl.Unlock()
+		return // Already stopped
+	default:
+		close(bl.stopCleanup)
+	}
+	bl.dirty = true
+	bl.Unlock()
+	bl.saveIfChanged()
+}
+
+// GetBansIssued returns the number of bans issued since startup.
+func (bl *BanList) GetBansIssued() int64 {
+	bl.RLock()
+	defer bl.RUnlock()
+	return bl.bansIssued
+}
+
+// GetBannedRequests returns the number of requests rejected because their client was banned.
+func (bl *BanList) GetBannedRequests() int64 {
+	return bl.bannedRequests.Load()
+}
+
+// setupBanList creates the ban list of the auto_ban policy and restores the saved bans. With a state
+// file, the ban list is shared with the instance a reload replaces, taking on the new policy.
+func (m *Middleware) setupBanList() error {
+	if m.AutoBan.Threshold <= 0 {
+		m.logger.Info("Automatic IP banning is disabled")
+		return nil
+	}
+	banList, err := NewBanList(m.AutoBan, m.logger)
+	if err != nil {
+		return fmt.Errorf("invalid auto_ban configuration: %w", err)
+	}
+	config := banList.config
+	if config.StateFile != "" {
+		shared, loaded, err := banLists.LoadOrNew(config.StateFile, func() (caddy.Destructor, error) {
+			if err := banList.load(config.StateFile); err != nil {
+				m.logger.Warn("Failed to restore bans, starting with an empty ban list", zap.Error(err))
+			}
+			banList.startCleanup()
+			return banList, nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set up ban list: %w", err)
+		}
+		banList = shared.(*BanList)
+		if loaded {
+			banList.reconfigure(config)
+		}
+	} else {
+		banList.startCleanup()
+	}
+	m.logger.Info("Automatic IP banning configuration",
+		zap.Int("threshold", config.Threshold),
+		zap.Duration("window", config.Window),
+		zap.Duration("duration", config.Duration),
+		zap.Duration("max_duration", config.MaxDuration),
+		zap.Float64("escalation", config.Escalation),
+		zap.Int("ipv4_prefix", config.IPv4Prefix),
+		zap.Int("ipv6_prefix", config.IPv6Prefix),
+		zap.String("state_file", config.StateFile),
+		zap.Int("restored_bans", banList.activeBans()),
+	)
+	m.banList = banList
+	return nil
+}
+
+// releaseBanList stops using the ban list, once. A ban list with a state file is stopped and saved when
+// no config uses it anymore; any other one right away.
+func (m *Middleware) releaseBanList() {
+	if m.banList == nil {
+		return
+	}
+	m.banListRelease.Do(func() {
+		if m.AutoBan.StateFile == "" {
+			m.banList.signalStopCleanup()
+			return
+		}
+		if _, err := banLists.Delete(m.AutoBan.StateFile); err != nil {
+			m.logger.Error("Failed to release ban list", zap.Error(err))
+		}
+	})
+}
+
+// recordBlock counts a blocked request against its client, which the auto_ban policy may then ban.
+// Requests rejected by a ban, and requests from allowlisted clients, do not count.
+func (m *Middleware) recordBlock(r *http.Request, state *WAFState) {
+	if m.banList == nil || state.banned || state.IPAllowlisted {
+		return
+	}
+	ip := clientIP(r)
+	entry, banned := m.banList.recordBlock(ip)
+	if !banned {
+		return
+	}
+	m.logger.Warn("Client IP banned",
+		zap.String("log_id", getLogID(r.Context())),
+		zap.String("client_ip", ip),
+		zap.String("prefix", entry.Prefix),
+		zap.Time("until", entry.Until),
+		zap.Int("offenses", entry.Offenses),
+	)
+}
@@ -0,0 +1,301 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// newTestBanList returns a ban list whose clock is advanced by the returned function.
+func newTestBanList(t *testing.T, config AutoBan) (*BanList, func(time.Duration)) {
+	t.Helper()
+	bl, err := NewBanList(config, zap.NewNop())
+	assert.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bl.now = func() time.Time { return now }
+	return bl, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBanList_ThresholdAndExpiry(t *testing.T) {
+	bl, advance := newTestBanList(t, AutoBan{Threshold: 3, Window: time.Minute, Duration: 10 * time.Minute})
+
+	for i := 0; i < 2; i++ {
+		_, banned := bl.recordBlock("192.0.2.1")
+		assert.False(t, banned)
+		advance(10 * time.Second)
+	}
+	_, banned := bl.isBanned("192.0.2.1")
+	assert.False(t, banned)
+
+	entry, banned := bl.recordBlock("192.0.2.1")
+	assert.True(t, banned)
+	assert.Equal(t, "192.0.2.1/32", entry.Prefix)
+	assert.Equal(t, 1, entry.Offenses)
+	until, banned := bl.isBanned("192.0.2.1")
+	assert.True(t, banned)
+	assert.Equal(t, entry.Until, until)
+	_, banned = bl.isBanned("192.0.2.2")
+	assert.False(t, banned, "only the offending address is banned")
+	assert.Equal(t, 1, bl.activeBans())
+
+	advance(10 * time.Minute)
+	_, banned = bl.isBanned("192.0.2.1")
+	assert.False(t, banned, "the ban expires")
+	assert.Equal(t, 0, bl.activeBans())
+	assert.Equal(t, int64(1), bl.GetBansIssued())
+	assert.Equal(t, int64(1), bl.GetBannedRequests())
+}
+
+func TestBanList_ConcurrentLookups(t *testing.T) {
+	bl, _ := newTestBanList(t, AutoBan{Threshold: 1, Duration: time.Minute})
+	_, banned := bl.recordBlock("192.0.2.1")
+	assert.True(t, banned)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				bl.isBanned("192.0.2.1")
+				bl.isBanned("192.0.2.2")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(800), bl.GetBannedRequests())
+}
+
+func TestBanList_Window(t *testing.T) {
+	bl, advance := newTestBanList(t, AutoBan{Threshold: 2, Window: time.Minute})
+	bl.recordBlock("192.0.2.1")
+	advance(2 * time.Minute)
+	_, banned := bl.recordBlock("192.0.2.1")
+	assert.False(t, banned, "blocks outside the window do not count")
+	_, banned = bl.recordBlock("192.0.2.1")
+	assert.True(t, banned)
+}
+
+func TestBanList_Escalation(t *testing.T) {
+	bl, advance := newTestBanList(t, AutoBan{Threshold: 1, Duration: time.Minute, Escalation: 3, MaxDuration: 5 * time.Minute, ResetAfter: time.Hour})
+
+	var durations []time.Duration
+	for i := 0; i < 4; i++ {
+		entry, banned := bl.recordBlock("2001:db8::1")
+		assert.True(t, banned)
+		durations = append(durations, entry.Until.Sub(bl.now()))
+		advance(entry.Until.Sub(bl.now()))
+	}
+	assert.Equal(t, []time.Duration{time.Minute, 3 * time.Minute, 5 * time.Minute, 5 * time.Minute}, durations)
+
+	advance(2 * time.Hour)
+	entry, _ := bl.recordBlock("2001:db8::1")
+	assert.Equal(t, 1, entry.Offenses, "offenses are forgotten after reset_after")
+	assert.Equal(t, time.Minute, entry.Until.Sub(bl.now()))
+}
+
+func TestBanList_Prefixes(t *testing.T) {
+	bl, _ := newTestBanList(t, AutoBan{Threshold: 2, IPv4Prefix: 24, IPv6Prefix: 64})
+
+	bl.recordBlock("192.0.2.1")
+	entry, banned := bl.recordBlock("::ffff:192.0.2.200")
+	assert.True(t, banned, "blocks from the same /24 add up")
+	assert.Equal(t, "192.0.2.0/24", entry.Prefix)
+	_, banned = bl.isBanned("192.0.2.77")
+	assert.True(t, banned)
+	_, banned = bl.isBanned("192.0.3.1")
+	assert.False(t, banned)
+
+	bl.recordBlock("2001:db8:0:1::1")
+	entry, banned = bl.recordBlock("2001:db8:0:1:ffff::2")
+	assert.True(t, banned)
+	assert.Equal(t, "2001:db8:0:1::/64", entry.Prefix)
+	_, banned = bl.isBanned("2001:db8:0:2::1")
+	assert.False(t, banned)
+
+	_, banned = bl.recordBlock("not-an-ip")
+	assert.False(t, banned)
+}
+
+func TestBanList_Cleanup(t *testing.T) {
+	bl, advance := newTestBanList(t, AutoBan{Threshold: 2, Window: time.Minute, Duration: time.Minute, ResetAfter: time.Hour})
+	bl.recordBlock("192.0.2.1")
+	bl.recordBlock("192.0.2.2")
+	bl.recordBlock("192.0.2.2")
+
+	advance(2 * time.Minute)
+	bl.cleanupExpiredEntries()
+	assert.NotContains(t, bl.entries, "192.0.2.1/32", "stale blocks are dropped")
+	assert.Contains(t, bl.entries, "192.0.2.2/32", "the offense is remembered for escalation")
+
+	advance(2 * time.Hour)
+	bl.cleanupExpiredEntries()
+	assert.Empty(t, bl.entries)
+}
+
+func TestBanList_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+	config := AutoBan{Threshold: 1, Duration: time.Hour, IPv4Prefix: 24, StateFile: file}
+	bl, _ := newTestBanList(t, config)
+	bl.recordBlock("192.0.2.1")
+	bl.recordBlock("198.51.100.1")
+	bl.saveIfChanged()
+
+	restored, advance := newTestBanList(t, config)
+	assert.NoError(t, restored.load(file))
+	_, banned := restored.isBanned("192.0.2.9")
+	assert.True(t, banned)
+	assert.Equal(t, 2, restored.activeBans())
+
+	advance(2 * time.Hour)
+	entry, _ := restored.recordBlock("192.0.2.1")
+	assert.Equal(t, 2, entry.Offenses, "restored offenses escalate the next ban")
+
+	assert.NoError(t, (&BanList{}).load(filepath.Join(t.TempDir(), "missing.json")))
+	assert.NoError(t, os.WriteFile(file, []byte("not json"), 0644))
+	assert.Error(t, restored.load(file))
+}
+
+func TestSetupBanList_SharedAcrossReloads(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+	newMiddleware := func(threshold int) *Middleware {
+		m := &Middleware{logger: zap.NewNop(), AutoBan: AutoBan{Threshold: threshold, StateFile: file}}
+		assert.NoError(t, m.setupBanList())
+		return m
+	}
+
+	old := newMiddleware(1)
+	_, banned := old.banList.recordBlock("192.0.2.1")
+	assert.True(t, banned)
+
+	// On a reload the new config is provisioned before the old one is cleaned up
+	reloaded := newMiddleware(2)
+	assert.Same(t, old.banList, reloaded.banList)
+	_, banned = reloaded.banList.isBanned("192.0.2.1")
+	assert.True(t, banned, "a ban issued since the last save survives the reload")
+	assert.Equal(t, 2, reloaded.banList.config.Threshold, "the new policy applies")
+	assert.NoError(t, old.Cleanup())
+	assert.NoError(t, old.Cleanup(), "the ban list is released once")
+	assert.NoFileExists(t, file, "the ban list is still in use")
+
+	_, banned = reloaded.banList.recordBlock("198.51.100.1")
+	assert.False(t, banned)
+	assert.NoError(t, reloaded.Cleanup())
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "192.0.2.1/32")
+
+	restarted := newMiddleware(1)
+	assert.NotSame(t, reloaded.banList, restarted.banList)
+	_, banned = restarted.banList.isBanned("192.0.2.1")
+	assert.True(t, banned, "restored from the state file")
+	assert.NoError(t, restarted.Cleanup())
+}
+
+func TestNewBanList_Invalid(t *testing.T) {
+	for _, config := range []AutoBan{
+		{},
+		{Threshold: 1, IPv4Prefix: 33},
+		{Threshold: 1, IPv6Prefix: 8},
+		{Threshold: 1, Escalation: 0.5},
+		{Threshold: 1, Duration: time.Hour, MaxDuration: time.Minute},
+	} {
+		_, err := NewBanList(config, nil)
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+func TestServeHTTP_AutoBan(t *testing.T) {
+	logger := zap.NewNop()
+	attack, err := compileOperator("contains", "attack", "")
+	assert.NoError(t, err)
+	m := &Middleware{
+		logger:           logger,
+		AnomalyThreshold: 5,
+		AllowIPs:         []string{"203.0.113.1"},
+		AllowlistScope:   AllowlistScopeIPChecks,
+		Rules: map[int][]Rule{
+			2: {{ID: "attack", Phase: 2, Targets: []string{"URI"}, Score: 5, Action: ActionBlock, matcher: attack}},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	m.ipWhitelist, err = m.loadIPWhitelist()
+	assert.NoError(t, err)
+	m.banList, err = NewBanList(AutoBan{Threshold: 2}, logger)
+	assert.NoError(t, err)
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	serve := func(remoteAddr, uri string) int {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, req, next))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:4711", "/attack"))
+	assert.Equal(t, http.StatusOK, serve("192.0.2.1:4711", "/"))
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:4711", "/attack"))
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.1:4711", "/"), "the client is banned")
+	assert.Equal(t, http.StatusOK, serve("192.0.2.2:4711", "/"))
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusForbidden, serve("203.0.113.1:4711", "/attack"))
+	}
+	assert.Equal(t, http.StatusOK, serve("203.0.113.1:4711", "/"), "allowlisted clients are not banned")
+
+	assert.Equal(t, int64(1), m.banList.GetBansIssued())
+	assert.Equal(t, int64(1), m.banList.GetBannedRequests())
+}
+
+func TestParseAutoBan(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`waf {
+		rule_file rules.json
+		auto_ban {
+			threshold 20
+			window 30s
+			duration 5m
+			max_duration 12h
+			escalation 1.5
+			reset_after 48h
+			ipv4_prefix 24
+			ipv6_prefix 64
+			state_file /var/lib/caddy/bans.json
+			cleanup_interval 2m
+		}
+	}`)
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, AutoBan{
+		Threshold:       20,
+		Window:          30 * time.Second,
+		Duration:        5 * time.Minute,
+		MaxDuration:     12 * time.Hour,
+		Escalation:      1.5,
+		ResetAfter:      48 * time.Hour,
+		IPv4Prefix:      24,
+		IPv6Prefix:      64,
+		StateFile:       "/var/lib/caddy/bans.json",
+		CleanupInterval: 2 * time.Minute,
+	}, m.AutoBan)
+
+	for _, block := range []string{"window 1m", "threshold 0", "threshold 5\n ipv4_prefix 40", "threshold 5\n escalation fast", "threshold 5\n ban_forever"} {
+		t.Run(block, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n auto_ban {\n " + block + "\n }\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+}
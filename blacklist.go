@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/oschwald/maxminddb-golang"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // BlacklistLoader handles loading IP and DNS blacklists from files.
@@ -64,17 +67,50 @@ func (bl *BlacklistLoader) LoadDNSBlacklistFromFile(path string, dnsBlacklist ma
 }
 
 func (m *Middleware) isIPBlacklisted(ip string) bool {
-	if m.ipBlacklist == nil { // Defensive check: ensure ipBlacklist is not nil
-		return false
+	_, blacklisted := m.lookupIPBlacklist(ip)
+	return blacklisted
+}
+
+// lookupIPBlacklist returns the entry of ip_blacklist_file or of an IP feed that lists the IP.
+func (m *Middleware) lookupIPBlacklist(ip string) (BlacklistEntry, bool) {
+	entry, found := BlacklistEntry{}, false
+	if m.ipBlacklist != nil { // Defensive check: ipBlacklist may be nil
+		entry, found = m.ipBlacklist.Lookup(ip)
+	}
+	if !found {
+		entry, found = m.feedLookup(ip)
+	}
+	if !found {
+		return BlacklistEntry{}, false // Indicate that the IP is NOT blacklisted
 	}
-	if m.ipBlacklist.Contains(ip) {
-		m.muIPBlacklistMetrics.Lock()                            // Acquire lock before accessing shared counter
-		m.IPBlacklistBlockCount++                                // Increment the counter
-		m.muIPBlacklistMetrics.Unlock()                          // Release lock after accessing counter
-		m.logger.Debug("IP blacklist hit", zap.String("ip", ip)) // Keep existing debug log
-		return true                                              // Indicate that the IP is blacklisted
+	m.logger.Debug("IP blacklist hit", append([]zap.Field{zap.String("ip", ip)}, entry.logFields()...)...)
+	return entry, true
+}
+
+// incrementIPBlacklistBlockCount counts a request blocked by the IP blacklist.
+func (m *Middleware) incrementIPBlacklistBlockCount() {
+	m.muIPBlacklistMetrics.Lock() // Acquire lock before accessing shared counter
+	m.IPBlacklistBlockCount++
+	m.muIPBlacklistMetrics.Unlock()
+}
+
+// blacklistEntryBlocks reports whether an IP blacklist entry blocks the request. An entry without a score
+// blocks it outright; an entry with a score adds it to the inbound anomaly score, and blocks the request
+// only once the score reaches the threshold, so that the rules of phase 2 can still tip it over.
+func (m *Middleware) blacklistEntryBlocks(r *http.Request, entry BlacklistEntry, state *WAFState) bool {
+	if entry.Score <= 0 {
+		return true
 	}
-	return false // Indicate that the IP is NOT blacklisted
+	rule := &Rule{ID: "ip_blacklist_rule", Phase: 1, Score: entry.Score, Tags: []string{"ip-blacklist"}}
+	oldScore := m.addRuleScore(rule, state)
+	m.logRequest(zapcore.DebugLevel, "Anomaly score increased by IP blacklist entry", r,
+		append(entry.logFields(),
+			zap.Int("old_score", oldScore),
+			zap.Int("new_score", state.InboundScore),
+			zap.Int("anomaly_threshold", m.anomalyThreshold(1)),
+		)...,
+	)
+	return state.InboundScore >= m.anomalyThreshold(1)
 }
 
 // isCountryInList checks if the IP's country is in the provided list using the GeoIP database.
@@ -94,15 +130,22 @@ func (m *Middleware) isDNSBlacklisted(host string) bool {
 	}
 
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	_, exists := m.dnsBlacklist[normalizedHost]
+	m.mu.RUnlock()
+	feed := ""
+	if !exists {
+		feed = m.feedListing(FeedTypeDNS, normalizedHost)
+		exists = feed != ""
+	}
 
-	if _, exists := m.dnsBlacklist[normalizedHost]; exists {
+	if exists {
 		m.muDNSBlacklistMetrics.Lock() // Acquire lock before accessing shared counter
 		m.DNSBlacklistBlockCount++
 		m.muDNSBlacklistMetrics.Unlock() // Release lock after accessing counter
 		m.logger.Debug("DNS blacklist hit",
 			zap.String("host", host),
 			zap.String("blacklisted_domain", normalizedHost),
+			zap.String("feed", feed),
 		)
 		return true
 	}
@@ -127,57 +170,48 @@ func extractIP(remoteAddr string, logger *zap.Logger) string {
 	return host
 }
 
-// LoadIPBlacklistFromFile loads IP addresses from a file into the provided map.
 // LoadIPBlacklistFromFile loads IP addresses from a file into the provided map.
 func (bl *BlacklistLoader) LoadIPBlacklistFromFile(path string, ipBlacklist map[string]struct{}) error {
-	bl.logger.Debug("Loading IP blacklist", zap.String("path", path))
-
-	file, err := os.Open(path)
+	entries, err := bl.LoadIPBlacklistEntries(path)
 	if err != nil {
-		bl.logger.Warn("Failed to open IP blacklist file", zap.String("path", path), zap.Error(err))
-		return fmt.Errorf("failed to open IP blacklist file: %w", err)
+		return err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	validEntries := 0
-	totalLines := 0
-	invalidEntries := 0
-
-	for scanner.Scan() {
-		totalLines++
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue // Skip empty lines and comments
+	for _, entry := range entries {
+		if err := bl.addIPEntry(entry.Value, ipBlacklist); err != nil {
+			bl.logger.Warn("Invalid IP/CIDR entry in blacklist file", zap.String("path", path), zap.String("entry", entry.Value))
 		}
+	}
+	return nil
+}
 
-		err = bl.addIPEntry(line, ipBlacklist)
-		if err != nil {
-			bl.logger.Warn("Invalid IP/CIDR entry in blacklist file",
-				zap.String("path", path),
-				zap.Int("line", totalLines),
-				zap.String("entry", line),
-			)
-			invalidEntries++
-			// If you want the entire load to fail if any single IP entry is invalid, uncomment the line below
-			// return fmt.Errorf("failed to add IP entry %s : %w", line, err)
-		} else {
-			validEntries++
-		}
+// LoadIPBlacklistEntries loads the entries of an IP blacklist file along with their metadata. A .csv file
+// is read as CSV; any other file may mix plain IPs and CIDRs, FireHOL netset, Spamhaus DROP and
+// start-end range lines. Entries without a source get the file name as their source.
+func (bl *BlacklistLoader) LoadIPBlacklistEntries(path string) ([]BlacklistEntry, error) {
+	bl.logger.Debug("Loading IP blacklist", zap.String("path", path))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		bl.logger.Warn("Failed to open IP blacklist file", zap.String("path", path), zap.Error(err))
+		return nil, fmt.Errorf("failed to open IP blacklist file: %w", err)
 	}
 
-	if scanner.Err() != nil {
-		bl.logger.Error("Error reading IP blacklist file", zap.String("path", path), zap.Error(scanner.Err()))
-		return fmt.Errorf("error reading IP blacklist file: %w", scanner.Err())
+	format := blacklistFormat(path)
+	entries, invalidEntries := parseBlacklist(data, format, filepath.Base(path))
+	if invalidEntries > 0 {
+		bl.logger.Warn("Skipped invalid entries in IP blacklist file",
+			zap.String("path", path),
+			zap.Int("invalid_entries", invalidEntries),
+		)
 	}
 
 	bl.logger.Info("IP blacklist loaded",
 		zap.String("path", path),
-		zap.Int("valid_entries", validEntries),
+		zap.String("format", format),
+		zap.Int("valid_entries", len(entries)),
 		zap.Int("invalid_entries", invalidEntries),
-		zap.Int("total_lines", totalLines),
 	)
-	return nil
+	return entries, nil
 }
 
 // Helper function to add an IP entry
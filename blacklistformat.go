@@ -0,0 +1,297 @@
+package caddywaf
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Formats of IP blacklist files and feeds. The line formats are parsed alike, line by line: each line holds
+// an IP, a CIDR or a start-end range, optionally followed by "; annotation" (Spamhaus DROP/EDROP) or a
+// "# comment". CSV files carry metadata per entry.
+const (
+	BlacklistFormatPlain  = "plain"  // One IP or CIDR per line
+	BlacklistFormatNetset = "netset" // FireHOL .netset
+	BlacklistFormatDrop   = "drop"   // Spamhaus DROP/EDROP: CIDR ; SBLnnnnnn
+	BlacklistFormatRange  = "range"  // start-end ranges, converted to CIDRs
+	BlacklistFormatCSV    = "csv"    // Header row, then ip,reason,source,added,expires,score columns
+)
+
+// BlacklistEntry is an IP blacklist entry with the metadata its list provides. Lookups return it, blocks
+// log it, and it stops matching once it expires.
+type BlacklistEntry struct {
+	Value   string    // IP or CIDR
+	Reason  string    // Logged as the reason of the block instead of ip_blacklist
+	Source  string    // List the entry comes from
+	AddedAt time.Time // When the list says the entry was added, or else when the list was loaded
+	Expires time.Time // Zero if the entry does not expire
+	Score   int       // If set, added to the anomaly score instead of blocking the request outright
+}
+
+// expired reports whether the entry has expired at now.
+func (e BlacklistEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// logFields returns the fields that describe the entry in the block log.
+func (e BlacklistEntry) logFields() []zap.Field {
+	fields := []zap.Field{
+		zap.String("blacklist_entry", e.Value),
+		zap.String("blacklist_source", e.Source),
+	}
+	if e.Reason != "" {
+		fields = append(fields, zap.String("blacklist_reason", e.Reason))
+	}
+	if !e.AddedAt.IsZero() {
+		fields = append(fields, zap.Time("blacklist_added_at", e.AddedAt))
+	}
+	if !e.Expires.IsZero() {
+		fields = append(fields, zap.Time("blacklist_expires_at", e.Expires))
+	}
+	if e.Score > 0 {
+		fields = append(fields, zap.Int("blacklist_score", e.Score))
+	}
+	return fields
+}
+
+// blacklistFormat returns the format of an IP blacklist file: csv for a .csv file, the line format otherwise.
+func blacklistFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return BlacklistFormatCSV
+	}
+	return BlacklistFormatPlain
+}
+
+// parseBlacklist parses an IP blacklist in one of the formats. Entries from source without a source of
+// their own get it, entries without an added date get the current time, and expired entries are left out.
+// It returns the number of lines that hold no valid entry.
+func parseBlacklist(data []byte, format, source string) ([]BlacklistEntry, int) {
+	var entries []BlacklistEntry
+	var invalid int
+	if format == BlacklistFormatCSV {
+		entries, invalid = parseBlacklistCSV(data)
+	} else {
+		entries, invalid = parseBlacklistLines(data)
+	}
+
+	now := time.Now()
+	valid := entries[:0]
+	for _, entry := range entries {
+		if entry.expired(now) {
+			continue
+		}
+		if entry.Source == "" {
+			entry.Source = source
+		}
+		if entry.AddedAt.IsZero() {
+			entry.AddedAt = now
+		}
+		valid = append(valid, entry)
+	}
+	return valid, invalid
+}
+
+// parseBlacklistLines parses the line formats: plain, netset, drop and range.
+func parseBlacklistLines(data []byte) ([]BlacklistEntry, int) {
+	var entries []BlacklistEntry
+	invalid := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line, annotation, _ := strings.Cut(line, ";")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue // Empty line, or a comment such as the "; Spamhaus DROP List" header
+		}
+		values, err := parseBlacklistValue(line)
+		if err != nil {
+			invalid++
+			continue
+		}
+		for _, value := range values {
+			entries = append(entries, BlacklistEntry{Value: value, Reason: strings.TrimSpace(annotation)})
+		}
+	}
+	return entries, invalid
+}
+
+// parseBlacklistCSV parses a CSV blacklist. The header row names the columns: ip (or cidr, network,
+// range), and optionally reason, source, added and expires (RFC 3339 or YYYY-MM-DD), and score.
+func parseBlacklistCSV(data []byte) ([]BlacklistEntry, int) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, 1
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "ip", "cidr", "network", "range":
+			name = "ip"
+		case "added", "added_at":
+			name = "added"
+		case "expires", "expires_at", "expiry":
+			name = "expires"
+		}
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	if _, ok := columns["ip"]; !ok {
+		return nil, 1 // Without an ip column, no row can be valid
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []BlacklistEntry
+	invalid := 0
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			invalid++
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+			break
+		}
+		values, err := parseBlacklistValue(field(record, "ip"))
+		if err != nil {
+			invalid++
+			continue
+		}
+		var added, expires time.Time
+		if value := field(record, "added"); value != "" {
+			if added, err = parseEntryTime(value); err != nil {
+				invalid++
+				continue
+			}
+		}
+		if value := field(record, "expires"); value != "" {
+			if expires, err = parseEntryTime(value); err != nil {
+				invalid++
+				continue
+			}
+		}
+		score := 0
+		if value := field(record, "score"); value != "" {
+			if score, err = strconv.Atoi(value); err != nil || score < 0 {
+				invalid++
+				continue
+			}
+		}
+		for _, value := range values {
+			entries = append(entries, BlacklistEntry{
+				Value:   value,
+				Reason:  field(record, "reason"),
+				Source:  field(record, "source"),
+				AddedAt: added,
+				Expires: expires,
+				Score:   score,
+			})
+		}
+	}
+	return entries, invalid
+}
+
+// parseEntryTime parses the date an entry was added or expires, as a timestamp (RFC 3339) or a day
+// (midnight UTC).
+func parseEntryTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// parseBlacklistValue validates an IP or a CIDR, or converts a start-end range to the CIDRs that cover it.
+func parseBlacklistValue(value string) ([]string, error) {
+	if start, end, ok := strings.Cut(value, "-"); ok {
+		first, err := netip.ParseAddr(strings.TrimSpace(start))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range start in '%s': %w", value, err)
+		}
+		last, err := netip.ParseAddr(strings.TrimSpace(end))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range end in '%s': %w", value, err)
+		}
+		prefixes, err := rangeToCIDRs(first, last)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, len(prefixes))
+		for i, prefix := range prefixes {
+			values[i] = prefix.String()
+		}
+		return values, nil
+	}
+	if strings.Contains(value, "/") {
+		if _, err := netip.ParsePrefix(value); err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+	if _, err := netip.ParseAddr(value); err != nil {
+		return nil, err
+	}
+	return []string{value}, nil
+}
+
+// rangeToCIDRs returns the fewest CIDRs that cover the addresses from first to last.
+func rangeToCIDRs(first, last netip.Addr) ([]netip.Prefix, error) {
+	first, last = first.Unmap(), last.Unmap()
+	if first.Is4() != last.Is4() {
+		return nil, fmt.Errorf("range %s-%s mixes IPv4 and IPv6", first, last)
+	}
+	if last.Less(first) {
+		return nil, fmt.Errorf("range %s-%s ends before it starts", first, last)
+	}
+
+	var prefixes []netip.Prefix
+	for {
+		// Grow the prefix while first stays its network address and it does not reach past last
+		bits := first.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(first, bits-1).Masked()
+			if wider.Addr() != first || last.Less(lastAddr(wider)) {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(first, bits)
+		prefixes = append(prefixes, prefix)
+		end := lastAddr(prefix)
+		if end == last {
+			return prefixes, nil
+		}
+		first = end.Next()
+	}
+}
+
+// lastAddr returns the last address of a prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(addr)*8; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
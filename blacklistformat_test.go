@@ -0,0 +1,264 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// withoutAddedAt checks that the entries got an added date when loaded, and clears it for comparison.
+func withoutAddedAt(t *testing.T, entries []BlacklistEntry) []BlacklistEntry {
+	t.Helper()
+	for i := range entries {
+		assert.False(t, entries[i].AddedAt.IsZero(), entries[i].Value)
+		entries[i].AddedAt = time.Time{}
+	}
+	return entries
+}
+
+func TestRangeToCIDRs(t *testing.T) {
+	tests := []struct {
+		first, last string
+		expected    []string
+	}{
+		{"192.0.2.7", "192.0.2.7", []string{"192.0.2.7/32"}},
+		{"192.0.2.0", "192.0.2.255", []string{"192.0.2.0/24"}},
+		{"192.0.2.1", "192.0.2.10", []string{"192.0.2.1/32", "192.0.2.2/31", "192.0.2.4/30", "192.0.2.8/31", "192.0.2.10/32"}},
+		{"10.0.0.0", "10.1.255.255", []string{"10.0.0.0/15"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"2001:db8::", "2001:db8::ffff", []string{"2001:db8::/112"}},
+		{"2001:db8::ffff", "2001:db8::1:0", []string{"2001:db8::ffff/128", "2001:db8::1:0/128"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.first+"-"+tt.last, func(t *testing.T) {
+			prefixes, err := rangeToCIDRs(netip.MustParseAddr(tt.first), netip.MustParseAddr(tt.last))
+			assert.NoError(t, err)
+			var cidrs []string
+			for _, prefix := range prefixes {
+				cidrs = append(cidrs, prefix.String())
+			}
+			assert.Equal(t, tt.expected, cidrs)
+		})
+	}
+
+	_, err := rangeToCIDRs(netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("192.0.2.1"))
+	assert.Error(t, err)
+	_, err = rangeToCIDRs(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1"))
+	assert.Error(t, err)
+}
+
+func TestParseBlacklist_Lines(t *testing.T) {
+	data := []byte(`; Spamhaus DROP List 2024/01/01 - (c) 2024 The Spamhaus Project
+; Last-Modified: Mon, 01 Jan 2024 00:00:00 GMT
+1.10.16.0/20 ; SBL256894
+# FireHOL netset
+#
+192.0.2.1
+198.51.100.0/24 # documentation
+203.0.113.0 - 203.0.113.127
+2001:db8::/32
+not-an-ip
+192.0.2.9-192.0.2.1
+`)
+	entries, invalid := parseBlacklist(data, BlacklistFormatDrop, "drop.txt")
+	assert.Equal(t, []BlacklistEntry{
+		{Value: "1.10.16.0/20", Reason: "SBL256894", Source: "drop.txt"},
+		{Value: "192.0.2.1", Source: "drop.txt"},
+		{Value: "198.51.100.0/24", Source: "drop.txt"},
+		{Value: "203.0.113.0/25", Source: "drop.txt"},
+		{Value: "2001:db8::/32", Source: "drop.txt"},
+	}, withoutAddedAt(t, entries))
+	assert.Equal(t, 2, invalid)
+}
+
+func TestParseBlacklist_CSV(t *testing.T) {
+	tomorrow := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	data := []byte(`IP,Reason,Source,Expires
+# Comment
+192.0.2.1,credential stuffing,abuse-desk,
+198.51.100.0/24,"scanner, aggressive",,` + tomorrow.Format(time.RFC3339) + `
+203.0.113.0-203.0.113.3,botnet,c2-tracker,2000-01-01
+bad-ip,whatever,,
+192.0.2.2,bad expiry,,next week
+`)
+	entries, invalid := parseBlacklist(data, BlacklistFormatCSV, "list.csv")
+	assert.Equal(t, []BlacklistEntry{
+		{Value: "192.0.2.1", Reason: "credential stuffing", Source: "abuse-desk"},
+		{Value: "198.51.100.0/24", Reason: "scanner, aggressive", Source: "list.csv", Expires: tomorrow},
+	}, withoutAddedAt(t, entries), "expired entries are left out")
+	assert.Equal(t, 2, invalid)
+
+	entries, invalid = parseBlacklist([]byte("reason,source\nscanner,abuse-desk\n"), BlacklistFormatCSV, "list.csv")
+	assert.Empty(t, entries, "a CSV file needs an ip column")
+	assert.Equal(t, 1, invalid)
+}
+
+func TestCIDRTrie_Lookup(t *testing.T) {
+	trie := NewCIDRTrie()
+	assert.NoError(t, trie.Insert("10.0.0.0/8"))
+	assert.NoError(t, trie.InsertEntry(BlacklistEntry{Value: "10.1.0.0/16", Reason: "SBL1", Source: "drop.txt"}))
+	assert.NoError(t, trie.InsertEntry(BlacklistEntry{Value: "2001:db8::1", Reason: "scanner"}))
+	assert.Error(t, trie.InsertEntry(BlacklistEntry{Value: "not-an-ip"}))
+
+	entry, ok := trie.Lookup("10.1.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, BlacklistEntry{Value: "10.1.0.0/16", Reason: "SBL1", Source: "drop.txt"}, entry, "the most specific network wins")
+
+	entry, ok = trie.Lookup("10.2.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, BlacklistEntry{Value: "10.0.0.0/8"}, entry)
+
+	entry, ok = trie.Lookup("2001:db8::1")
+	assert.True(t, ok)
+	assert.Equal(t, "scanner", entry.Reason)
+
+	_, ok = trie.Lookup("192.0.2.1")
+	assert.False(t, ok)
+	_, ok = trie.Lookup("invalid")
+	assert.False(t, ok)
+}
+
+func TestServeHTTP_BlacklistEntryReason(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "blocklist.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("ip,reason\n192.0.2.0/24,known scanner\n198.51.100.1,\n"), 0644))
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+	m := &Middleware{
+		logger:                logger,
+		AnomalyThreshold:      5,
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		blacklistLoader:       NewBlacklistLoader(logger),
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	assert.NoError(t, m.loadIPBlacklist(path, m.ipBlacklist))
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	blockReason := func(remoteAddr string) (int, string, string) {
+		logs.TakeAll()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, req, next))
+		blocked := logs.FilterMessage("Request blocked").All()
+		if len(blocked) == 0 {
+			return w.Code, "", ""
+		}
+		fields := blocked[0].ContextMap()
+		return w.Code, fields["reason"].(string), fields["blacklist_source"].(string)
+	}
+
+	code, reason, source := blockReason("192.0.2.7:4711")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "known scanner", reason)
+	assert.Equal(t, "blocklist.csv", source)
+
+	code, reason, _ = blockReason("198.51.100.1:4711")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, "ip_blacklist", reason, "entries without a reason keep the generic one")
+
+	code, _, _ = blockReason("203.0.113.1:4711")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestParseBlacklist_CSVMetadata(t *testing.T) {
+	data := []byte("ip,added_at,score\n192.0.2.1,2024-01-01,3\n192.0.2.2,,\n192.0.2.3,,-1\n192.0.2.4,yesterday,\n")
+	entries, invalid := parseBlacklist(data, BlacklistFormatCSV, "list.csv")
+	assert.Len(t, entries, 2)
+	assert.Equal(t, 2, invalid)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), entries[0].AddedAt)
+	assert.Equal(t, 3, entries[0].Score)
+	assert.WithinDuration(t, time.Now(), entries[1].AddedAt, time.Minute, "entries without an added date get the load time")
+	assert.Zero(t, entries[1].Score)
+}
+
+func TestCIDRTrie_Expiry(t *testing.T) {
+	trie := NewCIDRTrie()
+	assert.NoError(t, trie.InsertEntry(BlacklistEntry{Value: "10.0.0.0/8", Reason: "wide"}))
+	assert.NoError(t, trie.InsertEntry(BlacklistEntry{Value: "10.1.0.0/16", Reason: "expired", Expires: time.Now().Add(-time.Second)}))
+	assert.NoError(t, trie.InsertEntry(BlacklistEntry{Value: "192.0.2.1", Expires: time.Now().Add(-time.Second)}))
+	assert.NoError(t, trie.InsertEntry(BlacklistEntry{Value: "2001:db8::/32", Expires: time.Now().Add(50 * time.Millisecond)}))
+
+	entry, ok := trie.Lookup("10.1.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, "wide", entry.Reason, "an expired entry no longer hides the network around it")
+	assert.True(t, trie.Contains("10.1.2.3"))
+
+	_, ok = trie.Lookup("192.0.2.1")
+	assert.False(t, ok)
+	assert.False(t, trie.Contains("192.0.2.1"))
+
+	assert.True(t, trie.Contains("2001:db8::1"))
+	assert.Eventually(t, func() bool { return !trie.Contains("2001:db8::1") }, 5*time.Second, 10*time.Millisecond,
+		"entries stop matching when they expire, without a reload")
+	_, ok = trie.Lookup("2001:db8::1")
+	assert.False(t, ok)
+}
+
+func TestServeHTTP_BlacklistEntryScore(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+	attack, err := compileOperator("contains", "attack", "")
+	assert.NoError(t, err)
+	m := &Middleware{
+		logger:           logger,
+		logLevel:         zapcore.DebugLevel,
+		AnomalyThreshold: 5,
+		Rules: map[int][]Rule{
+			2: {{ID: "attack", Phase: 2, Targets: []string{"URI"}, Score: 2, matcher: attack}},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	expires := time.Now().Add(time.Hour)
+	assert.NoError(t, m.ipBlacklist.InsertEntry(BlacklistEntry{Value: "192.0.2.0/24", Reason: "suspicious", Source: "reputation.csv", Expires: expires, Score: 3}))
+	assert.NoError(t, m.ipBlacklist.InsertEntry(BlacklistEntry{Value: "198.51.100.1", Score: 5}))
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	serve := func(remoteAddr, uri string) int {
+		logs.TakeAll()
+		req := httptest.NewRequest("GET", uri, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, req, next))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("192.0.2.7:4711", "/"), "the entry's score alone stays below the threshold")
+	assert.Equal(t, http.StatusForbidden, serve("192.0.2.7:4711", "/attack"), "rule scores add to the entry's score")
+	assert.Equal(t, http.StatusOK, serve("203.0.113.1:4711", "/attack"))
+
+	assert.Zero(t, m.IPBlacklistBlockCount, "entries below the threshold are not counted as blocks")
+	assert.Equal(t, http.StatusForbidden, serve("198.51.100.1:4711", "/"), "a score that reaches the threshold blocks in phase 1")
+	assert.Equal(t, int64(1), m.IPBlacklistBlockCount)
+	blocked := logs.FilterMessage("Request blocked").All()
+	if assert.Len(t, blocked, 1) {
+		fields := blocked[0].ContextMap()
+		assert.Equal(t, "ip_blacklist", fields["reason"])
+		assert.Equal(t, int64(5), fields["blacklist_score"])
+	}
+
+	serve("192.0.2.7:4711", "/")
+	scored := logs.FilterMessage("Anomaly score increased by IP blacklist entry").All()
+	if assert.Len(t, scored, 1) {
+		fields := scored[0].ContextMap()
+		assert.Equal(t, "suspicious", fields["blacklist_reason"])
+		assert.Equal(t, "reputation.csv", fields["blacklist_source"])
+		assert.Equal(t, expires.UTC(), fields["blacklist_expires_at"].(time.Time).UTC())
+	}
+}
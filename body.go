@@ -0,0 +1,530 @@
+package caddywaf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Actions for a request body over request_body_limit or request_body_no_files_limit.
+const (
+	BodyLimitActionReject         = "reject"          // Block the request with 413 Request Entity Too Large
+	BodyLimitActionProcessPartial = "process_partial" // Inspect the body up to the limits and let the request through (default)
+)
+
+// Default request body limits, as recommended for ModSecurity.
+const (
+	defaultRequestBodyLimit         = 13107200 // 12.5 MiB
+	defaultRequestBodyNoFilesLimit  = 131072   // 128 KiB
+	defaultRequestBodyInMemoryLimit = 131072   // 128 KiB
+)
+
+// Names of the request body limits, as reported when a body exceeds one.
+const (
+	limitRequestBody        = "request_body_limit"
+	limitRequestBodyNoFiles = "request_body_no_files_limit"
+)
+
+// requestBodyLimits bounds how much of a request body is read and inspected. Zero means no limit.
+type requestBodyLimits struct {
+	limit            int64 // Whole body, including uploaded files
+	noFilesLimit     int64 // Form fields, JSON or XML data, i.e. everything but the content of uploaded files
+	inMemory         int64 // Bytes kept in memory; the rest of the inspected body is spooled to a temporary file
+	inspectOversized bool  // Read a body declared larger than limit up to the limit instead of leaving it unread
+	decompression    decompressionLimits
+}
+
+// requestBody is the request body parsed once according to its Content-Type. Rules read the
+// structured model instead of re-reading and re-parsing the raw body for every target.
+type requestBody struct {
+	raw      []byte        // In-memory part of the inspected body, the value of the BODY target
+	spool    *os.File      // Inspected bytes beyond the in-memory limit
+	size     int64         // Bytes inspected, in memory and spooled
+	decoded  []byte        // The inspected body decoded according to its Content-Encoding, if compressed
+	exceeded string        // Name of the limit the body exceeded, if any
+	args     []TargetValue // urlencoded fields, multipart non-file fields or flattened JSON members
+	files    []bodyFile    // multipart file parts
+	json     interface{}   // decoded JSON document, nil for other bodies
+	xml      []TargetValue // XML element text and attributes, named by path (e.g. "/order/item/@id")
+	err      error         // why the body could not be (fully) parsed, exposed as REQBODY_ERROR
+}
+
+// bodyFile is one file part of a multipart body. Its content is only counted, never kept.
+type bodyFile struct {
+	field       string
+	fileName    string
+	contentType string
+	size        int64
+}
+
+// replayBody replaces a request body that was read for inspection.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// requestBodyCache holds the parsed body for one request; ServeHTTP stores it in the request context.
+type requestBodyCache struct {
+	once sync.Once
+	body *requestBody
+}
+
+// withRequestBodyCache returns a context in which the request body is parsed at most once.
+func withRequestBodyCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ContextKeyRequestBody("requestBody"), &requestBodyCache{})
+}
+
+// releaseRequestBody removes the temporary file of a spooled request body once the request is done.
+func releaseRequestBody(r *http.Request) {
+	if cache, ok := r.Context().Value(ContextKeyRequestBody("requestBody")).(*requestBodyCache); ok && cache.body != nil {
+		cache.body.release()
+	}
+}
+
+// requestBody returns the parsed body of r, parsing it on first use. Without a cache in the request
+// context (e.g. when the extractor is used on its own) the body is parsed on every call, and kept
+// in memory since nothing would remove a temporary file.
+func (rve *RequestValueExtractor) requestBody(r *http.Request) *requestBody {
+	cache, ok := r.Context().Value(ContextKeyRequestBody("requestBody")).(*requestBodyCache)
+	if !ok {
+		limits := rve.bodyLimits
+		limits.inMemory = 0
+		return rve.parseRequestBody(r, limits)
+	}
+	cache.once.Do(func() { cache.body = rve.parseRequestBody(r, rve.bodyLimits) })
+	return cache.body
+}
+
+// parseRequestBody reads the body within limits and parses it as urlencoded, multipart, JSON or XML data.
+// Bodies of any other type are only available raw, through the BODY target. A body over a limit is
+// parsed up to the limit; a truncated document usually fails to parse, which sets REQBODY_ERROR.
+func (rve *RequestValueExtractor) parseRequestBody(r *http.Request, limits requestBodyLimits) *requestBody {
+	body := &requestBody{}
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return body
+	}
+	if limits.limit > 0 && r.ContentLength > limits.limit && !limits.inspectOversized {
+		body.exceeded = limitRequestBody // Rejected without reading it
+		return body
+	}
+	if err := body.read(r, limits); err != nil {
+		rve.logger.Error("Failed to read request body", zap.Error(err))
+		body.err = fmt.Errorf("failed to read request body: %w", err)
+		return body
+	}
+	if body.size == 0 {
+		return body
+	}
+	if codings := contentCodings(r.Header); len(codings) > 0 && !body.decompress(codings, limits) {
+		rve.logger.Debug("Request body could not be decompressed", zap.Strings("content_encoding", codings), zap.Error(body.err))
+		return body
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return body
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		body.err = fmt.Errorf("malformed Content-Type '%s': %w", contentType, err)
+		return body
+	}
+
+	isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	isXML := mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+	switch {
+	case mediaType == "multipart/form-data":
+		var exceeded bool
+		body.args, body.files, exceeded, body.err = parseMultipartBody(body.reader(), params["boundary"], limits.noFilesLimit)
+		if exceeded {
+			body.exceed(limitRequestBodyNoFiles)
+		}
+	case mediaType == "application/x-www-form-urlencoded" || isJSON || isXML:
+		data, err := readLimited(body.reader(), limits.noFilesLimit)
+		if err != nil {
+			body.err = fmt.Errorf("failed to read request body: %w", err)
+			break
+		}
+		if limits.noFilesLimit > 0 && int64(len(data)) > limits.noFilesLimit {
+			body.exceed(limitRequestBodyNoFiles)
+			data = data[:limits.noFilesLimit]
+		}
+		body.parse(mediaType, data, isJSON, isXML)
+	}
+	if body.err != nil {
+		rve.logger.Debug("Request body could not be parsed",
+			zap.String("content_type", contentType),
+			zap.Error(body.err),
+		)
+	}
+	return body
+}
+
+// parse parses urlencoded, JSON or XML data.
+func (body *requestBody) parse(mediaType string, data []byte, isJSON, isXML bool) {
+	switch {
+	case isJSON:
+		if err := json.Unmarshal(data, &body.json); err != nil {
+			body.err = fmt.Errorf("malformed JSON body: %w", err)
+			return
+		}
+		flattenJSON("", body.json, &body.args)
+	case isXML:
+		body.xml, body.err = parseXMLBody(data)
+	default:
+		form, err := url.ParseQuery(string(data))
+		body.args = sortedValues(form) // Keep whatever parsed before a malformed pair
+		if err != nil {
+			body.err = fmt.Errorf("malformed urlencoded body: %w", err)
+		}
+	}
+}
+
+// read reads up to limits.limit bytes of the body for inspection (plus one, to detect a larger body),
+// keeping the first limits.inMemory bytes in memory and spooling the rest to a temporary file.
+// r.Body is replaced by a reader that replays everything read followed by whatever was left unread,
+// so the upstream handler still receives the whole body.
+func (body *requestBody) read(r *http.Request, limits requestBodyLimits) error {
+	original := r.Body
+	var src io.Reader = original
+	if limits.limit > 0 {
+		src = io.LimitReader(original, limits.limit+1)
+	}
+
+	var memory bytes.Buffer
+	var spooled int64
+	var err error
+	if limits.inMemory > 0 {
+		_, err = io.CopyN(&memory, src, limits.inMemory)
+		if err == io.EOF {
+			err = nil
+		} else if err == nil { // The body may not fit in memory
+			spooled, err = body.spoolRest(src)
+		}
+	} else {
+		_, err = memory.ReadFrom(src)
+	}
+
+	replay := []io.Reader{bytes.NewReader(memory.Bytes())}
+	if body.spool != nil {
+		replay = append(replay, io.NewSectionReader(body.spool, 0, spooled))
+	}
+	r.Body = replayBody{Reader: io.MultiReader(append(replay, original)...), Closer: original}
+
+	body.raw = memory.Bytes()
+	body.size = int64(len(body.raw)) + spooled
+	if limits.limit > 0 && body.size > limits.limit {
+		body.exceeded = limitRequestBody
+		body.size = limits.limit
+		if int64(len(body.raw)) > limits.limit {
+			body.raw = body.raw[:limits.limit]
+		}
+	}
+	return err
+}
+
+// decompress decodes a compressed body for inspection, within the decompression limits; the upstream
+// handler still receives the original bytes. From then on the rules see the decoded body, and BODY its
+// first limits.inMemory bytes. It reports whether the body could be decoded.
+func (body *requestBody) decompress(codings []string, limits requestBodyLimits) bool {
+	decoded, exceeded, err := decompressBody(codings, body.reader(), body.size, limits.decompression)
+	body.decoded = decoded
+	body.raw = decoded
+	if limits.inMemory > 0 && int64(len(body.raw)) > limits.inMemory {
+		body.raw = body.raw[:limits.inMemory]
+	}
+	if exceeded != "" {
+		body.exceed(exceeded)
+	}
+	if err != nil {
+		body.err = err
+		return false
+	}
+	return true
+}
+
+// spoolRest copies the rest of src to a temporary file, which is only kept if src was not empty.
+func (body *requestBody) spoolRest(src io.Reader) (int64, error) {
+	file, err := os.CreateTemp("", "caddy-waf-body-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	body.spool = file
+	written, err := io.Copy(file, src)
+	if err == nil && written == 0 {
+		body.release()
+	}
+	return written, err
+}
+
+// reader returns the inspected body: the decoded body of a compressed one, or else the in-memory part
+// followed by the spooled part.
+func (body *requestBody) reader() io.Reader {
+	if body.decoded != nil {
+		return bytes.NewReader(body.decoded)
+	}
+	if body.spool == nil {
+		return bytes.NewReader(body.raw)
+	}
+	return io.MultiReader(bytes.NewReader(body.raw), io.NewSectionReader(body.spool, 0, body.size-int64(len(body.raw))))
+}
+
+// exceed records that the body exceeded a limit, keeping the first one.
+func (body *requestBody) exceed(limit string) {
+	if body.exceeded == "" {
+		body.exceeded = limit
+	}
+}
+
+// release closes and removes the temporary file of a spooled body.
+func (body *requestBody) release() {
+	if body.spool == nil {
+		return
+	}
+	body.spool.Close()
+	os.Remove(body.spool.Name())
+	body.spool = nil
+}
+
+// readLimited reads up to limit bytes plus one, so that the caller can tell a longer input apart,
+// or everything if limit is 0.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	return io.ReadAll(r)
+}
+
+// parseMultipartBody splits a multipart body into its form fields and file parts. File contents
+// are read but not kept; the other parts are limited to noFilesLimit bytes in total, and the third
+// return value reports whether they exceeded it.
+func parseMultipartBody(r io.Reader, boundary string, noFilesLimit int64) ([]TargetValue, []bodyFile, bool, error) {
+	if boundary == "" {
+		return nil, nil, false, fmt.Errorf("multipart body has no boundary")
+	}
+	reader := multipart.NewReader(r, boundary)
+	var args []TargetValue
+	var files []bodyFile
+	var noFiles int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return args, files, false, nil
+		}
+		if err != nil {
+			return args, files, false, fmt.Errorf("malformed multipart body: %w", err)
+		}
+		if part.FormName() == "" {
+			continue
+		}
+		if part.FileName() != "" {
+			size, err := io.Copy(io.Discard, part)
+			if err != nil {
+				return args, files, false, fmt.Errorf("malformed multipart body: %w", err)
+			}
+			files = append(files, bodyFile{
+				field:       part.FormName(),
+				fileName:    part.FileName(),
+				contentType: part.Header.Get("Content-Type"),
+				size:        size,
+			})
+			continue
+		}
+		src := io.Reader(part)
+		if noFilesLimit > 0 {
+			src = io.LimitReader(part, noFilesLimit-noFiles+1)
+		}
+		value, err := io.ReadAll(src)
+		if err != nil {
+			return args, files, false, fmt.Errorf("malformed multipart body: %w", err)
+		}
+		noFiles += int64(len(value))
+		if noFilesLimit > 0 && noFiles > noFilesLimit {
+			value = value[:int64(len(value))-(noFiles-noFilesLimit)]
+			args = append(args, TargetValue{Name: part.FormName(), Value: string(value)})
+			return args, files, true, nil
+		}
+		args = append(args, TargetValue{Name: part.FormName(), Value: string(value)})
+	}
+}
+
+// parseXMLBody returns the text of every element and the value of every attribute, named by
+// their slash separated path from the root, e.g. "/order/item" and "/order/item/@id".
+// The text of an element is the concatenation of its own character data, trimmed.
+func parseXMLBody(raw []byte) ([]TargetValue, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+	var values []TargetValue
+	var path []string
+	var text []*strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil // The decoder reports unclosed elements as a syntax error
+		}
+		if err != nil {
+			return values, fmt.Errorf("malformed XML body: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			text = append(text, &strings.Builder{})
+			elementPath := "/" + strings.Join(path, "/")
+			for _, attr := range t.Attr {
+				values = append(values, TargetValue{Name: elementPath + "/@" + attr.Name.Local, Value: attr.Value})
+			}
+		case xml.CharData:
+			if len(text) > 0 {
+				text[len(text)-1].Write(t)
+			}
+		case xml.EndElement:
+			if value := strings.TrimSpace(text[len(text)-1].String()); value != "" {
+				values = append(values, TargetValue{Name: "/" + strings.Join(path, "/"), Value: value})
+			}
+			path = path[:len(path)-1]
+			text = text[:len(text)-1]
+		}
+	}
+}
+
+// matchXMLPath reports whether the path of an XML value is selected by an XPath-like expression.
+// Supported are absolute paths ("/order/item"), "*" for any single step, a leading "//" for
+// any ancestors ("//item/@id") and "/*" or "*" for every value.
+func matchXMLPath(selector, name string) bool {
+	if selector == TargetCollectionAll || selector == "/"+TargetCollectionAll {
+		return true
+	}
+	nameSteps := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if strings.HasPrefix(selector, "//") {
+		steps := strings.Split(selector[2:], "/")
+		return len(nameSteps) >= len(steps) && matchXMLSteps(steps, nameSteps[len(nameSteps)-len(steps):])
+	}
+	steps := strings.Split(strings.TrimPrefix(selector, "/"), "/")
+	return len(nameSteps) == len(steps) && matchXMLSteps(steps, nameSteps)
+}
+
+func matchXMLSteps(steps, nameSteps []string) bool {
+	for i, step := range steps {
+		if step != nameSteps[i] && !(step == TargetCollectionAll && !strings.HasPrefix(nameSteps[i], "@")) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestBodyLimits returns the configured request body limits, falling back to the defaults.
+// A body declared larger than request_body_limit is still read up to the limit when it is
+// not going to be rejected, i.e. with process_partial or in detection_only mode.
+func (m *Middleware) requestBodyLimits() requestBodyLimits {
+	limits := requestBodyLimits{
+		limit:            m.RequestBodyLimit,
+		noFilesLimit:     m.RequestBodyNoFilesLimit,
+		inMemory:         m.RequestBodyInMemoryLimit,
+		inspectOversized: m.bodyLimitAction() == BodyLimitActionProcessPartial || m.detectionOnly(),
+		decompression:    m.decompressionLimits(),
+	}
+	if limits.limit == 0 {
+		limits.limit = defaultRequestBodyLimit
+	}
+	if limits.noFilesLimit == 0 {
+		limits.noFilesLimit = defaultRequestBodyNoFilesLimit
+	}
+	if limits.inMemory == 0 {
+		limits.inMemory = defaultRequestBodyInMemoryLimit
+	}
+	return limits
+}
+
+// bodyLimitAction returns request_body_limit_action, process_partial unless it is set.
+func (m *Middleware) bodyLimitAction() string {
+	if m.RequestBodyLimitAction == "" {
+		return BodyLimitActionProcessPartial
+	}
+	return m.RequestBodyLimitAction
+}
+
+// rulesReadRequestBody reports whether a rule, or a condition of its chain, reads the request body.
+func rulesReadRequestBody(rules map[int][]Rule) bool {
+	for _, phaseRules := range rules {
+		for _, rule := range phaseRules {
+			if slices.ContainsFunc(rule.Targets, readsRequestBody) {
+				return true
+			}
+			for _, condition := range rule.Chain {
+				if slices.ContainsFunc(condition.Targets, readsRequestBody) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// checkRequestBodyLimits blocks a request whose body exceeds request_body_limit, request_body_no_files_limit
+// or a configured decompression guard with 413 if request_body_limit_action is reject; with process_partial,
+// or when a default decompression guard trips, the rules inspect the body up to the limits. The body is only
+// read if a loaded rule inspects it. Otherwise reject still applies to request_body_limit: a body declared
+// larger is blocked, and one that streams past it fails upstream with an *http.MaxBytesError.
+func (m *Middleware) checkRequestBodyLimits(w http.ResponseWriter, r *http.Request, state *WAFState) {
+	if !m.requestBodyRules.Load() {
+		m.enforceRequestBodyLimit(w, r, state)
+		return
+	}
+	body := m.requestValueExtractor.requestBody(r)
+	if body.exceeded == "" {
+		return
+	}
+	m.incrementRequestBodyLimitExceededMetric()
+	if m.bodyLimitAction() == BodyLimitActionProcessPartial || !m.decompressionGuardConfigured(body.exceeded) {
+		m.logRequest(zapcore.InfoLevel, "Request body exceeds limit, inspecting it partially", r,
+			zap.String("limit", body.exceeded),
+			zap.Int64("inspected_bytes", body.size),
+		)
+		return
+	}
+	m.blockRequestBodyLimit(w, r, state, body.exceeded)
+}
+
+// enforceRequestBodyLimit applies request_body_limit_action reject to a body that no rule reads, so it is
+// never inspected: a body declared larger than request_body_limit is blocked without reading it, and any
+// other body is cut off at the limit as the upstream handler reads it.
+func (m *Middleware) enforceRequestBodyLimit(w http.ResponseWriter, r *http.Request, state *WAFState) {
+	if m.bodyLimitAction() != BodyLimitActionReject || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	limit := m.requestBodyLimits().limit
+	if r.ContentLength > limit {
+		m.incrementRequestBodyLimitExceededMetric()
+		m.blockRequestBodyLimit(w, r, state, limitRequestBody)
+		return
+	}
+	if !m.detectionOnly() {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+}
+
+// blockRequestBodyLimit blocks a request whose body exceeds limit with 413.
+func (m *Middleware) blockRequestBodyLimit(w http.ResponseWriter, r *http.Request, state *WAFState, limit string) {
+	m.blockRequest(w, r, state, http.StatusRequestEntityTooLarge, "request_body_limit", "request_body_limit_rule", limit,
+		zap.String("message", "Request blocked, body exceeds "+limit),
+	)
+}
+
+func (m *Middleware) incrementRequestBodyLimitExceededMetric() {
+	m.muMetrics.Lock()
+	m.requestBodyLimitExceeded++
+	m.muMetrics.Unlock()
+}
@@ -0,0 +1,645 @@
+package caddywaf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const testMultipartBody = "--xyz\r\nContent-Disposition: form-data; name=\"comment\"\r\n\r\nhello\r\n" +
+	"--xyz\r\nContent-Disposition: form-data; name=\"upload\"; filename=\"shell.php\"\r\nContent-Type: application/x-php\r\n\r\n<?php system($_GET['c']); ?>\r\n" +
+	"--xyz\r\nContent-Disposition: form-data; name=\"avatar\"; filename=\"me.png\"\r\nContent-Type: image/png\r\n\r\nPNG\r\n--xyz--\r\n"
+
+const testXMLBody = `<?xml version="1.0"?>
+<order id="42">
+  <item sku="a-1">Book</item>
+  <item sku="b-2"><name>Pen</name></item>
+  <note>rush</note>
+</order>`
+
+func newBodyRequest(contentType, body string) *http.Request {
+	req := httptest.NewRequest("POST", "http://example.com/submit", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+func TestParseRequestBody(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+
+	t.Run("urlencoded", func(t *testing.T) {
+		body := rve.parseRequestBody(newBodyRequest("application/x-www-form-urlencoded", "b=2&a=1"), requestBodyLimits{})
+		assert.NoError(t, body.err)
+		assert.Equal(t, []TargetValue{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, body.args)
+	})
+
+	t.Run("multipart fields and files", func(t *testing.T) {
+		body := rve.parseRequestBody(newBodyRequest("multipart/form-data; boundary=xyz", testMultipartBody), requestBodyLimits{})
+		assert.NoError(t, body.err)
+		assert.Equal(t, []TargetValue{{Name: "comment", Value: "hello"}}, body.args)
+		if assert.Len(t, body.files, 2) {
+			assert.Equal(t, "upload", body.files[0].field)
+			assert.Equal(t, "shell.php", body.files[0].fileName)
+			assert.Equal(t, "application/x-php", body.files[0].contentType)
+			assert.Equal(t, int64(len("<?php system($_GET['c']); ?>")), body.files[0].size)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		body := rve.parseRequestBody(newBodyRequest("application/vnd.api+json", `{"user": {"name": "bob"}, "ids": [1, 2]}`), requestBodyLimits{})
+		assert.NoError(t, body.err)
+		assert.NotNil(t, body.json)
+		assert.Equal(t, []TargetValue{
+			{Name: "ids.0", Value: "1"},
+			{Name: "ids.1", Value: "2"},
+			{Name: "user.name", Value: "bob"},
+		}, body.args)
+	})
+
+	t.Run("XML text and attributes", func(t *testing.T) {
+		body := rve.parseRequestBody(newBodyRequest("application/xml", testXMLBody), requestBodyLimits{})
+		assert.NoError(t, body.err)
+		assert.Equal(t, []TargetValue{
+			{Name: "/order/@id", Value: "42"},
+			{Name: "/order/item/@sku", Value: "a-1"},
+			{Name: "/order/item", Value: "Book"},
+			{Name: "/order/item/@sku", Value: "b-2"},
+			{Name: "/order/item/name", Value: "Pen"},
+			{Name: "/order/note", Value: "rush"},
+		}, body.xml)
+	})
+
+	malformed := []struct {
+		name        string
+		contentType string
+		body        string
+		reason      string
+	}{
+		{"JSON", "application/json", `{"user":`, "malformed JSON body"},
+		{"XML", "text/xml", "<a><b>x</a>", "malformed XML body"},
+		{"unclosed XML", "text/xml", "<a><b>x</b>", "unexpected EOF"},
+		{"urlencoded", "application/x-www-form-urlencoded", "a=%zz", "malformed urlencoded body"},
+		{"multipart without boundary", "multipart/form-data", "--xyz--", "no boundary"},
+		{"multipart", "multipart/form-data; boundary=xyz", "--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nunterminated", "malformed multipart body"},
+		{"Content-Type", "application/json; charset", "{}", "malformed Content-Type"},
+	}
+	for _, tt := range malformed {
+		t.Run("malformed "+tt.name, func(t *testing.T) {
+			body := rve.parseRequestBody(newBodyRequest(tt.contentType, tt.body), requestBodyLimits{})
+			if assert.Error(t, body.err) {
+				assert.Contains(t, body.err.Error(), tt.reason)
+			}
+			assert.Equal(t, tt.body, string(body.raw))
+		})
+	}
+
+	t.Run("other content types are kept raw", func(t *testing.T) {
+		body := rve.parseRequestBody(newBodyRequest("text/plain", "<a>"), requestBodyLimits{})
+		assert.NoError(t, body.err)
+		assert.Empty(t, body.args)
+		assert.Empty(t, body.xml)
+		assert.Equal(t, "<a>", string(body.raw))
+	})
+}
+
+func TestRequestBody_ParsedOncePerRequest(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+
+	req := newBodyRequest("application/json", `{"a": "1"}`)
+	req = req.WithContext(withRequestBodyCache(req.Context()))
+
+	first := rve.requestBody(req)
+	second := rve.requestBody(req.WithContext(req.Context()))
+	assert.Same(t, first, second, "derived requests share the parsed body")
+
+	// Without a cache every call parses the body again
+	plain := newBodyRequest("application/json", `{"a": "1"}`)
+	assert.NotSame(t, rve.requestBody(plain), rve.requestBody(plain))
+}
+
+func TestExtractValues_BodyTargets(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		expected    []TargetValue
+		expectedErr bool
+	}{
+		{
+			name:        "FILES",
+			target:      "FILES",
+			contentType: "multipart/form-data; boundary=xyz",
+			body:        testMultipartBody,
+			expected: []TargetValue{
+				{Name: "FILES:upload", Value: "shell.php"},
+				{Name: "FILES:avatar", Value: "me.png"},
+			},
+		},
+		{
+			name:        "FILES:name",
+			target:      "files:Upload",
+			contentType: "multipart/form-data; boundary=xyz",
+			body:        testMultipartBody,
+			expected:    []TargetValue{{Name: "FILES:upload", Value: "shell.php"}},
+		},
+		{
+			name:        "FILES_NAMES",
+			target:      "FILES_NAMES",
+			contentType: "multipart/form-data; boundary=xyz",
+			body:        testMultipartBody,
+			expected: []TargetValue{
+				{Name: "FILES_NAMES:upload", Value: "upload"},
+				{Name: "FILES_NAMES:avatar", Value: "avatar"},
+			},
+		},
+		{
+			name:        "FILE_NAME is the first file",
+			target:      "FILE_NAME",
+			contentType: "multipart/form-data; boundary=xyz",
+			body:        testMultipartBody,
+			expected:    []TargetValue{{Name: "FILE_NAME", Value: "shell.php"}},
+		},
+		{
+			name:        "FILE_MIME_TYPE is the first file",
+			target:      "FILE_MIME_TYPE",
+			contentType: "multipart/form-data; boundary=xyz",
+			body:        testMultipartBody,
+			expected:    []TargetValue{{Name: "FILE_MIME_TYPE", Value: "application/x-php"}},
+		},
+		{
+			name:        "FILES without files",
+			target:      "FILES",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "a=1",
+			expectedErr: true,
+		},
+		{
+			name:        "JSON:*",
+			target:      "JSON:*",
+			contentType: "application/json",
+			body:        `{"user": {"name": "bob"}, "admin": false}`,
+			expected: []TargetValue{
+				{Name: "JSON:admin", Value: "false"},
+				{Name: "JSON:user.name", Value: "bob"},
+			},
+		},
+		{
+			name:        "JSON:path",
+			target:      "JSON:user.name",
+			contentType: "application/json",
+			body:        `{"user": {"name": "bob"}, "admin": false}`,
+			expected:    []TargetValue{{Name: "JSON:user.name", Value: "bob"}},
+		},
+		{
+			name:        "JSON on a form body",
+			target:      "JSON:*",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "a=1",
+			expectedErr: true,
+		},
+		{
+			name:        "JSON_PATH reads the parsed document",
+			target:      "JSON_PATH:user",
+			contentType: "application/json",
+			body:        `{"user": {"name": "bob"}}`,
+			expected:    []TargetValue{{Name: "JSON_PATH:user", Value: `{"name":"bob"}`}},
+		},
+		{
+			name:        "XML absolute path",
+			target:      "XML:/order/item",
+			contentType: "application/xml",
+			body:        testXMLBody,
+			expected:    []TargetValue{{Name: "XML:/order/item", Value: "Book"}},
+		},
+		{
+			name:        "XML descendant attribute",
+			target:      "XML://item/@sku",
+			contentType: "application/xml",
+			body:        testXMLBody,
+			expected: []TargetValue{
+				{Name: "XML:/order/item/@sku", Value: "a-1"},
+				{Name: "XML:/order/item/@sku", Value: "b-2"},
+			},
+		},
+		{
+			name:        "XML wildcard step",
+			target:      "XML:/order/*/name",
+			contentType: "application/xml",
+			body:        testXMLBody,
+			expected:    []TargetValue{{Name: "XML:/order/item/name", Value: "Pen"}},
+		},
+		{
+			name:        "XML:/* selects everything",
+			target:      "XML:/*",
+			contentType: "application/xml",
+			body:        "<a b=\"1\">x</a>",
+			expected: []TargetValue{
+				{Name: "XML:/a/@b", Value: "1"},
+				{Name: "XML:/a", Value: "x"},
+			},
+		},
+		{
+			name:        "REQBODY_ERROR on malformed JSON",
+			target:      "REQBODY_ERROR",
+			contentType: "application/json",
+			body:        `{"user":`,
+			expected:    []TargetValue{{Name: "REQBODY_ERROR", Value: "1"}},
+		},
+		{
+			name:        "REQBODY_ERROR on a valid body",
+			target:      "REQBODY_ERROR",
+			contentType: "application/json",
+			body:        `{}`,
+			expected:    []TargetValue{{Name: "REQBODY_ERROR", Value: "0"}},
+		},
+		{
+			name:        "REQBODY_ERROR_MSG",
+			target:      "REQBODY_ERROR_MSG",
+			contentType: "text/xml",
+			body:        "<a>",
+			expected:    []TargetValue{{Name: "REQBODY_ERROR_MSG", Value: "malformed XML body: XML syntax error on line 1: unexpected EOF"}},
+		},
+		{
+			name:        "REQBODY_ERROR_MSG without an error",
+			target:      "REQBODY_ERROR_MSG",
+			contentType: "application/json",
+			body:        `{}`,
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := rve.ExtractValues(tt.target, newBodyRequest(tt.contentType, tt.body), httptest.NewRecorder())
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, values)
+		})
+	}
+}
+
+func TestMatchXMLPath(t *testing.T) {
+	tests := []struct {
+		selector string
+		name     string
+		expected bool
+	}{
+		{"/a/b", "/a/b", true},
+		{"/a/b", "/a/b/c", false},
+		{"/a/B", "/a/b", false},
+		{"/a/*", "/a/b", true},
+		{"/a/*", "/a/@id", false},
+		{"/a/@*", "/a/@id", false},
+		{"//b", "/a/x/b", true},
+		{"//b/@id", "/a/b/@id", true},
+		{"//b", "/a/b/@id", false},
+		{"/*", "/a/b/@id", true},
+		{"*", "/a", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, matchXMLPath(tt.selector, tt.name), "%s against %s", tt.selector, tt.name)
+	}
+}
+
+func TestServeHTTP_BlocksUnparsableBody(t *testing.T) {
+	logger := zap.NewNop()
+	bodyError, err := compileOperator("eq", "1", "")
+	assert.NoError(t, err)
+
+	middleware := &Middleware{
+		logger:           logger,
+		AnomalyThreshold: 5,
+		Rules: map[int][]Rule{2: {
+			{ID: "reqbody-error", Phase: 2, Targets: []string{"REQBODY_ERROR"}, Score: 5, Action: ActionBlock, matcher: bodyError},
+		}},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, middleware.ServeHTTP(w, newBodyRequest("application/json", `{"q": "union select"`), next))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, middleware.ServeHTTP(w, newBodyRequest("application/json", `{"q": "hello"}`), next))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestParseRequestBody_Limits(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+	limits := requestBodyLimits{limit: 16, noFilesLimit: 8}
+
+	tests := []struct {
+		name             string
+		contentType      string
+		body             string
+		chunked          bool
+		inspectOversized bool
+		exceeded         string
+		raw              string
+		args             []TargetValue
+	}{
+		{
+			name:        "within the limits",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "a=1&b=2",
+			raw:         "a=1&b=2",
+			args:        []TargetValue{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+		},
+		{
+			name:        "declared too large is left unread",
+			contentType: "text/plain",
+			body:        strings.Repeat("x", 20),
+			exceeded:    limitRequestBody,
+		},
+		{
+			name:             "declared too large is inspected up to the limit",
+			contentType:      "text/plain",
+			body:             strings.Repeat("x", 15) + "yyyyy",
+			inspectOversized: true,
+			exceeded:         limitRequestBody,
+			raw:              strings.Repeat("x", 15) + "y",
+		},
+		{
+			name:        "chunked body over the limit",
+			contentType: "text/plain",
+			body:        strings.Repeat("x", 20),
+			chunked:     true,
+			exceeded:    limitRequestBody,
+			raw:         strings.Repeat("x", 16),
+		},
+		{
+			name:        "raw bodies are not bound by the no-files limit",
+			contentType: "application/octet-stream",
+			body:        strings.Repeat("x", 12),
+			raw:         strings.Repeat("x", 12),
+		},
+		{
+			name:        "form fields over the no-files limit",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "a=1&b=234567",
+			exceeded:    limitRequestBodyNoFiles,
+			raw:         "a=1&b=234567",
+			args:        []TargetValue{{Name: "a", Value: "1"}, {Name: "b", Value: "23"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newBodyRequest(tt.contentType, tt.body)
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			limits := limits
+			limits.inspectOversized = tt.inspectOversized
+			body := rve.parseRequestBody(req, limits)
+			assert.Equal(t, tt.exceeded, body.exceeded)
+			assert.Equal(t, tt.raw, string(body.raw))
+			assert.Equal(t, tt.args, body.args)
+
+			// The upstream handler still receives the whole body
+			forwarded, err := io.ReadAll(req.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.body, string(forwarded))
+		})
+	}
+}
+
+func TestParseMultipartBody_NoFilesLimit(t *testing.T) {
+	body := "--xyz\r\nContent-Disposition: form-data; name=\"upload\"; filename=\"big.bin\"\r\n\r\n" + strings.Repeat("x", 100) + "\r\n" +
+		"--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1234\r\n" +
+		"--xyz\r\nContent-Disposition: form-data; name=\"b\"\r\n\r\n5678\r\n--xyz--\r\n"
+
+	// File contents do not count towards the no-files limit
+	args, files, exceeded, err := parseMultipartBody(strings.NewReader(body), "xyz", 8)
+	assert.NoError(t, err)
+	assert.False(t, exceeded)
+	assert.Equal(t, []TargetValue{{Name: "a", Value: "1234"}, {Name: "b", Value: "5678"}}, args)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, int64(100), files[0].size)
+	}
+
+	args, _, exceeded, err = parseMultipartBody(strings.NewReader(body), "xyz", 6)
+	assert.NoError(t, err)
+	assert.True(t, exceeded)
+	assert.Equal(t, []TargetValue{{Name: "a", Value: "1234"}, {Name: "b", Value: "56"}}, args)
+}
+
+func TestRequestBody_Spooling(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+	rve.bodyLimits = requestBodyLimits{limit: 1 << 20, noFilesLimit: 1 << 20, inMemory: 8}
+
+	content := `{"padding": "` + strings.Repeat("x", 64) + `", "cmd": "cat /etc/passwd"}`
+	req := newBodyRequest("application/json", content)
+	req = req.WithContext(withRequestBodyCache(req.Context()))
+
+	body := rve.requestBody(req)
+	assert.Equal(t, content[:8], string(body.raw), "only the in-memory part is kept in memory")
+	if assert.NotNil(t, body.spool) {
+		assert.FileExists(t, body.spool.Name())
+	}
+	assert.Equal(t, int64(len(content)), body.size)
+
+	// The spooled part is still parsed and inspected
+	values, err := rve.ExtractValues("JSON:cmd", req, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetValue{{Name: "JSON:cmd", Value: "cat /etc/passwd"}}, values)
+
+	forwarded, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(forwarded))
+
+	spool := body.spool.Name()
+	releaseRequestBody(req)
+	assert.NoFileExists(t, spool)
+}
+
+func TestServeHTTP_RequestBodyLimit(t *testing.T) {
+	logger := zap.NewNop()
+	passwd, err := compileOperator("contains", "/etc/passwd", "")
+	assert.NoError(t, err)
+
+	newMiddleware := func(action string) *Middleware {
+		m := &Middleware{
+			logger:                  logger,
+			AnomalyThreshold:        5,
+			RequestBodyLimit:        32,
+			RequestBodyNoFilesLimit: 32,
+			RequestBodyLimitAction:  action,
+			Rules: map[int][]Rule{2: {
+				{ID: "lfi", Phase: 2, Targets: []string{"BODY"}, Score: 5, Action: ActionBlock, matcher: passwd},
+			}},
+			ruleCache:             NewRuleCache(),
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+		}
+		m.requestValueExtractor.bodyLimits = m.requestBodyLimits()
+		m.requestBodyRules.Store(rulesReadRequestBody(m.Rules))
+		return m
+	}
+
+	var forwarded string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		data, err := io.ReadAll(r.Body)
+		forwarded = string(data)
+		return err
+	})
+
+	large := "file=" + strings.Repeat("a", 40)
+
+	t.Run("reject", func(t *testing.T) {
+		m := newMiddleware(BodyLimitActionReject)
+		forwarded = ""
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBodyRequest("text/plain", large), next))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Empty(t, forwarded)
+		assert.Equal(t, int64(1), m.requestBodyLimitExceeded)
+		assert.Equal(t, int64(1), m.blockedRequests)
+	})
+
+	t.Run("process_partial inspects the prefix", func(t *testing.T) {
+		m := newMiddleware(BodyLimitActionProcessPartial)
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBodyRequest("text/plain", "file=/etc/passwd"+strings.Repeat("a", 40)), next))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("process_partial forwards the whole body", func(t *testing.T) {
+		m := newMiddleware(BodyLimitActionProcessPartial)
+		forwarded = ""
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBodyRequest("text/plain", large), next))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, large, forwarded)
+		assert.Equal(t, int64(1), m.requestBodyLimitExceeded)
+	})
+
+	t.Run("process_partial is the default", func(t *testing.T) {
+		m := newMiddleware("")
+		forwarded = ""
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBodyRequest("text/plain", large), next))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, large, forwarded)
+	})
+
+	withoutBodyRules := func(action string) *Middleware {
+		m := newMiddleware(action)
+		m.Rules = map[int][]Rule{2: {
+			{ID: "lfi", Phase: 2, Targets: []string{"ARGS"}, Score: 5, Action: ActionBlock, matcher: passwd},
+		}}
+		m.requestBodyRules.Store(rulesReadRequestBody(m.Rules))
+		return m
+	}
+
+	t.Run("body not read without body rules", func(t *testing.T) {
+		m := withoutBodyRules(BodyLimitActionProcessPartial)
+		forwarded = ""
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBodyRequest("text/plain", large), next))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, large, forwarded)
+		assert.Equal(t, int64(0), m.requestBodyLimitExceeded)
+	})
+
+	t.Run("reject without body rules", func(t *testing.T) {
+		m := withoutBodyRules(BodyLimitActionReject)
+
+		forwarded = ""
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBodyRequest("text/plain", "file=small"), next))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "file=small", forwarded)
+
+		forwarded = ""
+		w = httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBodyRequest("text/plain", large), next))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, "declared larger than the limit")
+		assert.Empty(t, forwarded)
+		assert.Equal(t, int64(1), m.requestBodyLimitExceeded)
+
+		req := newBodyRequest("text/plain", large)
+		req.ContentLength = -1 // Streamed, e.g. chunked
+		var maxBytesErr *http.MaxBytesError
+		err := m.ServeHTTP(httptest.NewRecorder(), req, next)
+		assert.ErrorAs(t, err, &maxBytesErr, "cut off at the limit while streaming")
+		assert.Len(t, forwarded, 32)
+	})
+}
+
+func TestServeHTTP_BodyForwardedAfterPhase1BodyRule(t *testing.T) {
+	logger := zap.NewNop()
+	attack, err := compileOperator("contains", "attack", "")
+	assert.NoError(t, err)
+	m := &Middleware{
+		logger:           logger,
+		AnomalyThreshold: 5,
+		Rules: map[int][]Rule{1: {
+			{ID: "args", Phase: 1, Targets: []string{"ARGS:*"}, Score: 5, Action: ActionBlock, matcher: attack},
+		}},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	m.requestValueExtractor.bodyLimits = m.requestBodyLimits()
+	m.requestBodyRules.Store(rulesReadRequestBody(m.Rules))
+
+	var forwarded string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		data, err := io.ReadAll(r.Body)
+		forwarded = string(data)
+		return err
+	})
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.ServeHTTP(w, newBodyRequest("application/x-www-form-urlencoded", "a=hello&b=world"), next))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a=hello&b=world", forwarded)
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, m.ServeHTTP(w, newBodyRequest("application/x-www-form-urlencoded", "a=attack"), next))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRulesReadRequestBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules map[int][]Rule
+		want  bool
+	}{
+		{"no rules", nil, false},
+		{"query and headers", map[int][]Rule{1: {{Targets: []string{"ARGS", "HEADERS:User-Agent"}}}}, false},
+		{"body", map[int][]Rule{2: {{Targets: []string{"BODY"}}}}, true},
+		{"alias", map[int][]Rule{2: {{Targets: []string{"REQUEST_BODY"}}}}, true},
+		{"comma separated", map[int][]Rule{2: {{Targets: []string{"URI,ARGS_POST"}}}}, true},
+		{"prefix", map[int][]Rule{2: {{Targets: []string{"JSON:user.name"}}}}, true},
+		{"chain", map[int][]Rule{2: {{Targets: []string{"URI"}, Chain: []RuleCondition{{Targets: []string{"FILES"}}}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, rulesReadRequestBody(tt.rules))
+		})
+	}
+}
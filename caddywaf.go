@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
@@ -27,6 +30,7 @@ var (
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
 	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 )
 
 // Add or update the version constant as needed
@@ -121,7 +125,13 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		zap.String("log_path", m.LogFilePath),
 		zap.Bool("log_json", m.LogJSON),
 		zap.Int("anomaly_threshold", m.AnomalyThreshold),
+		zap.Int("inbound_anomaly_threshold", m.anomalyThreshold(1)),
+		zap.Int("outbound_anomaly_threshold", m.anomalyThreshold(3)),
+		zap.String("mode", m.Mode),
 	)
+	if m.detectionOnly() {
+		m.logger.Warn("WAF running in detection_only mode, requests are logged but never blocked")
+	}
 
 	// Start the asynchronous logging worker
 	m.StartLogWorker()
@@ -139,8 +149,8 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 
 	// Start file watchers for rule files and blacklist files
 	// Context cancellation could be added in the future to gracefully stop watchers.
-	m.startFileWatcher(m.RuleFiles)
-	m.startFileWatcher([]string{m.IPBlacklistFile, m.DNSBlacklistFile})
+	m.startFileWatcher(m.RuleFiles, m.ReloadRules)
+	m.startFileWatcher([]string{m.IPBlacklistFile, m.DNSBlacklistFile, m.IPWhitelistFile}, m.ReloadConfig)
 
 	// Configure rate limiting
 	if m.RateLimit.Requests > 0 {
@@ -164,6 +174,11 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		m.logger.Info("Rate limiting is disabled")
 	}
 
+	// Configure automatic IP banning
+	if err := m.setupBanList(); err != nil {
+		return err
+	}
+
 	// Initialize GeoIP stats
 	m.geoIPStats = make(map[string]int64)
 
@@ -209,6 +224,21 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	if err := m.compileExclusions(); err != nil {
+		return fmt.Errorf("invalid exclusions: %w", err)
+	}
+	if err := m.compileTrustedProxies(); err != nil {
+		return err
+	}
+
+	// Apply request body limits
+	m.requestValueExtractor.bodyLimits = m.requestBodyLimits()
+	m.logger.Debug("Request body limits configured",
+		zap.Int64("request_body_limit", m.requestValueExtractor.bodyLimits.limit),
+		zap.Int64("request_body_no_files_limit", m.requestValueExtractor.bodyLimits.noFilesLimit),
+		zap.Int64("request_body_in_memory_limit", m.requestValueExtractor.bodyLimits.inMemory),
+	)
+
 	// Load IP blacklist
 	if m.IPBlacklistFile != "" {
 		m.ipBlacklist = NewCIDRTrie()
@@ -218,6 +248,17 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	// Start remote feeds, including the Tor exit node list
+	if err := m.setupFeeds(); err != nil {
+		return fmt.Errorf("failed to set up feeds: %w", err)
+	}
+
+	// Load IP whitelist
+	m.ipWhitelist, err = m.loadIPWhitelist()
+	if err != nil {
+		return err
+	}
+
 	// Load DNS blacklist
 	if m.DNSBlacklistFile != "" {
 		m.dnsBlacklist = make(map[string]struct{})
@@ -240,6 +281,23 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper. Caddy calls it on the old instance when a config is unloaded,
+// e.g. on reload, while its in-flight requests may still be running. It therefore only stops the
+// background work and saves its state; shared resources such as the GeoIP databases stay open.
+func (m *Middleware) Cleanup() error {
+	// Stop the feed refreshes
+	for _, feed := range m.feeds {
+		feed.signalStop()
+	}
+
+	// Release the ban list: it is stopped and saved unless the config that replaces this one shares it
+	m.releaseBanList()
+
+	// Requests still in flight log synchronously once the worker is stopped
+	m.StopLogWorker()
+	return nil
+}
+
 func (m *Middleware) Shutdown(ctx context.Context) error {
 	m.logger.Info("Starting WAF middleware shutdown procedures")
 	m.isShuttingDown = true
@@ -253,6 +311,14 @@ func (m *Middleware) Shutdown(ctx context.Context) error {
 		m.logger.Debug("Rate limiter is nil, no cleanup signaling needed.")
 	}
 
+	// Stop the feed refreshes
+	for _, feed := range m.feeds {
+		feed.signalStop()
+	}
+
+	// Release the ban list, stopping its cleanup and saving the bans unless another config shares it
+	m.releaseBanList()
+
 	// Stop the asynchronous logging worker
 	m.logger.Debug("Stopping logging worker...")
 	m.StopLogWorker()
@@ -326,63 +392,96 @@ func (m *Middleware) logVersion() {
 	m.logger.Info("WAF middleware version", zap.String("version", wafVersion))
 }
 
-func (m *Middleware) startFileWatcher(filePaths []string) {
-	for _, path := range filePaths {
-		// Skip watching if the file doesn't exist
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			m.logger.Warn("Skipping file watch, file does not exist",
-				zap.String("file", path),
-			)
+// watchedPath is a configured path the file watcher reloads on: a file, a rule directory or a glob pattern.
+type watchedPath struct {
+	dir     string                 // Directory watched for the path
+	matches func(name string) bool // Reports whether a changed file is covered by the path
+}
+
+// newWatchedPath returns how a configured path is watched. Files are watched through their directory, so
+// that a file replaced by a rename (as editors and deploys do) is still picked up; a rule directory covers
+// the rule files directly inside it, and a glob pattern the files it matches.
+func newWatchedPath(path string) watchedPath {
+	path = filepath.Clean(path)
+	if strings.ContainsAny(path, "*?[") {
+		return watchedPath{dir: filepath.Dir(path), matches: func(name string) bool {
+			matched, _ := filepath.Match(path, name)
+			return matched
+		}}
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return watchedPath{dir: path, matches: func(name string) bool {
+			return filepath.Dir(name) == path && isRuleFile(name)
+		}}
+	}
+	return watchedPath{dir: filepath.Dir(path), matches: func(name string) bool { return name == path }}
+}
+
+// startFileWatcher watches the configured paths and calls reload when a file they cover is written,
+// created, renamed or removed. Empty paths are skipped, as are paths whose directory does not exist.
+func (m *Middleware) startFileWatcher(paths []string, reload func() error) {
+	var watched []watchedPath
+	for _, path := range paths {
+		if path == "" {
 			continue
 		}
+		wp := newWatchedPath(path)
+		if _, err := os.Stat(wp.dir); err != nil {
+			m.logger.Warn("Skipping file watch, directory does not exist", zap.String("file", path), zap.String("dir", wp.dir))
+			continue
+		}
+		watched = append(watched, wp)
+	}
+	if len(watched) == 0 {
+		return
+	}
 
-		// Note: In future, a context may be used here for cancellation.
-		go func(file string) {
-			watcher, err := fsnotify.NewWatcher()
-			if err != nil {
-				m.logger.Error("Failed to start file watcher", zap.Error(err))
-				return
-			}
-			defer watcher.Close()
-
-			err = watcher.Add(file)
-			if err != nil {
-				m.logger.Error("Failed to watch file", zap.String("file", file), zap.Error(err))
-				return
-			}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		m.logger.Error("Failed to start file watcher", zap.Error(err))
+		return
+	}
+	for _, wp := range watched {
+		if slices.Contains(watcher.WatchList(), wp.dir) {
+			continue
+		}
+		if err := watcher.Add(wp.dir); err != nil {
+			m.logger.Error("Failed to watch directory", zap.String("dir", wp.dir), zap.Error(err))
+		}
+	}
 
-			for {
-				select {
-				case event := <-watcher.Events:
-					if event.Op&fsnotify.Write == fsnotify.Write {
-						m.logger.Info("Detected configuration change. Reloading...", zap.String("file", file))
-						if strings.Contains(file, "rule") {
-							if err := m.ReloadRules(); err != nil {
-								m.logger.Error("Failed to reload rules after change", zap.String("file", file), zap.Error(err))
-							} else {
-								m.logger.Info("Rules reloaded successfully", zap.String("file", file))
-							}
-						} else {
-							err := m.ReloadConfig()
-							if err != nil {
-								m.logger.Error("Failed to reload config after change", zap.Error(err))
-							} else {
-								m.logger.Info("Configuration reloaded successfully")
-							}
-						}
-					}
-				case err := <-watcher.Errors:
-					m.logger.Error("File watcher error", zap.Error(err))
+	// Note: In future, a context may be used here for cancellation.
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
+					continue
+				}
+				name := filepath.Clean(event.Name)
+				if !slices.ContainsFunc(watched, func(wp watchedPath) bool { return wp.matches(name) }) {
+					continue
+				}
+				m.logger.Info("Detected configuration change. Reloading...", zap.String("file", name), zap.String("op", event.Op.String()))
+				if err := reload(); err != nil {
+					m.logger.Error("Failed to reload after change", zap.String("file", name), zap.Error(err))
 				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				m.logger.Error("File watcher error", zap.Error(err))
 			}
-		}(path)
-	}
+		}
+	}()
 }
 
+// ReloadRules reloads all rule files. loadRules takes the middleware lock itself.
 func (m *Middleware) ReloadRules() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	m.logger.Info("Reloading WAF rules")
 	// Call the external loadRules function
 	if err := m.loadRules(m.RuleFiles); err != nil {
@@ -396,12 +495,11 @@ func (m *Middleware) ReloadRules() error {
 
 func (m *Middleware) ReloadConfig() error {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	m.logger.Info("Reloading WAF configuration")
 	if m.IPBlacklistFile != "" {
 		newIPBlacklist := NewCIDRTrie()
 		if err := m.loadIPBlacklist(m.IPBlacklistFile, newIPBlacklist); err != nil {
+			m.mu.Unlock()
 			m.logger.Error("Failed to reload IP blacklist", zap.String("file", m.IPBlacklistFile), zap.Error(err))
 			return fmt.Errorf("failed to reload IP blacklist: %v", err)
 		}
@@ -410,11 +508,20 @@ func (m *Middleware) ReloadConfig() error {
 	if m.DNSBlacklistFile != "" {
 		newDNSBlacklist := make(map[string]struct{})
 		if err := m.loadDNSBlacklist(m.DNSBlacklistFile, newDNSBlacklist); err != nil {
+			m.mu.Unlock()
 			m.logger.Error("Failed to reload DNS blacklist", zap.String("file", m.DNSBlacklistFile), zap.Error(err))
 			return fmt.Errorf("failed to reload DNS blacklist: %v", err)
 		}
 		m.dnsBlacklist = newDNSBlacklist
 	}
+	newIPWhitelist, err := m.loadIPWhitelist()
+	if err != nil {
+		m.mu.Unlock()
+		m.logger.Error("Failed to reload IP whitelist", zap.String("file", m.IPWhitelistFile), zap.Error(err))
+		return fmt.Errorf("failed to reload IP whitelist: %v", err)
+	}
+	m.ipWhitelist = newIPWhitelist
+	m.mu.Unlock() // loadRules takes the lock itself
 
 	// Call the external loadRules function
 	if err := m.loadRules(m.RuleFiles); err != nil {
@@ -432,15 +539,16 @@ func (m *Middleware) loadIPBlacklist(path string, blacklistMap *CIDRTrie) error
 		return nil
 	}
 
-	blacklist := make(map[string]struct{})
-	err := m.blacklistLoader.LoadIPBlacklistFromFile(path, blacklist)
+	entries, err := m.blacklistLoader.LoadIPBlacklistEntries(path)
 	if err != nil {
 		return fmt.Errorf("failed to load IP blacklist: %w", err)
 	}
 
-	// Convert the map to CIDRTrie
-	for ip := range blacklist {
-		blacklistMap.Insert(ip)
+	// Insert the entries with their metadata, so that blocks report the reason and source of the entry
+	for _, entry := range entries {
+		if err := blacklistMap.InsertEntry(entry); err != nil {
+			m.logger.Warn("Failed to add IP list entry", zap.String("file", path), zap.String("entry", entry.Value), zap.Error(err))
+		}
 	}
 	return nil
 }
@@ -491,23 +599,59 @@ func (m *Middleware) handleMetricsRequest(w http.ResponseWriter, r *http.Request
 		rateLimiterBlockedRequests = m.rateLimiter.GetBlockedRequests()
 	}
 
+	// Get ban list metrics
+	var activeBans int
+	var bansIssued, bannedRequests int64
+	if m.banList != nil {
+		activeBans = m.banList.activeBans()
+		bansIssued = m.banList.GetBansIssued()
+		bannedRequests = m.banList.GetBannedRequests()
+	}
+
 	// Collect rule hits using getRuleHitStats
 	ruleHits := m.getRuleHitStats()
 
-	// Collect all metrics
+	m.mu.RLock()
+	ruleLoadReport := m.ruleLoadReport
+	m.mu.RUnlock()
+
+	m.muIPBlacklistMetrics.Lock()
+	ipBlacklistHits := m.IPBlacklistBlockCount
+	m.muIPBlacklistMetrics.Unlock()
+	m.muDNSBlacklistMetrics.Lock()
+	dnsBlacklistHits := m.DNSBlacklistBlockCount
+	m.muDNSBlacklistMetrics.Unlock()
+
+	// Collect all metrics. Request handlers keep updating the counters and maps under muMetrics, so they
+	// are copied under the lock and the copies are marshaled.
+	m.muMetrics.RLock()
 	metrics := map[string]interface{}{
 		"total_requests":                m.totalRequests,
 		"blocked_requests":              m.blockedRequests,
 		"allowed_requests":              m.allowedRequests,
 		"rule_hits":                     ruleHits,
-		"rule_hits_by_phase":            m.ruleHitsByPhase,          // Include rule hits by phase
-		"geoip_blocked":                 m.geoIPBlocked,             // Add the new geoIPBlocked metric
-		"ip_blacklist_hits":             m.IPBlacklistBlockCount,    // Add IP blacklist hits metric
-		"dns_blacklist_hits":            m.DNSBlacklistBlockCount,   // Add DNS blacklist hits metric
-		"rate_limiter_requests":         rateLimiterTotalRequests,   // Add rate limiter total requests
-		"rate_limiter_blocked_requests": rateLimiterBlockedRequests, // Add rate limiter blocked requests
+		"rule_hits_by_phase":            maps.Clone(m.ruleHitsByPhase),    // Include rule hits by phase
+		"rule_hits_by_variable":         maps.Clone(m.ruleHitsByVariable), // Matched variable, e.g. ARGS:username
+		"geoip_blocked":                 m.geoIPBlocked,                   // Add the new geoIPBlocked metric
+		"ip_blacklist_hits":             ipBlacklistHits,                  // Add IP blacklist hits metric
+		"dns_blacklist_hits":            dnsBlacklistHits,                 // Add DNS blacklist hits metric
+		"rate_limiter_requests":         rateLimiterTotalRequests,         // Add rate limiter total requests
+		"rate_limiter_blocked_requests": rateLimiterBlockedRequests,       // Add rate limiter blocked requests
+		"rule_load_report":              ruleLoadReport,                   // Loaded/skipped rules per rule file
+		"exclusion_hits":                maps.Clone(m.exclusionHits),      // Requests each exclusion applied to
+		"would_block_requests":          m.wouldBlockRequests,             // Requests detection_only mode or shadow rules would have blocked
+		"shadow_rule_hits":              maps.Clone(m.shadowRuleHits),     // Matches per shadow rule
+		"anomaly_score_by_phase":        maps.Clone(m.scoreByPhase),       // Score added by matched rules per phase
+		"anomaly_score_by_category":     maps.Clone(m.scoreByCategory),    // Score added by matched rules per category (sqli, xss, ...)
+		"request_body_limit_exceeded":   m.requestBodyLimitExceeded,       // Requests whose body exceeded a request body limit
+		"ip_whitelist_hits":             m.ipWhitelistHits,                // Requests from allowlisted client IPs
+		"active_bans":                   activeBans,                       // Client IPs or prefixes currently banned
+		"bans_issued":                   bansIssued,                       // Bans issued by the auto_ban policy
+		"banned_requests":               bannedRequests,                   // Requests rejected because their client was banned
+		"feeds":                         m.feedStats(),                    // Entries, refreshes and hits per remote feed
 		"version":                       wafVersion,
 	}
+	m.muMetrics.RUnlock()
 
 	jsonMetrics, err := json.Marshal(metrics)
 	if err != nil {
@@ -530,6 +674,10 @@ func (m *Middleware) extractValue(target string, r *http.Request, w http.Respons
 	return m.requestValueExtractor.ExtractValue(target, r, w)
 }
 
+func (m *Middleware) extractValues(target string, r *http.Request, w http.ResponseWriter) ([]TargetValue, error) {
+	return m.requestValueExtractor.ExtractValues(target, r, w)
+}
+
 // ==================== Unimplemented Functions ====================
 
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -544,5 +692,40 @@ func (m *Middleware) Validate() error {
 	if m.logLevel == 0 {
 		m.logLevel = zapcore.InfoLevel // Default log level
 	}
+	if m.ParanoiaLevel < 0 || m.ParanoiaLevel > maxParanoiaLevel {
+		return fmt.Errorf("paranoia_level must be between 1 and %d, got %d", maxParanoiaLevel, m.ParanoiaLevel)
+	}
+	if m.InboundAnomalyThreshold < 0 || m.OutboundAnomalyThreshold < 0 {
+		return fmt.Errorf("inbound_anomaly_threshold and outbound_anomaly_threshold must not be negative")
+	}
+	if m.Mode != "" && m.Mode != ModeBlocking && m.Mode != ModeDetectionOnly {
+		return fmt.Errorf("mode must be %s or %s, got '%s'", ModeBlocking, ModeDetectionOnly, m.Mode)
+	}
+	if m.RequestBodyLimit < 0 || m.RequestBodyNoFilesLimit < 0 || m.RequestBodyInMemoryLimit < 0 {
+		return fmt.Errorf("request_body_limit, request_body_no_files_limit and request_body_in_memory_limit must not be negative")
+	}
+	if m.RequestBodyLimitAction != "" && m.RequestBodyLimitAction != BodyLimitActionReject && m.RequestBodyLimitAction != BodyLimitActionProcessPartial {
+		return fmt.Errorf("request_body_limit_action must be %s or %s, got '%s'", BodyLimitActionReject, BodyLimitActionProcessPartial, m.RequestBodyLimitAction)
+	}
+	if m.ResponseBodyLimit < 0 {
+		return fmt.Errorf("response_body_limit must not be negative")
+	}
+	if m.AllowlistScope != "" && m.AllowlistScope != AllowlistScopeAll && m.AllowlistScope != AllowlistScopeIPChecks {
+		return fmt.Errorf("allowlist_scope must be %s or %s, got '%s'", AllowlistScopeAll, AllowlistScopeIPChecks, m.AllowlistScope)
+	}
+	if m.AutoBan.Threshold < 0 {
+		return fmt.Errorf("auto_ban threshold must not be negative")
+	}
+	if m.AutoBan.Threshold > 0 {
+		if err := m.AutoBan.withDefaults().validate(); err != nil {
+			return err
+		}
+	}
+	if m.DecompressedBodyLimit < 0 || m.DecompressionRatioLimit < 0 {
+		return fmt.Errorf("decompressed_body_limit and decompression_ratio_limit must not be negative")
+	}
+	if m.ResponseBodyMode != "" && m.ResponseBodyMode != ResponseBodyModeBuffer && m.ResponseBodyMode != ResponseBodyModeStream {
+		return fmt.Errorf("response_body_mode must be %s or %s, got '%s'", ResponseBodyModeBuffer, ResponseBodyModeStream, m.ResponseBodyMode)
+	}
 	return nil
 }
@@ -2,15 +2,20 @@ package caddywaf
 
 import (
 	"context"
-
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
-
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
 func TestMiddleware_Provision(t *testing.T) {
@@ -161,3 +166,114 @@ func TestResponseRecorder_Write_EmptyBody(t *testing.T) {
 	// Assert that the status code is set to 200 by default
 	assert.Equal(t, http.StatusOK, rr.StatusCode())
 }
+
+func TestHandleMetricsRequest_ConcurrentRequests(t *testing.T) {
+	logger := zap.NewNop()
+	attack, err := compileOperator("contains", "attack", "")
+	assert.NoError(t, err)
+	m := &Middleware{
+		logger:           logger,
+		MetricsEndpoint:  "/metrics",
+		AnomalyThreshold: 100,
+		Rules: map[int][]Rule{
+			2: {{ID: "attack", Phase: 2, Targets: []string{"ARGS:*"}, Score: 1, Tags: []string{"attack-test"}, matcher: attack}},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+
+	// Requests add new metric keys while the metrics are marshaled; run with -race to catch unlocked reads
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req := httptest.NewRequest("GET", fmt.Sprintf("/?p%d_%d=attack", i, j), nil)
+				assert.NoError(t, m.ServeHTTP(httptest.NewRecorder(), req, next))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil), next))
+				assert.Equal(t, http.StatusOK, w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil), next))
+	var metrics map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &metrics))
+	assert.Len(t, metrics["rule_hits_by_variable"], 200)
+	assert.Equal(t, float64(200), metrics["anomaly_score_by_category"].(map[string]interface{})["test"])
+}
+
+func TestNewWatchedPath(t *testing.T) {
+	dir := t.TempDir()
+	rulesDir := filepath.Join(dir, "rules")
+	assert.NoError(t, os.Mkdir(rulesDir, 0755))
+
+	file := newWatchedPath(filepath.Join(rulesDir, "blacklist.txt"))
+	assert.Equal(t, rulesDir, file.dir)
+	assert.True(t, file.matches(filepath.Join(rulesDir, "blacklist.txt")))
+	assert.False(t, file.matches(filepath.Join(rulesDir, "sqli.json")), "a file covers only itself, whatever its directory is called")
+
+	ruleDir := newWatchedPath(rulesDir)
+	assert.Equal(t, rulesDir, ruleDir.dir)
+	assert.True(t, ruleDir.matches(filepath.Join(rulesDir, "new.yaml")))
+	assert.False(t, ruleDir.matches(filepath.Join(rulesDir, "blacklist.txt")), "not a rule file")
+	assert.False(t, ruleDir.matches(filepath.Join(dir, "other.json")))
+
+	glob := newWatchedPath(filepath.Join(rulesDir, "*.json"))
+	assert.Equal(t, rulesDir, glob.dir)
+	assert.True(t, glob.matches(filepath.Join(rulesDir, "xss.json")))
+	assert.False(t, glob.matches(filepath.Join(rulesDir, "xss.yaml")))
+}
+
+func TestStartFileWatcher_RuleDirectory(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sqli.json"), []byte("[]"), 0644))
+
+	reloads := make(chan struct{}, 16)
+	m := &Middleware{logger: zap.NewNop()}
+	m.startFileWatcher([]string{dir}, func() error {
+		reloads <- struct{}{}
+		return nil
+	})
+	expectReload := func(msg string) {
+		t.Helper()
+		select {
+		case <-reloads:
+		case <-time.After(5 * time.Second):
+			t.Fatal(msg)
+		}
+		time.Sleep(50 * time.Millisecond) // Let the remaining events of the same change arrive
+		for len(reloads) > 0 {
+			<-reloads
+		}
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "xss.json"), []byte("[]"), 0644))
+	expectReload("a created rule file reloads the rules")
+
+	assert.NoError(t, os.Rename(filepath.Join(dir, "notes.txt"), filepath.Join(dir, "lfi.yaml")))
+	expectReload("a rule file renamed into the directory reloads the rules")
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "sqli.json")))
+	expectReload("a removed rule file reloads the rules")
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0644))
+	select {
+	case <-reloads:
+		t.Fatal("a file that is not a rule file does not reload the rules")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
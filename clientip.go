@@ -0,0 +1,180 @@
+package caddywaf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Headers a trusted proxy may use to pass on the client IP.
+const (
+	HeaderXForwardedFor  = "X-Forwarded-For"
+	HeaderXRealIP        = "X-Real-IP"
+	HeaderCFConnectingIP = "CF-Connecting-IP"
+	HeaderForwarded      = "Forwarded"
+)
+
+// trustedProxiesPrivateRanges stands for all private IPv4 and IPv6 ranges in trusted_proxies.
+const trustedProxiesPrivateRanges = "private_ranges"
+
+// defaultClientIPHeaders are read when client_ip_headers is not configured, as in Caddy.
+var defaultClientIPHeaders = []string{HeaderXForwardedFor}
+
+// clientIPHeaders are the supported client_ip_headers, by their canonical name.
+var clientIPHeaders = map[string]string{
+	http.CanonicalHeaderKey(HeaderXForwardedFor):  HeaderXForwardedFor,
+	http.CanonicalHeaderKey(HeaderXRealIP):        HeaderXRealIP,
+	http.CanonicalHeaderKey(HeaderCFConnectingIP): HeaderCFConnectingIP,
+	http.CanonicalHeaderKey(HeaderForwarded):      HeaderForwarded,
+}
+
+// compileTrustedProxies prepares the trusted_proxies matcher and validates client_ip_headers.
+func (m *Middleware) compileTrustedProxies() error {
+	for _, header := range m.ClientIPHeaders {
+		if _, ok := clientIPHeaders[http.CanonicalHeaderKey(header)]; !ok {
+			return fmt.Errorf("unsupported client_ip_headers value '%s', must be one of: %s, %s, %s, %s",
+				header, HeaderXForwardedFor, HeaderXRealIP, HeaderCFConnectingIP, HeaderForwarded)
+		}
+	}
+	m.trustedProxies = nil
+	if len(m.TrustedProxies) == 0 {
+		return nil
+	}
+	var ranges []string
+	for _, entry := range m.TrustedProxies {
+		if entry == trustedProxiesPrivateRanges {
+			ranges = append(ranges, caddyhttp.PrivateRangesCIDR()...)
+			continue
+		}
+		ranges = append(ranges, entry)
+	}
+	matcher, err := newIPMatcher(strings.Join(ranges, ","))
+	if err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	m.trustedProxies = matcher
+	return nil
+}
+
+// resolveClientIP returns the IP of the client that sent r. A request from one of the trusted_proxies
+// is attributed to the address the proxy passed on in client_ip_headers; any other request to its peer
+// address, whatever its headers claim. Without trusted_proxies, the client IP resolved by Caddy (from
+// the server's own trusted_proxies) is used.
+func (m *Middleware) resolveClientIP(r *http.Request) string {
+	peer := extractIP(r.RemoteAddr, nil)
+	if m.trustedProxies == nil {
+		if clientIP, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && clientIP != "" {
+			return clientIP
+		}
+		return peer
+	}
+	if !m.trustedProxies.Match(peer) {
+		return peer
+	}
+
+	headers := m.ClientIPHeaders
+	if len(headers) == 0 {
+		headers = defaultClientIPHeaders
+	}
+	for _, header := range headers {
+		var clientIP string
+		switch clientIPHeaders[http.CanonicalHeaderKey(header)] {
+		case HeaderXForwardedFor:
+			clientIP = m.lastUntrustedIP(forwardedForIPs(r.Header.Values(HeaderXForwardedFor)))
+		case HeaderForwarded:
+			clientIP = m.lastUntrustedIP(forwardedIPs(r.Header.Values(HeaderForwarded)))
+		default: // X-Real-IP and CF-Connecting-IP hold a single address
+			clientIP = parseForwardedIP(r.Header.Get(header))
+		}
+		if clientIP != "" {
+			return clientIP
+		}
+	}
+	return peer
+}
+
+// lastUntrustedIP walks a proxy chain right to left, i.e. from the proxy closest to the WAF outward,
+// and returns the first address that is not a trusted proxy. Entries further left were added by the
+// client itself and cannot be trusted. A malformed entry invalidates the chain.
+func (m *Middleware) lastUntrustedIP(chain []string) string {
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(chain[i])
+		if ip == "" {
+			return ""
+		}
+		if i == 0 || !m.trustedProxies.Match(ip) {
+			return ip
+		}
+	}
+	return ""
+}
+
+// forwardedForIPs returns the entries of X-Forwarded-For headers, left to right.
+func forwardedForIPs(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(entry))
+		}
+	}
+	return chain
+}
+
+// forwardedIPs returns the for= parameters of Forwarded headers (RFC 7239), left to right.
+func forwardedIPs(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseForwardedIP returns the IP address of a proxy header entry, which may carry a port and
+// brackets ("[2001:db8::1]:4711"), or "" if it holds no address (e.g. "unknown" or an obfuscated
+// identifier in Forwarded).
+func parseForwardedIP(entry string) string {
+	entry = strings.TrimSpace(entry)
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+	entry = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// withClientIP returns a context that carries the resolved client IP of the request.
+func withClientIP(ctx context.Context, clientIP string) context.Context {
+	return context.WithValue(ctx, ContextKeyClientIP("clientIP"), clientIP)
+}
+
+// clientIP returns the client IP resolved for r by ServeHTTP, or the host of r.RemoteAddr for a
+// request that did not go through it.
+func clientIP(r *http.Request) string {
+	if clientIP, ok := r.Context().Value(ContextKeyClientIP("clientIP")).(string); ok {
+		return clientIP
+	}
+	return extractIP(r.RemoteAddr, nil)
+}
+
+// remoteIP is the value of the REMOTE_IP target: the resolved client IP, or r.RemoteAddr as is for a
+// request that did not go through ServeHTTP.
+func remoteIP(r *http.Request) string {
+	if clientIP, ok := r.Context().Value(ContextKeyClientIP("clientIP")).(string); ok {
+		return clientIP
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,195 @@
+package caddywaf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		headers        []string
+		remoteAddr     string
+		requestHeaders map[string][]string
+		want           string
+	}{
+		{
+			name:           "no trusted proxies ignores X-Forwarded-For",
+			remoteAddr:     "203.0.113.7:4711",
+			requestHeaders: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:           "203.0.113.7",
+		},
+		{
+			name:           "untrusted peer ignores X-Forwarded-For",
+			trustedProxies: []string{"10.0.0.0/8"},
+			remoteAddr:     "203.0.113.7:4711",
+			requestHeaders: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:           "203.0.113.7",
+		},
+		{
+			name:           "X-Forwarded-For is walked right to left",
+			trustedProxies: []string{"10.0.0.0/8"},
+			remoteAddr:     "10.0.0.1:4711",
+			requestHeaders: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.9", "10.0.0.2"}},
+			want:           "203.0.113.9",
+		},
+		{
+			name:           "chain of trusted proxies only yields the leftmost entry",
+			trustedProxies: []string{"10.0.0.0/8"},
+			remoteAddr:     "10.0.0.1:4711",
+			requestHeaders: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:           "10.0.0.3",
+		},
+		{
+			name:           "malformed X-Forwarded-For falls back to the peer",
+			trustedProxies: []string{"10.0.0.0/8"},
+			remoteAddr:     "10.0.0.1:4711",
+			requestHeaders: map[string][]string{"X-Forwarded-For": {"198.51.100.1, not-an-ip"}},
+			want:           "10.0.0.1",
+		},
+		{
+			name:           "private_ranges",
+			trustedProxies: []string{"private_ranges"},
+			remoteAddr:     "192.168.1.1:4711",
+			requestHeaders: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:           "198.51.100.1",
+		},
+		{
+			name:           "X-Real-IP",
+			trustedProxies: []string{"10.0.0.1"},
+			headers:        []string{"X-Real-IP"},
+			remoteAddr:     "10.0.0.1:4711",
+			requestHeaders: map[string][]string{"X-Real-Ip": {"198.51.100.1"}, "X-Forwarded-For": {"203.0.113.9"}},
+			want:           "198.51.100.1",
+		},
+		{
+			name:           "CF-Connecting-IP with IPv6",
+			trustedProxies: []string{"10.0.0.0/8"},
+			headers:        []string{"CF-Connecting-IP"},
+			remoteAddr:     "10.0.0.1:4711",
+			requestHeaders: map[string][]string{"Cf-Connecting-Ip": {"2001:db8::1"}},
+			want:           "2001:db8::1",
+		},
+		{
+			name:           "Forwarded",
+			trustedProxies: []string{"10.0.0.0/8"},
+			headers:        []string{"Forwarded"},
+			remoteAddr:     "10.0.0.1:4711",
+			requestHeaders: map[string][]string{"Forwarded": {`for=198.51.100.1;proto=https, for="[2001:db8::1]:4711";by=10.0.0.1`}},
+			want:           "2001:db8::1",
+		},
+		{
+			name:           "Forwarded with an obfuscated client falls back to the next header",
+			trustedProxies: []string{"10.0.0.0/8"},
+			headers:        []string{"Forwarded", "X-Forwarded-For"},
+			remoteAddr:     "10.0.0.1:4711",
+			requestHeaders: map[string][]string{"Forwarded": {"for=_hidden"}, "X-Forwarded-For": {"198.51.100.1"}},
+			want:           "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Middleware{TrustedProxies: tt.trustedProxies, ClientIPHeaders: tt.headers}
+			assert.NoError(t, m.compileTrustedProxies())
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.requestHeaders {
+				req.Header[name] = values
+			}
+			assert.Equal(t, tt.want, m.resolveClientIP(req))
+		})
+	}
+}
+
+func TestResolveClientIP_CaddyClientIP(t *testing.T) {
+	m := &Middleware{}
+	assert.NoError(t, m.compileTrustedProxies())
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:4711"
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{
+		caddyhttp.ClientIPVarKey: "198.51.100.1",
+	}))
+	assert.Equal(t, "198.51.100.1", m.resolveClientIP(req))
+}
+
+func TestCompileTrustedProxies_Invalid(t *testing.T) {
+	assert.Error(t, (&Middleware{TrustedProxies: []string{"10.0.0.0/33"}}).compileTrustedProxies())
+	assert.Error(t, (&Middleware{ClientIPHeaders: []string{"X-Client-IP"}}).compileTrustedProxies())
+}
+
+func TestServeHTTP_ClientIP(t *testing.T) {
+	logger := zap.NewNop()
+	newMiddleware := func(trustedProxies ...string) *Middleware {
+		m := &Middleware{
+			logger:                logger,
+			TrustedProxies:        trustedProxies,
+			Rules:                 map[int][]Rule{},
+			ruleCache:             NewRuleCache(),
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+		}
+		assert.NoError(t, m.compileTrustedProxies())
+		assert.NoError(t, m.ipBlacklist.Insert("198.51.100.0/24"))
+		return m
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	newRequest := func(remoteAddr, xff string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", xff)
+		return req
+	}
+
+	t.Run("a spoofed X-Forwarded-For does not evade the blacklist", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, newMiddleware().ServeHTTP(w, newRequest("198.51.100.7:4711", "203.0.113.1"), next))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("a spoofed X-Forwarded-For does not get another client blocked", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, newMiddleware().ServeHTTP(w, newRequest("203.0.113.1:4711", "198.51.100.7"), next))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("the client behind a trusted proxy is blacklisted", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, newMiddleware("10.0.0.0/8").ServeHTTP(w, newRequest("10.0.0.1:4711", "203.0.113.1, 198.51.100.7"), next))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("exclusions match the resolved client IP", func(t *testing.T) {
+		m := newMiddleware("10.0.0.0/8")
+		m.Exclusions = []RuleExclusion{{ClientIPs: []string{"203.0.113.1"}, Rules: []string{"1"}}}
+		assert.NoError(t, m.compileExclusions())
+		req := newRequest("10.0.0.1:4711", "203.0.113.1")
+		req = req.WithContext(withClientIP(req.Context(), m.resolveClientIP(req)))
+		assert.True(t, m.Exclusions[0].matches(req))
+	})
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n trusted_proxies 10.0.0.0/8 192.0.2.1\n trusted_proxies private_ranges\n client_ip_headers cf-connecting-ip x-forwarded-for\n}")
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.1", "private_ranges"}, m.TrustedProxies)
+	assert.Equal(t, []string{HeaderCFConnectingIP, HeaderXForwardedFor}, m.ClientIPHeaders)
+
+	for _, input := range []string{"trusted_proxies", "trusted_proxies 10.0.0.0/33", "trusted_proxies example.com", "client_ip_headers X-Client-IP"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+}
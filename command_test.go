@@ -0,0 +1,71 @@
+package caddywaf
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestImportModSecurityFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := `SecRule ARGS "@rx (?i)<script" "id:941100,phase:2,block,t:none,t:htmlEntityDecode,severity:CRITICAL"
+SecRule REQUEST_HEADERS:User-Agent "@pm nikto sqlmap" "id:913100,phase:1,block,severity:CRITICAL"
+SecRule ARGS "@rx (?<=a)b" "id:942999,phase:2,block"
+`
+	second := `SecRuleRemoveById 941100
+SecRule REQUEST_URI "@contains /etc/passwd" "id:930120,phase:2,deny"
+SecRule REQUEST_URI "@contains /etc/shadow" "id:913100,phase:2,deny"
+`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.conf"), []byte(first), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.conf"), []byte(second), 0644))
+
+	rules, reports, err := importModSecurityFiles([]string{dir})
+	assert.NoError(t, err)
+
+	// Ordered by phase, the removed rule and the rules that don't load are left out
+	var ids []string
+	for _, rule := range rules {
+		ids = append(ids, rule.ID)
+	}
+	assert.Equal(t, []string{"913100", "930120"}, ids)
+
+	if assert.Len(t, reports, 2) {
+		assert.Equal(t, 1, reports[0].Skipped)
+		assert.Contains(t, reports[0].Reasons[0], "invalid regex pattern") // Lookbehind is not supported by RE2
+		assert.Equal(t, 1, reports[1].Skipped)
+		assert.Contains(t, reports[1].Reasons[0], "Duplicate rule ID '913100'")
+		assert.Equal(t, []string{"941100"}, reports[1].Removed)
+	}
+
+	_, _, err = importModSecurityFiles([]string{filepath.Join(dir, "missing.conf")})
+	assert.Error(t, err)
+}
+
+func TestEncodeRules(t *testing.T) {
+	rules := []Rule{{ID: "1", Phase: 2, Pattern: "x", Targets: []string{"ARGS:*"}, Score: 5, RemoveRules: []string{"2"}}}
+
+	output, err := encodeRules(rules, "json")
+	assert.NoError(t, err)
+	var decoded []Rule
+	assert.NoError(t, json.Unmarshal(output, &decoded))
+	assert.Equal(t, rules, decoded)
+
+	output, err = encodeRules(rules, "yaml")
+	assert.NoError(t, err)
+	var generic []map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal(output, &generic))
+	assert.Equal(t, []interface{}{"2"}, generic[0]["remove_rules"])
+
+	// The YAML output is itself a loadable rule file
+	sets, err := decodeRuleSets("rules.yaml", output)
+	assert.NoError(t, err)
+	if assert.Len(t, sets, 1) {
+		rule, err := decodeRule(sets[0].Rules[0])
+		assert.NoError(t, err)
+		assert.Equal(t, rules[0], rule)
+	}
+}
@@ -2,12 +2,15 @@ package caddywaf
 
 import (
 	"fmt"
+	"math"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
 )
 
@@ -118,6 +121,66 @@ func (cl *ConfigLoader) parseRateLimit(d *caddyfile.Dispenser, m *Middleware) er
 	return nil
 }
 
+// parseAutoBan parses the auto_ban directive. Options left out take their defaults at provisioning.
+func (cl *ConfigLoader) parseAutoBan(d *caddyfile.Dispenser, m *Middleware) error {
+	if m.AutoBan.Threshold > 0 {
+		return d.Err("auto_ban directive already specified")
+	}
+
+	var ab AutoBan
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		var err error
+		switch option {
+		case "threshold":
+			ab.Threshold, err = cl.parsePositiveInteger(d, "threshold")
+		case "window":
+			ab.Window, err = cl.parseDuration(d, "window")
+		case "duration":
+			ab.Duration, err = cl.parseDuration(d, "duration")
+		case "max_duration":
+			ab.MaxDuration, err = cl.parseDuration(d, "max_duration")
+		case "reset_after":
+			ab.ResetAfter, err = cl.parseDuration(d, "reset_after")
+		case "cleanup_interval":
+			ab.CleanupInterval, err = cl.parseDuration(d, "cleanup_interval")
+		case "escalation":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ab.Escalation, err = strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid escalation value '%s': %v", d.Val(), err)
+			}
+		case "ipv4_prefix":
+			ab.IPv4Prefix, err = cl.parsePositiveInteger(d, "ipv4_prefix")
+		case "ipv6_prefix":
+			ab.IPv6Prefix, err = cl.parsePositiveInteger(d, "ipv6_prefix")
+		case "state_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ab.StateFile = d.Val()
+		default:
+			return d.Errf("unrecognized auto_ban option: %s", option)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if ab.Threshold <= 0 {
+		return d.Err("auto_ban requires a positive threshold")
+	}
+	if err := ab.withDefaults().validate(); err != nil {
+		return d.Err(err.Error())
+	}
+
+	m.AutoBan = ab
+	cl.logger.Debug("Auto ban configuration applied", zap.Any("auto_ban", m.AutoBan), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
 // UnmarshalCaddyfile is the primary parsing function for the middleware configuration.
 func (cl *ConfigLoader) UnmarshalCaddyfile(d *caddyfile.Dispenser, m *Middleware) error {
 	if cl.logger == nil {
@@ -146,21 +209,46 @@ func (cl *ConfigLoader) UnmarshalCaddyfile(d *caddyfile.Dispenser, m *Middleware
 	m.LogBuffer = 1000
 
 	directiveHandlers := map[string]func(d *caddyfile.Dispenser, m *Middleware) error{
-		"metrics_endpoint":      cl.parseMetricsEndpoint,
-		"log_path":              cl.parseLogPath,
-		"rate_limit":            cl.parseRateLimit,
-		"block_countries":       cl.parseCountryBlockDirective(true),  // Use directive-specific helper
-		"whitelist_countries":   cl.parseCountryBlockDirective(false), // Use directive-specific helper
-		"log_severity":          cl.parseLogSeverity,
-		"log_json":              cl.parseLogJSON,
-		"rule_file":             cl.parseRuleFile,
-		"ip_blacklist_file":     cl.parseBlacklistFileDirective(true),  // Use directive-specific helper
-		"dns_blacklist_file":    cl.parseBlacklistFileDirective(false), // Use directive-specific helper
-		"anomaly_threshold":     cl.parseAnomalyThreshold,
-		"custom_response":       cl.parseCustomResponse,
-		"redact_sensitive_data": cl.parseRedactSensitiveData,
-		"tor":                   cl.parseTorBlock,
-		"log_buffer":            cl.parseLogBuffer,
+		"metrics_endpoint":             cl.parseMetricsEndpoint,
+		"log_path":                     cl.parseLogPath,
+		"rate_limit":                   cl.parseRateLimit,
+		"auto_ban":                     cl.parseAutoBan,
+		"block_countries":              cl.parseCountryBlockDirective(true),  // Use directive-specific helper
+		"whitelist_countries":          cl.parseCountryBlockDirective(false), // Use directive-specific helper
+		"log_severity":                 cl.parseLogSeverity,
+		"log_json":                     cl.parseLogJSON,
+		"rule_file":                    cl.parseRuleFile,
+		"rule_dir":                     cl.parseRuleDir,
+		"ip_blacklist_file":            cl.parseBlacklistFileDirective(true),  // Use directive-specific helper
+		"dns_blacklist_file":           cl.parseBlacklistFileDirective(false), // Use directive-specific helper
+		"anomaly_threshold":            cl.parseAnomalyThreshold,
+		"inbound_anomaly_threshold":    cl.parseDirectionAnomalyThreshold(true),
+		"outbound_anomaly_threshold":   cl.parseDirectionAnomalyThreshold(false),
+		"mode":                         cl.parseMode,
+		"custom_response":              cl.parseCustomResponse,
+		"redact_sensitive_data":        cl.parseRedactSensitiveData,
+		"tor":                          cl.parseTorBlock,
+		"feed":                         cl.parseFeed,
+		"log_buffer":                   cl.parseLogBuffer,
+		"paranoia_level":               cl.parseParanoiaLevel,
+		"enable_tags":                  cl.parseEnableTags,
+		"disable_tags":                 cl.parseDisableTags,
+		"disable_rule":                 cl.parseDisableRule,
+		"exclusions":                   cl.parseExclusions,
+		"request_body_limit":           cl.parseBodySize("request_body_limit"),
+		"request_body_no_files_limit":  cl.parseBodySize("request_body_no_files_limit"),
+		"request_body_in_memory_limit": cl.parseBodySize("request_body_in_memory_limit"),
+		"request_body_limit_action":    cl.parseRequestBodyLimitAction,
+		"response_body_limit":          cl.parseBodySize("response_body_limit"),
+		"response_body_mime_types":     cl.parseResponseBodyMIMETypes,
+		"response_body_mode":           cl.parseResponseBodyMode,
+		"decompressed_body_limit":      cl.parseBodySize("decompressed_body_limit"),
+		"decompression_ratio_limit":    cl.parseDecompressionRatioLimit,
+		"trusted_proxies":              cl.parseTrustedProxies,
+		"ip_whitelist_file":            cl.parseIPWhitelistFile,
+		"allow_ips":                    cl.parseAllowIPs,
+		"allowlist_scope":              cl.parseAllowlistScope,
+		"client_ip_headers":            cl.parseClientIPHeaders,
 	}
 
 	for d.Next() {
@@ -185,19 +273,47 @@ func (cl *ConfigLoader) UnmarshalCaddyfile(d *caddyfile.Dispenser, m *Middleware
 	return nil
 }
 
+// parseRuleFile parses the rule_file directive. Each argument is a rule file (JSON, YAML or ModSecurity .conf)
+// or a glob pattern such as rules/*.json, expanded every time the rules are loaded.
 func (cl *ConfigLoader) parseRuleFile(d *caddyfile.Dispenser, m *Middleware) error {
-	if !d.NextArg() {
+	ruleFiles := d.RemainingArgs()
+	if len(ruleFiles) == 0 {
 		return d.ArgErr()
 	}
-	ruleFile := d.Val()
-	m.RuleFiles = append(m.RuleFiles, ruleFile)
+	m.RuleFiles = append(m.RuleFiles, ruleFiles...)
 
 	if m.MetricsEndpoint != "" && !strings.HasPrefix(m.MetricsEndpoint, "/") {
 		return d.Err("metrics_endpoint must start with a leading '/'")
 	}
 
 	cl.logger.Info("Loading WAF rule file",
-		zap.String("path", ruleFile),
+		zap.Strings("paths", ruleFiles),
+		zap.String("file", d.File()),
+		zap.Int("line", d.Line()),
+	)
+	return nil
+}
+
+// parseRuleDir parses the rule_dir directive. Every .json, .yaml, .yml and .conf file directly inside
+// each directory is loaded, in file name order.
+func (cl *ConfigLoader) parseRuleDir(d *caddyfile.Dispenser, m *Middleware) error {
+	ruleDirs := d.RemainingArgs()
+	if len(ruleDirs) == 0 {
+		return d.ArgErr()
+	}
+	for _, dir := range ruleDirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return d.Errf("rule_dir %s: %v", dir, err)
+		}
+		if !info.IsDir() {
+			return d.Errf("rule_dir %s is not a directory", dir)
+		}
+	}
+	m.RuleFiles = append(m.RuleFiles, ruleDirs...)
+
+	cl.logger.Info("Loading WAF rule directory",
+		zap.Strings("paths", ruleDirs),
 		zap.String("file", d.File()),
 		zap.Int("line", d.Line()),
 	)
@@ -364,6 +480,309 @@ func (cl *ConfigLoader) parseAnomalyThreshold(d *caddyfile.Dispenser, m *Middlew
 	return nil
 }
 
+// parseDirectionAnomalyThreshold returns a closure to handle the inbound_anomaly_threshold (phases 1-2)
+// and outbound_anomaly_threshold (phases 3-4) directives.
+func (cl *ConfigLoader) parseDirectionAnomalyThreshold(inbound bool) func(d *caddyfile.Dispenser, m *Middleware) error {
+	return func(d *caddyfile.Dispenser, m *Middleware) error {
+		directiveName := "outbound_anomaly_threshold"
+		if inbound {
+			directiveName = "inbound_anomaly_threshold"
+		}
+		threshold, err := cl.parsePositiveInteger(d, directiveName)
+		if err != nil {
+			return err
+		}
+		if inbound {
+			m.InboundAnomalyThreshold = threshold
+		} else {
+			m.OutboundAnomalyThreshold = threshold
+		}
+		cl.logger.Debug("Anomaly threshold set", zap.String("directive", directiveName), zap.Int("threshold", threshold), zap.String("file", d.File()), zap.Int("line", d.Line()))
+		return nil
+	}
+}
+
+// parseMode parses the mode directive: blocking (the default) or detection_only, where matches are
+// scored and logged but requests are never blocked.
+func (cl *ConfigLoader) parseMode(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	mode := d.Val()
+	if mode != ModeBlocking && mode != ModeDetectionOnly {
+		return d.Errf("invalid mode value '%s', must be one of: %s, %s", mode, ModeBlocking, ModeDetectionOnly)
+	}
+	m.Mode = mode
+	cl.logger.Debug("WAF mode set", zap.String("mode", mode), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseBodySize returns a handler for a request or response body size directive. Sizes are given in bytes or
+// with a unit, e.g. 131072, 128KiB or 10MB.
+func (cl *ConfigLoader) parseBodySize(directiveName string) func(d *caddyfile.Dispenser, m *Middleware) error {
+	return func(d *caddyfile.Dispenser, m *Middleware) error {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		size, err := humanize.ParseBytes(d.Val())
+		if err != nil {
+			return d.Errf("invalid %s value '%s': %v", directiveName, d.Val(), err)
+		}
+		if size == 0 || size > math.MaxInt64 {
+			return d.Errf("%s must be a positive size, got '%s'", directiveName, d.Val())
+		}
+		switch directiveName {
+		case "request_body_limit":
+			m.RequestBodyLimit = int64(size)
+		case "request_body_no_files_limit":
+			m.RequestBodyNoFilesLimit = int64(size)
+		case "request_body_in_memory_limit":
+			m.RequestBodyInMemoryLimit = int64(size)
+		case "response_body_limit":
+			m.ResponseBodyLimit = int64(size)
+		case "decompressed_body_limit":
+			m.DecompressedBodyLimit = int64(size)
+		}
+		cl.logger.Debug("Body limit set", zap.String("directive", directiveName), zap.Uint64("bytes", size), zap.String("file", d.File()), zap.Int("line", d.Line()))
+		return nil
+	}
+}
+
+// parseRequestBodyLimitAction parses the request_body_limit_action directive: reject blocks a request whose
+// body exceeds a limit with 413, process_partial (the default) inspects the body up to the limits.
+func (cl *ConfigLoader) parseRequestBodyLimitAction(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	action := d.Val()
+	if action != BodyLimitActionReject && action != BodyLimitActionProcessPartial {
+		return d.Errf("invalid request_body_limit_action value '%s', must be one of: %s, %s", action, BodyLimitActionReject, BodyLimitActionProcessPartial)
+	}
+	m.RequestBodyLimitAction = action
+	cl.logger.Debug("Request body limit action set", zap.String("action", action), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseResponseBodyMIMETypes parses the response_body_mime_types directive, a list of content types
+// whose response body the phase 4 rules inspect. A type may end in a wildcard, e.g. text/*.
+func (cl *ConfigLoader) parseResponseBodyMIMETypes(d *caddyfile.Dispenser, m *Middleware) error {
+	mimeTypes := d.RemainingArgs()
+	if len(mimeTypes) == 0 {
+		return d.ArgErr()
+	}
+	for _, mimeType := range mimeTypes {
+		if !strings.Contains(mimeType, "/") {
+			return d.Errf("invalid response_body_mime_types value '%s', must be a type/subtype", mimeType)
+		}
+		m.ResponseBodyMIMETypes = append(m.ResponseBodyMIMETypes, strings.ToLower(mimeType))
+	}
+	cl.logger.Debug("Response body MIME types set", zap.Strings("mime_types", m.ResponseBodyMIMETypes), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseResponseBodyMode parses the response_body_mode directive: buffer (the default) holds the response
+// back until the phase 4 rules have seen it, stream passes it through while inspecting a sliding window.
+func (cl *ConfigLoader) parseResponseBodyMode(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	mode := d.Val()
+	if mode != ResponseBodyModeBuffer && mode != ResponseBodyModeStream {
+		return d.Errf("invalid response_body_mode value '%s', must be one of: %s, %s", mode, ResponseBodyModeBuffer, ResponseBodyModeStream)
+	}
+	m.ResponseBodyMode = mode
+	cl.logger.Debug("Response body mode set", zap.String("mode", mode), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseDecompressionRatioLimit parses the decompression_ratio_limit directive: how many times larger than
+// its compressed size a body may get when it is decoded for inspection.
+func (cl *ConfigLoader) parseDecompressionRatioLimit(d *caddyfile.Dispenser, m *Middleware) error {
+	ratio, err := cl.parsePositiveInteger(d, "decompression_ratio_limit")
+	if err != nil {
+		return err
+	}
+	m.DecompressionRatioLimit = ratio
+	cl.logger.Debug("Decompression ratio limit set", zap.Int("ratio", ratio), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseTrustedProxies parses the trusted_proxies directive: the CIDRs or IPs of the proxies in front of
+// Caddy, or private_ranges for all private networks. It may be repeated.
+func (cl *ConfigLoader) parseTrustedProxies(d *caddyfile.Dispenser, m *Middleware) error {
+	proxies := d.RemainingArgs()
+	if len(proxies) == 0 {
+		return d.ArgErr()
+	}
+	for _, proxy := range proxies {
+		if proxy == trustedProxiesPrivateRanges {
+			continue
+		}
+		if _, err := newIPMatcher(proxy); err != nil {
+			return d.Errf("invalid trusted_proxies value '%s': %v", proxy, err)
+		}
+	}
+	m.TrustedProxies = append(m.TrustedProxies, proxies...)
+	cl.logger.Debug("Trusted proxies set", zap.Strings("trusted_proxies", m.TrustedProxies), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseClientIPHeaders parses the client_ip_headers directive: the headers a trusted proxy passes the
+// client IP in, tried in order.
+func (cl *ConfigLoader) parseClientIPHeaders(d *caddyfile.Dispenser, m *Middleware) error {
+	headers := d.RemainingArgs()
+	if len(headers) == 0 {
+		return d.ArgErr()
+	}
+	for _, header := range headers {
+		canonical, ok := clientIPHeaders[http.CanonicalHeaderKey(header)]
+		if !ok {
+			return d.Errf("invalid client_ip_headers value '%s', must be one of: %s, %s, %s, %s",
+				header, HeaderXForwardedFor, HeaderXRealIP, HeaderCFConnectingIP, HeaderForwarded)
+		}
+		m.ClientIPHeaders = append(m.ClientIPHeaders, canonical)
+	}
+	cl.logger.Debug("Client IP headers set", zap.Strings("client_ip_headers", m.ClientIPHeaders), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseIPWhitelistFile parses the ip_whitelist_file directive. The file lists IPs and CIDRs like
+// ip_blacklist_file, and is reloaded when it changes.
+func (cl *ConfigLoader) parseIPWhitelistFile(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	filePath := d.Val()
+	if _, err := os.Stat(filePath); err != nil {
+		return d.Errf("could not access ip_whitelist_file '%s': %v", filePath, err)
+	}
+	m.IPWhitelistFile = filePath
+	cl.logger.Info("IP whitelist file configured", zap.String("path", filePath), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseAllowIPs parses the allow_ips directive, a list of IPs and CIDRs to allowlist. It may be repeated.
+func (cl *ConfigLoader) parseAllowIPs(d *caddyfile.Dispenser, m *Middleware) error {
+	entries := d.RemainingArgs()
+	if len(entries) == 0 {
+		return d.ArgErr()
+	}
+	for _, entry := range entries {
+		if err := NewCIDRTrie().InsertAddress(entry); err != nil {
+			return d.Errf("invalid allow_ips value '%s': %v", entry, err)
+		}
+	}
+	m.AllowIPs = append(m.AllowIPs, entries...)
+	cl.logger.Debug("Allowlisted IPs set", zap.Strings("allow_ips", m.AllowIPs), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseAllowlistScope parses the allowlist_scope directive: all (the default) lets allowlisted clients
+// bypass the WAF, ip_checks only skips rate limiting, country blocking and the blacklists for them.
+func (cl *ConfigLoader) parseAllowlistScope(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	scope := d.Val()
+	if scope != AllowlistScopeAll && scope != AllowlistScopeIPChecks {
+		return d.Errf("invalid allowlist_scope value '%s', must be one of: %s, %s", scope, AllowlistScopeAll, AllowlistScopeIPChecks)
+	}
+	m.AllowlistScope = scope
+	cl.logger.Debug("Allowlist scope set", zap.String("scope", scope), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseParanoiaLevel parses the paranoia_level directive (1-4). Rules with a higher paranoia level are not applied.
+func (cl *ConfigLoader) parseParanoiaLevel(d *caddyfile.Dispenser, m *Middleware) error {
+	level, err := cl.parsePositiveInteger(d, "paranoia_level")
+	if err != nil {
+		return err
+	}
+	if level > maxParanoiaLevel {
+		return d.Errf("paranoia_level must be between 1 and %d, got %d", maxParanoiaLevel, level)
+	}
+	m.ParanoiaLevel = level
+	cl.logger.Debug("Paranoia level set", zap.Int("level", level), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseEnableTags parses the enable_tags directive. Once set, only rules with one of the tags apply.
+func (cl *ConfigLoader) parseEnableTags(d *caddyfile.Dispenser, m *Middleware) error {
+	tags := d.RemainingArgs()
+	if len(tags) == 0 {
+		return d.ArgErr()
+	}
+	m.EnableTags = append(m.EnableTags, tags...)
+	cl.logger.Debug("Rule tags enabled", zap.Strings("tags", tags), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseDisableTags parses the disable_tags directive. Rules with any of the tags are not applied.
+func (cl *ConfigLoader) parseDisableTags(d *caddyfile.Dispenser, m *Middleware) error {
+	tags := d.RemainingArgs()
+	if len(tags) == 0 {
+		return d.ArgErr()
+	}
+	m.DisableTags = append(m.DisableTags, tags...)
+	cl.logger.Debug("Rule tags disabled", zap.Strings("tags", tags), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseDisableRule parses the disable_rule directive. Each argument is a rule ID or a numeric "first-last" range.
+func (cl *ConfigLoader) parseDisableRule(d *caddyfile.Dispenser, m *Middleware) error {
+	ids := d.RemainingArgs()
+	if len(ids) == 0 {
+		return d.ArgErr()
+	}
+	m.DisableRules = append(m.DisableRules, ids...)
+	cl.logger.Debug("Rules disabled", zap.Strings("rule_ids", ids), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
+// parseExclusions parses the exclusions block. Each entry is a named block of request conditions
+// (path, host, method, client_ip) and what to exclude when they all match (rule, tag, target).
+func (cl *ConfigLoader) parseExclusions(d *caddyfile.Dispenser, m *Middleware) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		exclusion := RuleExclusion{Name: d.Val()}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for inner := d.Nesting(); d.NextBlock(inner); {
+			option := d.Val()
+			values := d.RemainingArgs()
+			if len(values) == 0 {
+				return d.Errf("exclusion '%s': %s requires at least one value", exclusion.Name, option)
+			}
+			switch option {
+			case "path":
+				exclusion.Paths = append(exclusion.Paths, values...)
+			case "host":
+				exclusion.Hosts = append(exclusion.Hosts, values...)
+			case "method":
+				exclusion.Methods = append(exclusion.Methods, values...)
+			case "client_ip":
+				exclusion.ClientIPs = append(exclusion.ClientIPs, values...)
+			case "rule":
+				exclusion.Rules = append(exclusion.Rules, values...)
+			case "tag":
+				exclusion.Tags = append(exclusion.Tags, values...)
+			case "target":
+				exclusion.Targets = append(exclusion.Targets, values...)
+			default:
+				return d.Errf("exclusion '%s': unrecognized option: %s", exclusion.Name, option)
+			}
+		}
+
+		if err := exclusion.compile(); err != nil {
+			return d.Err(err.Error())
+		}
+		m.Exclusions = append(m.Exclusions, exclusion)
+		cl.logger.Debug("Rule exclusion configured", zap.String("name", exclusion.Name), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	}
+	return nil
+}
+
 func (cl *ConfigLoader) parseTorBlock(d *caddyfile.Dispenser, m *Middleware) error {
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		subDirective := d.Val()
@@ -412,6 +831,85 @@ func (cl *ConfigLoader) parseTorBlock(d *caddyfile.Dispenser, m *Middleware) err
 	return nil
 }
 
+// parseFeed parses a feed block: feed <name> { url ... }. It may be repeated, once per feed.
+func (cl *ConfigLoader) parseFeed(d *caddyfile.Dispenser, m *Middleware) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	feed := Feed{Name: d.Val()}
+	for _, existing := range m.Feeds {
+		if existing.Name == feed.Name {
+			return d.Errf("feed %s already specified", feed.Name)
+		}
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		var err error
+		switch option {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			feed.URL = d.Val()
+		case "type":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			feed.Type = d.Val()
+		case "format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			feed.Format = d.Val()
+		case "cache_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			feed.CacheFile = d.Val()
+		case "refresh_interval":
+			feed.RefreshInterval, err = cl.parseDuration(d, "refresh_interval")
+		case "timeout":
+			feed.Timeout, err = cl.parseDuration(d, "timeout")
+		case "retry_backoff":
+			feed.RetryBackoff, err = cl.parseDuration(d, "retry_backoff")
+		case "retries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			retries, convErr := strconv.Atoi(d.Val())
+			if convErr != nil || retries < 0 {
+				return d.Errf("invalid retries value '%s', must be a non-negative integer", d.Val())
+			}
+			feed.Retries = retries
+			if retries == 0 {
+				feed.Retries = -1 // Zero would fall back to the default
+			}
+		case "max_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, convErr := humanize.ParseBytes(d.Val())
+			if convErr != nil || size == 0 || size > math.MaxInt64 {
+				return d.Errf("invalid max_size value '%s', must be a positive size", d.Val())
+			}
+			feed.MaxSize = int64(size)
+		default:
+			return d.Errf("unrecognized feed option: %s", option)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := feed.withDefaults().validate(); err != nil {
+		return d.Err(err.Error())
+	}
+	m.Feeds = append(m.Feeds, feed)
+	cl.logger.Debug("Feed configured", zap.Any("feed", feed), zap.String("file", d.File()), zap.Int("line", d.Line()))
+	return nil
+}
+
 func (cl *ConfigLoader) parseLogJSON(d *caddyfile.Dispenser, m *Middleware) error {
 	m.LogJSON = true
 	cl.logger.Debug("Log JSON enabled", zap.String("file", d.File()), zap.Int("line", d.Line()))
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
 
 	"go.uber.org/zap"
 )
@@ -136,6 +137,130 @@ func TestParseRuleFile(t *testing.T) {
 	}
 }
 
+func TestParseRuleFile_MultipleAndGlob(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`
+        rule_file rules/sql-injection.json rules/*.yaml
+    `)
+	if !d.Next() {
+		t.Fatal("Failed to advance to the first directive")
+	}
+
+	assert.NoError(t, cl.parseRuleFile(d, m))
+	assert.Equal(t, []string{"rules/sql-injection.json", "rules/*.yaml"}, m.RuleFiles)
+}
+
+func TestParseRuleDir(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rules.json")
+	assert.NoError(t, os.WriteFile(file, []byte("[]"), 0644))
+
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"directory", "rule_dir " + dir, false},
+		{"missing directory", "rule_dir " + filepath.Join(dir, "missing"), true},
+		{"file instead of directory", "rule_dir " + file, true},
+		{"no argument", "rule_dir", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Middleware{}
+			d := caddyfile.NewTestDispenser(tt.input)
+			if !d.Next() {
+				t.Fatal("Failed to advance to the first directive")
+			}
+			err := cl.parseRuleDir(d, m)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []string{dir}, m.RuleFiles)
+		})
+	}
+}
+
+func TestParseRuleSelectionDirectives(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`
+	waf {
+		rule_file rules.json
+		paranoia_level 2
+		enable_tags attack-sqli attack-xss
+		disable_tags OWASP_CRS/WEB_ATTACK
+		disable_rule 942100 920100-920199
+		disable_rule noisy-rule
+	}
+	`)
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, 2, m.ParanoiaLevel)
+	assert.Equal(t, []string{"attack-sqli", "attack-xss"}, m.EnableTags)
+	assert.Equal(t, []string{"OWASP_CRS/WEB_ATTACK"}, m.DisableTags)
+	assert.Equal(t, []string{"942100", "920100-920199", "noisy-rule"}, m.DisableRules)
+
+	for _, input := range []string{"paranoia_level 5", "paranoia_level 0", "paranoia_level", "enable_tags", "disable_tags", "disable_rule"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+}
+
+func TestParseExclusions(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`
+	waf {
+		rule_file rules.json
+		exclusions {
+			search_query {
+				path /search
+				rule sqli-basic-keywords
+				target ARGS:query
+			}
+			office_cms {
+				path /admin/cms/*
+				host cms.example.com
+				method GET POST
+				client_ip 203.0.113.0/24 2001:db8::/32
+				tag attack-xss
+			}
+		}
+	}
+	`)
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	if assert.Len(t, m.Exclusions, 2) {
+		assert.Equal(t, "search_query", m.Exclusions[0].Name)
+		assert.Equal(t, []string{"/search"}, m.Exclusions[0].Paths)
+		assert.Equal(t, []string{"sqli-basic-keywords"}, m.Exclusions[0].Rules)
+		assert.Equal(t, []string{"ARGS:query"}, m.Exclusions[0].Targets)
+		assert.Equal(t, "office_cms", m.Exclusions[1].Name)
+		assert.Equal(t, []string{"GET", "POST"}, m.Exclusions[1].Methods)
+		assert.Equal(t, []string{"203.0.113.0/24", "2001:db8::/32"}, m.Exclusions[1].ClientIPs)
+		assert.Equal(t, []string{"attack-xss"}, m.Exclusions[1].Tags)
+	}
+
+	invalid := []string{
+		"exclusions {\n a {\n path /x\n }\n }",                 // Nothing to exclude
+		"exclusions {\n a {\n rule 1\n header X\n }\n }",       // Unknown option
+		"exclusions {\n a {\n rule\n }\n }",                    // Missing value
+		"exclusions {\n a {\n target ARG:x\n }\n }",            // Unknown target
+		"exclusions {\n a b {\n rule 1\n }\n }",                // Extra argument
+		"exclusions {\n a {\n rule 1\n client_ip nope\n }\n }", // Invalid IP
+	}
+	for _, input := range invalid {
+		d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+		assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}), input)
+	}
+}
+
 // TestParseCustomResponse tests the parseCustomResponse function.
 func TestParseCustomResponse(t *testing.T) {
 	logger := zap.NewNop()
@@ -344,3 +469,100 @@ func TestUnmarshalCaddyfile_MissingRuleFile(t *testing.T) {
 		t.Fatal("Expected error for missing rule_file directive, got nil")
 	}
 }
+
+func TestParseMode(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n mode detection_only\n}")
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, ModeDetectionOnly, m.Mode)
+
+	for _, input := range []string{"mode", "mode monitor"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+
+	assert.Error(t, (&Middleware{Mode: "monitor"}).Validate())
+	assert.NoError(t, (&Middleware{Mode: ModeBlocking}).Validate())
+}
+
+func TestParseDirectionAnomalyThresholds(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n inbound_anomaly_threshold 10\n outbound_anomaly_threshold 4\n}")
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, 5, m.AnomalyThreshold)
+	assert.Equal(t, 10, m.InboundAnomalyThreshold)
+	assert.Equal(t, 4, m.OutboundAnomalyThreshold)
+
+	for _, input := range []string{"inbound_anomaly_threshold 0", "outbound_anomaly_threshold", "outbound_anomaly_threshold x"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+}
+
+func TestParseRequestBodyLimits(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n request_body_limit 10MB\n request_body_no_files_limit 65536\n request_body_in_memory_limit 64KiB\n request_body_limit_action process_partial\n}")
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, int64(10000000), m.RequestBodyLimit)
+	assert.Equal(t, int64(65536), m.RequestBodyNoFilesLimit)
+	assert.Equal(t, int64(65536), m.RequestBodyInMemoryLimit)
+	assert.Equal(t, BodyLimitActionProcessPartial, m.RequestBodyLimitAction)
+
+	for _, input := range []string{"request_body_limit", "request_body_limit 0", "request_body_limit ten", "request_body_no_files_limit -1", "request_body_limit_action drop"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+
+	assert.Error(t, (&Middleware{RequestBodyLimit: -1}).Validate())
+	assert.Error(t, (&Middleware{RequestBodyLimitAction: "drop"}).Validate())
+	assert.NoError(t, (&Middleware{RequestBodyLimitAction: BodyLimitActionReject}).Validate())
+}
+
+func TestParseResponseBodyInspection(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n response_body_limit 1MiB\n response_body_mime_types text/* Application/JSON\n response_body_mode stream\n}")
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, int64(1048576), m.ResponseBodyLimit)
+	assert.Equal(t, []string{"text/*", "application/json"}, m.ResponseBodyMIMETypes)
+	assert.Equal(t, ResponseBodyModeStream, m.ResponseBodyMode)
+
+	for _, input := range []string{"response_body_limit 0", "response_body_mime_types", "response_body_mime_types html", "response_body_mode chunked"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+
+	assert.Error(t, (&Middleware{ResponseBodyLimit: -1}).Validate())
+	assert.Error(t, (&Middleware{ResponseBodyMode: "chunked"}).Validate())
+	assert.NoError(t, (&Middleware{ResponseBodyMode: ResponseBodyModeBuffer}).Validate())
+}
+
+func TestParseDecompressionLimits(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n decompressed_body_limit 4MiB\n decompression_ratio_limit 50\n}")
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, int64(4194304), m.DecompressedBodyLimit)
+	assert.Equal(t, 50, m.DecompressionRatioLimit)
+	assert.Equal(t, decompressionLimits{size: 4194304, ratio: 50}, m.decompressionLimits())
+	assert.Equal(t, decompressionLimits{size: defaultDecompressedBodyLimit, ratio: defaultDecompressionRatioLimit}, (&Middleware{}).decompressionLimits())
+
+	for _, input := range []string{"decompressed_body_limit 0", "decompression_ratio_limit 0", "decompression_ratio_limit x"} {
+		t.Run(input, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + input + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+	assert.Error(t, (&Middleware{DecompressionRatioLimit: -1}).Validate())
+}
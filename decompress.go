@@ -0,0 +1,143 @@
+package caddywaf
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Default guards against compressed bodies that expand to far more than they weigh (zip bombs).
+const (
+	defaultDecompressedBodyLimit   = 1048576 // 1 MiB
+	defaultDecompressionRatioLimit = 100
+)
+
+// Names of the decompression guards, as reported when a body trips one.
+const (
+	limitDecompressedBody   = "decompressed_body_limit"
+	limitDecompressionRatio = "decompression_ratio_limit"
+)
+
+// maxZstdWindow bounds the memory a zstd frame may ask the decoder for.
+const maxZstdWindow = 8 << 20 // 8 MiB
+
+// decompressionLimits bounds how much a compressed body is decoded for inspection. Zero means no limit.
+type decompressionLimits struct {
+	size  int64 // Decoded bytes
+	ratio int64 // Decoded bytes per compressed byte
+}
+
+// decompressionLimits returns the configured decompression guards, or the defaults.
+func (m *Middleware) decompressionLimits() decompressionLimits {
+	limits := decompressionLimits{size: defaultDecompressedBodyLimit, ratio: defaultDecompressionRatioLimit}
+	if m.DecompressedBodyLimit > 0 {
+		limits.size = m.DecompressedBodyLimit
+	}
+	if m.DecompressionRatioLimit > 0 {
+		limits.ratio = int64(m.DecompressionRatioLimit)
+	}
+	return limits
+}
+
+// decompressionGuardConfigured reports whether limit is not a decompression guard, or one set in the
+// config. The default guards only bound how much of a body is inspected, so a body that trips one is
+// never rejected.
+func (m *Middleware) decompressionGuardConfigured(limit string) bool {
+	switch limit {
+	case limitDecompressedBody:
+		return m.DecompressedBodyLimit > 0
+	case limitDecompressionRatio:
+		return m.DecompressionRatioLimit > 0
+	default:
+		return true
+	}
+}
+
+// contentCodings returns the content codings listed in the Content-Encoding header, in the order
+// they were applied, leaving out identity.
+func contentCodings(header http.Header) []string {
+	var codings []string
+	for _, value := range header.Values("Content-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	return codings
+}
+
+// decompressBody decodes size bytes of compressed data, undoing the codings in reverse order. Decoding
+// stops at limits.size bytes, or once the output is limits.ratio times larger than the input: the decoded
+// prefix is returned with the name of the guard it tripped. Data that cannot be decoded, e.g. because
+// it was truncated, returns what was decoded before the error.
+func decompressBody(codings []string, compressed io.Reader, size int64, limits decompressionLimits) ([]byte, string, error) {
+	if size == 0 {
+		return []byte{}, "", nil
+	}
+	maxSize, guard := limits.size, limitDecompressedBody
+	if limits.ratio > 0 && (maxSize == 0 || limits.ratio*size < maxSize) {
+		maxSize, guard = limits.ratio*size, limitDecompressionRatio
+	}
+
+	reader := compressed
+	for i := len(codings) - 1; i >= 0; i-- {
+		decoder, err := newDecoder(codings[i], reader)
+		if err != nil {
+			return []byte{}, "", err
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+
+	data, err := readLimited(reader, maxSize)
+	if err != nil {
+		return data, "", fmt.Errorf("malformed %s body: %w", strings.Join(codings, ", "), err)
+	}
+	if maxSize > 0 && int64(len(data)) > maxSize {
+		return data[:maxSize], guard, nil
+	}
+	return data, "", nil
+}
+
+// newDecoder returns a reader that decodes r according to a content coding.
+func newDecoder(coding string, r io.Reader) (io.ReadCloser, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		decoder, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("malformed gzip body: %w", err)
+		}
+		return decoder, nil
+	case "deflate":
+		// deflate should be zlib-wrapped (RFC 9110), but some clients send a raw deflate stream
+		buffered := bufio.NewReader(r)
+		if header, err := buffered.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			decoder, err := zlib.NewReader(buffered)
+			if err != nil {
+				return nil, fmt.Errorf("malformed deflate body: %w", err)
+			}
+			return decoder, nil
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, fmt.Errorf("malformed zstd body: %w", err)
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding '%s'", coding)
+	}
+}
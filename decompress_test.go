@@ -0,0 +1,239 @@
+package caddywaf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// compress encodes data with a content coding.
+func compress(t *testing.T, coding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch coding {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "deflate":
+		writer = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		writer, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		writer = brotli.NewWriter(&buf)
+	case "zstd":
+		encoder, err := zstd.NewWriter(&buf)
+		assert.NoError(t, err)
+		writer = encoder
+	default:
+		t.Fatalf("unknown coding %s", coding)
+	}
+	_, err := writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func TestContentCodings(t *testing.T) {
+	header := http.Header{}
+	assert.Empty(t, contentCodings(header))
+	header.Set("Content-Encoding", "identity")
+	assert.Empty(t, contentCodings(header))
+	header.Set("Content-Encoding", "Gzip, br")
+	header.Add("Content-Encoding", "zstd")
+	assert.Equal(t, []string{"gzip", "br", "zstd"}, contentCodings(header))
+}
+
+func TestDecompressBody(t *testing.T) {
+	payload := []byte(`{"user":"admin' OR '1'='1"}`)
+	noLimits := decompressionLimits{}
+
+	for _, coding := range []string{"gzip", "deflate", "br", "zstd"} {
+		t.Run(coding, func(t *testing.T) {
+			compressed := compress(t, coding, payload)
+			decoded, exceeded, err := decompressBody([]string{coding}, bytes.NewReader(compressed), int64(len(compressed)), noLimits)
+			assert.NoError(t, err)
+			assert.Empty(t, exceeded)
+			assert.Equal(t, payload, decoded)
+		})
+	}
+
+	t.Run("raw deflate", func(t *testing.T) {
+		compressed := compress(t, "raw-deflate", payload)
+		decoded, _, err := decompressBody([]string{"deflate"}, bytes.NewReader(compressed), int64(len(compressed)), noLimits)
+		assert.NoError(t, err)
+		assert.Equal(t, payload, decoded)
+	})
+
+	t.Run("codings are undone in reverse order", func(t *testing.T) {
+		compressed := compress(t, "gzip", compress(t, "br", payload))
+		decoded, _, err := decompressBody([]string{"br", "gzip"}, bytes.NewReader(compressed), int64(len(compressed)), noLimits)
+		assert.NoError(t, err)
+		assert.Equal(t, payload, decoded)
+	})
+
+	t.Run("unsupported coding", func(t *testing.T) {
+		_, _, err := decompressBody([]string{"compress"}, strings.NewReader("data"), 4, noLimits)
+		assert.EqualError(t, err, "unsupported Content-Encoding 'compress'")
+	})
+
+	t.Run("malformed data", func(t *testing.T) {
+		_, _, err := decompressBody([]string{"gzip"}, strings.NewReader("not gzip"), 8, noLimits)
+		assert.ErrorContains(t, err, "malformed gzip body")
+	})
+
+	t.Run("truncated data returns the decoded prefix", func(t *testing.T) {
+		compressed := compress(t, "gzip", bytes.Repeat(payload, 100))
+		compressed = compressed[:len(compressed)-10]
+		decoded, _, err := decompressBody([]string{"gzip"}, bytes.NewReader(compressed), int64(len(compressed)), noLimits)
+		assert.Error(t, err)
+		assert.True(t, bytes.HasPrefix(bytes.Repeat(payload, 100), decoded))
+	})
+
+	bomb := compress(t, "gzip", bytes.Repeat([]byte{'a'}, 1<<20))
+
+	t.Run("size guard", func(t *testing.T) {
+		decoded, exceeded, err := decompressBody([]string{"gzip"}, bytes.NewReader(bomb), int64(len(bomb)), decompressionLimits{size: 1000})
+		assert.NoError(t, err)
+		assert.Equal(t, limitDecompressedBody, exceeded)
+		assert.Len(t, decoded, 1000)
+	})
+
+	t.Run("ratio guard", func(t *testing.T) {
+		decoded, exceeded, err := decompressBody([]string{"gzip"}, bytes.NewReader(bomb), int64(len(bomb)), decompressionLimits{size: 1 << 30, ratio: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, limitDecompressionRatio, exceeded)
+		assert.Len(t, decoded, 10*len(bomb))
+	})
+}
+
+func TestParseRequestBody_Compressed(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+	compressed := compress(t, "gzip", []byte(`{"user":{"name":"admin"}}`))
+
+	req := newBodyRequest("application/json", string(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	body := rve.parseRequestBody(req, requestBodyLimits{})
+	assert.NoError(t, body.err)
+	assert.Equal(t, []TargetValue{{Name: "user.name", Value: "admin"}}, body.args)
+	assert.Equal(t, `{"user":{"name":"admin"}}`, string(body.raw))
+
+	forwarded, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, compressed, forwarded, "the upstream receives the original bytes")
+
+	req = newBodyRequest("application/json", "not gzip")
+	req.Header.Set("Content-Encoding", "gzip")
+	body = rve.parseRequestBody(req, requestBodyLimits{})
+	assert.ErrorContains(t, body.err, "malformed gzip body")
+
+	bomb := compress(t, "gzip", bytes.Repeat([]byte{'a'}, 1<<20))
+	req = newBodyRequest("text/plain", string(bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+	body = rve.parseRequestBody(req, requestBodyLimits{decompression: decompressionLimits{size: 1 << 30, ratio: 100}})
+	assert.Equal(t, limitDecompressionRatio, body.exceeded)
+	assert.Len(t, body.raw, 100*len(bomb))
+}
+
+func TestServeHTTP_CompressedBodies(t *testing.T) {
+	logger := zap.NewNop()
+	sqli, err := compileOperator("contains", "' OR '1'='1", "")
+	assert.NoError(t, err)
+	secret, err := compileOperator("contains", "SECRET", "")
+	assert.NoError(t, err)
+
+	m := &Middleware{
+		logger:                 logger,
+		AnomalyThreshold:       5,
+		RequestBodyLimitAction: BodyLimitActionReject,
+		Rules: map[int][]Rule{
+			2: {{ID: "sqli", Phase: 2, Targets: []string{"JSON:*"}, Score: 5, Action: ActionBlock, matcher: sqli}},
+			4: {{ID: "secret", Phase: 4, Targets: []string{"RESPONSE_BODY"}, Score: 5, Action: ActionBlock, matcher: secret}},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	m.requestValueExtractor.bodyLimits = m.requestBodyLimits()
+	m.requestBodyRules.Store(true)
+
+	upstream := func(body string) caddyhttp.Handler {
+		return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			_, err := w.Write(compress(t, "gzip", []byte(body)))
+			return err
+		})
+	}
+	newRequest := func(body string) *http.Request {
+		req := newBodyRequest("application/json", string(compress(t, "gzip", []byte(body))))
+		req.Header.Set("Content-Encoding", "gzip")
+		return req
+	}
+
+	t.Run("compressed request body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newRequest(`{"user":"admin' OR '1'='1"}`), upstream("ok")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	bomb := compress(t, "gzip", bytes.Repeat([]byte{'a'}, 1<<20))
+	newBombRequest := func() *http.Request {
+		req := newBodyRequest("text/plain", string(bomb))
+		req.Header.Set("Content-Encoding", "gzip")
+		return req
+	}
+
+	t.Run("decompression bomb under the default guards is inspected partially", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBombRequest(), upstream("ok")))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("decompression bomb under a configured guard is rejected", func(t *testing.T) {
+		m.DecompressionRatioLimit = defaultDecompressionRatioLimit
+		defer func() { m.DecompressionRatioLimit = 0 }()
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newBombRequest(), upstream("ok")))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("compressed response body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newRequest(`{"user":"admin"}`), upstream("the SECRET")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+	})
+
+	t.Run("clean response is forwarded compressed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newRequest(`{"user":"admin"}`), upstream("hello")))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		reader, err := gzip.NewReader(w.Body)
+		assert.NoError(t, err)
+		decoded, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(decoded))
+	})
+
+	t.Run("stream mode buffers a compressed response", func(t *testing.T) {
+		m.ResponseBodyMode = ResponseBodyModeStream
+		defer func() { m.ResponseBodyMode = "" }()
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, newRequest(`{"user":"admin"}`), upstream("the SECRET")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
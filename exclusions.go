@@ -0,0 +1,225 @@
+package caddywaf
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// RuleExclusion removes rules, tags or individual targets from evaluation for the requests that match
+// all of its conditions. Conditions left empty match every request.
+type RuleExclusion struct {
+	Name string `json:"name,omitempty"` // Label used in logs and metrics
+
+	// Conditions
+	Paths     []string `json:"paths,omitempty"`      // Exact paths, or patterns where * matches any characters (e.g. /admin/cms/*)
+	Hosts     []string `json:"hosts,omitempty"`      // Host names (case-insensitive); a leading *. matches any subdomain
+	Methods   []string `json:"methods,omitempty"`    // HTTP methods (case-insensitive)
+	ClientIPs []string `json:"client_ips,omitempty"` // Client IPs or CIDRs
+
+	// What is excluded
+	Rules   []string `json:"rules,omitempty"`   // Rule IDs or "first-last" ranges
+	Tags    []string `json:"tags,omitempty"`    // Rules with any of these tags
+	Targets []string `json:"targets,omitempty"` // Variables such as ARGS:query; only removed from the selected rules, or from all rules if none are selected
+
+	paths     []*regexp.Regexp
+	clientIPs *ipMatcher
+}
+
+// compile validates the exclusion and prepares its path and client IP matchers.
+func (e *RuleExclusion) compile() error {
+	if len(e.Rules) == 0 && len(e.Tags) == 0 && len(e.Targets) == 0 {
+		return fmt.Errorf("exclusion '%s' must list rules, tags or targets to exclude", e.Name)
+	}
+	for _, target := range e.Targets {
+		if err := validateTarget(target); err != nil {
+			return fmt.Errorf("exclusion '%s': %w", e.Name, err)
+		}
+	}
+
+	e.paths = e.paths[:0]
+	for _, p := range e.Paths {
+		if !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "*") {
+			return fmt.Errorf("exclusion '%s': path '%s' must start with '/'", e.Name, p)
+		}
+		parts := strings.Split(p, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		e.paths = append(e.paths, regexp.MustCompile("^"+strings.Join(parts, ".*")+"$"))
+	}
+
+	e.clientIPs = nil
+	if len(e.ClientIPs) > 0 {
+		matcher, err := newIPMatcher(strings.Join(e.ClientIPs, ","))
+		if err != nil {
+			return fmt.Errorf("exclusion '%s': %w", e.Name, err)
+		}
+		e.clientIPs = matcher
+	}
+	return nil
+}
+
+// matches reports whether the request satisfies every condition of the exclusion.
+func (e *RuleExclusion) matches(r *http.Request) bool {
+	if len(e.paths) > 0 {
+		matched := false
+		for _, re := range e.paths {
+			if re.MatchString(r.URL.Path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(e.Hosts) > 0 && !matchHost(e.Hosts, r.Host) {
+		return false
+	}
+	if len(e.Methods) > 0 {
+		matched := false
+		for _, method := range e.Methods {
+			if strings.EqualFold(method, r.Method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if e.clientIPs != nil && !e.clientIPs.Match(clientIP(r)) {
+		return false
+	}
+	return true
+}
+
+// selectsRule reports whether the exclusion applies to the rule: it lists the rule or one of its tags,
+// or it only lists targets, which then apply to every rule.
+func (e *RuleExclusion) selectsRule(rule *Rule) bool {
+	if len(e.Rules) == 0 && len(e.Tags) == 0 {
+		return true
+	}
+	if ruleIDRemoved(e.Rules, rule.ID) {
+		return true
+	}
+	_, ok := hasAnyTag(rule.Tags, e.Tags)
+	return ok
+}
+
+// excludesTarget reports whether the variable name (e.g. ARGS:query, HEADERS:User-Agent or a whole
+// target such as BODY) is listed in the exclusion. ARGS:name also covers the body parameter ARGS_POST:name,
+// and a trailing * matches any name (e.g. COOKIES:*).
+func (e *RuleExclusion) excludesTarget(variable string) bool {
+	variable = canonicalTarget(variable)
+	for _, target := range e.Targets {
+		target = canonicalTarget(target)
+		if prefix, ok := strings.CutSuffix(target, TargetCollectionAll); ok && strings.Contains(prefix, ":") {
+			if len(variable) >= len(prefix) && strings.EqualFold(variable[:len(prefix)], prefix) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(target, variable) {
+			return true
+		}
+		if name, ok := cutPrefixFold(target, TargetArgsPrefix); ok && strings.EqualFold(variable, TargetArgsPostPrefix+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return "", false
+}
+
+// matchHost reports whether host (with an optional port) matches one of the patterns.
+func matchHost(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, host) {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok && len(host) > len(suffix)+1 &&
+			strings.EqualFold(host[len(host)-len(suffix)-1:], "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileExclusions validates the configured exclusions, naming unnamed ones after their position.
+func (m *Middleware) compileExclusions() error {
+	for i := range m.Exclusions {
+		exclusion := &m.Exclusions[i]
+		if exclusion.Name == "" {
+			exclusion.Name = fmt.Sprintf("exclusion-%d", i+1)
+		}
+		if err := exclusion.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestExclusions returns the exclusions whose conditions match the request. They are evaluated once
+// per request, before the first rule, and cached in the request state.
+func (m *Middleware) requestExclusions(r *http.Request, state *WAFState) []*RuleExclusion {
+	if state.exclusionsEvaluated {
+		return state.exclusions
+	}
+	state.exclusionsEvaluated = true
+	for i := range m.Exclusions {
+		exclusion := &m.Exclusions[i]
+		if exclusion.matches(r) {
+			state.exclusions = append(state.exclusions, exclusion)
+			m.incrementExclusionHitsMetric(exclusion.Name)
+			m.logger.Debug("Rule exclusion applies to request",
+				zap.String("exclusion", exclusion.Name),
+				zap.String("path", r.URL.Path),
+			)
+		}
+	}
+	return state.exclusions
+}
+
+// ruleExcluded reports whether a matching exclusion removes the whole rule for this request.
+func ruleExcluded(exclusions []*RuleExclusion, rule *Rule) bool {
+	for _, exclusion := range exclusions {
+		if len(exclusion.Targets) == 0 && exclusion.selectsRule(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetExcluded reports whether a matching exclusion removes the variable from the rule for this request.
+func targetExcluded(exclusions []*RuleExclusion, rule *Rule, variable string) bool {
+	for _, exclusion := range exclusions {
+		if len(exclusion.Targets) > 0 && exclusion.selectsRule(rule) && exclusion.excludesTarget(variable) {
+			return true
+		}
+	}
+	return false
+}
+
+// incrementExclusionHitsMetric counts the requests each exclusion applied to.
+func (m *Middleware) incrementExclusionHitsMetric(name string) {
+	m.muMetrics.Lock()
+	if m.exclusionHits == nil {
+		m.exclusionHits = make(map[string]int64)
+	}
+	m.exclusionHits[name]++
+	m.muMetrics.Unlock()
+}
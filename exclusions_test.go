@@ -0,0 +1,178 @@
+package caddywaf
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRuleExclusion_Matches(t *testing.T) {
+	exclusion := RuleExclusion{
+		Name:      "cms",
+		Paths:     []string{"/admin/cms/*", "/editor"},
+		Hosts:     []string{"example.com", "*.example.org"},
+		Methods:   []string{"post"},
+		ClientIPs: []string{"203.0.113.0/24"},
+		Tags:      []string{"attack-xss"},
+	}
+	assert.NoError(t, exclusion.compile())
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		remote string
+		want   bool
+	}{
+		{"all conditions match", "POST", "http://example.com/admin/cms/pages/1", "203.0.113.7:5000", true},
+		{"exact path and wildcard host", "POST", "http://www.example.org:8443/editor", "203.0.113.7:5000", true},
+		{"path mismatch", "POST", "http://example.com/admin/users", "203.0.113.7:5000", false},
+		{"exact path does not match prefix", "POST", "http://example.com/editor/x", "203.0.113.7:5000", false},
+		{"host mismatch", "POST", "http://example.net/editor", "203.0.113.7:5000", false},
+		{"bare domain does not match subdomain wildcard", "POST", "http://example.org/editor", "203.0.113.7:5000", false},
+		{"method mismatch", "GET", "http://example.com/editor", "203.0.113.7:5000", false},
+		{"client outside CIDR", "POST", "http://example.com/editor", "198.51.100.1:5000", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			req.RemoteAddr = tt.remote
+			assert.Equal(t, tt.want, exclusion.matches(req))
+		})
+	}
+}
+
+func TestRuleExclusion_Compile(t *testing.T) {
+	tests := []struct {
+		name      string
+		exclusion RuleExclusion
+		wantErr   string
+	}{
+		{"nothing to exclude", RuleExclusion{Name: "empty", Paths: []string{"/x"}}, "must list rules, tags or targets"},
+		{"invalid target", RuleExclusion{Name: "t", Targets: []string{"ARG:q"}}, "unknown target"},
+		{"invalid CIDR", RuleExclusion{Name: "ip", Rules: []string{"1"}, ClientIPs: []string{"10.0.0.0/33"}}, "invalid CIDR"},
+		{"relative path", RuleExclusion{Name: "p", Rules: []string{"1"}, Paths: []string{"search"}}, "must start with '/'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.exclusion.compile()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleExclusion_ExcludesTarget(t *testing.T) {
+	exclusion := RuleExclusion{Targets: []string{"ARGS:query", "REQUEST_HEADERS:User-Agent", "COOKIES:*", "BODY"}}
+
+	assert.True(t, exclusion.excludesTarget("ARGS:query"))
+	assert.True(t, exclusion.excludesTarget("ARGS:QUERY"))
+	assert.True(t, exclusion.excludesTarget("ARGS_POST:query"))
+	assert.True(t, exclusion.excludesTarget("HEADERS:user-agent"))
+	assert.True(t, exclusion.excludesTarget("COOKIES:session"))
+	assert.True(t, exclusion.excludesTarget("BODY"))
+	assert.False(t, exclusion.excludesTarget("ARGS:q"))
+	assert.False(t, exclusion.excludesTarget("ARGS_NAMES:query"))
+	assert.False(t, exclusion.excludesTarget("COOKIES"))
+	assert.False(t, exclusion.excludesTarget("HEADERS:Referer"))
+}
+
+func TestHandlePhase_Exclusions(t *testing.T) {
+	sqli, err := compileOperator("contains", "union select", "")
+	assert.NoError(t, err)
+	xss, err := compileOperator("contains", "<script", "")
+	assert.NoError(t, err)
+
+	newMiddleware := func(exclusions ...RuleExclusion) *Middleware {
+		logger := zap.NewNop()
+		m := &Middleware{
+			logger:                logger,
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+			ruleCache:             NewRuleCache(),
+			AnomalyThreshold:      5,
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			Rules: map[int][]Rule{2: {
+				{ID: "sqli-basic-keywords", Phase: 2, Targets: []string{"ARGS:*"}, Score: 5, Tags: []string{"attack-sqli"}, matcher: sqli},
+				{ID: "xss-script", Phase: 2, Targets: []string{"ARGS:*"}, Score: 5, Tags: []string{"attack-xss"}, matcher: xss},
+			}},
+			Exclusions: exclusions,
+		}
+		assert.NoError(t, m.compileExclusions())
+		return m
+	}
+
+	searchQuery := RuleExclusion{Paths: []string{"/search"}, Rules: []string{"sqli-basic-keywords"}, Targets: []string{"ARGS:query"}}
+	officeCMS := RuleExclusion{Name: "office-cms", Paths: []string{"/admin/cms/*"}, ClientIPs: []string{"203.0.113.0/24"}, Tags: []string{"attack-xss"}}
+
+	tests := []struct {
+		name        string
+		middleware  *Middleware
+		url         string
+		remote      string
+		wantBlocked bool
+	}{
+		{"no exclusions", newMiddleware(), "/search?query=union%20select", "198.51.100.1:1000", true},
+		{"target removed from rule on path", newMiddleware(searchQuery), "/search?query=union%20select", "198.51.100.1:1000", false},
+		{"other parameters still inspected", newMiddleware(searchQuery), "/search?query=x&page=union%20select", "198.51.100.1:1000", true},
+		{"other rules still inspect the target", newMiddleware(searchQuery), "/search?query=%3Cscript%3E", "198.51.100.1:1000", true},
+		{"exclusion only on its path", newMiddleware(searchQuery), "/find?query=union%20select", "198.51.100.1:1000", true},
+		{"tag removed for office CIDR", newMiddleware(officeCMS), "/admin/cms/edit?body=%3Cscript%3E", "203.0.113.9:1000", false},
+		{"tag kept outside office CIDR", newMiddleware(officeCMS), "/admin/cms/edit?body=%3Cscript%3E", "198.51.100.1:1000", true},
+		{"untagged rules kept for office CIDR", newMiddleware(officeCMS), "/admin/cms/edit?body=union%20select", "203.0.113.9:1000", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			req.RemoteAddr = tt.remote
+			req = req.WithContext(context.WithValue(req.Context(), ContextKeyLogId("logID"), "test-log-id"))
+			state := &WAFState{}
+
+			tt.middleware.handlePhase(httptest.NewRecorder(), req, 2, state)
+
+			assert.Equal(t, tt.wantBlocked, state.Blocked)
+		})
+	}
+
+	m := newMiddleware(searchQuery, officeCMS)
+	req := httptest.NewRequest("GET", "/search?query=union%20select", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ContextKeyLogId("logID"), "test-log-id"))
+	m.handlePhase(httptest.NewRecorder(), req, 2, &WAFState{})
+	assert.Equal(t, map[string]int64{"exclusion-1": 1}, m.exclusionHits)
+}
+
+func TestHandlePhase_ExclusionsApplyToChain(t *testing.T) {
+	post, err := compileOperator("streq", "POST", "")
+	assert.NoError(t, err)
+	sqli, err := compileOperator("contains", "' or", "")
+	assert.NoError(t, err)
+
+	logger := zap.NewNop()
+	m := &Middleware{
+		logger:                logger,
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+		AnomalyThreshold:      5,
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		Rules: map[int][]Rule{2: {{ID: "login-sqli", Phase: 2, Targets: []string{"METHOD"}, Score: 5, matcher: post,
+			Chain: []RuleCondition{{Targets: []string{"ARGS_POST"}, matcher: sqli}}}}},
+		Exclusions: []RuleExclusion{{Targets: []string{"ARGS:password"}}},
+	}
+	assert.NoError(t, m.compileExclusions())
+
+	for body, wantBlocked := range map[string]bool{"password=x'+or+1=1": false, "user=x'+or+1=1": true} {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), ContextKeyLogId("logID"), "test-log-id"))
+		state := &WAFState{}
+		m.handlePhase(httptest.NewRecorder(), req, 2, state)
+		assert.Equal(t, wantBlocked, state.Blocked, "body %q", body)
+	}
+}
@@ -0,0 +1,541 @@
+package caddywaf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Types of remote feeds, by the list they extend.
+const (
+	FeedTypeIP  = "ip"  // IPs and CIDRs, checked like ip_blacklist_file
+	FeedTypeDNS = "dns" // Host names, checked like dns_blacklist_file
+)
+
+// FeedFormatPlain is one entry per line, with # comments. It is the only format of DNS feeds; IP feeds
+// take any of the IP blacklist formats.
+const FeedFormatPlain = BlacklistFormatPlain
+
+// Defaults of a feed.
+const (
+	defaultFeedRefreshInterval = 24 * time.Hour
+	defaultFeedMaxSize         = 10 << 20 // 10 MiB
+	defaultFeedTimeout         = 30 * time.Second
+	defaultFeedRetries         = 3
+	defaultFeedRetryBackoff    = 5 * time.Second
+)
+
+// feedNamePattern restricts feed names to what can be used in a cache file name.
+var feedNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// feedFormats are the formats of IP feeds.
+var feedFormats = map[string]bool{
+	BlacklistFormatPlain:  true,
+	BlacklistFormatNetset: true,
+	BlacklistFormatDrop:   true,
+	BlacklistFormatRange:  true,
+	BlacklistFormatCSV:    true,
+}
+
+// Feed is a remote IP or DNS blocklist, fetched on a schedule and checked along with ip_blacklist_file
+// or dns_blacklist_file. Zero values fall back to the defaults.
+type Feed struct {
+	Name            string        `json:"name"`
+	URL             string        `json:"url"`
+	Type            string        `json:"type,omitempty"`             // ip (default) or dns
+	Format          string        `json:"format,omitempty"`           // plain (default), netset, drop, range or csv
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"` // Time between fetches
+	MaxSize         int64         `json:"max_size,omitempty"`         // Larger responses are rejected
+	Timeout         time.Duration `json:"timeout,omitempty"`          // Per fetch attempt
+	Retries         int           `json:"retries,omitempty"`          // Attempts after a failed fetch, -1 for none
+	RetryBackoff    time.Duration `json:"retry_backoff,omitempty"`    // Delay before the first retry, doubled for each further one
+	CacheFile       string        `json:"cache_file,omitempty"`       // Last good copy, used until a fetch succeeds
+}
+
+// withDefaults returns the feed with zero values replaced by the defaults.
+func (f Feed) withDefaults() Feed {
+	if f.Type == "" {
+		f.Type = FeedTypeIP
+	}
+	if f.Format == "" {
+		f.Format = FeedFormatPlain
+	}
+	if f.RefreshInterval <= 0 {
+		f.RefreshInterval = defaultFeedRefreshInterval
+	}
+	if f.MaxSize <= 0 {
+		f.MaxSize = defaultFeedMaxSize
+	}
+	if f.Timeout <= 0 {
+		f.Timeout = defaultFeedTimeout
+	}
+	if f.Retries == 0 {
+		f.Retries = defaultFeedRetries
+	}
+	if f.Retries < 0 {
+		f.Retries = 0
+	}
+	if f.RetryBackoff <= 0 {
+		f.RetryBackoff = defaultFeedRetryBackoff
+	}
+	if f.CacheFile == "" && f.Name != "" {
+		f.CacheFile = filepath.Join(caddy.AppDataDir(), "waf", "feeds", f.Name+".txt")
+	}
+	return f
+}
+
+// validate checks the feed after defaults have been applied.
+func (f Feed) validate() error {
+	if !feedNamePattern.MatchString(f.Name) {
+		return fmt.Errorf("invalid feed name '%s': use letters, digits, '.', '_' and '-'", f.Name)
+	}
+	if !strings.HasPrefix(f.URL, "http://") && !strings.HasPrefix(f.URL, "https://") {
+		return fmt.Errorf("feed %s: url must be an http or https URL, got '%s'", f.Name, f.URL)
+	}
+	if f.Type != FeedTypeIP && f.Type != FeedTypeDNS {
+		return fmt.Errorf("feed %s: type must be %s or %s, got '%s'", f.Name, FeedTypeIP, FeedTypeDNS, f.Type)
+	}
+	if !feedFormats[f.Format] {
+		return fmt.Errorf("feed %s: unsupported format '%s'", f.Name, f.Format)
+	}
+	if f.Type == FeedTypeDNS && f.Format != FeedFormatPlain {
+		return fmt.Errorf("feed %s: dns feeds must use the %s format, got '%s'", f.Name, FeedFormatPlain, f.Format)
+	}
+	return nil
+}
+
+// parsePlainFeed parses one entry per line. Comments start with # and may follow an entry.
+func parsePlainFeed(data []byte, feedType string) ([]string, int) {
+	var entries []string
+	invalid := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !validFeedEntry(line, feedType) {
+			invalid++
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return unique(entries), invalid
+}
+
+// validFeedEntry reports whether entry is an IP or CIDR for an IP feed, or a host name for a DNS feed.
+func validFeedEntry(entry, feedType string) bool {
+	if feedType == FeedTypeDNS {
+		return !strings.ContainsAny(entry, " \t/:")
+	}
+	if _, _, err := net.ParseCIDR(entry); err == nil {
+		return true
+	}
+	return net.ParseIP(entry) != nil
+}
+
+// feedList is the parsed content of a feed. A refresh replaces it as a whole.
+type feedList struct {
+	ips     *CIDRTrie
+	domains map[string]struct{}
+	entries int
+}
+
+// contains reports whether the list holds the IP (IP feeds) or host name (DNS feeds).
+func (l *feedList) contains(value string) bool {
+	if l.ips != nil {
+		return l.ips.Contains(value)
+	}
+	_, ok := l.domains[value]
+	return ok
+}
+
+// lookup returns the entry of an IP feed that holds the IP.
+func (l *feedList) lookup(ip string) (BlacklistEntry, bool) {
+	if l.ips == nil {
+		return BlacklistEntry{}, false
+	}
+	return l.ips.Lookup(ip)
+}
+
+// feedCacheMeta is stored next to the cache file, to make conditional requests after a restart.
+type feedCacheMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// FeedStats is the state of a feed, as reported by the metrics endpoint.
+type FeedStats struct {
+	Entries     int       `json:"entries"`
+	LastRefresh time.Time `json:"last_refresh,omitempty"` // Last fetch that succeeded, or found the list unchanged
+	LastError   string    `json:"last_error,omitempty"`   // Error of the last refresh, if it failed
+	Refreshes   int64     `json:"refreshes"`
+	Failures    int64     `json:"failures"`
+	Hits        int64     `json:"hits"`
+}
+
+// remoteFeed keeps the list of a feed up to date.
+type remoteFeed struct {
+	config Feed
+	client *http.Client
+	logger *zap.Logger
+	list   atomic.Pointer[feedList]
+	hits   atomic.Int64
+	stop   chan struct{}
+
+	mu    sync.Mutex // Guards meta and stats
+	meta  feedCacheMeta
+	stats FeedStats
+}
+
+// newRemoteFeed prepares a feed whose defaults have been applied.
+func newRemoteFeed(config Feed, logger *zap.Logger) *remoteFeed {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &remoteFeed{
+		config: config,
+		client: &http.Client{},
+		logger: logger.With(zap.String("feed", config.Name)),
+		stop:   make(chan struct{}),
+	}
+}
+
+// contains reports whether the current list of the feed holds value.
+func (f *remoteFeed) contains(value string) bool {
+	list := f.list.Load()
+	if list == nil || !list.contains(value) {
+		return false
+	}
+	f.hits.Add(1)
+	return true
+}
+
+// lookup returns the entry of the current list of an IP feed that holds the IP.
+func (f *remoteFeed) lookup(ip string) (BlacklistEntry, bool) {
+	list := f.list.Load()
+	if list == nil {
+		return BlacklistEntry{}, false
+	}
+	entry, ok := list.lookup(ip)
+	if !ok {
+		return BlacklistEntry{}, false
+	}
+	f.hits.Add(1)
+	return entry, true
+}
+
+// parse builds the list from the body of the feed. A body with entries that are all invalid, such as an
+// error page, is rejected rather than replacing the current list with an empty one.
+func (f *remoteFeed) parse(data []byte) (*feedList, error) {
+	if f.config.Type == FeedTypeDNS {
+		entries, invalid := parsePlainFeed(data, FeedTypeDNS)
+		if err := f.checkInvalid(len(entries), invalid); err != nil {
+			return nil, err
+		}
+		list := &feedList{entries: len(entries), domains: make(map[string]struct{}, len(entries))}
+		for _, entry := range entries {
+			list.domains[strings.ToLower(entry)] = struct{}{}
+		}
+		return list, nil
+	}
+
+	// Entries without a source of their own are attributed to the feed
+	entries, invalid := parseBlacklist(data, f.config.Format, f.config.Name)
+	if err := f.checkInvalid(len(entries), invalid); err != nil {
+		return nil, err
+	}
+	list := &feedList{entries: len(entries), ips: NewCIDRTrie()}
+	for _, entry := range entries {
+		if err := list.ips.InsertEntry(entry); err != nil {
+			return nil, fmt.Errorf("invalid entry '%s': %w", entry.Value, err)
+		}
+	}
+	return list, nil
+}
+
+// checkInvalid rejects a body without valid entries, and logs the invalid ones of an accepted body.
+func (f *remoteFeed) checkInvalid(valid, invalid int) error {
+	if valid == 0 && invalid > 0 {
+		return fmt.Errorf("no valid entries in %d lines", invalid)
+	}
+	if invalid > 0 {
+		f.logger.Warn("Skipped invalid feed entries", zap.Int("invalid_entries", invalid))
+	}
+	return nil
+}
+
+// swap makes list the current list of the feed.
+func (f *remoteFeed) swap(list *feedList) {
+	f.list.Store(list)
+	f.mu.Lock()
+	f.stats.Entries = list.entries
+	f.mu.Unlock()
+}
+
+// loadCache restores the list from the cache file, so the feed is enforced before the first fetch and
+// while the source is unreachable. A missing cache file is not an error.
+func (f *remoteFeed) loadCache() error {
+	data, err := os.ReadFile(f.config.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read feed cache: %w", err)
+	}
+	list, err := f.parse(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse feed cache %s: %w", f.config.CacheFile, err)
+	}
+	f.swap(list)
+
+	var meta feedCacheMeta
+	if data, err := os.ReadFile(f.config.CacheFile + ".meta"); err == nil && json.Unmarshal(data, &meta) == nil {
+		f.mu.Lock()
+		f.meta = meta
+		f.mu.Unlock()
+	}
+	f.logger.Info("Feed loaded from cache", zap.String("file", f.config.CacheFile), zap.Int("entries", list.entries))
+	return nil
+}
+
+// saveCache writes the body of the feed and its validators to the cache file.
+func (f *remoteFeed) saveCache(data []byte, meta feedCacheMeta) error {
+	if err := os.MkdirAll(filepath.Dir(f.config.CacheFile), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(f.config.CacheFile, data); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.config.CacheFile+".meta", encoded)
+}
+
+// fetch downloads the feed once and swaps in the new list. The request is conditional when a list is
+// loaded, and a 304 keeps it.
+func (f *remoteFeed) fetch() error {
+	ctx, cancel := context.WithTimeout(context.Background(), f.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.config.URL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid feed request: %w", err)
+	}
+	req.Header.Set("User-Agent", "caddy-waf/"+wafVersion)
+	f.mu.Lock()
+	meta := f.meta
+	f.mu.Unlock()
+	if f.list.Load() != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http get failed for %s: %w", f.config.URL, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if f.list.Load() != nil {
+			f.logger.Debug("Feed not modified")
+			return nil
+		}
+		return fmt.Errorf("%s returned 304 without a cached copy", f.config.URL)
+	default:
+		return fmt.Errorf("http get returned status %s for %s", resp.Status, f.config.URL)
+	}
+	if resp.ContentLength > f.config.MaxSize {
+		return fmt.Errorf("feed of %d bytes exceeds max_size of %d bytes", resp.ContentLength, f.config.MaxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.config.MaxSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read response body from %s: %w", f.config.URL, err)
+	}
+	if int64(len(data)) > f.config.MaxSize {
+		return fmt.Errorf("feed exceeds max_size of %d bytes", f.config.MaxSize)
+	}
+
+	list, err := f.parse(data)
+	if err != nil {
+		return err
+	}
+	meta = feedCacheMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified"), FetchedAt: time.Now()}
+	if err := f.saveCache(data, meta); err != nil {
+		f.logger.Warn("Failed to write feed cache", zap.String("file", f.config.CacheFile), zap.Error(err))
+	}
+	f.mu.Lock()
+	f.meta = meta
+	f.mu.Unlock()
+	f.swap(list)
+	f.logger.Info("Feed updated", zap.Int("entries", list.entries))
+	return nil
+}
+
+// refresh fetches the feed, retrying with exponential backoff. When every attempt fails, the current
+// list, possibly the one from the cache, stays in place.
+func (f *remoteFeed) refresh() error {
+	backoff := f.config.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = f.fetch(); err == nil {
+			f.mu.Lock()
+			f.stats.LastRefresh = time.Now()
+			f.stats.LastError = ""
+			f.stats.Refreshes++
+			f.mu.Unlock()
+			return nil
+		}
+		if attempt >= f.config.Retries {
+			break
+		}
+		f.logger.Warn("Failed to refresh feed, retrying", zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-f.stop:
+			return err
+		}
+		backoff = min(backoff*2, f.config.RefreshInterval)
+	}
+
+	f.mu.Lock()
+	f.stats.LastError = err.Error()
+	f.stats.Failures++
+	f.mu.Unlock()
+	f.logger.Error("Failed to refresh feed, keeping the current list", zap.Error(err))
+	return err
+}
+
+// start loads the cached list and refreshes the feed now and every refresh interval, until stopped.
+func (f *remoteFeed) start() {
+	if err := f.loadCache(); err != nil {
+		f.logger.Warn("Ignoring feed cache", zap.Error(err))
+	}
+	go func() {
+		ticker := time.NewTicker(f.config.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			_ = f.refresh() // Logged by refresh
+			select {
+			case <-ticker.C:
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// signalStop stops the refreshes.
+func (f *remoteFeed) signalStop() {
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+}
+
+// getStats returns the state of the feed.
+func (f *remoteFeed) getStats() FeedStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := f.stats
+	stats.Hits = f.hits.Load()
+	return stats
+}
+
+// setupFeeds starts the configured feeds, and the Tor exit node feed if Tor blocking is enabled.
+func (m *Middleware) setupFeeds() error {
+	feeds := append([]Feed(nil), m.Feeds...)
+	if m.Tor.Enabled {
+		torFeed, err := m.Tor.feed()
+		if err != nil {
+			return err
+		}
+		if torFeed.CacheFile == m.IPBlacklistFile {
+			m.logger.Warn("tor_ip_blacklist_file is the ip_blacklist_file, caching the Tor exit node list elsewhere",
+				zap.String("file", m.IPBlacklistFile))
+			torFeed.CacheFile = ""
+		}
+		feeds = append(feeds, torFeed)
+	}
+
+	seen := make(map[string]bool, len(feeds))
+	m.feeds = nil
+	for _, config := range feeds {
+		config = config.withDefaults()
+		if err := config.validate(); err != nil {
+			return err
+		}
+		if seen[config.Name] {
+			return fmt.Errorf("duplicate feed name '%s'", config.Name)
+		}
+		seen[config.Name] = true
+		m.logger.Info("Feed configured",
+			zap.String("feed", config.Name),
+			zap.String("url", config.URL),
+			zap.String("type", config.Type),
+			zap.String("format", config.Format),
+			zap.Duration("refresh_interval", config.RefreshInterval),
+			zap.String("cache_file", config.CacheFile),
+		)
+		m.feeds = append(m.feeds, newRemoteFeed(config, m.logger))
+	}
+	for _, feed := range m.feeds {
+		feed.start()
+	}
+	return nil
+}
+
+// feedListing returns the name of the first feed of the type that lists value, or "".
+func (m *Middleware) feedListing(feedType, value string) string {
+	for _, feed := range m.feeds {
+		if feed.config.Type == feedType && feed.contains(value) {
+			return feed.config.Name
+		}
+	}
+	return ""
+}
+
+// feedLookup returns the entry of the first IP feed that lists the IP.
+func (m *Middleware) feedLookup(ip string) (BlacklistEntry, bool) {
+	for _, feed := range m.feeds {
+		if feed.config.Type != FeedTypeIP {
+			continue
+		}
+		if entry, ok := feed.lookup(ip); ok {
+			return entry, true
+		}
+	}
+	return BlacklistEntry{}, false
+}
+
+// feedStats returns the state of every feed, by name.
+func (m *Middleware) feedStats() map[string]FeedStats {
+	stats := make(map[string]FeedStats, len(m.feeds))
+	for _, feed := range m.feeds {
+		stats[feed.config.Name] = feed.getStats()
+	}
+	return stats
+}
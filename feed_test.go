@@ -0,0 +1,291 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// newTestFeed returns a feed of the server's URL, cached in a temporary directory.
+func newTestFeed(t *testing.T, url string, feedType string) *remoteFeed {
+	t.Helper()
+	config := Feed{
+		Name:         "test",
+		URL:          url,
+		Type:         feedType,
+		RetryBackoff: time.Millisecond,
+		Retries:      -1,
+		CacheFile:    filepath.Join(t.TempDir(), "test.txt"),
+	}.withDefaults()
+	assert.NoError(t, config.validate())
+	return newRemoteFeed(config, zap.NewNop())
+}
+
+func TestParsePlainFeed(t *testing.T) {
+	entries, invalid := parsePlainFeed([]byte("# Exit nodes\n192.0.2.1\n\n198.51.100.0/24 # a range\n192.0.2.1\nnot-an-ip\n2001:db8::/32\r\n"), FeedTypeIP)
+	assert.Equal(t, []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"}, entries)
+	assert.Equal(t, 1, invalid)
+
+	entries, invalid = parsePlainFeed([]byte("evil.example\nbad entry\nphish.example # reported\n"), FeedTypeDNS)
+	assert.Equal(t, []string{"evil.example", "phish.example"}, entries)
+	assert.Equal(t, 1, invalid)
+}
+
+func TestRemoteFeed_ConditionalGet(t *testing.T) {
+	var requests, notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		w.Write([]byte("192.0.2.1\n198.51.100.0/24\n"))
+	}))
+	defer server.Close()
+
+	feed := newTestFeed(t, server.URL, FeedTypeIP)
+	assert.NoError(t, feed.refresh())
+	assert.True(t, feed.contains("198.51.100.7"))
+	assert.False(t, feed.contains("203.0.113.1"))
+
+	cached, err := os.ReadFile(feed.config.CacheFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1\n198.51.100.0/24\n", string(cached))
+	meta, err := os.ReadFile(feed.config.CacheFile + ".meta")
+	assert.NoError(t, err)
+	assert.Contains(t, string(meta), `"etag":"\"v1\""`)
+
+	assert.NoError(t, feed.refresh())
+	assert.Equal(t, int32(1), notModified.Load(), "the second fetch is conditional")
+	assert.True(t, feed.contains("192.0.2.1"), "a 304 keeps the list")
+
+	// After a restart the validators come from the cache
+	restarted := newRemoteFeed(feed.config, zap.NewNop())
+	assert.NoError(t, restarted.loadCache())
+	assert.NoError(t, restarted.refresh())
+	assert.Equal(t, int32(2), notModified.Load())
+	assert.Equal(t, int32(3), requests.Load())
+
+	stats := restarted.getStats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(1), stats.Refreshes)
+	assert.False(t, stats.LastRefresh.IsZero())
+}
+
+func TestRemoteFeed_NotModifiedWithoutCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("If-None-Match"), "no list is loaded, so the request is not conditional")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+	assert.Error(t, newTestFeed(t, server.URL, FeedTypeIP).refresh())
+}
+
+func TestRemoteFeed_Retries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("192.0.2.1\n"))
+	}))
+	defer server.Close()
+
+	feed := newTestFeed(t, server.URL, FeedTypeIP)
+	feed.config.Retries = 1
+	assert.ErrorContains(t, feed.refresh(), "503")
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, int64(1), feed.getStats().Failures)
+
+	feed.config.Retries = 3
+	assert.NoError(t, feed.refresh())
+	assert.Equal(t, int32(3), requests.Load())
+	assert.True(t, feed.contains("192.0.2.1"))
+	assert.Empty(t, feed.getStats().LastError)
+}
+
+func TestRemoteFeed_KeepsListOnBadResponse(t *testing.T) {
+	body := "192.0.2.1\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	feed := newTestFeed(t, server.URL, FeedTypeIP)
+	feed.config.MaxSize = 64
+	assert.NoError(t, feed.refresh())
+
+	body = strings.Repeat("192.0.2.2\n", 10)
+	assert.ErrorContains(t, feed.refresh(), "max_size")
+
+	body = "<html><body>Service Unavailable</body></html>"
+	assert.ErrorContains(t, feed.refresh(), "no valid entries")
+
+	assert.True(t, feed.contains("192.0.2.1"))
+	assert.False(t, feed.contains("192.0.2.2"))
+	cached, err := os.ReadFile(feed.config.CacheFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1\n", string(cached), "the cache keeps the last good copy")
+}
+
+func TestRemoteFeed_CacheFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close() // The source is unreachable
+
+	feed := newTestFeed(t, server.URL, FeedTypeDNS)
+	assert.NoError(t, os.WriteFile(feed.config.CacheFile, []byte("Evil.example\n"), 0644))
+	feed.start()
+	defer feed.signalStop()
+
+	assert.True(t, feed.contains("evil.example"), "the cached list is enforced before the first fetch")
+	assert.Eventually(t, func() bool { return feed.getStats().Failures == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, feed.contains("evil.example"))
+}
+
+func TestRemoteFeed_Formats(t *testing.T) {
+	body := "; Spamhaus DROP List\n1.10.16.0/20 ; SBL256894\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	feed := newTestFeed(t, server.URL, FeedTypeIP)
+	feed.config.Format = BlacklistFormatDrop
+	assert.NoError(t, feed.refresh())
+	entry, ok := feed.lookup("1.10.20.1")
+	assert.True(t, ok)
+	assert.Equal(t, BlacklistEntry{Value: "1.10.16.0/20", Reason: "SBL256894", Source: "test"}, withoutAddedAt(t, []BlacklistEntry{entry})[0])
+
+	body = "ip,reason,source\n198.51.100.0-198.51.100.255,spam,listing-service\n"
+	feed.config.Format = BlacklistFormatCSV
+	assert.NoError(t, feed.refresh())
+	entry, ok = feed.lookup("198.51.100.9")
+	assert.True(t, ok)
+	assert.Equal(t, BlacklistEntry{Value: "198.51.100.0/24", Reason: "spam", Source: "listing-service"}, withoutAddedAt(t, []BlacklistEntry{entry})[0])
+	assert.False(t, feed.contains("1.10.20.1"))
+	assert.Equal(t, int64(2), feed.getStats().Hits)
+}
+
+func TestMiddleware_Feeds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ips":
+			w.Write([]byte("198.51.100.0/24\n"))
+		case "/domains":
+			w.Write([]byte("evil.example\n"))
+		case "/tor":
+			w.Write([]byte("203.0.113.9\n"))
+		}
+	}))
+	defer server.Close()
+
+	originalURL := torExitNodeURL
+	torExitNodeURL = server.URL + "/tor"
+	defer func() { torExitNodeURL = originalURL }()
+
+	dir := t.TempDir()
+	m := &Middleware{
+		logger:       zap.NewNop(),
+		dnsBlacklist: map[string]struct{}{},
+		Feeds: []Feed{
+			{Name: "ips", URL: server.URL + "/ips", CacheFile: filepath.Join(dir, "ips.txt")},
+			{Name: "domains", URL: server.URL + "/domains", Type: FeedTypeDNS, CacheFile: filepath.Join(dir, "domains.txt")},
+		},
+		Tor: TorConfig{Enabled: true, TORIPBlacklistFile: filepath.Join(dir, "tor.txt"), UpdateInterval: "1h"},
+	}
+	assert.NoError(t, m.setupFeeds())
+	defer func() {
+		for _, feed := range m.feeds {
+			feed.signalStop()
+		}
+	}()
+	assert.Len(t, m.feeds, 3)
+	assert.Eventually(t, func() bool {
+		for _, feed := range m.feeds {
+			if feed.getStats().Refreshes == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.True(t, m.isIPBlacklisted("198.51.100.7"))
+	assert.True(t, m.isIPBlacklisted("203.0.113.9"), "Tor exit nodes come from the tor feed")
+	assert.False(t, m.isIPBlacklisted("192.0.2.1"))
+	assert.True(t, m.isDNSBlacklisted("EVIL.example"))
+	assert.False(t, m.isDNSBlacklisted("example.com"))
+	assert.Zero(t, m.IPBlacklistBlockCount, "lookups alone are not blocks")
+
+	stats := m.feedStats()
+	assert.Equal(t, int64(1), stats["ips"].Hits)
+	assert.Equal(t, int64(1), stats["tor"].Hits)
+	assert.Equal(t, 1, stats["domains"].Entries)
+
+	m.Feeds = append(m.Feeds, Feed{Name: "ips", URL: server.URL})
+	assert.ErrorContains(t, m.setupFeeds(), "duplicate feed name")
+}
+
+func TestParseFeed(t *testing.T) {
+	cl := NewConfigLoader(zap.NewNop())
+	m := &Middleware{}
+	d := caddyfile.NewTestDispenser(`waf {
+		rule_file rules.json
+		feed firehol {
+			url https://iplists.example/firehol_level1.netset
+			refresh_interval 6h
+			max_size 5MiB
+			timeout 10s
+			retries 0
+			retry_backoff 1m
+			cache_file /var/lib/caddy/firehol.txt
+		}
+		feed phishing {
+			url https://lists.example/phishing.txt
+			type dns
+		}
+	}`)
+	assert.NoError(t, cl.UnmarshalCaddyfile(d, m))
+	assert.Equal(t, []Feed{
+		{
+			Name:            "firehol",
+			URL:             "https://iplists.example/firehol_level1.netset",
+			RefreshInterval: 6 * time.Hour,
+			MaxSize:         5 << 20,
+			Timeout:         10 * time.Second,
+			Retries:         -1,
+			RetryBackoff:    time.Minute,
+			CacheFile:       "/var/lib/caddy/firehol.txt",
+		},
+		{Name: "phishing", URL: "https://lists.example/phishing.txt", Type: FeedTypeDNS},
+	}, m.Feeds)
+
+	for _, block := range []string{
+		"feed {\n url https://lists.example/a.txt\n }",
+		"feed a/b {\n url https://lists.example/a.txt\n }",
+		"feed a {\n }",
+		"feed a {\n url ftp://lists.example/a.txt\n }",
+		"feed a {\n url https://lists.example/a.txt\n type asn\n }",
+		"feed a {\n url https://lists.example/a.txt\n format xml\n }",
+		"feed a {\n url https://lists.example/a.txt\n type dns\n format netset\n }",
+		"feed a {\n url https://lists.example/a.txt\n retries -1\n }",
+		"feed a {\n url https://lists.example/a.txt\n }\n feed a {\n url https://lists.example/b.txt\n }",
+	} {
+		t.Run(block, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf {\n rule_file rules.json\n " + block + "\n}")
+			assert.Error(t, cl.UnmarshalCaddyfile(d, &Middleware{}))
+		})
+	}
+}
@@ -3,7 +3,6 @@ package caddywaf
 import (
 	"context"
 	"net/http"
-	"strings"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/google/uuid"
@@ -13,23 +12,47 @@ import (
 
 type ContextKeyLogId string
 type ContextKeyRule string
+type ContextKeyRequestBody string
+type ContextKeyClientIP string
 
 // ServeHTTP implements caddyhttp.Handler.
 // handler.go
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	logID := uuid.New().String()
 
-	m.logRequestStart(r, logID)
-
 	// Propagate log ID within the request context for logging
 	ctx := context.WithValue(r.Context(), ContextKeyLogId("logID"), logID)
+	// Resolve the client IP once, for every check and log line of this request
+	ctx = withClientIP(ctx, m.resolveClientIP(r))
+	// Parse the request body at most once, however many rules inspect it
+	ctx = withRequestBodyCache(ctx)
 	r = r.WithContext(ctx)
+	defer releaseRequestBody(r)
 
+	m.logRequestStart(r, logID)
 	m.incrementTotalRequestsMetric()
 
 	// Initialize WAF state for this request
 	state := m.initializeWAFState()
 
+	// Allowlisted clients bypass the WAF, unless the allowlist only covers the IP-based checks. They
+	// still get the metrics endpoint, which is typically scraped from an allowlisted monitoring host.
+	if m.checkIPWhitelist(r, state) {
+		if m.isMetricsRequest(r) {
+			return m.handleMetricsRequest(w, r)
+		}
+		err := next.ServeHTTP(w, r)
+		m.incrementAllowedRequestsMetric()
+		m.logRequestCompletion(logID, state)
+		return err
+	}
+
+	// Read the body before any rule does: rules run on copies of the request, and the reader that replays
+	// the body must replace the body of the request passed to the upstream handler
+	if m.requestBodyRules.Load() {
+		m.requestValueExtractor.requestBody(r)
+	}
+
 	// Phase 1: Pre-request checks and blocking
 	if m.isPhaseBlocked(w, r, 1, state) {
 		return nil // Request blocked, short-circuit
@@ -40,36 +63,33 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next cadd
 		return nil // Request blocked, short-circuit
 	}
 
-	// Response capture and processing
-	recorder := NewResponseRecorder(w)
-	err := next.ServeHTTP(recorder, r)
-
-	// Phase 3: Response Header analysis
-	if m.isPhaseBlocked(recorder, r, 3, state) {
-		return nil // Request blocked in Phase 3, short-circuit
-	}
-
-	// Phase 4: Response Body analysis (if not already blocked)
-	m.handleResponseBodyPhase(recorder, r, state)
-
-	if state.Blocked {
-		// Metrics and response handling if blocked after headers phase
-		m.incrementBlockedRequestsMetric()
-		m.writeCustomResponse(recorder, state.StatusCode)
-		return nil
-	}
-
 	// Handle metrics request separately
 	if m.isMetricsRequest(r) {
 		return m.handleMetricsRequest(w, r)
 	}
 
-	// If not blocked, copy recorded response back to original writer
-	// Moved this inside if check to call only if not blocked
-	if !state.Blocked {
-		m.incrementAllowedRequestsMetric() // Increment here only if not blocked
-		m.copyResponse(w, recorder, r)
+	// Phases 3 and 4 run as the upstream handler writes its response. Without response rules
+	// there is nothing to hold back, and the response goes straight to the client.
+	var err error
+	if m.inspectsResponse() {
+		recorder := m.newResponseRecorder(w, r, state)
+		err = next.ServeHTTP(recorder, r)
+		recorder.finish()
+
+		if state.Blocked {
+			m.incrementBlockedRequestsMetric()
+			m.recordBlock(r, state)
+			if recorder.abort {
+				// Part of the response already reached the client, abort the connection instead
+				panic(http.ErrAbortHandler)
+			}
+			return nil
+		}
+	} else {
+		err = next.ServeHTTP(w, r)
 	}
+
+	m.incrementAllowedRequestsMetric()
 	m.logRequestCompletion(logID, state)
 
 	return err // Return any error from the next handler
@@ -80,7 +100,10 @@ func (m *Middleware) isPhaseBlocked(w http.ResponseWriter, r *http.Request, phas
 	m.handlePhase(w, r, phase, state)
 	if state.Blocked {
 		m.incrementBlockedRequestsMetric()
-		w.WriteHeader(state.StatusCode)
+		m.recordBlock(r, state)
+		if state.action != ActionDrop { // A dropped connection is already closed
+			w.WriteHeader(state.StatusCode)
+		}
 		return true
 	}
 	return false
@@ -93,6 +116,7 @@ func (m *Middleware) logRequestStart(r *http.Request, logID string) {
 		zap.String("method", r.Method),
 		zap.String("uri", r.RequestURI),
 		zap.String("remote_address", r.RemoteAddr),
+		zap.String("client_ip", clientIP(r)),
 		zap.String("user_agent", r.UserAgent()),
 	)
 }
@@ -125,17 +149,34 @@ func getLogID(ctx context.Context) string {
 // handleResponseBodyPhase processes Phase 4 (response body).
 func (m *Middleware) handleResponseBodyPhase(recorder *responseRecorder, r *http.Request, state *WAFState) {
 	// No need to check if recorder.body is nil here, it's always initialized in NewResponseRecorder
-	body := recorder.BodyString()
+	body := recorder.inspectedBody()
 	logID := getLogID(r.Context())
 	if logID == "unknown" {
 		m.logger.Error("Log ID missing in context")
 		return
 	}
 	m.logger.Debug("Response body captured for Phase 4 analysis", zap.String("log_id", logID))
+	if state.Allowed {
+		return
+	}
 
+	exclusions := m.requestExclusions(r, state)
 	for _, rule := range m.Rules[4] {
-		if rule.regex.MatchString(body) {
-			if m.processRuleMatch(recorder, r, &rule, body, state) {
+		if ruleIDRemoved(state.removedRules, rule.ID) || ruleExcluded(exclusions, &rule) ||
+			targetExcluded(exclusions, &rule, TargetResponseBody) {
+			continue
+		}
+		if recorder.matched[rule.ID] {
+			continue // Already matched an earlier window of a streamed body
+		}
+		if m.matchRule(&rule, body, state) {
+			if len(rule.Chain) > 0 && !m.matchChain(&rule, r, recorder, state) {
+				continue
+			}
+			if recorder.matched != nil {
+				recorder.matched[rule.ID] = true
+			}
+			if !m.processRuleMatch(recorder, r, &rule, TargetResponseBody, body, state) {
 				return
 			}
 
@@ -180,116 +221,118 @@ func (m *Middleware) logRequestCompletion(logID string, state *WAFState) {
 	m.logger.Info("WAF request evaluation completed",
 		zap.String("log_id", logID),
 		zap.Int("total_score", state.TotalScore),
+		zap.Int("inbound_score", state.InboundScore),
+		zap.Int("outbound_score", state.OutboundScore),
+		zap.Any("category_scores", state.CategoryScores),
 		zap.Bool("blocked", state.Blocked),
+		zap.Bool("allowed", state.Allowed),
 		zap.Int("status_code", state.StatusCode),
+		zap.Bool("would_block", state.WouldBlock),
+		zap.Int("shadow_score", state.ShadowScore),
 	)
 }
 
-// copyResponse copies the captured response from the recorder to the original writer
-func (m *Middleware) copyResponse(w http.ResponseWriter, recorder *responseRecorder, r *http.Request) {
-	header := w.Header()
-	for key, values := range recorder.Header() {
-		for _, value := range values {
-			header.Add(key, value)
-		}
-	}
-	w.WriteHeader(recorder.StatusCode())
-
-	logID := getLogID(r.Context())
-	if logID == "unknown" {
-		m.logger.Error("Log ID not found in context during response copy") // added error log for clarity
-	}
-	_, err := w.Write(recorder.body.Bytes()) // Copy body from recorder to original writer
-	if err != nil {
-		m.logger.Error("Failed to write recorded response body to client", zap.Error(err), zap.String("log_id", logID))
-	}
-}
-
 func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase int, state *WAFState) {
+	if state.Allowed {
+		m.logger.Debug("Request allowed by a rule, skipping phase", zap.Int("phase", phase))
+		return
+	}
+	ip := clientIP(r)
 	m.logger.Debug("Starting phase evaluation",
 		zap.Int("phase", phase),
-		zap.String("source_ip", r.RemoteAddr),
+		zap.String("source_ip", ip),
 		zap.String("user_agent", r.UserAgent()),
 	)
 
-	if phase == 1 && m.CountryBlock.Enabled {
+	if phase == 1 && m.banList != nil && !state.IPAllowlisted {
+		if until, banned := m.banList.isBanned(ip); banned {
+			m.logger.Debug("Starting ban list phase")
+			state.banned = true
+			m.blockRequest(w, r, state, http.StatusForbidden, "ip_banned", "ip_ban_rule", ip,
+				zap.String("message", "Request blocked by the dynamic ban list"),
+				zap.Time("banned_until", until),
+			)
+			if state.Blocked {
+				return
+			}
+		}
+	}
+
+	if phase == 1 && m.CountryBlock.Enabled && !state.IPAllowlisted {
 		m.logger.Debug("Starting country blocking phase")
-		blocked, err := m.isCountryInList(r.RemoteAddr, m.CountryBlock.CountryList, m.CountryBlock.geoIP)
+		blocked, err := m.isCountryInList(ip, m.CountryBlock.CountryList, m.CountryBlock.geoIP)
 		if err != nil {
 			m.logRequest(zapcore.ErrorLevel, "Failed to check country block",
 				r,
 				zap.Error(err),
 			)
-			m.blockRequest(w, r, state, http.StatusForbidden, "internal_error", "country_block_rule", r.RemoteAddr,
+			m.blockRequest(w, r, state, http.StatusForbidden, "internal_error", "country_block_rule", ip,
 				zap.String("message", "Request blocked due to internal error"),
 			)
 			m.logger.Debug("Country blocking phase completed - blocked due to error")
 			m.incrementGeoIPRequestsMetric(false) // Increment with false for error
-			return
 		} else if blocked {
 
-			m.blockRequest(w, r, state, http.StatusForbidden, "country_block", "country_block_rule", r.RemoteAddr,
+			m.blockRequest(w, r, state, http.StatusForbidden, "country_block", "country_block_rule", ip,
 				zap.String("message", "Request blocked by country"))
 			m.incrementGeoIPRequestsMetric(true) // Increment with true for blocked
+		} else {
+			m.logger.Debug("Country blocking phase completed - not blocked")
+			m.incrementGeoIPRequestsMetric(false) // Increment with false for no block
+		}
+		if state.Blocked {
 			return
 		}
-		m.logger.Debug("Country blocking phase completed - not blocked")
-		m.incrementGeoIPRequestsMetric(false) // Increment with false for no block
 	}
 
-	if phase == 1 && m.rateLimiter != nil {
+	if phase == 1 && m.rateLimiter != nil && !state.IPAllowlisted {
 		m.logger.Debug("Starting rate limiting phase")
-		ip := extractIP(r.RemoteAddr, m.logger) // Pass the logger here
-		path := r.URL.Path                      // Get the request path
+		path := r.URL.Path // Get the request path
 		if m.rateLimiter.isRateLimited(ip, path) {
 			m.incrementRateLimiterBlockedRequestsMetric() // Increment the counter in the Middleware
-			m.blockRequest(w, r, state, http.StatusTooManyRequests, "rate_limit", "rate_limit_rule", r.RemoteAddr,
+			m.blockRequest(w, r, state, http.StatusTooManyRequests, "rate_limit", "rate_limit_rule", ip,
 				zap.String("message", "Request blocked by rate limit"),
 			)
-			return
+			if state.Blocked {
+				return
+			}
 		}
 		m.logger.Debug("Rate limiting phase completed - not blocked")
 	}
 
-	if phase == 1 {
-		m.logger.Debug("Checking for IP blacklisting", zap.String("remote_addr", r.RemoteAddr)) //Added log for checking before to isIPBlacklisted call
-		xForwardedFor := r.Header.Get("X-Forwarded-For")
-		if xForwardedFor != "" {
-			ips := strings.Split(xForwardedFor, ",")
-			if len(ips) > 0 {
-				firstIP := strings.TrimSpace(ips[0])
-				m.logger.Debug("Checking IP blacklist with X-Forwarded-For", zap.String("remote_addr_xff", firstIP), zap.String("r.RemoteAddr", r.RemoteAddr))
-				if m.isIPBlacklisted(firstIP) {
-					m.logger.Debug("Starting IP blacklist phase")
-					m.blockRequest(w, r, state, http.StatusForbidden, "ip_blacklist", "ip_blacklist_rule", firstIP,
-						zap.String("message", "Request blocked by IP blacklist"),
-					)
-					return
-				}
-			} else {
-				m.logger.Debug("X-Forwarded-For header present but empty or invalid")
-
+	if phase == 1 && !state.IPAllowlisted {
+		m.logger.Debug("Checking for IP blacklisting", zap.String("client_ip", ip), zap.String("remote_addr", r.RemoteAddr))
+		if entry, blacklisted := m.lookupIPBlacklist(ip); blacklisted && m.blacklistEntryBlocks(r, entry, state) {
+			m.logger.Debug("Starting IP blacklist phase")
+			m.incrementIPBlacklistBlockCount()
+			reason := "ip_blacklist"
+			if entry.Reason != "" {
+				reason = entry.Reason // Reason of the list entry, such as a Spamhaus SBL reference
 			}
-
-		} else {
-			m.logger.Debug("X-Forwarded-For header not present using r.RemoteAddr")
-			if m.isIPBlacklisted(r.RemoteAddr) {
-				m.logger.Debug("Starting IP blacklist phase")
-				m.blockRequest(w, r, state, http.StatusForbidden, "ip_blacklist", "ip_blacklist_rule", r.RemoteAddr,
-					zap.String("message", "Request blocked by IP blacklist"),
-				)
+			fields := append([]zap.Field{zap.String("message", "Request blocked by IP blacklist")}, entry.logFields()...)
+			m.blockRequest(w, r, state, http.StatusForbidden, reason, "ip_blacklist_rule", ip, fields...)
+			if state.Blocked {
 				return
 			}
 		}
 	}
 
-	if phase == 1 && m.isDNSBlacklisted(r.Host) {
+	if phase == 1 && !state.IPAllowlisted && m.isDNSBlacklisted(r.Host) {
 		m.logger.Debug("Starting DNS blacklist phase")
 		m.blockRequest(w, r, state, http.StatusForbidden, "dns_blacklist", "dns_blacklist_rule", r.Host,
 			zap.String("message", "Request blocked by DNS blacklist"),
 			zap.String("host", r.Host),
 		)
-		return
+		if state.Blocked {
+			return
+		}
+	}
+
+	if phase == 2 {
+		m.checkRequestBodyLimits(w, r, state)
+		if state.Blocked {
+			return
+		}
 	}
 
 	rules, ok := m.Rules[phase]
@@ -300,7 +343,28 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 
 	m.logger.Debug("Starting rule evaluation for phase", zap.Int("phase", phase), zap.Int("rule_count", len(rules)))
 
+	// Response targets can only be extracted from the recorder in phases 3 and 4
+	var responseWriter http.ResponseWriter
+	if phase == 3 || phase == 4 {
+		if recorder, ok := w.(*responseRecorder); ok {
+			responseWriter = recorder
+		} else {
+			m.logger.Error("response recorder is not available in phase 3 or 4 when required")
+		}
+	}
+
+	// Exclusions are evaluated once per request, before any rule
+	exclusions := m.requestExclusions(r, state)
+
 	for _, rule := range rules {
+		if ruleIDRemoved(state.removedRules, rule.ID) {
+			m.logger.Debug("Rule removed for this request, skipping", zap.String("rule_id", string(rule.ID)))
+			continue
+		}
+		if ruleExcluded(exclusions, &rule) {
+			m.logger.Debug("Rule excluded for this request, skipping", zap.String("rule_id", string(rule.ID)))
+			continue
+		}
 		m.logger.Debug("Processing rule", zap.String("rule_id", string(rule.ID)), zap.Int("target_count", len(rule.Targets)))
 
 		// Use the custom type as the key
@@ -309,20 +373,7 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 
 		for _, target := range rule.Targets {
 			m.logger.Debug("Extracting value for target", zap.String("target", target), zap.String("rule_id", string(rule.ID)))
-			var value string
-			var err error
-
-			if phase == 3 || phase == 4 {
-				if recorder, ok := w.(*responseRecorder); ok {
-					value, err = m.extractValue(target, r, recorder)
-				} else {
-					m.logger.Error("response recorder is not available in phase 3 or 4 when required")
-					value, err = m.extractValue(target, r, nil)
-				}
-			} else {
-				value, err = m.extractValue(target, r, nil)
-			}
-
+			values, err := m.extractValues(target, r, responseWriter)
 			if err != nil {
 				m.logger.Debug("Failed to extract value for target, skipping rule for this target",
 					zap.String("target", target),
@@ -332,43 +383,55 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 				continue
 			}
 
-			m.logger.Debug("Extracted value",
-				zap.String("rule_id", string(rule.ID)),
-				zap.String("target", target),
-				zap.String("value", value),
-			)
-
-			if rule.regex.MatchString(value) {
-				m.logger.Debug("Rule matched",
+			// Collection targets yield one value per parameter/header, each named after its variable
+			for _, tv := range values {
+				if targetExcluded(exclusions, &rule, tv.Name) {
+					m.logger.Debug("Target excluded for this request", zap.String("rule_id", string(rule.ID)), zap.String("target", tv.Name))
+					continue
+				}
+				m.logger.Debug("Extracted value",
 					zap.String("rule_id", string(rule.ID)),
-					zap.String("target", target),
-					zap.String("value", value),
+					zap.String("target", tv.Name),
+					zap.String("value", tv.Value),
 				)
-				if phase == 3 || phase == 4 {
-					if recorder, ok := w.(*responseRecorder); ok {
-						if m.processRuleMatch(recorder, r, &rule, value, state) {
-							return // Stop processing if the rule match indicates blocking
+
+				if m.matchRule(&rule, tv.Value, state) {
+					if len(rule.Chain) > 0 && !m.matchChain(&rule, r, responseWriter, state) {
+						m.logger.Debug("Rule chain did not match", zap.String("rule_id", string(rule.ID)), zap.String("target", tv.Name))
+						continue
+					}
+					m.logger.Debug("Rule matched",
+						zap.String("rule_id", string(rule.ID)),
+						zap.String("target", tv.Name),
+						zap.String("value", tv.Value),
+					)
+					// processRuleMatch returns false once the request is blocked
+					if phase == 3 || phase == 4 {
+						if recorder, ok := w.(*responseRecorder); ok {
+							if !m.processRuleMatch(recorder, r, &rule, tv.Name, tv.Value, state) {
+								return // Stop processing if the rule match indicates blocking
+							}
+						} else {
+							if !m.processRuleMatch(w, r, &rule, tv.Name, tv.Value, state) {
+								return // Stop processing if the rule match indicates blocking
+							}
 						}
 					} else {
-						if m.processRuleMatch(w, r, &rule, value, state) {
+						if !m.processRuleMatch(w, r, &rule, tv.Name, tv.Value, state) {
 							return // Stop processing if the rule match indicates blocking
 						}
 					}
-				} else {
-					if m.processRuleMatch(w, r, &rule, value, state) {
-						return // Stop processing if the rule match indicates blocking
+					if state.Blocked || state.ResponseWritten {
+						m.logger.Debug("Rule evaluation completed early due to blocking or response written", zap.Int("phase", phase), zap.String("rule_id", string(rule.ID)))
+						return
 					}
+				} else {
+					m.logger.Debug("Rule did not match",
+						zap.String("rule_id", string(rule.ID)),
+						zap.String("target", tv.Name),
+						zap.String("value", tv.Value),
+					)
 				}
-				if state.Blocked || state.ResponseWritten {
-					m.logger.Debug("Rule evaluation completed early due to blocking or response written", zap.Int("phase", phase), zap.String("rule_id", string(rule.ID)))
-					return
-				}
-			} else {
-				m.logger.Debug("Rule did not match",
-					zap.String("rule_id", string(rule.ID)),
-					zap.String("target", target),
-					zap.String("value", value),
-				)
 			}
 		}
 	}
@@ -391,7 +454,8 @@ func (m *Middleware) handlePhase(w http.ResponseWriter, r *http.Request, phase i
 	m.logger.Debug("Completed phase evaluation",
 		zap.Int("phase", phase),
 		zap.Int("total_score", state.TotalScore),
-		zap.Int("anomaly_threshold", m.AnomalyThreshold),
+		zap.Int("phase_score", state.PhaseScores[phase]),
+		zap.Int("anomaly_threshold", m.anomalyThreshold(phase)),
 	)
 }
 
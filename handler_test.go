@@ -1737,3 +1737,297 @@ func TestBlockedRequestPhase1_RateLimiting_MatchAllPaths(t *testing.T) {
 	assert.True(t, state3.Blocked, "Second request to /some-other-path should be rate-limited because MatchAllPaths=true")
 	assert.Equal(t, http.StatusTooManyRequests, w3.Code, "Expected status code 429")
 }
+
+func TestBlockedRequestPhase1_TransformedArgs(t *testing.T) {
+	logger := zap.NewNop()
+	middleware := &Middleware{
+		logger: logger,
+		Rules: map[int][]Rule{
+			1: {
+				{
+					ID:         "sqli-or",
+					Pattern:    `' or 1=1`,
+					Targets:    []string{"ARGS"},
+					Phase:      1,
+					Score:      5,
+					Action:     "block",
+					Transforms: []string{"urlDecodeUni", "htmlEntityDecode", "lowercase"},
+					regex:      regexp.MustCompile(`' or 1=1`),
+				},
+			},
+		},
+		CustomResponses: map[int]CustomBlockResponse{
+			403: {
+				StatusCode: http.StatusForbidden,
+				Body:       "Blocked by Transformed Args",
+			},
+		},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+
+	// The raw query is URL-encoded and upper case, so the pattern only matches after transformation
+	req := httptest.NewRequest("GET", "http://example.com/search?q=%27%20OR%201=1", nil)
+	ctx := context.WithValue(context.Background(), ContextKeyLogId("logID"), "test-log-id-transforms")
+	req = req.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+
+	middleware.handlePhase(w, req, 1, state)
+
+	assert.True(t, state.Blocked, "Request should be blocked")
+	assert.Equal(t, http.StatusForbidden, w.Code, "Expected status code 403")
+	assert.Contains(t, w.Body.String(), "Blocked by Transformed Args")
+}
+
+func TestBlockedRequestPhase2_ChainedRule(t *testing.T) {
+	logger := zap.NewNop()
+	newMiddleware := func() *Middleware {
+		methodMatcher, _ := compileOperator("streq", "POST", "")
+		pathMatcher, _ := compileOperator("rx", "^/login", "")
+		bodyMatcher, _ := compileOperator("contains", "' or", "")
+		return &Middleware{
+			logger: logger,
+			Rules: map[int][]Rule{
+				2: {
+					{
+						ID:       "login-sqli",
+						Operator: "streq",
+						Pattern:  "POST",
+						Targets:  []string{"METHOD"},
+						Phase:    2,
+						Score:    5,
+						Action:   "block",
+						matcher:  methodMatcher,
+						Chain: []RuleCondition{
+							{Targets: []string{"PATH"}, Pattern: "^/login", matcher: pathMatcher},
+							{Targets: []string{"BODY"}, Operator: "contains", Pattern: "' or", Transforms: []string{"lowercase"}, matcher: bodyMatcher},
+						},
+					},
+				},
+			},
+			ruleCache:             NewRuleCache(),
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+		}
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		body        string
+		wantBlocked bool
+	}{
+		{"all conditions match", "POST", "http://example.com/login", "user=admin' OR 1=1", true},
+		{"method does not match", "GET", "http://example.com/login", "user=admin' OR 1=1", false},
+		{"path does not match", "POST", "http://example.com/search", "user=admin' OR 1=1", false},
+		{"body does not match", "POST", "http://example.com/login", "user=admin", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			ctx := context.WithValue(context.Background(), ContextKeyLogId("logID"), "test-log-id-chain")
+			req = req.WithContext(ctx)
+
+			w := httptest.NewRecorder()
+			state := &WAFState{}
+
+			newMiddleware().handlePhase(w, req, 2, state)
+
+			assert.Equal(t, tt.wantBlocked, state.Blocked)
+		})
+	}
+}
+
+func TestBlockedRequestPhase1_PerParameterTargets(t *testing.T) {
+	logger := zap.NewNop()
+	middleware := &Middleware{
+		logger: logger,
+		Rules: map[int][]Rule{
+			1: {
+				{
+					ID:      "anchored-arg",
+					Pattern: `^\d+$`,
+					Targets: []string{"ARGS:id"},
+					Phase:   1,
+					Score:   5,
+					Action:  "log",
+					regex:   regexp.MustCompile(`^\d+$`),
+				},
+				{
+					ID:      "suspicious-arg-name",
+					Pattern: `^__proto__$`,
+					Targets: []string{"ARGS_NAMES"},
+					Phase:   1,
+					Score:   5,
+					Action:  "block",
+					regex:   regexp.MustCompile(`^__proto__$`),
+				},
+			},
+		},
+		AnomalyThreshold:      100,
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+
+	// ^\d+$ only makes sense against the single parameter, not the whole query string
+	req := httptest.NewRequest("GET", "http://example.com/item?id=42&__proto__=x", nil)
+	ctx := context.WithValue(context.Background(), ContextKeyLogId("logID"), "test-log-id-args")
+	req = req.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+
+	middleware.handlePhase(w, req, 1, state)
+
+	assert.True(t, state.Blocked, "Request should be blocked by the parameter name rule")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, int64(1), middleware.ruleHitsByVariable["ARGS:id"])
+	assert.Equal(t, int64(1), middleware.ruleHitsByVariable["ARGS_NAMES:__proto__"])
+}
+
+func TestServeHTTP_DetectionOnlyMode(t *testing.T) {
+	logger := zap.NewNop()
+	nikto, err := compileOperator("contains", "Nikto", "")
+	assert.NoError(t, err)
+
+	middleware := &Middleware{
+		logger:           logger,
+		Mode:             ModeDetectionOnly,
+		AnomalyThreshold: 5,
+		Rules: map[int][]Rule{1: {
+			{ID: "scanner", Phase: 1, Targets: []string{"HEADERS:User-Agent"}, Score: 5, Action: "block", matcher: nikto},
+		}},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{"malicious.domain": {}},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte("upstream"))
+		return err
+	})
+
+	req := httptest.NewRequest("GET", "http://malicious.domain/", nil)
+	req.Header.Set("User-Agent", "Nikto/2.5")
+	w := httptest.NewRecorder()
+
+	assert.NoError(t, middleware.ServeHTTP(w, req, next))
+
+	// Both the DNS blacklist and the rule would have blocked; the request still reaches the upstream
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "upstream", w.Body.String())
+	assert.Equal(t, int64(1), middleware.wouldBlockRequests)
+	assert.Equal(t, int64(0), middleware.blockedRequests)
+	assert.Equal(t, int64(1), middleware.allowedRequests)
+	hits, ok := middleware.ruleHits.Load(RuleID("scanner"))
+	assert.True(t, ok, "rules must still be evaluated after a blacklist match")
+	assert.Equal(t, HitCount(1), hits)
+}
+
+func TestServeHTTP_RuleActions(t *testing.T) {
+	logger := zap.NewNop()
+	operator := func(name, pattern string) operatorMatcher {
+		matcher, err := compileOperator(name, pattern, "")
+		assert.NoError(t, err)
+		return matcher
+	}
+
+	newMiddleware := func() *Middleware {
+		return &Middleware{
+			logger:           logger,
+			AnomalyThreshold: 5,
+			Rules: map[int][]Rule{
+				1: {
+					{ID: "health", Phase: 1, Targets: []string{"PATH"}, Action: ActionAllow, matcher: operator("streq", "/healthz")},
+					{ID: "old-site", Phase: 1, Targets: []string{"PATH"}, Action: ActionRedirect, RedirectURL: "https://example.com/new", Status: http.StatusMovedPermanently, matcher: operator("beginsWith", "/old")},
+					{ID: "slow-down", Phase: 1, Targets: []string{"PATH"}, Action: ActionTarpit, TarpitDelay: "20ms", Status: http.StatusTooManyRequests, matcher: operator("streq", "/wp-login.php")},
+					{ID: "scanner", Phase: 1, Targets: []string{"HEADERS:User-Agent"}, Action: ActionDrop, matcher: operator("contains", "masscan")},
+				},
+				2: {
+					{ID: "probe", Phase: 2, Targets: []string{"ARGS:*"}, Action: ActionDeny, Status: http.StatusNotAcceptable, matcher: operator("contains", "attack")},
+					{ID: "scored", Phase: 2, Targets: []string{"ARGS:*"}, Action: ActionPass, Score: 3, matcher: operator("contains", "suspicious")},
+				},
+			},
+			ruleCache:             NewRuleCache(),
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+		}
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte("upstream"))
+		return err
+	})
+
+	tests := []struct {
+		name         string
+		url          string
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+		minDuration  time.Duration
+	}{
+		{"allow skips the remaining rules", "/healthz?q=attack", http.StatusOK, "upstream", "", 0},
+		{"deny with rule status", "/search?q=attack", http.StatusNotAcceptable, "", "", 0},
+		{"pass only scores", "/search?q=suspicious", http.StatusOK, "upstream", "", 0},
+		{"redirect", "/old/page", http.StatusMovedPermanently, "", "https://example.com/new", 0},
+		{"tarpit delays the denial", "/wp-login.php", http.StatusTooManyRequests, "", "", 20 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMiddleware()
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+
+			start := time.Now()
+			assert.NoError(t, m.ServeHTTP(w, req, next))
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+			assert.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+			assert.GreaterOrEqual(t, time.Since(start), tt.minDuration)
+		})
+	}
+
+	t.Run("drop closes the connection", func(t *testing.T) {
+		m := newMiddleware()
+		served := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(served)
+			_ = m.ServeHTTP(w, r, next)
+		}))
+		defer server.Close()
+
+		req, err := http.NewRequest("GET", server.URL+"/", nil)
+		assert.NoError(t, err)
+		req.Header.Set("User-Agent", "masscan/1.3")
+		resp, err := server.Client().Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		assert.Error(t, err, "no response is sent for a dropped request")
+		<-served
+		assert.Equal(t, int64(1), m.blockedRequests)
+	})
+
+	t.Run("drop falls back to deny without hijacking", func(t *testing.T) {
+		m := newMiddleware()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", "masscan/1.3")
+		w := httptest.NewRecorder() // Does not implement http.Hijacker
+
+		assert.NoError(t, m.ServeHTTP(w, req, next))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
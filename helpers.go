@@ -2,6 +2,7 @@ package caddywaf
 
 import (
 	"os"
+	"path/filepath"
 )
 
 // fileExists checks if a file exists and is readable.
@@ -15,3 +16,21 @@ func fileExists(path string) bool {
 	}
 	return !info.IsDir()
 }
+
+// writeFileAtomic replaces the file at path with data through a temporary file in the same directory,
+// so readers, and a restart after a crash, never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -93,7 +93,14 @@ func (m *Middleware) logRequest(level zapcore.Level, msg string, r *http.Request
 
 	allFields := m.prepareLogFields(r, fields) // Prepare all fields in one function
 
-	// Send the log entry to the buffered channel
+	// Send the log entry to the buffered channel. The read lock keeps StopLogWorker from closing the
+	// channel during the send; once it is closed, requests still in flight log synchronously.
+	m.logMu.RLock()
+	defer m.logMu.RUnlock()
+	if m.logChan == nil {
+		m.logger.Log(level, msg, allFields...)
+		return
+	}
 	select {
 	case m.logChan <- LogEntry{Level: level, Message: msg, Fields: allFields}:
 		// Log entry successfully queued
@@ -136,7 +143,7 @@ func (m *Middleware) prepareLogFields(r *http.Request, fields []zap.Field) []zap
 	var sourceIP, userAgent, requestMethod, requestPath, queryParams string
 	var statusCode int
 	if r != nil {
-		sourceIP = r.RemoteAddr
+		sourceIP = clientIP(r)
 		userAgent = r.UserAgent()
 		requestMethod = r.Method
 		requestPath = r.URL.Path
@@ -234,19 +241,30 @@ func (m *Middleware) StartLogWorker() {
 	if m.LogBuffer == 0 {
 		m.LogBuffer = 1000 // Setting default log buffer
 	}
-	m.logChan = make(chan LogEntry, m.LogBuffer) // Buffer size can be adjusted
-	m.logDone = make(chan struct{})
+	logChan := make(chan LogEntry, m.LogBuffer) // Buffer size can be adjusted
+	logDone := make(chan struct{})
+	m.logMu.Lock()
+	m.logChan, m.logDone = logChan, logDone
+	m.logMu.Unlock()
 
 	go func() {
-		for entry := range m.logChan {
+		for entry := range logChan {
 			m.logger.Log(entry.Level, entry.Message, entry.Fields...)
 		}
-		close(m.logDone) // Signal that the worker has finished
+		close(logDone) // Signal that the worker has finished
 	}()
 }
 
 // StopLogWorker stops the background logging worker.
+// Requests still in flight, e.g. during a config reload, log synchronously afterwards.
 func (m *Middleware) StopLogWorker() {
-	close(m.logChan) // Close the channel to stop the worker
-	<-m.logDone      // Wait for the worker to finish processing
+	m.logMu.Lock()
+	logChan, logDone := m.logChan, m.logDone
+	m.logChan = nil
+	m.logMu.Unlock()
+	if logChan == nil {
+		return // The worker was never started (e.g. because provisioning failed), or was already stopped
+	}
+	close(logChan) // Close the channel to stop the worker
+	<-logDone      // Wait for the worker to finish processing
 }
@@ -4,12 +4,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestLogRequest(t *testing.T) {
@@ -154,3 +157,32 @@ func TestLogWorker(t *testing.T) {
 	// Allow some time for async processing
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestCleanup_InFlightLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	m := &Middleware{
+		logger:    zap.New(core),
+		LogBuffer: 10,
+	}
+	m.StartLogWorker()
+
+	// Requests of the old instance keep logging while Caddy cleans it up on a config reload
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				m.logRequest(zapcore.InfoLevel, "in flight", nil)
+			}
+		}()
+	}
+	assert.NoError(t, m.Cleanup())
+	wg.Wait()
+
+	m.logRequest(zapcore.InfoLevel, "after cleanup", nil)
+	assert.Equal(t, 800, logs.FilterMessage("in flight").Len(), "no entry is lost")
+	assert.Equal(t, 1, logs.FilterMessage("after cleanup").Len(), "entries are logged synchronously once the worker is stopped")
+	assert.NoError(t, m.Cleanup(), "cleanup is idempotent")
+	m.StopLogWorker()
+}
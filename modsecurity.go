@@ -0,0 +1,677 @@
+package caddywaf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// modSecurityFileExtension marks a rule file written in ModSecurity SecRule syntax (e.g. the OWASP Core Rule Set).
+const modSecurityFileExtension = ".conf"
+
+func isModSecurityFile(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), modSecurityFileExtension)
+}
+
+// modSecImport is the result of converting one ModSecurity file.
+type modSecImport struct {
+	Rules    []Rule
+	Removed  []string // Rule IDs or "first-last" ranges removed by SecRuleRemoveById and SecAction ctl:ruleRemoveById
+	Skipped  []string // One entry per directive that could not be converted, with the reason
+	Warnings []string // Parts of converted rules that were dropped or approximated
+}
+
+// modSecVariables maps ModSecurity collections to native targets. Collections map to their
+// per-member form (e.g. ARGS -> ARGS:*) so that each parameter is matched on its own, as ModSecurity does.
+var modSecVariables = map[string]string{
+	"ARGS":                  TargetArgsPrefix + TargetCollectionAll,
+	"ARGS_GET":              TargetArgsPrefix + TargetCollectionAll,
+	"ARGS_POST":             TargetArgsPost,
+	"ARGS_NAMES":            TargetArgsNames,
+	"ARGS_GET_NAMES":        TargetArgsNames,
+	"ARGS_POST_NAMES":       TargetArgsNames,
+	"REQUEST_HEADERS":       TargetHeadersPrefix + TargetCollectionAll,
+	"REQUEST_HEADERS_NAMES": TargetRequestHeadersNames,
+	"REQUEST_COOKIES":       TargetCookiesPrefix + TargetCollectionAll,
+	"REQUEST_COOKIES_NAMES": TargetRequestCookiesNames,
+	"REQUEST_URI":           TargetURI,
+	"REQUEST_URI_RAW":       TargetURI,
+	"REQUEST_FILENAME":      TargetPath,
+	"REQUEST_BASENAME":      TargetPath,
+	"REQUEST_BODY":          TargetBody,
+	"REQUEST_METHOD":        TargetMethod,
+	"REQUEST_PROTOCOL":      TargetProtocol,
+	"QUERY_STRING":          TargetArgs,
+	"REMOTE_ADDR":           TargetRemoteIP,
+	"SERVER_NAME":           TargetHost,
+	"FILES":                 TargetFiles,
+	"FILES_NAMES":           TargetFilesNames,
+	"REQBODY_ERROR":         TargetReqBodyError,
+	"REQBODY_ERROR_MSG":     TargetReqBodyErrorMsg,
+	"RESPONSE_HEADERS":      TargetResponseHeaders,
+	"RESPONSE_BODY":         TargetResponseBody,
+}
+
+// modSecPrefixVariables maps ModSecurity collections that accept a member name (e.g. ARGS:id) to native prefixes.
+var modSecPrefixVariables = map[string]string{
+	"ARGS":             TargetArgsPrefix,
+	"ARGS_GET":         TargetURLParamPrefix,
+	"ARGS_POST":        TargetArgsPostPrefix,
+	"REQUEST_HEADERS":  TargetHeadersPrefix,
+	"REQUEST_COOKIES":  TargetCookiesPrefix,
+	"RESPONSE_HEADERS": TargetResponseHeadersPrefix,
+	"FILES":            TargetFilesPrefix,
+	"XML":              TargetXMLPrefix,
+}
+
+// modSecApproximateVariables are converted to a broader native target; a warning is recorded for them.
+var modSecApproximateVariables = map[string]bool{
+	"ARGS_GET": true, "ARGS_GET_NAMES": true, "ARGS_POST_NAMES": true, "REQUEST_BASENAME": true,
+}
+
+// modSecSeverities maps ModSecurity severities (names and syslog levels 0-7) to native severities.
+var modSecSeverities = map[string]string{
+	"EMERGENCY": "CRITICAL", "0": "CRITICAL",
+	"ALERT": "CRITICAL", "1": "CRITICAL",
+	"CRITICAL": "CRITICAL", "2": "CRITICAL",
+	"ERROR": "HIGH", "3": "HIGH",
+	"WARNING": "MEDIUM", "4": "MEDIUM",
+	"NOTICE": "LOW", "5": "LOW",
+	"INFO": "INFO", "6": "INFO",
+	"DEBUG": "INFO", "7": "INFO",
+}
+
+// modSecSeverityScores are the default anomaly scores of the Core Rule Set, used for rules that don't set one.
+var modSecSeverityScores = map[string]int{"CRITICAL": 5, "HIGH": 4, "MEDIUM": 3, "LOW": 2}
+
+// modSecAnomalyScoreVars maps the CRS anomaly score variables used in setvar to their default value.
+var modSecAnomalyScoreVars = map[string]int{
+	"tx.critical_anomaly_score": 5,
+	"tx.error_anomaly_score":    4,
+	"tx.warning_anomaly_score":  3,
+	"tx.notice_anomaly_score":   2,
+}
+
+// modSecRule is a SecRule or SecAction directive before conversion.
+type modSecRule struct {
+	line      int
+	variables string
+	operator  string
+	actions   []modSecAction
+}
+
+type modSecAction struct {
+	name  string
+	value string
+}
+
+// parseModSecurity converts the supported subset of ModSecurity syntax into rules:
+// SecRule (variables, operator, transforms, id, phase, severity, msg, tag, chain, ctl:ruleRemoveById),
+// SecAction with ctl:ruleRemoveById and SecRuleRemoveById. Other configuration directives are ignored.
+// A "paranoia-level/N" tag sets the rule's paranoia level.
+// A directive that cannot be converted faithfully is skipped and reported rather than loaded with different semantics.
+func parseModSecurity(content []byte) *modSecImport {
+	result := &modSecImport{}
+
+	var head *Rule        // Chain head waiting for its chained conditions
+	var headSkipped bool  // The chain head (or one of its links) could not be converted
+	var headLine int      // Line of the chain head, for reporting
+	var chainOpen bool    // The previous SecRule had the "chain" action
+	var headReason string // Why the chain was skipped
+
+	finishChain := func() {
+		if head != nil && !headSkipped {
+			result.Rules = append(result.Rules, *head)
+		} else if headSkipped {
+			result.Skipped = append(result.Skipped, headReason)
+		}
+		head, headSkipped, headReason, chainOpen = nil, false, "", false
+	}
+
+	for _, directive := range splitModSecDirectives(content) {
+		args, err := splitModSecArgs(directive.text)
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("Line %d: %v", directive.line, err))
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "secrule":
+			if len(args) < 3 || len(args) > 4 {
+				result.Skipped = append(result.Skipped, fmt.Sprintf("Line %d: SecRule requires variables, an operator and optional actions", directive.line))
+				continue
+			}
+			parsed := modSecRule{line: directive.line, variables: args[1], operator: args[2]}
+			if len(args) == 4 {
+				parsed.actions = parseModSecActions(args[3])
+			}
+
+			if chainOpen {
+				// A chained SecRule becomes an extra condition of the chain head
+				cond, warnings, err := convertModSecCondition(parsed)
+				for _, warning := range warnings {
+					result.Warnings = append(result.Warnings, fmt.Sprintf("Rule '%s': chained rule at line %d: %s", head.ID, parsed.line, warning))
+				}
+				if err != nil && !headSkipped {
+					headSkipped = true
+					headReason = fmt.Sprintf("Line %d: rule '%s': chained rule at line %d: %v", headLine, head.ID, parsed.line, err)
+				} else if err == nil && !headSkipped {
+					head.Chain = append(head.Chain, cond)
+				}
+				if !parsed.hasAction("chain") {
+					finishChain()
+				}
+				continue
+			}
+
+			rule, warnings, err := convertModSecRule(parsed)
+			result.Warnings = append(result.Warnings, warnings...)
+			if parsed.hasAction("chain") {
+				head, headLine, chainOpen = &rule, parsed.line, true
+				if err != nil {
+					headSkipped = true
+					headReason = fmt.Sprintf("Line %d: rule '%s': %v", parsed.line, parsed.actionValue("id"), err)
+				}
+				continue
+			}
+			if err != nil {
+				result.Skipped = append(result.Skipped, fmt.Sprintf("Line %d: rule '%s': %v", parsed.line, parsed.actionValue("id"), err))
+				continue
+			}
+			result.Rules = append(result.Rules, rule)
+
+		case "secaction":
+			if chainOpen {
+				finishChain()
+			}
+			if len(args) != 2 {
+				result.Skipped = append(result.Skipped, fmt.Sprintf("Line %d: SecAction requires a single action list", directive.line))
+				continue
+			}
+			// SecAction always matches, so a rule removal in it applies unconditionally at load time
+			for _, action := range parseModSecActions(args[1]) {
+				if id, ok := modSecRuleRemoveByID(action); ok {
+					result.Removed = append(result.Removed, id)
+				}
+			}
+
+		case "secruleremovebyid":
+			if chainOpen {
+				finishChain()
+			}
+			for _, arg := range args[1:] {
+				result.Removed = append(result.Removed, strings.Fields(arg)...)
+			}
+
+		default:
+			if chainOpen {
+				finishChain()
+			}
+			// Engine settings (SecRuleEngine, SecMarker, SecComponentSignature, ...) have no rule equivalent
+		}
+	}
+
+	if chainOpen {
+		if !headSkipped {
+			headSkipped = true
+			headReason = fmt.Sprintf("Line %d: rule '%s': chain is not terminated", headLine, head.ID)
+		}
+		finishChain()
+	}
+	return result
+}
+
+type modSecDirective struct {
+	line int
+	text string
+}
+
+// splitModSecDirectives joins backslash-continued lines and drops comments and blank lines.
+func splitModSecDirectives(content []byte) []modSecDirective {
+	var directives []modSecDirective
+	var current strings.Builder
+	start := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024) // CRS rules can have very long regexes
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if current.Len() == 0 {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			start = lineNo
+		} else {
+			line = strings.TrimLeft(line, " \t")
+		}
+
+		trimmed := strings.TrimRight(line, " \t\r")
+		if strings.HasSuffix(trimmed, "\\") {
+			current.WriteString(strings.TrimSuffix(trimmed, "\\"))
+			continue
+		}
+		current.WriteString(trimmed)
+		directives = append(directives, modSecDirective{line: start, text: current.String()})
+		current.Reset()
+	}
+	if current.Len() > 0 {
+		directives = append(directives, modSecDirective{line: start, text: current.String()})
+	}
+	return directives
+}
+
+// splitModSecArgs splits a directive into its arguments. Quoted arguments may contain spaces;
+// only an escaped quote (\") is unescaped, so regex backslashes are kept as written.
+func splitModSecArgs(text string) ([]string, error) {
+	var args []string
+	i := 0
+	for i < len(text) {
+		for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+			i++
+		}
+		if i >= len(text) {
+			break
+		}
+
+		if quote := text[i]; quote == '"' || quote == '\'' {
+			var arg strings.Builder
+			i++
+			closed := false
+			for i < len(text) {
+				if text[i] == '\\' && i+1 < len(text) && text[i+1] == quote {
+					arg.WriteByte(quote)
+					i += 2
+					continue
+				}
+				if text[i] == quote {
+					closed = true
+					i++
+					break
+				}
+				arg.WriteByte(text[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted argument")
+			}
+			args = append(args, arg.String())
+			continue
+		}
+
+		end := i
+		for end < len(text) && text[end] != ' ' && text[end] != '\t' {
+			end++
+		}
+		args = append(args, text[i:end])
+		i = end
+	}
+	return args, nil
+}
+
+// parseModSecActions splits an action list on commas outside single-quoted values.
+func parseModSecActions(text string) []modSecAction {
+	var actions []modSecAction
+	var current strings.Builder
+	inQuote := false
+
+	flush := func() {
+		entry := strings.TrimSpace(current.String())
+		current.Reset()
+		if entry == "" {
+			return
+		}
+		name, value, _ := strings.Cut(entry, ":")
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		actions = append(actions, modSecAction{name: strings.ToLower(strings.TrimSpace(name)), value: value})
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && inQuote && i+1 < len(text) && text[i+1] == '\'':
+			current.WriteByte('\'')
+			i++
+		case c == '\'':
+			inQuote = !inQuote
+			current.WriteByte(c)
+		case c == ',' && !inQuote:
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return actions
+}
+
+// actionValue returns the value of the first action with the given name, or "".
+func (mr *modSecRule) actionValue(name string) string {
+	for _, action := range mr.actions {
+		if action.name == name {
+			return action.value
+		}
+	}
+	return ""
+}
+
+func (mr *modSecRule) hasAction(name string) bool {
+	for _, action := range mr.actions {
+		if action.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// modSecRuleRemoveByID returns the rule ID (or range) of a ctl:ruleRemoveById action.
+func modSecRuleRemoveByID(action modSecAction) (string, bool) {
+	if action.name != "ctl" {
+		return "", false
+	}
+	name, value, ok := strings.Cut(action.value, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(name), "ruleRemoveById") {
+		return "", false
+	}
+	return strings.TrimSpace(value), true
+}
+
+// convertModSecRule converts a SecRule that starts a rule (not a chained link).
+func convertModSecRule(mr modSecRule) (Rule, []string, error) {
+	rule := Rule{Phase: 2} // ModSecurity's default phase
+	var warnings []string
+
+	targets, targetWarnings, err := convertModSecVariables(mr.variables)
+	warnings = append(warnings, targetWarnings...)
+	if err != nil {
+		return rule, warnings, err
+	}
+	rule.Targets = targets
+
+	rule.Operator, rule.Pattern, rule.Negate, err = convertModSecOperator(mr.operator)
+	if err != nil {
+		return rule, warnings, err
+	}
+
+	score := -1
+	disruptive := ""
+	status := 0
+	for _, action := range mr.actions {
+		switch action.name {
+		case "id":
+			rule.ID = action.value
+		case "phase":
+			phase, err := convertModSecPhase(action.value)
+			if err != nil {
+				return rule, warnings, err
+			}
+			rule.Phase = phase
+		case "severity":
+			severity, ok := modSecSeverities[strings.ToUpper(action.value)]
+			if !ok {
+				return rule, warnings, fmt.Errorf("unknown severity '%s'", action.value)
+			}
+			rule.Severity = severity
+		case "msg":
+			rule.Description = action.value
+		case "tag":
+			rule.Tags = append(rule.Tags, action.value)
+			// CRS marks the paranoia level of each rule with a "paranoia-level/N" tag
+			if level, ok := strings.CutPrefix(strings.ToLower(action.value), "paranoia-level/"); ok {
+				if n, err := strconv.Atoi(level); err == nil {
+					rule.ParanoiaLevel = n
+				}
+			}
+		case "t":
+			rule.Transforms = convertModSecTransform(rule.Transforms, action.value, &warnings)
+		case "ctl":
+			if id, ok := modSecRuleRemoveByID(action); ok {
+				rule.RemoveRules = append(rule.RemoveRules, id)
+			} else {
+				warnings = append(warnings, fmt.Sprintf("Line %d: unsupported action 'ctl:%s' ignored", mr.line, action.value))
+			}
+		case "setvar":
+			if s, ok := modSecAnomalyScore(action.value); ok {
+				score = s
+			}
+		case "status":
+			n, err := strconv.Atoi(action.value)
+			if err != nil {
+				return rule, warnings, fmt.Errorf("invalid status '%s'", action.value)
+			}
+			status = n
+		case "deny", "drop", "block", "pass":
+			disruptive = action.name
+		case "allow":
+			if action.value != "" {
+				warnings = append(warnings, fmt.Sprintf("'allow:%s' allows the whole request", action.value))
+			}
+			disruptive = action.name
+		case "redirect":
+			disruptive = action.name
+			rule.RedirectURL = action.value
+		case "proxy", "pause":
+			return rule, warnings, fmt.Errorf("unsupported disruptive action '%s'", action.name)
+		}
+	}
+	if rule.ID == "" {
+		return rule, warnings, fmt.Errorf("rule has no id action")
+	}
+
+	switch disruptive {
+	case "deny", "redirect":
+		rule.Action = disruptive
+		rule.Status = status
+	case "drop", "allow":
+		rule.Action = disruptive
+	case "pass":
+		rule.Action = ActionLog
+	}
+	if rule.Action == ActionRedirect && rule.Status != 0 && (rule.Status < 300 || rule.Status > 399) {
+		rule.Status = 0 // ModSecurity only honors 3xx statuses for redirects
+	}
+	if score < 0 {
+		score = 0
+		if disruptive != "pass" && disruptive != "allow" && len(rule.RemoveRules) == 0 {
+			score = modSecSeverityScores[rule.Severity]
+		}
+	}
+	rule.Score = score
+
+	for i := range warnings {
+		warnings[i] = fmt.Sprintf("Rule '%s': %s", rule.ID, warnings[i])
+	}
+	return rule, warnings, nil
+}
+
+// convertModSecCondition converts a chained SecRule into a rule condition.
+func convertModSecCondition(mr modSecRule) (RuleCondition, []string, error) {
+	var cond RuleCondition
+	var warnings []string
+
+	targets, targetWarnings, err := convertModSecVariables(mr.variables)
+	warnings = append(warnings, targetWarnings...)
+	if err != nil {
+		return cond, warnings, err
+	}
+	cond.Targets = targets
+
+	cond.Operator, cond.Pattern, cond.Negate, err = convertModSecOperator(mr.operator)
+	if err != nil {
+		return cond, warnings, err
+	}
+	for _, action := range mr.actions {
+		if action.name == "t" {
+			cond.Transforms = convertModSecTransform(cond.Transforms, action.value, &warnings)
+		}
+	}
+	return cond, warnings, nil
+}
+
+// convertModSecVariables converts a "|" separated variable list. Exclusions (!VAR) are dropped with a
+// warning, which makes the rule broader; counting (&VAR), regex selectors and unknown collections are errors.
+func convertModSecVariables(variables string) ([]string, []string, error) {
+	var targets, warnings []string
+	seen := make(map[string]bool)
+	for _, variable := range strings.Split(variables, "|") {
+		variable = strings.TrimSpace(variable)
+		switch {
+		case variable == "":
+			continue
+		case strings.HasPrefix(variable, "!"):
+			warnings = append(warnings, fmt.Sprintf("variable exclusion '%s' ignored", variable))
+			continue
+		case strings.HasPrefix(variable, "&"):
+			return nil, warnings, fmt.Errorf("counting variable '%s' is not supported", variable)
+		}
+
+		name, selector, hasSelector := strings.Cut(variable, ":")
+		name = strings.ToUpper(name)
+		var target string
+		if hasSelector {
+			if strings.HasPrefix(selector, "/") && name != "XML" { // XML selectors are XPath expressions
+				return nil, warnings, fmt.Errorf("regex selector in variable '%s' is not supported", variable)
+			}
+			prefix, ok := modSecPrefixVariables[name]
+			if !ok {
+				return nil, warnings, fmt.Errorf("unsupported variable '%s'", variable)
+			}
+			target = prefix + selector
+		} else {
+			var ok bool
+			target, ok = modSecVariables[name]
+			if !ok {
+				return nil, warnings, fmt.Errorf("unsupported variable '%s'", variable)
+			}
+			if modSecApproximateVariables[name] {
+				warnings = append(warnings, fmt.Sprintf("variable '%s' converted to the broader target '%s'", variable, target))
+			}
+		}
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, warnings, fmt.Errorf("no supported variables in '%s'", variables)
+	}
+	return targets, warnings, nil
+}
+
+// modSecOperatorAliases maps ModSecurity operator spellings that differ from the native names.
+var modSecOperatorAliases = map[string]string{
+	"pmf": OperatorPhraseFile,
+}
+
+// convertModSecOperator converts "[!]@op argument" (or a bare regex) into operator, pattern and negate.
+func convertModSecOperator(operator string) (string, string, bool, error) {
+	negate := false
+	if strings.HasPrefix(operator, "!") {
+		negate = true
+		operator = operator[1:]
+	}
+	if !strings.HasPrefix(operator, "@") {
+		return OperatorRegex, operator, negate, nil // A bare argument is a regex
+	}
+
+	name, argument, _ := strings.Cut(operator[1:], " ")
+	if alias, ok := modSecOperatorAliases[strings.ToLower(name)]; ok {
+		name = alias
+	}
+	canonical := normalizeOperator(name)
+	if canonical == "" || name == "" {
+		return "", "", false, fmt.Errorf("unsupported operator '@%s'", name)
+	}
+	return canonical, strings.TrimSpace(argument), negate, nil
+}
+
+// convertModSecPhase converts a phase number or name; phase 5 (logging) has no equivalent.
+func convertModSecPhase(value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "request":
+		return 2, nil
+	case "response":
+		return 4, nil
+	}
+	phase, err := strconv.Atoi(value)
+	if err != nil || phase < 1 || phase > 4 {
+		return 0, fmt.Errorf("unsupported phase '%s'", value)
+	}
+	return phase, nil
+}
+
+// convertModSecTransform appends one t: action to the transform chain. t:none resets the chain,
+// and unsupported transforms are dropped with a warning.
+func convertModSecTransform(transforms []string, name string, warnings *[]string) []string {
+	if strings.EqualFold(name, "none") {
+		return nil
+	}
+	if err := validateTransforms([]string{name}); err != nil {
+		*warnings = append(*warnings, fmt.Sprintf("unsupported transform 't:%s' ignored", name))
+		return transforms
+	}
+	return append(transforms, name)
+}
+
+// modSecAnomalyScore returns the score added by a CRS-style setvar, e.g.
+// tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score} or tx.anomaly_score=+5.
+func modSecAnomalyScore(setvar string) (int, bool) {
+	name, value, ok := strings.Cut(setvar, "=")
+	if !ok || !strings.Contains(strings.ToLower(name), "anomaly_score") || !strings.HasPrefix(value, "+") {
+		return 0, false
+	}
+	value = strings.TrimPrefix(value, "+")
+	if n, err := strconv.Atoi(value); err == nil {
+		return n, true
+	}
+	if strings.HasPrefix(value, "%{") && strings.HasSuffix(value, "}") {
+		score, ok := modSecAnomalyScoreVars[strings.ToLower(value[2:len(value)-1])]
+		return score, ok
+	}
+	return 0, false
+}
+
+// ruleSet wraps the converted rules in a RuleSet so they go through the same strict decoding as native rule files.
+func (mi *modSecImport) ruleSet() (RuleSet, error) {
+	set := RuleSet{Rules: make([]json.RawMessage, 0, len(mi.Rules))}
+	for _, rule := range mi.Rules {
+		raw, err := json.Marshal(rule)
+		if err != nil {
+			return set, fmt.Errorf("failed to encode imported rule '%s': %w", rule.ID, err)
+		}
+		set.Rules = append(set.Rules, raw)
+	}
+	return set, nil
+}
+
+// ruleIDRemoved reports whether id is listed in removed, either directly or within a "first-last" numeric range.
+func ruleIDRemoved(removed []string, id string) bool {
+	for _, spec := range removed {
+		if spec == id {
+			return true
+		}
+		first, last, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			continue
+		}
+		lo, err1 := strconv.Atoi(first)
+		hi, err2 := strconv.Atoi(last)
+		n, err3 := strconv.Atoi(id)
+		if err1 == nil && err2 == nil && err3 == nil && lo <= n && n <= hi {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,262 @@
+package caddywaf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const testModSecurityRules = `# Paranoia level 1 rules in Core Rule Set style
+SecRuleEngine On
+SecComponentSignature "OWASP_CRS/4.0.0"
+
+SecRule REQUEST_HEADERS:User-Agent "@pmFromFile scanners.data" \
+    "id:913100,\
+    phase:1,\
+    block,\
+    capture,\
+    t:none,t:lowercase,\
+    msg:'Found User-Agent associated with security scanner',\
+    tag:'attack-reconnaissance',\
+    tag:'paranoia-level/1',\
+    severity:'CRITICAL',\
+    setvar:'tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}'"
+
+SecRule ARGS|ARGS_NAMES|!REQUEST_COOKIES:/__utm/ "@rx (?i)union\s+select" \
+    "id:942100,phase:2,deny,t:none,t:urlDecodeUni,t:cmdLine,msg:'SQL Injection',severity:2"
+
+SecRule REQUEST_METHOD "@streq POST" \
+    "id:942200,phase:2,block,severity:'WARNING',chain"
+    SecRule REQUEST_FILENAME "@beginsWith /login" "chain"
+        SecRule &ARGS "@gt 10"
+
+SecRule REQUEST_FILENAME "@streq /admin/upload" \
+    "id:1000,phase:1,pass,nolog,ctl:ruleRemoveById=942100"
+
+SecRule ARGS "@detectSQLi" "id:942101,phase:2,block"
+SecRule TX:EXECUTING_PARANOIA_LEVEL "@lt 2" "id:942013,phase:1,pass,nolog,skipAfter:END"
+SecRule REQUEST_BODY "!@rx ^\{" "id:942300,phase:5,pass"
+
+SecRule REQUEST_METHOD "@streq PUT" "id:942400,phase:request,block,severity:NOTICE,chain"
+    SecRule REQUEST_HEADERS:Content-Type "@contains \"json\"" "t:lowercase"
+
+SecAction "id:900200,phase:1,pass,nolog,ctl:ruleRemoveById=920100-920199"
+SecRuleRemoveById 949110 980130
+`
+
+func TestParseModSecurity(t *testing.T) {
+	imported := parseModSecurity([]byte(testModSecurityRules))
+
+	rules := make(map[string]Rule)
+	for _, rule := range imported.Rules {
+		rules[rule.ID] = rule
+	}
+	assert.Len(t, imported.Rules, 4)
+
+	scanner := rules["913100"]
+	assert.Equal(t, 1, scanner.Phase)
+	assert.Equal(t, OperatorPhraseFile, scanner.Operator)
+	assert.Equal(t, "scanners.data", scanner.Pattern)
+	assert.Equal(t, []string{"HEADERS:User-Agent"}, scanner.Targets)
+	assert.Equal(t, []string{"lowercase"}, scanner.Transforms)
+	assert.Equal(t, []string{"attack-reconnaissance", "paranoia-level/1"}, scanner.Tags)
+	assert.Equal(t, 1, scanner.ParanoiaLevel)
+	assert.Equal(t, "CRITICAL", scanner.Severity)
+	assert.Equal(t, 5, scanner.Score)
+	assert.Equal(t, "", scanner.Action) // "block" defers to anomaly scoring
+	assert.Equal(t, "Found User-Agent associated with security scanner", scanner.Description)
+
+	sqli := rules["942100"]
+	assert.Equal(t, OperatorRegex, sqli.Operator)
+	assert.Equal(t, `(?i)union\s+select`, sqli.Pattern)
+	assert.Equal(t, []string{"ARGS:*", "ARGS_NAMES"}, sqli.Targets)
+	assert.Equal(t, []string{"urlDecodeUni"}, sqli.Transforms)
+	assert.Equal(t, ActionDeny, sqli.Action)
+	assert.Equal(t, 5, sqli.Score)
+
+	exclusion := rules["1000"]
+	assert.Equal(t, []string{"942100"}, exclusion.RemoveRules)
+	assert.Equal(t, "log", exclusion.Action)
+	assert.Equal(t, 0, exclusion.Score)
+
+	put := rules["942400"]
+	assert.Equal(t, 2, put.Phase)
+	assert.Equal(t, 2, put.Score)
+	if assert.Len(t, put.Chain, 1) {
+		assert.Equal(t, []string{"HEADERS:Content-Type"}, put.Chain[0].Targets)
+		assert.Equal(t, OperatorContains, put.Chain[0].Operator)
+		assert.Equal(t, `"json"`, put.Chain[0].Pattern)
+		assert.Equal(t, []string{"lowercase"}, put.Chain[0].Transforms)
+	}
+
+	assert.Equal(t, []string{"920100-920199", "949110", "980130"}, imported.Removed)
+
+	assert.Len(t, imported.Skipped, 4)
+	assert.Contains(t, imported.Skipped[0], "counting variable '&ARGS'")
+	assert.Contains(t, imported.Skipped[1], "unsupported operator '@detectSQLi'")
+	assert.Contains(t, imported.Skipped[2], "unsupported variable 'TX:EXECUTING_PARANOIA_LEVEL'")
+	assert.Contains(t, imported.Skipped[3], "unsupported phase '5'")
+
+	assert.Contains(t, imported.Warnings, "Rule '942100': variable exclusion '!REQUEST_COOKIES:/__utm/' ignored")
+	assert.Contains(t, imported.Warnings, "Rule '942100': unsupported transform 't:cmdLine' ignored")
+}
+
+func TestParseModSecurity_DisruptiveActions(t *testing.T) {
+	content := `SecRule REQUEST_FILENAME "@streq /healthz" "id:1,phase:1,allow,nolog"
+SecRule ARGS "@contains attack" "id:2,phase:2,deny,status:406"
+SecRule REQUEST_FILENAME "@beginsWith /old" "id:3,phase:1,redirect:https://example.com/new,status:301"
+SecRule REMOTE_ADDR "@ipMatch 198.51.100.0/24" "id:4,phase:1,drop"
+`
+	imported := parseModSecurity([]byte(content))
+	assert.Empty(t, imported.Skipped)
+	if assert.Len(t, imported.Rules, 4) {
+		assert.Equal(t, ActionAllow, imported.Rules[0].Action)
+		assert.Equal(t, 0, imported.Rules[0].Score)
+		assert.Equal(t, ActionDeny, imported.Rules[1].Action)
+		assert.Equal(t, 406, imported.Rules[1].Status)
+		assert.Equal(t, ActionRedirect, imported.Rules[2].Action)
+		assert.Equal(t, "https://example.com/new", imported.Rules[2].RedirectURL)
+		assert.Equal(t, 301, imported.Rules[2].Status)
+		assert.Equal(t, ActionDrop, imported.Rules[3].Action)
+	}
+	for _, rule := range imported.Rules {
+		assert.NoError(t, validateRule(&rule))
+	}
+}
+
+func TestParseModSecurity_BodyVariables(t *testing.T) {
+	content := `SecRule REQBODY_ERROR "!@eq 0" "id:200002,phase:2,deny,msg:'Failed to parse request body'"
+SecRule FILES|FILES_NAMES "@rx \.php$" "id:933110,phase:2,block"
+SecRule XML:/* "@contains <!ENTITY" "id:933120,phase:2,block"
+`
+	imported := parseModSecurity([]byte(content))
+	assert.Empty(t, imported.Skipped)
+	if assert.Len(t, imported.Rules, 3) {
+		assert.Equal(t, []string{"REQBODY_ERROR"}, imported.Rules[0].Targets)
+		assert.Equal(t, []string{"FILES", "FILES_NAMES"}, imported.Rules[1].Targets)
+		assert.Equal(t, []string{"XML:/*"}, imported.Rules[2].Targets)
+	}
+	for _, rule := range imported.Rules {
+		assert.NoError(t, validateRule(&rule))
+	}
+}
+
+func TestParseModSecurity_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		reason  string
+	}{
+		{"missing id", `SecRule ARGS "@rx x" "phase:2,block"`, "no id action"},
+		{"unterminated quote", `SecRule ARGS "@rx x`, "unterminated quoted argument"},
+		{"unterminated chain", `SecRule ARGS "@rx x" "id:1,chain"`, "chain is not terminated"},
+		{"regex selector", `SecRule ARGS:/^id_/ "@rx x" "id:2"`, "regex selector"},
+		{"unsupported disruptive action", `SecRule ARGS "@rx x" "id:3,proxy:http://backend"`, "unsupported disruptive action 'proxy'"},
+		{"invalid status", `SecRule ARGS "@rx x" "id:4,deny,status:abc"`, "invalid status 'abc'"},
+		{"missing operator", `SecRule ARGS`, "SecRule requires"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imported := parseModSecurity([]byte(tt.content))
+			assert.Empty(t, imported.Rules)
+			if assert.Len(t, imported.Skipped, 1) {
+				assert.Contains(t, imported.Skipped[0], tt.reason)
+			}
+		})
+	}
+}
+
+func TestRuleIDRemoved(t *testing.T) {
+	removed := []string{"942100", "920100-920199", "custom-rule"}
+	assert.True(t, ruleIDRemoved(removed, "942100"))
+	assert.True(t, ruleIDRemoved(removed, "920150"))
+	assert.True(t, ruleIDRemoved(removed, "custom-rule"))
+	assert.False(t, ruleIDRemoved(removed, "920200"))
+	assert.False(t, ruleIDRemoved(removed, "942101"))
+	assert.False(t, ruleIDRemoved(nil, "942100"))
+}
+
+func TestLoadRules_ModSecurityFile(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "scanners.data"), []byte("nikto\nsqlmap\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "crs.conf"), []byte(testModSecurityRules), 0644))
+	// A native rule removed by SecRuleRemoveById in the ModSecurity file
+	native := `[{"id": "949110", "phase": 2, "pattern": "x", "targets": ["URI"], "score": 5},
+		{"id": "local", "phase": 2, "pattern": "y", "targets": ["URI"], "score": 5}]`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "local.json"), []byte(native), 0644))
+
+	m := &Middleware{logger: zap.NewNop(), mu: sync.RWMutex{}, ruleCache: NewRuleCache()}
+	assert.NoError(t, m.loadRules([]string{dir}))
+
+	var ids []string
+	for phase := 1; phase <= 4; phase++ {
+		for _, rule := range m.Rules[phase] {
+			ids = append(ids, rule.ID)
+		}
+	}
+	assert.ElementsMatch(t, []string{"913100", "1000", "942100", "942400", "local"}, ids)
+
+	if assert.Len(t, m.ruleLoadReport, 2) {
+		report := m.ruleLoadReport[0]
+		assert.Equal(t, filepath.Join(dir, "crs.conf"), report.File)
+		assert.Equal(t, 4, report.Loaded)
+		assert.Equal(t, 4, report.Skipped)
+		assert.NotEmpty(t, report.Warnings)
+		assert.Equal(t, []string{"920100-920199", "949110", "980130"}, report.Removed)
+		assert.Equal(t, 1, m.ruleLoadReport[1].Loaded)
+	}
+}
+
+func TestHandlePhase_RuntimeRuleRemoval(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.conf")
+	content := `SecRule REQUEST_FILENAME "@beginsWith /admin/" "id:1000,phase:2,pass,nolog,ctl:ruleRemoveById=942100"
+SecRule ARGS "@rx (?i)union\s+select" "id:942100,phase:2,deny,severity:CRITICAL"
+`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(content), 0644))
+
+	logger := zap.NewNop()
+	m := &Middleware{
+		logger:                logger,
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+		ruleCache:             NewRuleCache(),
+		AnomalyThreshold:      10,
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+	}
+	assert.NoError(t, m.loadRules([]string{ruleFile}))
+
+	tests := []struct {
+		name        string
+		url         string
+		wantBlocked bool
+	}{
+		{"rule applies outside the excluded path", "/search?q=1%20UNION%20SELECT%20pass", true},
+		{"rule removed for the excluded path", "/admin/report?q=1%20UNION%20SELECT%20pass", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			req = req.WithContext(context.WithValue(req.Context(), ContextKeyLogId("logID"), "test-log-id"))
+			w := httptest.NewRecorder()
+			state := &WAFState{}
+
+			m.handlePhase(w, req, 2, state)
+
+			assert.Equal(t, tt.wantBlocked, state.Blocked)
+			if tt.wantBlocked {
+				assert.Equal(t, http.StatusForbidden, w.Code)
+			} else {
+				assert.Equal(t, []string{"942100"}, state.removedRules)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package caddywaf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule Operator Constants - names accepted in a rule's "operator" field (case-insensitive)
+const (
+	OperatorRegex      = "rx" // Default when no operator is given
+	OperatorContains   = "contains"
+	OperatorBeginsWith = "beginsWith"
+	OperatorEndsWith   = "endsWith"
+	OperatorStrEq      = "streq"
+	OperatorPhrase     = "pm"         // Whitespace separated phrase list
+	OperatorPhraseFile = "pmFromFile" // Phrase list loaded from one or more files
+	OperatorEq         = "eq"
+	OperatorGt         = "gt"
+	OperatorLt         = "lt"
+	OperatorGe         = "ge"
+	OperatorLe         = "le"
+	OperatorIPMatch    = "ipMatch" // Comma or whitespace separated IPs/CIDRs
+)
+
+var knownOperators = []string{
+	OperatorRegex, OperatorContains, OperatorBeginsWith, OperatorEndsWith, OperatorStrEq,
+	OperatorPhrase, OperatorPhraseFile,
+	OperatorEq, OperatorGt, OperatorLt, OperatorGe, OperatorLe,
+	OperatorIPMatch,
+}
+
+// operatorMatcher evaluates a (transformed) target value against a compiled rule operator.
+type operatorMatcher interface {
+	Match(value string) bool
+}
+
+// normalizeOperator returns the canonical spelling of an operator name, or "" if it is unknown.
+// An empty operator defaults to regex matching.
+func normalizeOperator(operator string) string {
+	if operator == "" {
+		return OperatorRegex
+	}
+	for _, known := range knownOperators {
+		if strings.EqualFold(operator, known) {
+			return known
+		}
+	}
+	return ""
+}
+
+// compileOperator builds the matcher for an operator and its pattern argument.
+// Relative phrase files are resolved against baseDir (usually the directory of the rule file).
+func compileOperator(operator, pattern, baseDir string) (operatorMatcher, error) {
+	switch normalizeOperator(operator) {
+	case OperatorRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex pattern: %w", err)
+		}
+		return &regexMatcher{regex: re}, nil
+	case OperatorContains, OperatorBeginsWith, OperatorEndsWith, OperatorStrEq:
+		return &stringMatcher{operator: normalizeOperator(operator), operand: pattern}, nil
+	case OperatorPhrase:
+		phrases := strings.Fields(pattern)
+		if len(phrases) == 0 {
+			return nil, fmt.Errorf("phrase list is empty")
+		}
+		return newAhoCorasick(phrases), nil
+	case OperatorPhraseFile:
+		phrases, err := loadPhraseFiles(strings.Fields(pattern), baseDir)
+		if err != nil {
+			return nil, err
+		}
+		return newAhoCorasick(phrases), nil
+	case OperatorEq, OperatorGt, OperatorLt, OperatorGe, OperatorLe:
+		operand, err := strconv.ParseFloat(strings.TrimSpace(pattern), 64)
+		if err != nil {
+			return nil, fmt.Errorf("numeric operator '%s' requires a number, got '%s'", operator, pattern)
+		}
+		return &numericMatcher{operator: normalizeOperator(operator), operand: operand}, nil
+	case OperatorIPMatch:
+		return newIPMatcher(pattern)
+	default:
+		return nil, fmt.Errorf("unknown operator '%s'", operator)
+	}
+}
+
+// regexMatcher implements the "rx" operator.
+type regexMatcher struct {
+	regex *regexp.Regexp
+}
+
+func (rm *regexMatcher) Match(value string) bool {
+	return rm.regex.MatchString(value)
+}
+
+// stringMatcher implements the case-sensitive string comparison operators.
+type stringMatcher struct {
+	operator string
+	operand  string
+}
+
+func (sm *stringMatcher) Match(value string) bool {
+	switch sm.operator {
+	case OperatorContains:
+		return strings.Contains(value, sm.operand)
+	case OperatorBeginsWith:
+		return strings.HasPrefix(value, sm.operand)
+	case OperatorEndsWith:
+		return strings.HasSuffix(value, sm.operand)
+	default: // OperatorStrEq
+		return value == sm.operand
+	}
+}
+
+// loadPhraseFiles reads one phrase per line from each file, skipping blank lines and '#' comments.
+func loadPhraseFiles(paths []string, baseDir string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no phrase file specified")
+	}
+	var phrases []string
+	for _, path := range paths {
+		if !filepath.IsAbs(path) && baseDir != "" {
+			path = filepath.Join(baseDir, path)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open phrase file: %w", err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			phrases = append(phrases, line)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read phrase file %s: %w", path, err)
+		}
+	}
+	if len(phrases) == 0 {
+		return nil, fmt.Errorf("phrase files %v contain no phrases", paths)
+	}
+	return phrases, nil
+}
+
+// numericMatcher implements the eq/gt/lt/ge/le operators. Non-numeric values never match.
+type numericMatcher struct {
+	operator string
+	operand  float64
+}
+
+func (nm *numericMatcher) Match(value string) bool {
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return false
+	}
+	switch nm.operator {
+	case OperatorEq:
+		return n == nm.operand
+	case OperatorGt:
+		return n > nm.operand
+	case OperatorLt:
+		return n < nm.operand
+	case OperatorGe:
+		return n >= nm.operand
+	default: // OperatorLe
+		return n <= nm.operand
+	}
+}
+
+// ipMatcher implements the "ipMatch" operator on top of CIDRTrie.
+type ipMatcher struct {
+	trie *CIDRTrie
+}
+
+func newIPMatcher(pattern string) (*ipMatcher, error) {
+	entries := strings.FieldsFunc(pattern, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("ipMatch requires at least one IP or CIDR")
+	}
+	trie := NewCIDRTrie()
+	for _, entry := range entries {
+		cidr, err := addressCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w in ipMatch", err)
+		}
+		if err := trie.Insert(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s' in ipMatch: %w", entry, err)
+		}
+	}
+	return &ipMatcher{trie: trie}, nil
+}
+
+func (im *ipMatcher) Match(value string) bool {
+	return im.trie.Contains(extractIP(strings.TrimSpace(value), nil))
+}
@@ -0,0 +1,188 @@
+package caddywaf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCompileOperator(t *testing.T) {
+	tests := []struct {
+		name     string
+		operator string
+		pattern  string
+		value    string
+		want     bool
+	}{
+		{"default regex", "", "^/admin", "/admin/login", true},
+		{"rx", "rx", "(?i)select", "SELECT 1", true},
+		{"contains", "contains", "' or", "user=' or 1=1", true},
+		{"contains case sensitive", "contains", "' or", "user=' OR 1=1", false},
+		{"beginsWith", "beginsWith", "/wp-", "/wp-login.php", true},
+		{"beginsWith case insensitive name", "BEGINSWITH", "/wp-", "/index.php", false},
+		{"endsWith", "endsWith", ".php", "/shell.php", true},
+		{"streq", "streq", "POST", "POST", true},
+		{"streq mismatch", "streq", "POST", "POSTED", false},
+		{"pm", "pm", "nikto sqlmap nuclei", "Mozilla/5.0 (SQLMap)", true},
+		{"pm no match", "pm", "nikto sqlmap nuclei", "Mozilla/5.0", false},
+		{"eq", "eq", "0", "0", true},
+		{"gt", "gt", "100", "101", true},
+		{"gt equal", "gt", "100", "100", false},
+		{"lt", "lt", "10", "9", true},
+		{"ge", "ge", "10", "10", true},
+		{"le", "le", "10", "11", false},
+		{"numeric non-number", "gt", "1", "abc", false},
+		{"ipMatch cidr", "ipMatch", "10.0.0.0/8, 192.168.1.1", "10.1.2.3", true},
+		{"ipMatch single ip with port", "ipMatch", "10.0.0.0/8, 192.168.1.1", "192.168.1.1:5555", true},
+		{"ipMatch ipv6", "ipMatch", "2001:db8::/32", "2001:db8::1", true},
+		{"ipMatch miss", "ipMatch", "10.0.0.0/8", "172.16.0.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher, err := compileOperator(tt.operator, tt.pattern, "")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, matcher.Match(tt.value))
+		})
+	}
+}
+
+func TestCompileOperator_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		operator string
+		pattern  string
+	}{
+		{"unknown operator", "soundsLike", "x"},
+		{"invalid regex", "rx", "("},
+		{"empty phrase list", "pm", "   "},
+		{"non-numeric operand", "gt", "ten"},
+		{"invalid ip", "ipMatch", "10.0.0.300"},
+		{"missing phrase file", "pmFromFile", "does-not-exist.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileOperator(tt.operator, tt.pattern, t.TempDir())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCompileOperator_PhraseFile(t *testing.T) {
+	dir := t.TempDir()
+	content := "# scanners\nnikto\n\n  Acunetix  \n"
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "scanners.txt"), []byte(content), 0644))
+
+	// Relative paths are resolved against the rule file directory
+	matcher, err := compileOperator("pmFromFile", "scanners.txt", dir)
+	assert.NoError(t, err)
+	assert.True(t, matcher.Match("Mozilla/5.0 acunetix-wvs"))
+	assert.False(t, matcher.Match("scanners"))
+}
+
+func TestMatchRule_NegateAndTransforms(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop()}
+
+	matcher, err := compileOperator("gt", "8", "")
+	assert.NoError(t, err)
+	rule := &Rule{ID: "long-arg", Transforms: []string{"length"}, matcher: matcher}
+	assert.True(t, m.matchRule(rule, "123456789", &WAFState{}))
+	assert.False(t, m.matchRule(rule, "1234", &WAFState{}))
+
+	matcher, err = compileOperator("ipMatch", "10.0.0.0/8", "")
+	assert.NoError(t, err)
+	rule = &Rule{ID: "not-internal", Negate: true, matcher: matcher}
+	assert.False(t, m.matchRule(rule, "10.0.0.1:1234", &WAFState{}))
+	assert.True(t, m.matchRule(rule, "8.8.8.8:1234", &WAFState{}))
+}
+
+func TestServeHTTP_NumericOperators(t *testing.T) {
+	logger := zap.NewNop()
+	tooMany, err := compileOperator("gt", "3", "")
+	assert.NoError(t, err)
+	tooLong, err := compileOperator("ge", "16", "")
+	assert.NoError(t, err)
+
+	m := &Middleware{
+		logger:           logger,
+		AnomalyThreshold: 5,
+		Rules: map[int][]Rule{1: {
+			{ID: "too-many-args", Phase: 1, Targets: []string{"&ARGS:*"}, Score: 5, Action: ActionBlock, matcher: tooMany},
+			{ID: "long-arg", Phase: 1, Targets: []string{"ARGS:*"}, Transforms: []string{"length"}, Score: 5, Action: ActionBlock, matcher: tooLong},
+		}},
+		ruleCache:             NewRuleCache(),
+		ipBlacklist:           NewCIDRTrie(),
+		dnsBlacklist:          map[string]struct{}{},
+		requestValueExtractor: NewRequestValueExtractor(logger, false),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"few short args", "a=1&b=2&c=3", http.StatusOK},
+		{"no args", "", http.StatusOK},
+		{"too many args", "a=1&b=2&c=3&d=4", http.StatusForbidden},
+		{"long arg", "a=" + strings.Repeat("x", 16), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/?"+tt.query, nil), next))
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestLoadRules_Operators(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "agents.txt"), []byte("nikto\nsqlmap\n"), 0644))
+
+	ruleFile := filepath.Join(dir, "rules.json")
+	rules := `[
+		{"id": "bad-agents", "phase": 1, "operator": "pmFromFile", "pattern": "agents.txt", "targets": ["USER_AGENT"], "score": 5},
+		{"id": "post-only", "phase": 1, "operator": "streq", "pattern": "POST", "negate": true, "targets": ["METHOD"], "score": 1},
+		{"id": "bad-operator", "phase": 1, "operator": "soundsLike", "pattern": "x", "targets": ["METHOD"], "score": 1},
+		{"id": "bad-number", "phase": 1, "operator": "gt", "pattern": "many", "targets": ["METHOD"], "score": 1}
+	]`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(rules), 0644))
+
+	m := &Middleware{logger: zap.NewNop(), mu: sync.RWMutex{}, ruleCache: NewRuleCache()}
+	assert.NoError(t, m.loadRules([]string{ruleFile}))
+	assert.Len(t, m.Rules[1], 2)
+	for _, rule := range m.Rules[1] {
+		assert.NotNil(t, rule.matcher, "rule %s should have a compiled matcher", rule.ID)
+	}
+}
+
+func TestLoadRules_Chain(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"id": "login-sqli", "phase": 2, "operator": "streq", "pattern": "POST", "targets": ["METHOD"], "score": 5,
+		 "chain": [
+			{"targets": ["PATH"], "pattern": "^/login"},
+			{"targets": ["BODY"], "operator": "contains", "pattern": "' or", "transforms": ["lowercase"]}
+		 ]},
+		{"id": "bad-chain", "phase": 2, "pattern": "POST", "targets": ["METHOD"], "score": 5,
+		 "chain": [{"targets": ["PATH"], "pattern": "("}]}
+	]`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(rules), 0644))
+
+	m := &Middleware{logger: zap.NewNop(), mu: sync.RWMutex{}, ruleCache: NewRuleCache()}
+	assert.NoError(t, m.loadRules([]string{ruleFile}))
+	assert.Len(t, m.Rules[2], 1)
+	for _, cond := range m.Rules[2][0].Chain {
+		assert.NotNil(t, cond.matcher)
+	}
+}
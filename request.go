@@ -3,9 +3,10 @@ package caddywaf
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,6 +17,7 @@ import (
 type RequestValueExtractor struct {
 	logger              *zap.Logger
 	redactSensitiveData bool // Add this field
+	bodyLimits          requestBodyLimits
 }
 
 // Extraction Target Constants - Improved Readability and Maintainability
@@ -42,8 +44,177 @@ const (
 	TargetCookiesPrefix         = "COOKIES:"          // Dynamic cookie extraction prefix
 	TargetHeadersPrefix         = "HEADERS:"          // Dynamic header extraction prefix
 	TargetResponseHeadersPrefix = "RESPONSE_HEADERS:" // Dynamic response header extraction prefix
+
+	// Collection targets - evaluated once per parameter/header instead of as one concatenated string
+	TargetArgsPrefix          = "ARGS:"      // ARGS:name for one query/body parameter, ARGS:* for all of them
+	TargetArgsNames           = "ARGS_NAMES" // Names of all query/body parameters
+	TargetArgsPost            = "ARGS_POST"  // All body parameters (urlencoded, multipart or JSON)
+	TargetArgsPostPrefix      = "ARGS_POST:" // One body parameter by name
+	TargetRequestHeadersNames = "REQUEST_HEADERS_NAMES"
+	TargetRequestCookiesNames = "REQUEST_COOKIES_NAMES"
+	TargetCollectionAll       = "*" // Selects every member of a collection, e.g. ARGS:* or HEADERS:*
+	TargetCountPrefix         = "&" // &collection counts the members of a collection, e.g. &ARGS:* or &FILES
+
+	// Targets of the parsed request body
+	TargetFiles           = "FILES"             // Original file name of each multipart file, named by form field
+	TargetFilesPrefix     = "FILES:"            // File name(s) uploaded in one form field
+	TargetFilesNames      = "FILES_NAMES"       // Form field name of each multipart file
+	TargetJSONPrefix      = "JSON:"             // JSON:path for one flattened JSON member, JSON:* for all of them
+	TargetXMLPrefix       = "XML:"              // XML:/xpath for element text and attributes, XML:/* for all of them
+	TargetReqBodyError    = "REQBODY_ERROR"     // "1" if the body could not be parsed according to its Content-Type, else "0"
+	TargetReqBodyErrorMsg = "REQBODY_ERROR_MSG" // Why the body could not be parsed
+)
+
+// knownTargets lists every target accepted as-is; dynamicTargetPrefixes must be followed by a name.
+var (
+	knownTargets = []string{
+		TargetMethod, TargetRemoteIP, TargetProtocol, TargetHost, TargetArgs, TargetUserAgent, TargetPath,
+		TargetURI, TargetBody, TargetHeaders, TargetResponseHeaders, TargetResponseBody, TargetFileName,
+		TargetFileMIMEType, TargetCookies, TargetContentType, TargetURL,
+		TargetArgsNames, TargetArgsPost, TargetRequestHeadersNames, TargetRequestCookiesNames,
+		TargetFiles, TargetFilesNames, TargetReqBodyError, TargetReqBodyErrorMsg,
+	}
+	dynamicTargetPrefixes = []string{
+		TargetHeadersPrefix, TargetResponseHeadersPrefix, TargetCookiesPrefix, TargetURLParamPrefix,
+		TargetJSONPathPrefix, TargetArgsPrefix, TargetArgsPostPrefix, TargetFilesPrefix, TargetJSONPrefix,
+		TargetXMLPrefix,
+	}
+)
+
+// collectionTargets lists the collection targets, and collectionTargetPrefixes the dynamic ones; only
+// these can be counted.
+var (
+	collectionTargets = []string{
+		TargetArgsNames, TargetArgsPost, TargetFiles, TargetFilesNames, TargetRequestHeadersNames,
+		TargetRequestCookiesNames, TargetHeadersPrefix + TargetCollectionAll, TargetCookiesPrefix + TargetCollectionAll,
+	}
+	collectionTargetPrefixes = []string{
+		TargetArgsPrefix, TargetArgsPostPrefix, TargetFilesPrefix, TargetJSONPrefix, TargetXMLPrefix,
+	}
 )
 
+// requestBodyTargets lists the targets that read the request body, and requestBodyTargetPrefixes the
+// dynamic ones. ARGS alone is the query string, while ARGS:name and ARGS_NAMES include body parameters.
+var (
+	requestBodyTargets = []string{
+		TargetBody, TargetArgsNames, TargetArgsPost, TargetFileName, TargetFileMIMEType, TargetFiles,
+		TargetFilesNames, TargetReqBodyError, TargetReqBodyErrorMsg,
+	}
+	requestBodyTargetPrefixes = []string{
+		TargetArgsPrefix, TargetArgsPostPrefix, TargetFilesPrefix, TargetJSONPrefix, TargetJSONPathPrefix, TargetXMLPrefix,
+	}
+)
+
+// readsRequestBody reports whether a target, or any entry of a comma separated list, reads the request body.
+func readsRequestBody(target string) bool {
+	for _, t := range strings.Split(target, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), TargetCountPrefix)
+		upper := strings.ToUpper(canonicalTarget(t))
+		if slices.Contains(requestBodyTargets, upper) {
+			return true
+		}
+		for _, prefix := range requestBodyTargetPrefixes {
+			if strings.HasPrefix(upper, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// targetAliases maps ModSecurity-style variable names, as used by the bundled and imported rules, to native targets.
+var targetAliases = map[string]string{
+	"REQUEST_COOKIES":  TargetCookies,
+	"REQUEST_HEADERS":  TargetHeaders,
+	"REQUEST_URI":      TargetURI,
+	"REQUEST_BODY":     TargetBody,
+	"REQUEST_METHOD":   TargetMethod,
+	"REQUEST_PROTOCOL": TargetProtocol,
+	"REQUEST_FILENAME": TargetPath,
+	"QUERY_STRING":     TargetArgs,
+	"REMOTE_ADDR":      TargetRemoteIP,
+	"SERVER_NAME":      TargetHost,
+}
+
+// targetPrefixAliases maps ModSecurity-style dynamic variable prefixes to native prefixes.
+var targetPrefixAliases = map[string]string{
+	"REQUEST_COOKIES:": TargetCookiesPrefix,
+	"REQUEST_HEADERS:": TargetHeadersPrefix,
+}
+
+// canonicalTarget resolves target aliases (case-insensitive), preserving the case of any name suffix.
+func canonicalTarget(target string) string {
+	upper := strings.ToUpper(target)
+	if native, ok := targetAliases[upper]; ok {
+		return native
+	}
+	for prefix, native := range targetPrefixAliases {
+		if strings.HasPrefix(upper, prefix) {
+			return native + target[len(prefix):]
+		}
+	}
+	return target
+}
+
+// validateTarget reports an error for a target the extractor does not understand, so that typos are
+// caught when rules are loaded instead of silently never matching. Comma separated lists are checked per entry.
+func validateTarget(target string) error {
+	for _, t := range strings.Split(target, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			return fmt.Errorf("empty target in '%s'", target)
+		}
+		if counted, ok := strings.CutPrefix(t, TargetCountPrefix); ok {
+			if !isCollectionTarget(counted) {
+				return fmt.Errorf("count target '%s' must count a collection target, e.g. &ARGS:*", t)
+			}
+			if t != strings.TrimSpace(target) {
+				return fmt.Errorf("count target '%s' cannot be part of a comma separated list", t)
+			}
+			t = counted
+		}
+		upper := strings.ToUpper(canonicalTarget(t))
+		known := false
+		for _, k := range knownTargets {
+			if upper == k {
+				known = true
+				break
+			}
+		}
+		for _, prefix := range dynamicTargetPrefixes {
+			if strings.HasPrefix(upper, prefix) && len(upper) > len(prefix) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown target '%s'", t)
+		}
+	}
+	return nil
+}
+
+// isCollectionTarget reports whether a target yields one value per member of a collection.
+func isCollectionTarget(target string) bool {
+	upper := strings.ToUpper(canonicalTarget(strings.TrimSpace(target)))
+	if slices.Contains(collectionTargets, upper) {
+		return true
+	}
+	for _, prefix := range collectionTargetPrefixes {
+		if strings.HasPrefix(upper, prefix) && len(upper) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetValue is one value extracted for a rule target, along with the name of the
+// variable it came from (e.g. "ARGS:username" for a collection target, or the target itself).
+type TargetValue struct {
+	Name  string
+	Value string
+}
+
 var sensitiveTargets = []string{"password", "token", "apikey", "authorization", "secret"} // Define sensitive targets for redaction as package variable
 
 // NewRequestValueExtractor creates a new RequestValueExtractor with a given logger
@@ -76,16 +247,235 @@ func (rve *RequestValueExtractor) ExtractValue(target string, r *http.Request, w
 	return rve.extractSingleValue(target, r, w)
 }
 
+// ExtractValues extracts the individual values for a target. Collection targets (ARGS:*, ARGS:name,
+// ARGS_NAMES, ARGS_POST, ARGS_POST:name, FILES[:name], FILES_NAMES, JSON:path, XML:/xpath,
+// REQUEST_HEADERS_NAMES, HEADERS:*, REQUEST_COOKIES_NAMES, COOKIES:*) yield one value per parameter,
+// file, body member, header or cookie; every other target yields a single value named after the target.
+// A count target (&ARGS:*) yields the number of members of its collection, which may be 0.
+func (rve *RequestValueExtractor) ExtractValues(target string, r *http.Request, w http.ResponseWriter) ([]TargetValue, error) {
+	target = strings.TrimSpace(target)
+	if counted, ok := strings.CutPrefix(target, TargetCountPrefix); ok {
+		values, isCollection, err := rve.extractCollection(counted, r)
+		if !isCollection {
+			return nil, fmt.Errorf("count target '%s' must count a collection target", target)
+		}
+		if err != nil {
+			rve.logger.Debug("Collection partially extracted", zap.String("target", target), zap.Error(err))
+		}
+		return []TargetValue{{Name: target, Value: strconv.Itoa(len(values))}}, nil
+	}
+	values, isCollection, err := rve.extractCollection(target, r)
+	if !isCollection {
+		value, err := rve.ExtractValue(target, r, w)
+		if err != nil {
+			return nil, err
+		}
+		return []TargetValue{{Name: target, Value: value}}, nil
+	}
+	if err != nil {
+		if len(values) == 0 {
+			return nil, err
+		}
+		rve.logger.Debug("Collection partially extracted", zap.String("target", target), zap.Error(err))
+	}
+	if len(values) == 0 {
+		rve.logger.Debug("Collection target is empty", zap.String("target", target))
+		return nil, fmt.Errorf("no values found for target: %s", target)
+	}
+	for _, tv := range values {
+		rve.logger.Debug("Extracted value",
+			zap.String("target", tv.Name),
+			zap.String("value", rve.redactValueIfSensitive(tv.Name, tv.Value)),
+		)
+	}
+	return values, nil
+}
+
+// extractCollection extracts the members of a collection target. The second return value
+// reports whether target is a collection target at all. Parameter names are matched
+// case-insensitively and reported with their original spelling.
+func (rve *RequestValueExtractor) extractCollection(target string, r *http.Request) ([]TargetValue, bool, error) {
+	target = canonicalTarget(target)
+	upper := strings.ToUpper(target)
+	switch {
+	case upper == TargetArgsNames:
+		args := rve.extractAllArgs(r)
+		seen := make(map[string]struct{}, len(args))
+		var names []TargetValue
+		for _, arg := range args {
+			if _, ok := seen[arg.Name]; ok {
+				continue
+			}
+			seen[arg.Name] = struct{}{}
+			names = append(names, TargetValue{Name: TargetArgsNames + ":" + arg.Name, Value: arg.Name})
+		}
+		return names, true, nil
+	case upper == TargetArgsPost:
+		args, err := rve.extractPostArgs(r)
+		return namedValues(TargetArgsPost+":", args, ""), true, err
+	case strings.HasPrefix(upper, TargetArgsPostPrefix):
+		args, err := rve.extractPostArgs(r)
+		return namedValues(TargetArgsPost+":", args, target[len(TargetArgsPostPrefix):]), true, err
+	case strings.HasPrefix(upper, TargetArgsPrefix):
+		args := rve.extractAllArgs(r)
+		return namedValues(TargetArgsPrefix, args, target[len(TargetArgsPrefix):]), true, nil
+	case upper == TargetFiles || strings.HasPrefix(upper, TargetFilesPrefix):
+		var files []TargetValue
+		for _, file := range rve.requestBody(r).files {
+			files = append(files, TargetValue{Name: file.field, Value: file.fileName})
+		}
+		return namedValues(TargetFilesPrefix, files, strings.TrimPrefix(target[len(TargetFiles):], ":")), true, nil
+	case upper == TargetFilesNames:
+		var names []TargetValue
+		for _, file := range rve.requestBody(r).files {
+			names = append(names, TargetValue{Name: TargetFilesNames + ":" + file.field, Value: file.field})
+		}
+		return names, true, nil
+	case strings.HasPrefix(upper, TargetJSONPrefix):
+		body := rve.requestBody(r)
+		if body.json == nil {
+			return nil, true, body.err
+		}
+		return namedValues(TargetJSONPrefix, body.args, target[len(TargetJSONPrefix):]), true, nil
+	case strings.HasPrefix(upper, TargetXMLPrefix):
+		body := rve.requestBody(r)
+		selector := target[len(TargetXMLPrefix):]
+		var values []TargetValue
+		for _, value := range body.xml {
+			if matchXMLPath(selector, value.Name) {
+				values = append(values, TargetValue{Name: TargetXMLPrefix + value.Name, Value: value.Value})
+			}
+		}
+		return values, true, body.err
+	case upper == TargetRequestHeadersNames:
+		var names []TargetValue
+		for _, name := range sortedHeaderNames(r.Header) {
+			names = append(names, TargetValue{Name: TargetRequestHeadersNames + ":" + name, Value: name})
+		}
+		return names, true, nil
+	case upper == TargetHeadersPrefix+TargetCollectionAll:
+		var values []TargetValue
+		for _, name := range sortedHeaderNames(r.Header) {
+			for _, value := range r.Header.Values(name) {
+				values = append(values, TargetValue{Name: TargetHeadersPrefix + name, Value: value})
+			}
+		}
+		return values, true, nil
+	case upper == TargetRequestCookiesNames:
+		var names []TargetValue
+		for _, cookie := range r.Cookies() {
+			names = append(names, TargetValue{Name: TargetRequestCookiesNames + ":" + cookie.Name, Value: cookie.Name})
+		}
+		return names, true, nil
+	case upper == TargetCookiesPrefix+TargetCollectionAll:
+		var values []TargetValue
+		for _, cookie := range r.Cookies() {
+			values = append(values, TargetValue{Name: TargetCookiesPrefix + cookie.Name, Value: cookie.Value})
+		}
+		return values, true, nil
+	}
+	return nil, false, nil
+}
+
+// namedValues prefixes each parameter name with the collection name, keeping only parameters
+// called selector (case-insensitive) unless selector is empty or "*".
+func namedValues(collection string, args []TargetValue, selector string) []TargetValue {
+	var values []TargetValue
+	for _, arg := range args {
+		if selector != "" && selector != TargetCollectionAll && !strings.EqualFold(arg.Name, selector) {
+			continue
+		}
+		values = append(values, TargetValue{Name: collection + arg.Name, Value: arg.Value})
+	}
+	return values
+}
+
+func sortedHeaderNames(header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// extractAllArgs returns the query string parameters followed by the body parameters.
+// A body that cannot be parsed only drops the body parameters.
+func (rve *RequestValueExtractor) extractAllArgs(r *http.Request) []TargetValue {
+	query, _ := url.ParseQuery(r.URL.RawQuery) // Keep whatever parsed before a malformed pair
+	args := sortedValues(query)
+	postArgs, err := rve.extractPostArgs(r)
+	if err != nil {
+		rve.logger.Debug("Skipping body parameters", zap.Error(err))
+	}
+	return append(args, postArgs...)
+}
+
+// extractPostArgs returns the parameters of the parsed request body. Parameters that were parsed
+// before the body turned out to be malformed are returned along with the parse error.
+// JSON members are named by their dotted path, as in JSON_PATH targets (e.g. "user.roles.0").
+func (rve *RequestValueExtractor) extractPostArgs(r *http.Request) ([]TargetValue, error) {
+	body := rve.requestBody(r)
+	return body.args, body.err
+}
+
+// flattenJSON appends every scalar member of data, named by its dotted path.
+func flattenJSON(path string, data interface{}, args *[]TargetValue) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch v := data.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flattenJSON(join(key), v[key], args)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenJSON(join(strconv.Itoa(i)), item, args)
+		}
+	case nil:
+		*args = append(*args, TargetValue{Name: path, Value: ""})
+	default:
+		*args = append(*args, TargetValue{Name: path, Value: fmt.Sprintf("%v", v)})
+	}
+}
+
+// sortedValues flattens url.Values into name/value pairs, ordered by name for deterministic evaluation.
+func sortedValues(values url.Values) []TargetValue {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []TargetValue
+	for _, name := range names {
+		for _, value := range values[name] {
+			args = append(args, TargetValue{Name: name, Value: value})
+		}
+	}
+	return args
+}
+
 // extractSingleValue extracts a value based on a single target
 func (rve *RequestValueExtractor) extractSingleValue(target string, r *http.Request, w http.ResponseWriter) (string, error) {
-	target = strings.ToUpper(strings.TrimSpace(target))
+	// Target names are case-insensitive, but header/cookie/parameter names after the prefix keep their case
+	target = canonicalTarget(strings.TrimSpace(target))
+	upper := strings.ToUpper(target)
 	var unredactedValue string
 	var err error
 
 	// Optimization: Use a map for target extraction logic
 	extractionLogic := map[string]func() (string, error){
 		TargetMethod:   func() (string, error) { return r.Method, nil },
-		TargetRemoteIP: func() (string, error) { return r.RemoteAddr, nil },
+		TargetRemoteIP: func() (string, error) { return remoteIP(r), nil },
 		TargetProtocol: func() (string, error) { return r.Proto, nil },
 		TargetHost:     func() (string, error) { return r.Host, nil },
 		TargetArgs: func() (string, error) {
@@ -119,40 +509,47 @@ func (rve *RequestValueExtractor) extractSingleValue(target string, r *http.Requ
 		TargetURL: func() (string, error) {
 			return r.URL.String(), rve.checkEmpty(r.URL.String(), target, "URL could not be extracted")
 		},
+		TargetReqBodyError: func() (string, error) {
+			if rve.requestBody(r).err != nil {
+				return "1", nil
+			}
+			return "0", nil
+		},
+		TargetReqBodyErrorMsg: func() (string, error) {
+			if err := rve.requestBody(r).err; err != nil {
+				return err.Error(), nil
+			}
+			return "", fmt.Errorf("request body has no parse error for target: %s", target)
+		},
 	}
 
-	if extractor, exists := extractionLogic[target]; exists {
+	if extractor, exists := extractionLogic[upper]; exists {
 		unredactedValue, err = extractor()
 		if err != nil {
 			return "", err // Return error from extractor
 		}
-	} else if strings.HasPrefix(target, TargetHeadersPrefix) {
-		unredactedValue, err = rve.extractDynamicHeader(r.Header, strings.TrimPrefix(target, TargetHeadersPrefix), target)
-		if err != nil {
-			return "", err
-		}
-	} else if strings.HasPrefix(target, TargetResponseHeadersPrefix) {
-		unredactedValue, err = rve.extractDynamicResponseHeader(w.Header(), strings.TrimPrefix(target, TargetResponseHeadersPrefix), target)
+	} else if strings.HasPrefix(upper, TargetHeadersPrefix) {
+		unredactedValue, err = rve.extractDynamicHeader(r.Header, target[len(TargetHeadersPrefix):], target)
 		if err != nil {
 			return "", err
 		}
-	} else if strings.HasPrefix(target, TargetCookiesPrefix) {
-		unredactedValue, err = rve.extractDynamicCookie(r, strings.TrimPrefix(target, TargetCookiesPrefix), target)
+	} else if strings.HasPrefix(upper, TargetResponseHeadersPrefix) {
+		unredactedValue, err = rve.extractDynamicResponseHeader(w.Header(), target[len(TargetResponseHeadersPrefix):], target)
 		if err != nil {
 			return "", err
 		}
-	} else if target == TargetCookies {
-		unredactedValue, err = rve.extractAllCookies(r.Cookies(), "No cookies found", target)
+	} else if strings.HasPrefix(upper, TargetCookiesPrefix) {
+		unredactedValue, err = rve.extractDynamicCookie(r, target[len(TargetCookiesPrefix):], target)
 		if err != nil {
 			return "", err
 		}
-	} else if strings.HasPrefix(target, TargetURLParamPrefix) {
-		unredactedValue, err = rve.extractURLParam(r.URL, strings.TrimPrefix(target, TargetURLParamPrefix), target)
+	} else if strings.HasPrefix(upper, TargetURLParamPrefix) {
+		unredactedValue, err = rve.extractURLParam(r.URL, target[len(TargetURLParamPrefix):], target)
 		if err != nil {
 			return "", err
 		}
-	} else if strings.HasPrefix(target, TargetJSONPathPrefix) {
-		unredactedValue, err = rve.extractValueForJSONPath(r, strings.TrimPrefix(target, TargetJSONPathPrefix), target)
+	} else if strings.HasPrefix(upper, TargetJSONPathPrefix) {
+		unredactedValue, err = rve.extractValueForJSONPath(r, target[len(TargetJSONPathPrefix):], target)
 		if err != nil {
 			return "", err
 		}
@@ -196,17 +593,12 @@ func (rve *RequestValueExtractor) extractBody(r *http.Request, target string) (s
 		rve.logger.Warn("Request body is nil", zap.String("target", target))
 		return "", fmt.Errorf("request body is nil for target: %s", target)
 	}
-	if r.ContentLength == 0 {
+	body := rve.requestBody(r)
+	if len(body.raw) == 0 {
 		rve.logger.Debug("Request body is empty", zap.String("target", target))
 		return "", fmt.Errorf("request body is empty for target: %s", target)
 	}
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		rve.logger.Error("Failed to read request body", zap.Error(err))
-		return "", fmt.Errorf("failed to read request body for target %s: %w", target, err)
-	}
-	r.Body = http.NoBody // Reset body for next read - using http.NoBody
-	return string(bodyBytes), nil
+	return string(body.raw), nil
 }
 
 // Helper function to extract all headers
@@ -231,41 +623,32 @@ func (rve *RequestValueExtractor) extractResponseBody(w http.ResponseWriter, tar
 	if !ok || recorder == nil {
 		return "", fmt.Errorf("response recorder not available for target: %s", target)
 	}
-	if recorder.body.Len() == 0 {
+	body := recorder.inspectedBody()
+	if body == "" {
 		rve.logger.Debug("Response body is empty", zap.String("target", target))
 		return "", fmt.Errorf("response body is empty for target: %s", target)
 	}
-	return recorder.BodyString(), nil
+	return body, nil
 }
 
-// Helper function to extract filename from multipart form
+// Helper function to extract the file name of the first multipart file
 func (rve *RequestValueExtractor) extractFileName(r *http.Request, target string) (string, error) {
-	if r.MultipartForm == nil || r.MultipartForm.File == nil {
+	files := rve.requestBody(r).files
+	if len(files) == 0 {
 		rve.logger.Debug("Multipart form file not found", zap.String("target", target))
-		return "", fmt.Errorf("multipart form file not found for target: %s", target)
-	}
-
-	for _, files := range r.MultipartForm.File {
-		if len(files) > 0 { // Check if there are files
-			return files[0].Filename, nil // Return the first file's name
-		}
+		return "", fmt.Errorf("no files found in multipart form for target: %s", target)
 	}
-	return "", fmt.Errorf("no files found in multipart form for target: %s", target) // No files found but form is present
+	return files[0].fileName, nil
 }
 
-// Helper function to extract MIME type from multipart form
+// Helper function to extract the MIME type of the first multipart file
 func (rve *RequestValueExtractor) extractFileMIMEType(r *http.Request, target string) (string, error) {
-	if r.MultipartForm == nil || r.MultipartForm.File == nil {
+	files := rve.requestBody(r).files
+	if len(files) == 0 {
 		rve.logger.Debug("Multipart form file not found", zap.String("target", target))
-		return "", fmt.Errorf("multipart form file not found for target: %s", target)
-	}
-
-	for _, files := range r.MultipartForm.File {
-		if len(files) > 0 { // Check if files are present
-			return files[0].Header.Get("Content-Type"), nil // Return MIME type of the first file
-		}
+		return "", fmt.Errorf("no files found in multipart form for target: %s", target)
 	}
-	return "", fmt.Errorf("no files found in multipart form for target: %s", target) // No files found even though form is present
+	return files[0].contentType, nil
 }
 
 // Helper function to extract dynamic header value
@@ -291,14 +674,15 @@ func (rve *RequestValueExtractor) extractDynamicResponseHeader(header http.Heade
 	return headerValue, nil
 }
 
-// Helper function to extract dynamic cookie value
+// Helper function to extract dynamic cookie value (cookie name matched case-insensitively)
 func (rve *RequestValueExtractor) extractDynamicCookie(r *http.Request, cookieName string, target string) (string, error) {
-	cookie, err := r.Cookie(cookieName)
-	if err != nil {
-		rve.logger.Debug("Cookie not found", zap.String("cookie", cookieName), zap.String("target", target))
-		return "", fmt.Errorf("cookie '%s' not found for target: %s", cookieName, target)
+	for _, cookie := range r.Cookies() {
+		if strings.EqualFold(cookie.Name, cookieName) {
+			return cookie.Value, nil
+		}
 	}
-	return cookie.Value, nil
+	rve.logger.Debug("Cookie not found", zap.String("cookie", cookieName), zap.String("target", target))
+	return "", fmt.Errorf("cookie '%s' not found for target: %s", cookieName, target)
 }
 
 // Helper function to extract URL parameter value
@@ -313,24 +697,17 @@ func (rve *RequestValueExtractor) extractURLParam(url *url.URL, paramName string
 
 // Helper function to extract value for JSON Path
 func (rve *RequestValueExtractor) extractValueForJSONPath(r *http.Request, jsonPath string, target string) (string, error) {
-	if r.Body == nil {
-		rve.logger.Warn("Request body is nil", zap.String("target", target))
-		return "", fmt.Errorf("request body is nil for target: %s", target)
-	}
-	if r.ContentLength == 0 {
+	body := rve.requestBody(r)
+	if len(body.raw) == 0 {
 		rve.logger.Debug("Request body is empty", zap.String("target", target))
 		return "", fmt.Errorf("request body is empty for target: %s", target)
 	}
-
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		rve.logger.Error("Failed to read request body", zap.Error(err))
-		return "", fmt.Errorf("failed to read request body for JSON_PATH target %s: %w", target, err)
+	if body.json == nil {
+		return "", fmt.Errorf("request body is not valid JSON for target: %s", target)
 	}
-	r.Body = http.NoBody // Reset body for next read
 
-	// Use helper method to dynamically extract value based on JSON path (e.g., 'data.items.0.name').
-	unredactedValue, err := rve.extractJSONPath(string(bodyBytes), jsonPath)
+	// Dynamically extract the value based on the JSON path (e.g., 'data.items.0.name').
+	unredactedValue, err := lookupJSONPath(body.json, jsonPath)
 	if err != nil {
 		rve.logger.Debug("Failed to extract value from JSON path", zap.String("target", target), zap.String("path", jsonPath), zap.Error(err))
 		return "", fmt.Errorf("failed to extract from JSON path '%s': %w", jsonPath, err)
@@ -363,24 +740,13 @@ func (rve *RequestValueExtractor) extractAllCookies(cookies []*http.Cookie, logM
 	return strings.Join(cookieStrings, "; "), nil
 }
 
-// Helper function for JSON path extraction.
-func (rve *RequestValueExtractor) extractJSONPath(jsonStr string, jsonPath string) (string, error) {
-	// Validate input JSON string
-	if jsonStr == "" {
-		return "", fmt.Errorf("json string is empty")
-	}
-
+// lookupJSONPath returns the member of a decoded JSON document at a dotted path.
+func lookupJSONPath(jsonData interface{}, jsonPath string) (string, error) {
 	// Validate JSON path
 	if jsonPath == "" {
 		return "", fmt.Errorf("json path is empty")
 	}
 
-	// Unmarshal JSON string into an interface{}
-	var jsonData interface{}
-	if err := json.Unmarshal([]byte(jsonStr), &jsonData); err != nil {
-		return "", fmt.Errorf("failed to unmarshal JSON: %w", err)
-	}
-
 	// Check if JSON data is valid
 	if jsonData == nil {
 		return "", fmt.Errorf("invalid json data")
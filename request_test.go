@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -391,7 +392,7 @@ func TestProcessRuleMatch_HighScore(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	// Test blocking rule with high score
-	shouldContinue := middleware.processRuleMatch(w, req, rule, "value", state)
+	shouldContinue := middleware.processRuleMatch(w, req, rule, "HEADERS", "value", state)
 	assert.False(t, shouldContinue)
 	assert.Equal(t, http.StatusForbidden, w.Code)
 	assert.True(t, state.Blocked)
@@ -540,3 +541,232 @@ func TestParseAnomalyThreshold_Invalid(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid syntax")
 }
+
+func TestExtractValues_Collections(t *testing.T) {
+	logger := zap.NewNop()
+	rve := NewRequestValueExtractor(logger, false)
+
+	newRequest := func(contentType, body string) *http.Request {
+		req := httptest.NewRequest("POST", "http://example.com/login?username=admin&Lang=en&lang=fr", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		return req
+	}
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		expected    []TargetValue
+		expectedErr bool
+	}{
+		{
+			name:   "ARGS:* iterates query parameters",
+			target: "ARGS:*",
+			expected: []TargetValue{
+				{Name: "ARGS:Lang", Value: "en"},
+				{Name: "ARGS:lang", Value: "fr"},
+				{Name: "ARGS:username", Value: "admin"},
+			},
+		},
+		{
+			name:   "ARGS:name matches case-insensitively",
+			target: "ARGS:LANG",
+			expected: []TargetValue{
+				{Name: "ARGS:Lang", Value: "en"},
+				{Name: "ARGS:lang", Value: "fr"},
+			},
+		},
+		{
+			name:        "ARGS:* includes urlencoded body parameters",
+			target:      "args:*",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "password=secret",
+			expected: []TargetValue{
+				{Name: "ARGS:Lang", Value: "en"},
+				{Name: "ARGS:lang", Value: "fr"},
+				{Name: "ARGS:username", Value: "admin"},
+				{Name: "ARGS:password", Value: "secret"},
+			},
+		},
+		{
+			name:     "&ARGS:* counts the parameters",
+			target:   "&ARGS:*",
+			expected: []TargetValue{{Name: "&ARGS:*", Value: "3"}},
+		},
+		{
+			name:     "&FILES counts an empty collection",
+			target:   "&FILES",
+			expected: []TargetValue{{Name: "&FILES", Value: "0"}},
+		},
+		{
+			name:        "ARGS_NAMES",
+			target:      "ARGS_NAMES",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "username=other",
+			expected: []TargetValue{
+				{Name: "ARGS_NAMES:Lang", Value: "Lang"},
+				{Name: "ARGS_NAMES:lang", Value: "lang"},
+				{Name: "ARGS_NAMES:username", Value: "username"},
+			},
+		},
+		{
+			name:        "ARGS_POST JSON body",
+			target:      "ARGS_POST",
+			contentType: "application/json",
+			body:        `{"user": {"name": "bob", "roles": ["admin", "dev"]}, "active": true}`,
+			expected: []TargetValue{
+				{Name: "ARGS_POST:active", Value: "true"},
+				{Name: "ARGS_POST:user.name", Value: "bob"},
+				{Name: "ARGS_POST:user.roles.0", Value: "admin"},
+				{Name: "ARGS_POST:user.roles.1", Value: "dev"},
+			},
+		},
+		{
+			name:        "ARGS_POST:name multipart body skips files",
+			target:      "ARGS_POST:comment",
+			contentType: "multipart/form-data; boundary=xyz",
+			body: "--xyz\r\nContent-Disposition: form-data; name=\"comment\"\r\n\r\n<script>\r\n" +
+				"--xyz\r\nContent-Disposition: form-data; name=\"comment\"; filename=\"a.txt\"\r\n\r\nfile\r\n--xyz--\r\n",
+			expected: []TargetValue{{Name: "ARGS_POST:comment", Value: "<script>"}},
+		},
+		{
+			name:        "ARGS_POST malformed JSON",
+			target:      "ARGS_POST",
+			contentType: "application/json",
+			body:        `{"user":`,
+			expectedErr: true,
+		},
+		{
+			name:        "ARGS_POST without body",
+			target:      "ARGS_POST",
+			expectedErr: true,
+		},
+		{
+			name:        "REQUEST_HEADERS_NAMES",
+			target:      "REQUEST_HEADERS_NAMES",
+			contentType: "text/plain",
+			expected: []TargetValue{
+				{Name: "REQUEST_HEADERS_NAMES:Content-Type", Value: "Content-Type"},
+				{Name: "REQUEST_HEADERS_NAMES:X-Forwarded-For", Value: "X-Forwarded-For"},
+			},
+		},
+		{
+			name:     "HEADERS:* iterates header values",
+			target:   "HEADERS:*",
+			expected: []TargetValue{{Name: "HEADERS:X-Forwarded-For", Value: "10.0.0.1"}},
+		},
+		{
+			name:     "scalar target is named after itself",
+			target:   "PATH",
+			expected: []TargetValue{{Name: "PATH", Value: "/login"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := rve.ExtractValues(tt.target, newRequest(tt.contentType, tt.body), httptest.NewRecorder())
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, values)
+		})
+	}
+}
+
+func TestExtractValues_BodyRemainsReadable(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("a=1&b=2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	values, err := rve.ExtractValues("ARGS_POST", req, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.Len(t, values, 2)
+
+	// Both a later BODY rule and the upstream handler still see the full body
+	value, err := rve.ExtractValue("BODY", req, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.Equal(t, "a=1&b=2", value)
+}
+
+func TestExtractValue_TargetAliases(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "http://example.com/search?q=1", strings.NewReader("payload"))
+		req.Header.Set("X-Test", "header-value")
+		req.AddCookie(&http.Cookie{Name: "sessionID", Value: "abc123"})
+		return req
+	}
+
+	tests := []struct {
+		target   string
+		expected string
+	}{
+		{"REQUEST_COOKIES", "sessionID=abc123"},
+		{"request_cookies:sessionid", "abc123"},
+		{"REQUEST_COOKIES:sessionID", "abc123"},
+		{"COOKIES:SESSIONID", "abc123"},
+		{"REQUEST_HEADERS:X-Test", "header-value"},
+		{"REQUEST_URI", "/search?q=1"},
+		{"REQUEST_BODY", "payload"},
+		{"REQUEST_METHOD", "POST"},
+		{"REQUEST_FILENAME", "/search"},
+		{"QUERY_STRING", "q=1"},
+		{"URL_PARAM:q", "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			value, err := rve.ExtractValue(tt.target, newRequest(), httptest.NewRecorder())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestExtractValues_CookieCollections(t *testing.T) {
+	rve := NewRequestValueExtractor(zap.NewNop(), false)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: "a", Value: "1"})
+	req.AddCookie(&http.Cookie{Name: "b", Value: "2"})
+
+	names, err := rve.ExtractValues("REQUEST_COOKIES_NAMES", req, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetValue{
+		{Name: "REQUEST_COOKIES_NAMES:a", Value: "a"},
+		{Name: "REQUEST_COOKIES_NAMES:b", Value: "b"},
+	}, names)
+
+	values, err := rve.ExtractValues("REQUEST_COOKIES:*", req, httptest.NewRecorder())
+	assert.NoError(t, err)
+	assert.Equal(t, []TargetValue{
+		{Name: "COOKIES:a", Value: "1"},
+		{Name: "COOKIES:b", Value: "2"},
+	}, values)
+}
+
+func TestValidateTarget(t *testing.T) {
+	valid := []string{
+		"ARGS", "args", "REQUEST_COOKIES", "REQUEST_COOKIES:session", "REQUEST_COOKIES_NAMES", "REQUEST_HEADERS",
+		"REQUEST_HEADERS:User-Agent", "HEADERS:*", "ARGS:*", "ARGS_POST:user.name", "JSON_PATH:data.value",
+		"RESPONSE_HEADERS:Server", "METHOD,PATH", "FILES", "FILES:upload", "FILES_NAMES", "JSON:*",
+		"JSON:user.name", "XML:/order/item/@id", "REQBODY_ERROR", "REQBODY_ERROR_MSG", "&ARGS:*", "&FILES",
+		"&REQUEST_HEADERS:*",
+	}
+	for _, target := range valid {
+		assert.NoError(t, validateTarget(target), "target %q should be valid", target)
+	}
+
+	invalid := []string{"REQUEST_COOKIE", "HEADER", "HEADERS:", "ARGS,", "TX:score", "XML:", "&ARGS", "&URI", "&", "&ARGS_NAMES,URI"}
+	for _, target := range invalid {
+		assert.Error(t, validateTarget(target), "target %q should be invalid", target)
+	}
+}
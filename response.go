@@ -1,17 +1,32 @@
 package caddywaf
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 // blockRequest handles blocking a request and logging the details.
+// In detection_only mode the request is only logged as one that would have been blocked.
 func (m *Middleware) blockRequest(recorder http.ResponseWriter, r *http.Request, state *WAFState, statusCode int, reason, ruleID, matchedValue string, fields ...zap.Field) {
+	if m.detectionOnly() {
+		m.markWouldBlock(state)
+		blockFields := append(m.blockLogFields(r, statusCode, reason, ruleID, matchedValue), fields...)
+		blockFields = append(blockFields, zap.Bool("would_block", true))
+		m.logRequest(zapcore.WarnLevel, "Request would be blocked", r, blockFields...)
+		return
+	}
 
 	state.Blocked = true
 	state.StatusCode = statusCode
@@ -28,15 +43,103 @@ func (m *Middleware) blockRequest(recorder http.ResponseWriter, r *http.Request,
 	}
 
 	// Default blocking behavior
+	blockFields := m.blockLogFields(r, statusCode, reason, ruleID, matchedValue)
+
+	// Debug: Print the blockFields to verify they are correct
+	m.logger.Debug("Block fields being passed to logRequest",
+		zap.Any("blockFields", blockFields),
+	)
+
+	// Append additional fields if any
+	blockFields = append(blockFields, fields...)
+
+	// Log the blocked request at WARN level
+	m.logRequest(zapcore.WarnLevel, "Request blocked", r, blockFields...)
+
+	// Write default response with status code using the recorder
+	recorder.WriteHeader(statusCode)
+}
+
+// enforceRuleAction stops the request with the disruptive action of the matched rule. Requests that
+// only exceed the anomaly threshold are denied with the rule's status (403 by default).
+func (m *Middleware) enforceRuleAction(w http.ResponseWriter, r *http.Request, state *WAFState, rule *Rule, reason, matchedValue string, fields ...zap.Field) {
+	statusCode := rule.statusCode()
+	fields = append(fields, zap.String("action", rule.Action))
+	if m.detectionOnly() {
+		m.blockRequest(w, r, state, statusCode, reason, rule.ID, matchedValue, fields...)
+		return
+	}
+
+	switch rule.Action {
+	case ActionRedirect:
+		m.redirectRequest(w, r, state, statusCode, rule.RedirectURL, reason, rule.ID, matchedValue, fields...)
+	case ActionDrop:
+		m.dropRequest(w, r, state, reason, rule.ID, matchedValue, fields...)
+	case ActionTarpit:
+		delay := rule.tarpitDuration()
+		m.logger.Debug("Tarpitting request", zap.String("rule_id", rule.ID), zap.Duration("delay", delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done(): // The client gave up, there is nothing left to hold
+			timer.Stop()
+		}
+		state.action = ActionTarpit
+		m.blockRequest(w, r, state, statusCode, reason, rule.ID, matchedValue, append(fields, zap.Duration("tarpit_delay", delay))...)
+	default:
+		state.action = rule.Action
+		m.blockRequest(w, r, state, statusCode, reason, rule.ID, matchedValue, fields...)
+	}
+}
+
+// redirectRequest ends the request with a redirect to location.
+func (m *Middleware) redirectRequest(w http.ResponseWriter, r *http.Request, state *WAFState, statusCode int, location, reason, ruleID, matchedValue string, fields ...zap.Field) {
+	state.Blocked = true
+	state.StatusCode = statusCode
+	state.ResponseWritten = true
+	state.action = ActionRedirect
+
+	redirectFields := append(m.blockLogFields(r, statusCode, reason, ruleID, matchedValue), fields...)
+	redirectFields = append(redirectFields, zap.String("redirect_url", location))
+	m.logRequest(zapcore.WarnLevel, "Request redirected", r, redirectFields...)
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(statusCode)
+}
+
+// dropRequest closes the client connection without sending a response. Connections that cannot be
+// hijacked (HTTP/2 and HTTP/3) are denied with 403 instead.
+func (m *Middleware) dropRequest(w http.ResponseWriter, r *http.Request, state *WAFState, reason, ruleID, matchedValue string, fields ...zap.Field) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		m.logger.Debug("Connection cannot be dropped, denying the request instead", zap.String("rule_id", ruleID), zap.Error(err))
+		state.action = ActionDeny
+		m.blockRequest(w, r, state, http.StatusForbidden, reason, ruleID, matchedValue, fields...)
+		return
+	}
+
+	state.Blocked = true
+	state.ResponseWritten = true
+	state.action = ActionDrop
+
+	dropFields := append(m.blockLogFields(r, 0, reason, ruleID, matchedValue), fields...)
+	m.logRequest(zapcore.WarnLevel, "Request dropped", r, dropFields...)
+
+	if err := conn.Close(); err != nil {
+		m.logger.Debug("Failed to close dropped connection", zap.Error(err))
+	}
+}
+
+// blockLogFields returns the standard fields logged for a blocked request.
+func (m *Middleware) blockLogFields(r *http.Request, statusCode int, reason, ruleID, matchedValue string) []zap.Field {
 	logID := uuid.New().String()
 	if logIDCtx, ok := r.Context().Value(ContextKeyLogId("logID")).(string); ok {
 		logID = logIDCtx
 	}
 
-	// Prepare standard fields for logging
-	blockFields := []zap.Field{
+	return []zap.Field{
 		zap.String("log_id", logID),
-		zap.String("source_ip", r.RemoteAddr),
+		zap.String("source_ip", clientIP(r)),
 		zap.String("user_agent", r.UserAgent()),
 		zap.String("request_method", r.Method),
 		zap.String("request_path", r.URL.Path),
@@ -47,50 +150,350 @@ func (m *Middleware) blockRequest(recorder http.ResponseWriter, r *http.Request,
 		zap.String("rule_id", ruleID),             // Include the rule ID
 		zap.String("matched_value", matchedValue), // Include the matched value
 	}
+}
 
-	// Debug: Print the blockFields to verify they are correct
-	m.logger.Debug("Block fields being passed to logRequest",
-		zap.Any("blockFields", blockFields),
-	)
+// detectionOnly reports whether the middleware runs in detection_only mode.
+func (m *Middleware) detectionOnly() bool {
+	return m.Mode == ModeDetectionOnly
+}
 
-	// Append additional fields if any
-	blockFields = append(blockFields, fields...)
+// Response body inspection modes.
+const (
+	ResponseBodyModeBuffer = "buffer" // Hold the body back, up to response_body_limit, until the phase 4 rules have seen it
+	ResponseBodyModeStream = "stream" // Pass the body through, inspecting it in overlapping windows
+)
 
-	// Log the blocked request at WARN level
-	m.logRequest(zapcore.WarnLevel, "Request blocked", r, blockFields...)
+const (
+	defaultResponseBodyLimit = 524288 // 512 KiB
+	maxStreamWindowOverlap   = 4096   // Bytes of one window repeated at the start of the next in stream mode
+)
 
-	// Write default response with status code using the recorder
-	recorder.WriteHeader(statusCode)
+// defaultResponseBodyMIMETypes are the response content types whose body is inspected by default.
+var defaultResponseBodyMIMETypes = []string{"text/plain", "text/html", "text/xml", "application/json", "application/xml"}
+
+// errResponseBlocked is returned to the upstream handler for writes to a blocked response.
+var errResponseBlocked = errors.New("response blocked by WAF")
+
+// inspectsResponse reports whether any rules inspect the response. Without them, responses are not recorded.
+func (m *Middleware) inspectsResponse() bool {
+	return len(m.Rules[3]) > 0 || len(m.Rules[4]) > 0
+}
+
+// responseBodyLimit returns the configured response_body_limit, or the default.
+func (m *Middleware) responseBodyLimit() int64 {
+	if m.ResponseBodyLimit > 0 {
+		return m.ResponseBodyLimit
+	}
+	return defaultResponseBodyLimit
+}
+
+// inspectsResponseBody reports whether a response body of the given Content-Type is inspected by the
+// phase 4 rules. A response without a Content-Type is inspected.
+func (m *Middleware) inspectsResponseBody(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true // Unparsable, so no way to tell it is harmless
+	}
+	mimeTypes := m.ResponseBodyMIMETypes
+	if len(mimeTypes) == 0 {
+		mimeTypes = defaultResponseBodyMIMETypes
+	}
+	for _, mimeType := range mimeTypes {
+		if mimeType == mediaType || mimeType == "*/*" ||
+			(strings.HasSuffix(mimeType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mimeType, "*"))) {
+			return true
+		}
+	}
+	return false
 }
 
-// responseRecorder captures the response status code, headers, and body.
+// responseBodyMode is what happens to the response body once the headers have passed phase 3.
+type responseBodyMode int
+
+const (
+	bodyPending       responseBodyMode = iota // Status and headers are not final yet
+	bodyBuffered                              // Held back until phase 4 has run
+	bodyStreamed                              // Inspected in windows and passed through
+	bodyPassedThrough                         // Passed through without inspection
+	bodyBlocked                               // Discarded, the response was blocked
+)
+
+// responseRecorder sits between the upstream handler and the client. It holds the status and headers
+// back until the phase 3 rules have seen them, and then buffers the body for the phase 4 rules, inspects
+// it in a sliding window while passing it through, or passes it through untouched. A recorder created
+// with NewResponseRecorder only captures the response.
+//
+// Pushes, flushes, io.ReaderFrom and hijacking pass through to the underlying writer once the rules allow
+// it; until then pushes are refused. An upgraded connection (a 101 Switching Protocols response, a CONNECT request or a hijack) has only
+// its handshake inspected by the phase 3 rules; what follows is passed through untouched.
 type responseRecorder struct {
-	http.ResponseWriter
+	*caddyhttp.ResponseWriterWrapper
 	body       *bytes.Buffer
+	header     http.Header // Upstream headers, sent to the client once phase 3 has passed
 	statusCode int
-	written    bool // To track if a write to the original writer has been done.
+
+	m          *Middleware
+	r          *http.Request
+	state      *WAFState
+	mode       responseBodyMode
+	inspecting bool            // Rules are running, so writes come from the WAF blocking the response
+	replaced   bool            // The WAF's block response replaced the upstream response
+	sent       bool            // Status and headers were sent to the client
+	abort      bool            // Blocked after part of the body was sent; the connection must be aborted
+	tail       []byte          // Stream mode: end of the previous window
+	decoded    []byte          // The body decoded according to its Content-Encoding, if compressed
+	matched    map[string]bool // Stream mode: phase 4 rules that matched an earlier window
 }
 
 // NewResponseRecorder creates a new responseRecorder.
 func NewResponseRecorder(w http.ResponseWriter) *responseRecorder {
 	return &responseRecorder{
-		ResponseWriter: w,
-		body:           new(bytes.Buffer),
-		statusCode:     0, // Zero means not explicitly set
-		written:        false,
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		body:                  new(bytes.Buffer),
+		header:                make(http.Header),
+		statusCode:            0, // Zero means not explicitly set
 	}
 }
 
-// WriteHeader captures the response status code.
+// newResponseRecorder returns a recorder that runs the phase 3 and 4 rules on the response to r.
+func (m *Middleware) newResponseRecorder(w http.ResponseWriter, r *http.Request, state *WAFState) *responseRecorder {
+	recorder := NewResponseRecorder(w)
+	recorder.m = m
+	recorder.r = r
+	recorder.state = state
+	if m.ResponseBodyMode == ResponseBodyModeStream {
+		recorder.matched = make(map[string]bool)
+	}
+	return recorder
+}
+
+// WriteHeader captures the response status code. The final status of the upstream response runs the phase 3 rules.
 func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.m == nil || r.capturingBlockResponse() {
+		r.statusCode = statusCode
+		return
+	}
+	if r.mode != bodyPending {
+		return // Superfluous, the status is already final
+	}
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		// Informational responses (e.g. 103 Early Hints) are not final, pass them on with their headers
+		header := r.ResponseWriter.Header()
+		copyHeader(header, r.header)
+		r.ResponseWriter.WriteHeader(statusCode)
+		for key := range r.header {
+			header.Del(key)
+		}
+		return
+	}
 	r.statusCode = statusCode
-	r.ResponseWriter.WriteHeader(statusCode)
+	r.inspectHeaders()
+}
+
+// capturingBlockResponse reports whether the WAF itself is writing, i.e. blocking the response while
+// its rules run. The first such write discards what the upstream handler prepared.
+func (r *responseRecorder) capturingBlockResponse() bool {
+	if !r.inspecting || !r.state.ResponseWritten {
+		return false
+	}
+	if !r.replaced {
+		r.header = make(http.Header)
+		r.body.Reset()
+		r.statusCode = 0
+		r.replaced = true
+	}
+	return true
+}
+
+// inspectHeaders runs the phase 3 rules on the final upstream status and headers, and decides
+// what happens to the body.
+func (r *responseRecorder) inspectHeaders() {
+	r.runRules(func() { r.m.handlePhase(r, r.r, 3, r.state) })
+	switch {
+	case r.state.Blocked:
+		r.mode = bodyBlocked
+		r.sendBlockResponse()
+	case len(r.m.Rules[4]) == 0 || r.state.Allowed || r.upgraded() || !r.m.inspectsResponseBody(r.header.Get("Content-Type")):
+		r.mode = bodyPassedThrough
+		r.sendHeaders()
+	case r.m.ResponseBodyMode == ResponseBodyModeStream && len(contentCodings(r.header)) == 0:
+		// A compressed body cannot be decoded window by window, it is buffered instead
+		r.mode = bodyStreamed
+		r.sendHeaders()
+	default:
+		r.mode = bodyBuffered
+	}
+}
+
+// inspectBody runs the phase 4 rules on the buffered body or the current window, and reports
+// whether the response may continue.
+func (r *responseRecorder) inspectBody() bool {
+	r.decodeBody()
+	r.runRules(func() { r.m.handleResponseBodyPhase(r, r.r, r.state) })
+	if !r.state.Blocked {
+		return true
+	}
+	r.mode = bodyBlocked
+	if r.sent {
+		r.abort = r.state.action != ActionDrop
+	} else {
+		r.sendBlockResponse()
+	}
+	return false
+}
+
+// decodeBody decodes a compressed body for the phase 4 rules, within the decompression limits. A body
+// that cannot be fully decoded, e.g. because only its first response_body_limit bytes were buffered,
+// is inspected as far as it could be decoded.
+func (r *responseRecorder) decodeBody() {
+	codings := contentCodings(r.header)
+	if len(codings) == 0 {
+		return
+	}
+	decoded, exceeded, err := decompressBody(codings, bytes.NewReader(r.body.Bytes()), int64(r.body.Len()), r.m.decompressionLimits())
+	r.decoded = decoded
+	if exceeded != "" || err != nil {
+		r.m.logger.Debug("Response body could only be partially decompressed",
+			zap.Strings("content_encoding", codings),
+			zap.String("limit", exceeded),
+			zap.Error(err),
+			zap.String("log_id", getLogID(r.r.Context())),
+		)
+	}
+}
+
+func (r *responseRecorder) runRules(rules func()) {
+	r.inspecting = true
+	defer func() { r.inspecting = false }()
+	rules()
+}
+
+// finish completes the response once the upstream handler has returned: an empty response still
+// goes through phase 3, and a buffered body goes through phase 4 before it is sent.
+func (r *responseRecorder) finish() {
+	if r.mode == bodyPending {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.mode == bodyBuffered && r.inspectBody() {
+		r.mode = bodyPassedThrough
+		if err := r.sendBody(); err != nil {
+			r.m.logger.Error("Failed to write response body to client", zap.Error(err), zap.String("log_id", getLogID(r.r.Context())))
+		}
+	}
+}
+
+// sendHeaders sends the upstream status and headers to the client.
+func (r *responseRecorder) sendHeaders() {
+	copyHeader(r.ResponseWriter.Header(), r.header)
+	r.ResponseWriter.WriteHeader(r.StatusCode())
+	r.sent = true
+}
+
+// sendBody sends the upstream status, headers and buffered body to the client.
+func (r *responseRecorder) sendBody() error {
+	r.sendHeaders()
+	_, err := r.ResponseWriter.Write(r.body.Bytes())
+	return err
+}
+
+// sendBlockResponse sends the response the WAF wrote while blocking. A dropped connection gets nothing.
+func (r *responseRecorder) sendBlockResponse() {
+	if r.sent || r.state.action == ActionDrop {
+		return
+	}
+	if !r.replaced {
+		r.header = make(http.Header)
+		r.body.Reset()
+		r.statusCode = r.state.StatusCode
+	}
+	if err := r.sendBody(); err != nil {
+		r.m.logger.Error("Failed to write block response to client", zap.Error(err), zap.String("log_id", getLogID(r.r.Context())))
+	}
+}
+
+// upgraded reports whether the response switches the connection to another protocol, e.g. a WebSocket.
+// The data exchanged after the handshake is not an HTTP response body.
+func (r *responseRecorder) upgraded() bool {
+	return r.statusCode == http.StatusSwitchingProtocols || r.r.Method == http.MethodConnect
+}
+
+// Flush sends what the upstream handler wrote so far. See FlushError.
+func (r *responseRecorder) Flush() {
+	_ = r.FlushError()
+}
+
+// FlushError sends what the upstream handler wrote so far, finalizing the status and headers first.
+// A buffered body is held back until the phase 4 rules have seen it, so flushing it is a no-op.
+func (r *responseRecorder) FlushError() error {
+	if r.m == nil || r.capturingBlockResponse() {
+		return nil
+	}
+	if r.mode == bodyPending {
+		r.WriteHeader(http.StatusOK)
+	}
+	switch r.mode {
+	case bodyBlocked:
+		return errResponseBlocked
+	case bodyBuffered:
+		return nil
+	}
+	return http.NewResponseController(r.ResponseWriter).Flush()
+}
 
+// Push initiates an HTTP/2 server push once the response is passed through to the client. While the
+// status and headers are pending, the body is buffered or the response is blocked, a push could
+// announce a response the rules have not allowed, so it is refused with http.ErrNotSupported.
+func (r *responseRecorder) Push(target string, opts *http.PushOptions) error {
+	if r.m != nil && (r.inspecting || r.mode == bodyPending || r.mode == bodyBuffered || r.mode == bodyBlocked) {
+		return http.ErrNotSupported
+	}
+	return r.ResponseWriterWrapper.Push(target, opts)
+}
+
+// Hijack hands the connection over to the upstream handler. A buffered body is inspected and sent
+// first; from then on nothing the handler sends is inspected. While the rules run, it is the WAF
+// dropping the connection.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.m != nil && !r.inspecting {
+		if r.mode == bodyBuffered && r.inspectBody() {
+			if err := r.sendBody(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if r.mode == bodyBlocked {
+			return nil, nil, errResponseBlocked
+		}
+		// The connection leaves HTTP, there is no response left to write
+		r.mode = bodyPassedThrough
+		r.sent = true
+	}
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// ReadFrom copies src into the response like Write does, using the underlying io.ReaderFrom
+// once the body is passed through.
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.m == nil || r.capturingBlockResponse() {
+		return r.body.ReadFrom(src)
+	}
+	if r.mode == bodyPending {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.mode == bodyPassedThrough {
+		return r.ResponseWriterWrapper.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{r}, src) // Hide ReadFrom so io.Copy goes through Write
 }
 
 // Header returns the response headers.
 func (r *responseRecorder) Header() http.Header {
-	return r.ResponseWriter.Header()
+	if r.m != nil {
+		r.capturingBlockResponse()
+	}
+	return r.header
 }
 
 // BodyString returns the captured response body as a string.
@@ -98,6 +501,14 @@ func (r *responseRecorder) BodyString() string {
 	return r.body.String()
 }
 
+// inspectedBody returns the response body as the phase 4 rules see it: decoded, if it is compressed.
+func (r *responseRecorder) inspectedBody() string {
+	if r.decoded != nil {
+		return string(r.decoded)
+	}
+	return r.body.String()
+}
+
 // StatusCode returns the captured status code.
 func (r *responseRecorder) StatusCode() int {
 	if r.statusCode == 0 {
@@ -106,12 +517,77 @@ func (r *responseRecorder) StatusCode() int {
 	return r.statusCode
 }
 
-// Write captures the response body and writes to the buffer only.
+// Write captures, inspects or passes through the response body, depending on the mode chosen when
+// the headers were inspected. Writes to a blocked response fail with errResponseBlocked.
 func (r *responseRecorder) Write(b []byte) (int, error) {
-	if r.statusCode == 0 && !r.written {
-		r.WriteHeader(http.StatusOK) // Default to 200 if not set
+	if r.m == nil || r.capturingBlockResponse() {
+		return r.body.Write(b)
+	}
+	if r.mode == bodyPending {
+		r.WriteHeader(http.StatusOK)
+	}
+	switch r.mode {
+	case bodyBlocked:
+		return 0, errResponseBlocked
+	case bodyPassedThrough:
+		return r.ResponseWriter.Write(b)
+	case bodyStreamed:
+		return r.writeStream(b)
+	}
+
+	limit := r.m.responseBodyLimit()
+	if int64(r.body.Len()+len(b)) <= limit {
+		return r.body.Write(b)
+	}
+	// Over the limit: inspect what fits, then pass the rest through uninspected
+	fits := int(limit) - r.body.Len()
+	r.body.Write(b[:fits])
+	r.m.logger.Debug("Response body exceeds response_body_limit, only the first part is inspected",
+		zap.Int64("response_body_limit", limit),
+		zap.String("log_id", getLogID(r.r.Context())),
+	)
+	if !r.inspectBody() {
+		return 0, errResponseBlocked
+	}
+	r.mode = bodyPassedThrough
+	if err := r.sendBody(); err != nil {
+		return 0, err
+	}
+	n, err := r.ResponseWriter.Write(b[fits:])
+	return fits + n, err
+}
+
+// writeStream inspects b in windows of at most response_body_limit bytes and passes each window on
+// once the rules have seen it. Every window starts with the end of the previous one, so a match
+// spanning two writes is still found.
+func (r *responseRecorder) writeStream(b []byte) (int, error) {
+	limit := int(r.m.responseBodyLimit())
+	overlap := min(maxStreamWindowOverlap, limit/2)
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(len(b), written+limit-len(r.tail))]
+		r.body.Reset()
+		r.body.Write(r.tail)
+		r.body.Write(chunk)
+		if !r.inspectBody() {
+			return written, errResponseBlocked
+		}
+		n, err := r.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		window := r.body.Bytes()
+		r.tail = append(r.tail[:0], window[max(0, len(window)-overlap):]...)
+	}
+	return written, nil
+}
+
+// copyHeader adds every header of src to dst.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
 	}
-	n, err := r.body.Write(b)
-	r.written = true
-	return n, err
 }
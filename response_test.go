@@ -1,12 +1,18 @@
 package caddywaf
 
 import (
+	"bufio"
 	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -81,4 +87,317 @@ func TestBlockRequest(t *testing.T) {
 		assert.True(t, state.ResponseWritten)                        // Check that the ResponseWritten flag is set
 		assert.True(t, state.Blocked)                                // Verify block is set to true
 	})
+
+	t.Run("only logs in detection_only mode", func(t *testing.T) {
+		m := &Middleware{
+			logger: logger,
+			Mode:   ModeDetectionOnly,
+			CustomResponses: map[int]CustomBlockResponse{
+				http.StatusForbidden: {StatusCode: http.StatusForbidden, Body: "Blocked"},
+			},
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/test", nil)
+		state := &WAFState{}
+
+		m.blockRequest(w, r, state, http.StatusForbidden, "test reason", "rule1", "match1")
+		m.blockRequest(w, r, state, http.StatusForbidden, "test reason", "rule2", "match2")
+
+		assert.False(t, state.Blocked)
+		assert.False(t, state.ResponseWritten)
+		assert.True(t, state.WouldBlock)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, int64(1), m.wouldBlockRequests) // Counted once per request
+	})
+}
+
+func TestServeHTTP_ResponseInspection(t *testing.T) {
+	logger := zap.NewNop()
+	secret, err := compileOperator("contains", "SECRET", "")
+	assert.NoError(t, err)
+	leak, err := compileOperator("contains", "internal", "")
+	assert.NoError(t, err)
+
+	newMiddleware := func(rules map[int][]Rule) *Middleware {
+		return &Middleware{
+			logger:                logger,
+			AnomalyThreshold:      5,
+			Rules:                 rules,
+			ruleCache:             NewRuleCache(),
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+		}
+	}
+	headerRules := map[int][]Rule{3: {
+		{ID: "leak", Phase: 3, Targets: []string{"RESPONSE_HEADERS:X-Backend"}, Score: 5, Action: ActionBlock, matcher: leak},
+	}}
+	bodyRules := map[int][]Rule{4: {
+		{ID: "secret", Phase: 4, Targets: []string{"RESPONSE_BODY"}, Score: 5, Action: ActionBlock, matcher: secret},
+	}}
+	upstream := func(contentType string, chunks ...string) caddyhttp.Handler {
+		return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Backend", "internal-1")
+			w.WriteHeader(http.StatusOK)
+			for _, chunk := range chunks {
+				if _, err := w.Write([]byte(chunk)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	t.Run("no response rules skips the recorder", func(t *testing.T) {
+		m := newMiddleware(map[int][]Rule{})
+		var writer http.ResponseWriter
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			writer = w
+			return nil
+		})
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), next))
+		assert.Same(t, w, writer)
+	})
+
+	t.Run("phase 3 block drops the upstream response", func(t *testing.T) {
+		m := newMiddleware(headerRules)
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("text/plain", "hello")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Header().Get("X-Backend"))
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, int64(1), m.blockedRequests)
+	})
+
+	t.Run("buffered body is blocked before it is sent", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("text/html", "the ", "SECRET")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("buffered body passes", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("text/html", "hello ", "world")))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "internal-1", w.Header().Get("X-Backend"))
+		assert.Equal(t, "hello world", w.Body.String())
+	})
+
+	t.Run("content type outside the allowlist is not inspected", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("image/png", "SECRET")))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "SECRET", w.Body.String())
+
+		m.ResponseBodyMIMETypes = []string{"image/*"}
+		w = httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("image/png", "SECRET")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("body beyond the limit passes uninspected", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		m.ResponseBodyLimit = 8
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("text/plain", "0123456789", "SECRET")))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "0123456789SECRET", w.Body.String())
+	})
+
+	t.Run("stream passes the body through", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		m.ResponseBodyMode = ResponseBodyModeStream
+		m.ResponseBodyLimit = 16
+		body := strings.Repeat("abcdefghij", 10)
+		w := httptest.NewRecorder()
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("text/plain", body[:45], body[45:])))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, body, w.Body.String())
+	})
+
+	t.Run("stream aborts on a match spanning two writes", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		m.ResponseBodyMode = ResponseBodyModeStream
+		m.ResponseBodyLimit = 16
+		w := httptest.NewRecorder()
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			_ = m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), upstream("text/plain", "safe part SEC", "RET rest"))
+		})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "safe part SEC", w.Body.String())
+		assert.Equal(t, int64(1), m.blockedRequests)
+	})
+}
+
+func TestInspectsResponseBody(t *testing.T) {
+	m := &Middleware{}
+	assert.True(t, m.inspectsResponseBody(""))
+	assert.True(t, m.inspectsResponseBody("text/html; charset=utf-8"))
+	assert.True(t, m.inspectsResponseBody("Application/JSON"))
+	assert.False(t, m.inspectsResponseBody("image/png"))
+
+	m.ResponseBodyMIMETypes = []string{"text/*"}
+	assert.True(t, m.inspectsResponseBody("text/csv"))
+	assert.False(t, m.inspectsResponseBody("application/json"))
+}
+
+func TestResponseRecorder_Passthrough(t *testing.T) {
+	logger := zap.NewNop()
+	secret, err := compileOperator("contains", "SECRET", "")
+	assert.NoError(t, err)
+	newMiddleware := func(rules map[int][]Rule) *Middleware {
+		return &Middleware{
+			logger:                logger,
+			AnomalyThreshold:      5,
+			Rules:                 rules,
+			ruleCache:             NewRuleCache(),
+			ipBlacklist:           NewCIDRTrie(),
+			dnsBlacklist:          map[string]struct{}{},
+			requestValueExtractor: NewRequestValueExtractor(logger, false),
+		}
+	}
+	bodyRules := map[int][]Rule{4: {
+		{ID: "secret", Phase: 4, Targets: []string{"RESPONSE_BODY"}, Score: 5, Action: ActionBlock, matcher: secret},
+	}}
+
+	t.Run("flush", func(t *testing.T) {
+		flushed := func(contentType string) bool {
+			m := newMiddleware(bodyRules)
+			w := httptest.NewRecorder()
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", contentType)
+				_, err := w.Write([]byte("data: 1\n\n"))
+				assert.NoError(t, err)
+				return http.NewResponseController(w).Flush()
+			})
+			assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), next))
+			assert.Equal(t, "data: 1\n\n", w.Body.String())
+			return w.Flushed
+		}
+		assert.True(t, flushed("text/event-stream"), "a body that is not inspected is flushed")
+		assert.False(t, flushed("text/plain"), "a buffered body is held back")
+	})
+
+	t.Run("ReadFrom is inspected", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		w := httptest.NewRecorder()
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			_, err := io.Copy(w, strings.NewReader("the SECRET"))
+			return err
+		})
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), next))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("upgraded connection is passed through", func(t *testing.T) {
+		m := newMiddleware(bodyRules)
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Upgrade", "echo")
+			w.Header().Set("Connection", "Upgrade")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			_, err = conn.Write([]byte("echo: " + line))
+			return err
+		})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.NoError(t, m.ServeHTTP(w, r, next))
+		}))
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nSECRET\n"))
+		assert.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "echo: SECRET\n", line)
+	})
+
+	t.Run("blocked handshake cannot be hijacked", func(t *testing.T) {
+		upgrade, err := compileOperator("streq", "echo", "")
+		assert.NoError(t, err)
+		m := newMiddleware(map[int][]Rule{3: {
+			{ID: "upgrade", Phase: 3, Targets: []string{"RESPONSE_HEADERS:Upgrade"}, Score: 5, Action: ActionBlock, matcher: upgrade},
+		}})
+		w := httptest.NewRecorder()
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Upgrade", "echo")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			_, _, err := http.NewResponseController(w).Hijack()
+			assert.ErrorIs(t, err, errResponseBlocked)
+			return nil
+		})
+		assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), next))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("push is gated until the response is passed through", func(t *testing.T) {
+		pushed := func(contentType string) (before, after error, targets []string) {
+			m := newMiddleware(bodyRules)
+			w := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+				pusher := rw.(http.Pusher)
+				before = pusher.Push("/early.css", nil)
+				rw.Header().Set("Content-Type", contentType)
+				rw.WriteHeader(http.StatusOK)
+				after = pusher.Push("/late.css", nil)
+				_, err := rw.Write([]byte("ok"))
+				return err
+			})
+			assert.NoError(t, m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil), next))
+			return before, after, w.pushed
+		}
+
+		before, after, targets := pushed("text/plain")
+		assert.ErrorIs(t, before, http.ErrNotSupported, "pending headers")
+		assert.ErrorIs(t, after, http.ErrNotSupported, "buffered body")
+		assert.Empty(t, targets)
+
+		before, after, targets = pushed("text/event-stream")
+		assert.ErrorIs(t, before, http.ErrNotSupported, "pending headers")
+		assert.NoError(t, after, "passed through body")
+		assert.Equal(t, []string{"/late.css"}, targets)
+	})
+
+	t.Run("push passes through", func(t *testing.T) {
+		recorder := NewResponseRecorder(httptest.NewRecorder())
+		assert.ErrorIs(t, recorder.Push("/style.css", nil), caddyhttp.ErrNotImplemented)
+		var _ http.Pusher = recorder
+		var _ http.Hijacker = recorder
+		var _ http.Flusher = recorder
+		var _ io.ReaderFrom = recorder
+	})
+}
+
+// pushRecorder is an httptest.ResponseRecorder that supports HTTP/2 server push.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (p *pushRecorder) Push(target string, _ *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	return nil
 }
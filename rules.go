@@ -2,55 +2,99 @@
 package caddywaf
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
 )
 
-func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, rule *Rule, value string, state *WAFState) bool {
+// maxVariableMetricKeys bounds the rule_hits_by_variable metric, since parameter and header names are client controlled.
+const maxVariableMetricKeys = 1000
+
+// processRuleMatch records a rule match on the variable named target (e.g. ARGS:username) and blocks the request if needed.
+func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, rule *Rule, target, value string, state *WAFState) bool {
 	logID := r.Context().Value(ContextKeyLogId("logID")).(string)
 
 	m.logRequest(zapcore.DebugLevel, "Rule Matched", r, // More concise log message
 		zap.String("rule_id", string(rule.ID)),
 		zap.String("target", strings.Join(rule.Targets, ",")),
+		zap.String("matched_variable", target),
 		zap.String("value", value),
 		zap.String("description", rule.Description),
 		zap.Int("score", rule.Score),
-		zap.Int("anomaly_threshold_config", m.AnomalyThreshold), // ADDED: Log configured anomaly threshold
-		zap.Int("current_anomaly_score", state.TotalScore),      // ADDED: Log current anomaly score before increment
+		zap.Int("anomaly_threshold_config", m.anomalyThreshold(rule.Phase)), // ADDED: Log configured anomaly threshold
+		zap.Int("current_anomaly_score", state.TotalScore),                  // ADDED: Log current anomaly score before increment
 	)
 
 	// Rule Hit Counter - Refactored for clarity
 	m.incrementRuleHitCount(RuleID(rule.ID))
 
+	// Shadow rules are scored and logged on their own and never change how the request is handled
+	if rule.Shadow {
+		m.processShadowMatch(r, rule, target, value, state)
+		return true
+	}
+
+	// Rules removed by a match (ctl:ruleRemoveById) are skipped for the rest of the request
+	if len(rule.RemoveRules) > 0 {
+		for _, spec := range rule.RemoveRules {
+			if !slices.Contains(state.removedRules, spec) {
+				state.removedRules = append(state.removedRules, spec)
+			}
+		}
+		m.logRequest(zapcore.DebugLevel, "Rules removed for request", r,
+			zap.String("rule_id", string(rule.ID)),
+			zap.Strings("removed_rules", rule.RemoveRules),
+		)
+	}
+
 	// Metrics for Rule Hits by Phase - Refactored for clarity
 	m.incrementRuleHitsByPhaseMetric(rule.Phase)
+	m.incrementRuleHitsByVariableMetric(target)
 
-	oldScore := state.TotalScore
-	state.TotalScore += rule.Score
+	oldScore := m.addRuleScore(rule, state)
+	directionScore, threshold := state.directionScore(rule.Phase), m.anomalyThreshold(rule.Phase)
 	m.logRequest(zapcore.DebugLevel, "Anomaly score increased", r, // Corrected argument order - 'r' is now the third argument
 		zap.String("log_id", logID),
 		zap.String("rule_id", string(rule.ID)),
 		zap.Int("score_increase", rule.Score),
 		zap.Int("old_score", oldScore),
-		zap.Int("new_score", state.TotalScore),
-		zap.Int("anomaly_threshold", m.AnomalyThreshold),
+		zap.Int("new_score", directionScore),
+		zap.Int("anomaly_threshold", threshold),
 	)
 
-	shouldBlock := !state.ResponseWritten && (state.TotalScore >= m.AnomalyThreshold || rule.Action == "block")
+	// An allow rule lets the request through and skips the remaining rules of every phase
+	if rule.Action == ActionAllow {
+		state.Allowed = true
+		m.logRequest(zapcore.InfoLevel, "Rule action: Allow", r,
+			zap.String("log_id", logID),
+			zap.String("rule_id", string(rule.ID)),
+			zap.String("matched_variable", target),
+			zap.Int("total_score", state.TotalScore),
+		)
+		return false
+	}
+
+	// In detection_only mode the threshold is only reported once, when it is first crossed
+	shouldBlock := !state.ResponseWritten && ((directionScore >= threshold && !state.WouldBlock) || isDisruptiveAction(rule.Action))
 	blockReason := ""
 
 	if shouldBlock {
 		blockReason = "Anomaly threshold exceeded"
-		if rule.Action == "block" {
-			blockReason = "Rule action is 'block'"
+		if isDisruptiveAction(rule.Action) {
+			blockReason = fmt.Sprintf("Rule action is '%s'", rule.Action)
 		}
 	}
 
@@ -58,25 +102,32 @@ func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, ru
 		zap.String("action", rule.Action),
 		zap.Bool("should_block", shouldBlock),
 		zap.String("block_reason", blockReason),
-		zap.Int("total_score", state.TotalScore),         // ADDED: Log total score in block decision log
-		zap.Int("anomaly_threshold", m.AnomalyThreshold), // ADDED: Log anomaly threshold in block decision log
+		zap.Int("total_score", state.TotalScore), // ADDED: Log total score in block decision log
+		zap.Int("direction_score", directionScore),
+		zap.Int("anomaly_threshold", threshold), // ADDED: Log anomaly threshold in block decision log
 	)
 
 	if shouldBlock {
-		m.blockRequest(w, r, state, http.StatusForbidden, blockReason, string(rule.ID), value,
+		m.enforceRuleAction(w, r, state, rule, blockReason, value,
+			zap.String("matched_variable", target),
 			zap.Int("total_score", state.TotalScore),
-			zap.Int("anomaly_threshold", m.AnomalyThreshold),
+			zap.Int("inbound_score", state.InboundScore),
+			zap.Int("outbound_score", state.OutboundScore),
+			zap.Any("phase_scores", state.PhaseScores),
+			zap.Any("category_scores", state.CategoryScores),
+			zap.Int("anomaly_threshold", threshold),
 			zap.String("final_block_reason", blockReason), // ADDED: Clarify block reason in blockRequest log
 		)
-		return false
+		return !state.Blocked // Evaluation goes on in detection_only mode
 	}
 
 	if rule.Action == "log" {
 		m.logRequest(zapcore.InfoLevel, "Rule action: Log", r,
 			zap.String("log_id", logID),
 			zap.String("rule_id", string(rule.ID)),
-			zap.Int("total_score", state.TotalScore),         // ADDED: Log total score for log action
-			zap.Int("anomaly_threshold", m.AnomalyThreshold), // ADDED: Log anomaly threshold for log action
+			zap.String("matched_variable", target),
+			zap.Int("total_score", state.TotalScore),                     // ADDED: Log total score for log action
+			zap.Int("anomaly_threshold", m.anomalyThreshold(rule.Phase)), // ADDED: Log anomaly threshold for log action
 		)
 	} else if !shouldBlock && !state.ResponseWritten {
 		m.logRequest(zapcore.DebugLevel, "Rule action: No Block", r,
@@ -84,7 +135,7 @@ func (m *Middleware) processRuleMatch(w http.ResponseWriter, r *http.Request, ru
 			zap.String("rule_id", string(rule.ID)),
 			zap.String("action", rule.Action),
 			zap.Int("total_score", state.TotalScore),
-			zap.Int("anomaly_threshold", m.AnomalyThreshold),
+			zap.Int("anomaly_threshold", m.anomalyThreshold(rule.Phase)),
 		)
 	}
 
@@ -104,6 +155,139 @@ func (m *Middleware) incrementRuleHitCount(ruleID RuleID) {
 	)
 }
 
+// processShadowMatch scores a shadow rule match separately from the anomaly score and logs whether the
+// rule would have blocked the request.
+func (m *Middleware) processShadowMatch(r *http.Request, rule *Rule, target, value string, state *WAFState) {
+	state.ShadowScore += rule.Score
+	wouldBlock := rule.Action == "block" || state.directionScore(rule.Phase)+state.ShadowScore >= m.anomalyThreshold(rule.Phase)
+
+	m.incrementRuleHitsByPhaseMetric(rule.Phase)
+	m.incrementRuleHitsByVariableMetric(target)
+	m.incrementShadowRuleHitsMetric(rule.ID)
+	if wouldBlock {
+		m.markWouldBlock(state)
+	}
+
+	m.logRequest(zapcore.InfoLevel, "Shadow rule matched", r,
+		zap.String("log_id", getLogID(r.Context())),
+		zap.String("rule_id", rule.ID),
+		zap.String("matched_variable", target),
+		zap.String("matched_value", value),
+		zap.String("action", rule.Action),
+		zap.Int("score", rule.Score),
+		zap.Int("shadow_score", state.ShadowScore),
+		zap.Int("total_score", state.TotalScore),
+		zap.Int("anomaly_threshold", m.anomalyThreshold(rule.Phase)),
+		zap.Bool("would_block", wouldBlock),
+	)
+}
+
+// isOutboundPhase reports whether the phase inspects the response (phases 3 and 4).
+func isOutboundPhase(phase int) bool {
+	return phase >= 3
+}
+
+// anomalyThreshold returns the anomaly threshold for the direction of the phase. The inbound and
+// outbound thresholds fall back to anomaly_threshold when they are not set.
+func (m *Middleware) anomalyThreshold(phase int) int {
+	if isOutboundPhase(phase) {
+		if m.OutboundAnomalyThreshold > 0 {
+			return m.OutboundAnomalyThreshold
+		}
+	} else if m.InboundAnomalyThreshold > 0 {
+		return m.InboundAnomalyThreshold
+	}
+	return m.AnomalyThreshold
+}
+
+// directionScore returns the inbound or outbound score, depending on the phase.
+func (state *WAFState) directionScore(phase int) int {
+	if isOutboundPhase(phase) {
+		return state.OutboundScore
+	}
+	return state.InboundScore
+}
+
+// addRuleScore adds the rule's score to the request's total, direction, phase and category scores,
+// and to the score metrics. It returns the direction score before the increase.
+func (m *Middleware) addRuleScore(rule *Rule, state *WAFState) int {
+	oldScore := state.directionScore(rule.Phase)
+	state.TotalScore += rule.Score
+	if isOutboundPhase(rule.Phase) {
+		state.OutboundScore += rule.Score
+	} else {
+		state.InboundScore += rule.Score
+	}
+	if rule.Score == 0 {
+		return oldScore
+	}
+
+	if state.PhaseScores == nil {
+		state.PhaseScores = make(map[int]int)
+	}
+	state.PhaseScores[rule.Phase] += rule.Score
+	if state.CategoryScores == nil {
+		state.CategoryScores = make(map[string]int)
+	}
+	categories := ruleCategories(rule)
+	for _, category := range categories {
+		state.CategoryScores[category] += rule.Score
+	}
+
+	m.muMetrics.Lock()
+	if m.scoreByPhase == nil {
+		m.scoreByPhase = make(map[int]int64)
+	}
+	m.scoreByPhase[rule.Phase] += int64(rule.Score)
+	if m.scoreByCategory == nil {
+		m.scoreByCategory = make(map[string]int64)
+	}
+	for _, category := range categories {
+		m.scoreByCategory[category] += int64(rule.Score)
+	}
+	m.muMetrics.Unlock()
+	return oldScore
+}
+
+// ruleCategories returns the categories a rule's score is reported under: the names of its attack-*
+// tags (attack-sqli counts as sqli), otherwise its tags as they are, otherwise "other".
+func ruleCategories(rule *Rule) []string {
+	var categories []string
+	for _, tag := range rule.Tags {
+		if category, ok := cutPrefixFold(tag, "attack-"); ok && category != "" {
+			categories = append(categories, strings.ToLower(category))
+		}
+	}
+	if len(categories) > 0 {
+		return categories
+	}
+	if len(rule.Tags) > 0 {
+		return rule.Tags
+	}
+	return []string{"other"}
+}
+
+// markWouldBlock flags a request that would have been blocked, counting it once.
+func (m *Middleware) markWouldBlock(state *WAFState) {
+	if state.WouldBlock {
+		return
+	}
+	state.WouldBlock = true
+	m.muMetrics.Lock()
+	m.wouldBlockRequests++
+	m.muMetrics.Unlock()
+}
+
+// incrementShadowRuleHitsMetric counts the matches of each shadow rule.
+func (m *Middleware) incrementShadowRuleHitsMetric(ruleID string) {
+	m.muMetrics.Lock()
+	if m.shadowRuleHits == nil {
+		m.shadowRuleHits = make(map[string]int64)
+	}
+	m.shadowRuleHits[ruleID]++
+	m.muMetrics.Unlock()
+}
+
 // incrementRuleHitsByPhaseMetric increments the rule hits by phase metric.
 func (m *Middleware) incrementRuleHitsByPhaseMetric(phase int) {
 	m.muMetrics.Lock()
@@ -114,6 +298,35 @@ func (m *Middleware) incrementRuleHitsByPhaseMetric(phase int) {
 	m.muMetrics.Unlock()
 }
 
+// incrementRuleHitsByVariableMetric increments the rule hits by matched variable metric.
+// Once maxVariableMetricKeys distinct variables are tracked, new ones are counted under "other".
+func (m *Middleware) incrementRuleHitsByVariableMetric(variable string) {
+	m.muMetrics.Lock()
+	if m.ruleHitsByVariable == nil {
+		m.ruleHitsByVariable = make(map[string]int64)
+	}
+	if _, ok := m.ruleHitsByVariable[variable]; !ok && len(m.ruleHitsByVariable) >= maxVariableMetricKeys {
+		variable = "other"
+	}
+	m.ruleHitsByVariable[variable]++
+	m.muMetrics.Unlock()
+}
+
+// validSeverities lists the accepted rule severities (case-insensitive); an empty severity is allowed.
+var validSeverities = []string{"INFO", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+func isValidSeverity(severity string) bool {
+	if severity == "" {
+		return true
+	}
+	for _, valid := range validSeverities {
+		if strings.EqualFold(severity, valid) {
+			return true
+		}
+	}
+	return false
+}
+
 func validateRule(rule *Rule) error {
 	if rule.ID == "" {
 		return fmt.Errorf("rule has an empty ID")
@@ -124,18 +337,240 @@ func validateRule(rule *Rule) error {
 	if len(rule.Targets) == 0 {
 		return fmt.Errorf("rule '%s' has no targets", rule.ID)
 	}
+	for _, target := range rule.Targets {
+		if err := validateTarget(target); err != nil {
+			return fmt.Errorf("rule '%s' has an invalid target: %w", rule.ID, err)
+		}
+	}
 	if rule.Phase < 1 || rule.Phase > 4 {
 		return fmt.Errorf("rule '%s' has an invalid phase: %d. Valid phases are 1 to 4", rule.ID, rule.Phase)
 	}
 	if rule.Score < 0 {
 		return fmt.Errorf("rule '%s' has a negative score", rule.ID)
 	}
-	if rule.Action != "" && rule.Action != "block" && rule.Action != "log" {
-		return fmt.Errorf("rule '%s' has an invalid action: '%s'. Valid actions are 'block' or 'log'", rule.ID, rule.Action)
+	if !isValidSeverity(rule.Severity) {
+		return fmt.Errorf("rule '%s' has an invalid severity: '%s'. Valid severities are: %s", rule.ID, rule.Severity, strings.Join(validSeverities, ", "))
+	}
+	if rule.Action != "" && !slices.Contains(validActions, rule.Action) {
+		return fmt.Errorf("rule '%s' has an invalid action: '%s'. Valid actions are: %s", rule.ID, rule.Action, strings.Join(validActions, ", "))
+	}
+	if err := validateRuleAction(rule); err != nil {
+		return fmt.Errorf("rule '%s': %w", rule.ID, err)
+	}
+	if err := validateTransforms(rule.Transforms); err != nil {
+		return fmt.Errorf("rule '%s' has an invalid transform: %w", rule.ID, err)
+	}
+	if normalizeOperator(rule.Operator) == "" {
+		return fmt.Errorf("rule '%s' has an invalid operator: '%s'. Valid operators are: %s", rule.ID, rule.Operator, strings.Join(knownOperators, ", "))
+	}
+	if rule.ParanoiaLevel < 0 || rule.ParanoiaLevel > maxParanoiaLevel {
+		return fmt.Errorf("rule '%s' has an invalid paranoia level: %d. Valid levels are 1 to %d", rule.ID, rule.ParanoiaLevel, maxParanoiaLevel)
+	}
+	for i, cond := range rule.Chain {
+		if err := validateRuleCondition(&cond); err != nil {
+			return fmt.Errorf("rule '%s' has an invalid chain condition at index %d: %w", rule.ID, i, err)
+		}
 	}
 	return nil
 }
 
+// validActions lists the rule actions accepted by validateRule.
+var validActions = []string{ActionBlock, ActionDeny, ActionLog, ActionPass, ActionAllow, ActionRedirect, ActionDrop, ActionTarpit}
+
+const (
+	defaultTarpitDelay = 5 * time.Second
+	maxTarpitDelay     = time.Minute // Bounds how long a tarpitted request holds a connection
+)
+
+// validateRuleAction checks the status, redirect_url and tarpit_delay fields against the rule's action.
+func validateRuleAction(rule *Rule) error {
+	switch rule.Action {
+	case ActionRedirect:
+		if rule.RedirectURL == "" {
+			return fmt.Errorf("redirect action requires a redirect_url")
+		}
+		if rule.Status != 0 && (rule.Status < 300 || rule.Status > 399) {
+			return fmt.Errorf("invalid redirect status %d, must be 3xx", rule.Status)
+		}
+	case ActionBlock, ActionDeny, ActionTarpit:
+		if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+			return fmt.Errorf("invalid %s status %d, must be 4xx or 5xx", rule.Action, rule.Status)
+		}
+	default:
+		if rule.Status != 0 {
+			return fmt.Errorf("status is only used by the block, deny, tarpit and redirect actions")
+		}
+	}
+	if rule.RedirectURL != "" && rule.Action != ActionRedirect {
+		return fmt.Errorf("redirect_url is only used by the redirect action")
+	}
+	if rule.TarpitDelay != "" {
+		if rule.Action != ActionTarpit {
+			return fmt.Errorf("tarpit_delay is only used by the tarpit action")
+		}
+		delay, err := time.ParseDuration(rule.TarpitDelay)
+		if err != nil {
+			return fmt.Errorf("invalid tarpit_delay: %w", err)
+		}
+		if delay <= 0 || delay > maxTarpitDelay {
+			return fmt.Errorf("tarpit_delay must be between 0 and %s", maxTarpitDelay)
+		}
+	}
+	return nil
+}
+
+// isDisruptiveAction reports whether a rule with the action stops the request as soon as it matches.
+func isDisruptiveAction(action string) bool {
+	switch action {
+	case ActionBlock, ActionDeny, ActionRedirect, ActionDrop, ActionTarpit:
+		return true
+	}
+	return false
+}
+
+// statusCode returns the response status used when the rule stops a request.
+func (rule *Rule) statusCode() int {
+	if rule.Status != 0 {
+		return rule.Status
+	}
+	if rule.Action == ActionRedirect {
+		return http.StatusFound
+	}
+	return http.StatusForbidden
+}
+
+// tarpitDuration returns the rule's tarpit delay. tarpit_delay is checked when the rule is loaded.
+func (rule *Rule) tarpitDuration() time.Duration {
+	if delay, err := time.ParseDuration(rule.TarpitDelay); err == nil {
+		return delay
+	}
+	return defaultTarpitDelay
+}
+
+// maxParanoiaLevel is the highest paranoia level. Rules above the site's level are not applied.
+const maxParanoiaLevel = 4
+
+// paranoiaLevel returns the configured paranoia level, defaulting to 1.
+func (m *Middleware) paranoiaLevel() int {
+	if m.ParanoiaLevel == 0 {
+		return 1
+	}
+	return m.ParanoiaLevel
+}
+
+// ruleDisabledReason reports why a valid rule is left out by the site's rule selection
+// (disable_rule, disable_tags, enable_tags, paranoia_level), or "" if the rule applies.
+func (m *Middleware) ruleDisabledReason(rule *Rule) string {
+	if ruleIDRemoved(m.DisableRules, rule.ID) {
+		return "disabled by disable_rule"
+	}
+	if tag, ok := hasAnyTag(rule.Tags, m.DisableTags); ok {
+		return fmt.Sprintf("tag '%s' disabled by disable_tags", tag)
+	}
+	if len(m.EnableTags) > 0 {
+		if _, ok := hasAnyTag(rule.Tags, m.EnableTags); !ok {
+			return "no tag listed in enable_tags"
+		}
+	}
+	if rule.ParanoiaLevel > m.paranoiaLevel() {
+		return fmt.Sprintf("paranoia level %d is above the configured level %d", rule.ParanoiaLevel, m.paranoiaLevel())
+	}
+	return ""
+}
+
+// hasAnyTag returns the first of tags that is also listed in selected (case-insensitive).
+func hasAnyTag(tags, selected []string) (string, bool) {
+	for _, tag := range tags {
+		for _, s := range selected {
+			if strings.EqualFold(tag, s) {
+				return tag, true
+			}
+		}
+	}
+	return "", false
+}
+
+// validateRuleCondition checks a single chained condition.
+func validateRuleCondition(cond *RuleCondition) error {
+	if cond.Pattern == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	if len(cond.Targets) == 0 {
+		return fmt.Errorf("no targets")
+	}
+	for _, target := range cond.Targets {
+		if err := validateTarget(target); err != nil {
+			return err
+		}
+	}
+	if normalizeOperator(cond.Operator) == "" {
+		return fmt.Errorf("invalid operator: '%s'", cond.Operator)
+	}
+	return validateTransforms(cond.Transforms)
+}
+
+// matchRule applies the rule's transforms to value and reports whether the result satisfies the rule operator.
+func (m *Middleware) matchRule(rule *Rule, value string, state *WAFState) bool {
+	transformed := applyTransforms(rule.Transforms, value, state)
+	var matched bool
+	if rule.matcher != nil {
+		matched = rule.matcher.Match(transformed)
+	} else {
+		matched = rule.regex.MatchString(transformed)
+	}
+	return matched != rule.Negate
+}
+
+// compileRuleChain compiles the operator of every chained condition of the rule.
+func compileRuleChain(rule *Rule, baseDir string) error {
+	for i := range rule.Chain {
+		cond := &rule.Chain[i]
+		matcher, err := compileOperator(cond.Operator, cond.Pattern, baseDir)
+		if err != nil {
+			return fmt.Errorf("chain condition at index %d: %w", i, err)
+		}
+		cond.matcher = matcher
+	}
+	return nil
+}
+
+// matchChain reports whether every chained condition of the rule matches at least one of its targets.
+// Response targets are extracted from w, which is nil in the request phases.
+func (m *Middleware) matchChain(rule *Rule, r *http.Request, w http.ResponseWriter, state *WAFState) bool {
+	for i := range rule.Chain {
+		cond := &rule.Chain[i]
+		condMatched := false
+		for _, target := range cond.Targets {
+			values, err := m.extractValues(target, r, w)
+			if err != nil {
+				continue
+			}
+			for _, tv := range values {
+				if targetExcluded(state.exclusions, rule, tv.Name) {
+					continue
+				}
+				transformed := applyTransforms(cond.Transforms, tv.Value, state)
+				if cond.matcher != nil && cond.matcher.Match(transformed) != cond.Negate {
+					condMatched = true
+					break
+				}
+			}
+			if condMatched {
+				break
+			}
+		}
+		if !condMatched {
+			m.logger.Debug("Chained condition did not match",
+				zap.String("rule_id", rule.ID),
+				zap.Int("condition_index", i),
+				zap.Strings("targets", cond.Targets),
+			)
+			return false
+		}
+	}
+	return true
+}
+
 // loadRules updates the RuleCache and Rules map when rules are loaded and sorts rules by priority.
 // loadRules updates the RuleCache and Rules map when rules are loaded and sorts rules by priority.
 func (m *Middleware) loadRules(paths []string) error {
@@ -149,25 +584,87 @@ func (m *Middleware) loadRules(paths []string) error {
 	invalidFiles := []string{}
 	allInvalidRules := []string{}
 	ruleIDs := make(map[string]bool)
+	report := make([]RuleFileReport, 0, len(paths))
 
+	// Expand directories and glob patterns into a de-duplicated, ordered list of files
+	var files []string
+	seenFiles := make(map[string]bool)
 	for _, path := range paths {
-		fileRules, fileInvalidRules, err := m.loadRulesFromFile(path, ruleIDs) // Load rules from a single file
+		expanded, err := expandRulePath(path)
+		if err != nil {
+			m.logger.Error("Failed to resolve rule path", zap.String("path", path), zap.Error(err))
+			invalidFiles = append(invalidFiles, path)
+			report = append(report, RuleFileReport{File: path, Error: err.Error()})
+			continue
+		}
+		for _, file := range expanded {
+			if !seenFiles[file] {
+				seenFiles[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+
+	// Load every file first: a rule removal (SecRuleRemoveById) in one file applies to the rules of all files
+	type loadedFile struct {
+		rules  map[int][]Rule
+		report RuleFileReport
+	}
+	var loadedFiles []loadedFile
+	var removedIDs []string
+	for _, path := range files {
+		fileRules, fileReport, err := m.loadRulesFromFile(path, ruleIDs) // Load rules from a single file
 		if err != nil {
 			m.logger.Error("Failed to load rule file", zap.String("file", path), zap.Error(err))
 			invalidFiles = append(invalidFiles, path)
+			loadedFiles = append(loadedFiles, loadedFile{report: RuleFileReport{File: path, Error: err.Error()}})
 			continue // Skip to the next file if loading fails
 		}
+		loadedFiles = append(loadedFiles, loadedFile{rules: fileRules, report: fileReport})
+		removedIDs = append(removedIDs, fileReport.Removed...)
+	}
 
-		if len(fileInvalidRules) > 0 {
-			m.logger.Warn("Invalid rules in file", zap.String("file", path), zap.Strings("errors", fileInvalidRules))
-			allInvalidRules = append(allInvalidRules, fileInvalidRules...)
+	for _, file := range loadedFiles {
+		path, fileReport := file.report.File, file.report
+		if fileReport.Error != "" {
+			report = append(report, fileReport)
+			continue
+		}
+		if len(fileReport.Reasons) > 0 {
+			m.logger.Warn("Invalid rules in file", zap.String("file", path), zap.Strings("errors", fileReport.Reasons))
+			allInvalidRules = append(allInvalidRules, fileReport.Reasons...)
+		}
+		if len(fileReport.Warnings) > 0 {
+			m.logger.Warn("Imported rules were approximated", zap.String("file", path), zap.Strings("warnings", fileReport.Warnings))
 		}
 
 		// Merge valid rules from the file into the temporary loadedRules map
-		for phase, rules := range fileRules {
-			loadedRules[phase] = append(loadedRules[phase], rules...)
-			totalRules += len(rules)
+		removed := 0
+		for phase, rules := range file.rules {
+			for _, rule := range rules {
+				if ruleIDRemoved(removedIDs, rule.ID) {
+					removed++
+					continue
+				}
+				if reason := m.ruleDisabledReason(&rule); reason != "" {
+					m.logger.Debug("Rule disabled for this site", zap.String("rule_id", rule.ID), zap.String("reason", reason))
+					fileReport.Disabled++
+					continue
+				}
+				loadedRules[phase] = append(loadedRules[phase], rule)
+				totalRules++
+				fileReport.Loaded++
+			}
 		}
+		report = append(report, fileReport)
+		m.logger.Info("Rule file loaded",
+			zap.String("file", path),
+			zap.Strings("rulesets", fileReport.Rulesets),
+			zap.Int("loaded", fileReport.Loaded),
+			zap.Int("skipped", fileReport.Skipped),
+			zap.Int("disabled", fileReport.Disabled),
+			zap.Int("removed", removed),
+		)
 	}
 
 	ruleCounts := ""
@@ -176,6 +673,8 @@ func (m *Middleware) loadRules(paths []string) error {
 	}
 
 	m.Rules = loadedRules // Atomically update m.Rules after loading all files
+	m.requestBodyRules.Store(rulesReadRequestBody(loadedRules))
+	m.ruleLoadReport = report
 
 	if len(invalidFiles) > 0 {
 		m.logger.Error("Failed to load rule files", zap.Strings("files", invalidFiles)) // Error level for file loading failures
@@ -194,50 +693,269 @@ func (m *Middleware) loadRules(paths []string) error {
 	return nil
 }
 
-// loadRulesFromFile loads and validates rules from a single file.
-func (m *Middleware) loadRulesFromFile(path string, ruleIDs map[string]bool) (validRules map[int][]Rule, invalidRules []string, err error) {
+// decodeRule strictly decodes a single rule: unknown fields (e.g. a misspelled "action") are errors.
+func decodeRule(raw json.RawMessage) (Rule, error) {
+	var rule Rule
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		if rule.ID != "" {
+			return rule, fmt.Errorf("rule '%s': %w", rule.ID, err)
+		}
+		return rule, err
+	}
+	return rule, nil
+}
+
+// ruleFileExtensions are the rule file formats picked up when a rule directory is loaded.
+var ruleFileExtensions = []string{".json", ".yaml", ".yml", modSecurityFileExtension}
+
+func isRuleFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, known := range ruleFileExtensions {
+		if ext == known {
+			return true
+		}
+	}
+	return false
+}
+
+// expandRulePath resolves one configured rule path. A directory yields the rule files directly inside it,
+// a glob pattern (e.g. rules/*.json) yields its matches, and anything else is returned unchanged.
+// Results are sorted by name so that the load order, and with it rule evaluation order, is deterministic.
+func expandRulePath(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule file pattern: %w", err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("rule file pattern matched no files")
+		}
+		sort.Strings(matches)
+		return matches, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return []string{path}, nil // A missing file is reported when it is read
+	}
+	entries, err := os.ReadDir(path) // Sorted by file name
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule directory: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isRuleFile(entry.Name()) {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("rule directory contains no rule files (%s)", strings.Join(ruleFileExtensions, ", "))
+	}
+	return files, nil
+}
+
+// decodeRuleSets splits a rule file into its documents: YAML files (by extension) may contain several
+// "---" separated documents and JSON files several concatenated values. Each document is either an
+// array of rules or a RuleSet object.
+func decodeRuleSets(path string, content []byte) ([]RuleSet, error) {
+	var docs []json.RawMessage
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		for {
+			var doc interface{}
+			if err := decoder.Decode(&doc); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to parse YAML rules: %w", err)
+			}
+			// Re-encode as JSON so that YAML rules go through exactly the same strict decoding
+			raw, err := json.Marshal(doc)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert YAML rules: %w", err)
+			}
+			docs = append(docs, raw)
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		for {
+			var doc json.RawMessage
+			if err := decoder.Decode(&doc); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+			}
+			docs = append(docs, doc)
+		}
+	}
+
+	sets := make([]RuleSet, 0, len(docs))
+	for i, doc := range docs {
+		doc = bytes.TrimSpace(doc)
+		switch {
+		case bytes.Equal(doc, []byte("null")):
+			continue // Empty YAML document
+		case bytes.HasPrefix(doc, []byte("[")):
+			var rules []json.RawMessage
+			if err := json.Unmarshal(doc, &rules); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal rules in document %d: %w", i+1, err)
+			}
+			sets = append(sets, RuleSet{Rules: rules})
+		case bytes.HasPrefix(doc, []byte("{")):
+			var set RuleSet
+			decoder := json.NewDecoder(bytes.NewReader(doc))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&set); err != nil {
+				return nil, fmt.Errorf("invalid rule set in document %d: %w", i+1, err)
+			}
+			sets = append(sets, set)
+		default:
+			return nil, fmt.Errorf("document %d must be an array of rules or a rule set object", i+1)
+		}
+	}
+	return sets, nil
+}
+
+// label returns "name version" for reporting, or "" for an anonymous rule set.
+func (rs *RuleSet) label() string {
+	return strings.TrimSpace(rs.Name + " " + rs.Version)
+}
+
+// applyDefaults fills in the rule fields left unset with the rule set defaults.
+func (rs *RuleSet) applyDefaults(rule *Rule) {
+	if rule.Phase == 0 {
+		rule.Phase = rs.Phase
+	}
+	if rule.Severity == "" {
+		rule.Severity = rs.Severity
+	}
+	if rule.ParanoiaLevel == 0 {
+		rule.ParanoiaLevel = rs.ParanoiaLevel
+	}
+	if rs.Shadow {
+		rule.Shadow = true
+	}
+	if len(rs.Tags) > 0 {
+		tags := append([]string{}, rs.Tags...)
+		for _, tag := range rule.Tags {
+			duplicate := false
+			for _, existing := range tags {
+				if strings.EqualFold(existing, tag) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				tags = append(tags, tag)
+			}
+		}
+		rule.Tags = tags
+	}
+}
+
+// loadRulesFromFile loads and validates rules from a single JSON, YAML or ModSecurity (.conf) file.
+// The returned report lists the rule sets and skipped rules; the caller fills in the loaded count.
+func (m *Middleware) loadRulesFromFile(path string, ruleIDs map[string]bool) (validRules map[int][]Rule, report RuleFileReport, err error) {
 	m.logger.Debug("Loading rules from file", zap.String("file", path)) // Log file being loaded
 	validRules = make(map[int][]Rule)
+	report = RuleFileReport{File: path}
 	var fileInvalidRules []string
 
 	content, err := os.ReadFile(path)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read rule file: %w", err)
+		return nil, report, fmt.Errorf("failed to read rule file: %w", err)
 	}
 
-	var rules []Rule
-	if err := json.Unmarshal(content, &rules); err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	var sets []RuleSet
+	if isModSecurityFile(path) {
+		imported := parseModSecurity(content)
+		set, err := imported.ruleSet()
+		if err != nil {
+			return nil, report, err
+		}
+		sets = []RuleSet{set}
+		fileInvalidRules = append(fileInvalidRules, imported.Skipped...)
+		report.Warnings = imported.Warnings
+		report.Removed = imported.Removed
+	} else {
+		sets, err = decodeRuleSets(path, content)
+		if err != nil {
+			return nil, report, err
+		}
+	}
+
+	// Decode each rule separately so that one malformed rule does not discard the whole file. Rules keep
+	// their index in the file, counted across all of its rule sets, so that errors point at the rule even
+	// after sorting by priority.
+	type indexedRule struct {
+		Rule
+		index int
+	}
+	var rules []indexedRule
+	index := 0
+	for _, set := range sets {
+		if label := set.label(); label != "" {
+			report.Rulesets = append(report.Rulesets, label)
+		}
+		for _, raw := range set.Rules {
+			i := index
+			index++
+			rule, err := decodeRule(raw)
+			if err != nil {
+				fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule at index %d: %v", i, err))
+				continue
+			}
+			set.applyDefaults(&rule)
+			rules = append(rules, indexedRule{Rule: rule, index: i})
+		}
 	}
 
-	// Sort rules by priority (higher priority first)
-	sort.Slice(rules, func(i, j int) bool {
+	// Sort rules by priority (higher priority first), keeping file order for equal priorities
+	sort.SliceStable(rules, func(i, j int) bool {
 		return rules[i].Priority > rules[j].Priority
 	})
 
-	for i, rule := range rules {
+	for _, indexed := range rules {
+		rule := indexed.Rule
 		if err := validateRule(&rule); err != nil {
-			fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule at index %d: %v", i, err))
+			fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule at index %d: %v", indexed.index, err))
 			continue
 		}
 
 		if _, exists := ruleIDs[string(rule.ID)]; exists {
-			fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Duplicate rule ID '%s' at index %d", rule.ID, i))
+			fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Duplicate rule ID '%s' at index %d", rule.ID, indexed.index))
 			continue
 		}
 		ruleIDs[string(rule.ID)] = true // Track rule IDs to prevent duplicates
 
-		// RuleCache handling (compile and cache regex)
-		if cachedRegex, exists := m.ruleCache.Get(rule.ID); exists {
-			rule.regex = cachedRegex
+		if normalizeOperator(rule.Operator) == OperatorRegex {
+			// RuleCache handling (compile and cache regex)
+			if cachedRegex, exists := m.ruleCache.Get(rule.ID); exists {
+				rule.regex = cachedRegex
+			} else {
+				compiledRegex, err := regexp.Compile(rule.Pattern)
+				if err != nil {
+					fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule '%s': invalid regex pattern: %v", rule.ID, err))
+					continue
+				}
+				rule.regex = compiledRegex
+				m.ruleCache.Set(rule.ID, compiledRegex) // Cache regex
+			}
+			rule.matcher = &regexMatcher{regex: rule.regex}
 		} else {
-			compiledRegex, err := regexp.Compile(rule.Pattern)
+			matcher, err := compileOperator(rule.Operator, rule.Pattern, filepath.Dir(path))
 			if err != nil {
-				fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule '%s': invalid regex pattern: %v", rule.ID, err))
+				fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule '%s': %v", rule.ID, err))
 				continue
 			}
-			rule.regex = compiledRegex
-			m.ruleCache.Set(rule.ID, compiledRegex) // Cache regex
+			rule.matcher = matcher
+		}
+
+		if err := compileRuleChain(&rule, filepath.Dir(path)); err != nil {
+			fileInvalidRules = append(fileInvalidRules, fmt.Sprintf("Rule '%s': %v", rule.ID, err))
+			continue
 		}
 
 		if _, ok := validRules[rule.Phase]; !ok {
@@ -252,5 +970,7 @@ func (m *Middleware) loadRulesFromFile(path string, ruleIDs map[string]bool) (va
 	}
 	m.logger.Debug("Rules loaded from file by phase", zap.String("file", path), zap.String("counts", ruleCounts)) // Log rules count per phase
 
-	return validRules, fileInvalidRules, nil
+	report.Skipped = len(fileInvalidRules)
+	report.Reasons = fileInvalidRules
+	return validRules, report, nil
 }
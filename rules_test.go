@@ -2,12 +2,18 @@ package caddywaf
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
 
@@ -70,6 +76,69 @@ func TestValidateRule(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Invalid Transform",
+			rule: Rule{
+				ID:         "test",
+				Pattern:    ".*",
+				Targets:    []string{"REQUEST_URI"},
+				Phase:      1,
+				Score:      5,
+				Action:     "block",
+				Transforms: []string{"lowercase", "rot13"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid Operator",
+			rule: Rule{
+				ID:       "test",
+				Pattern:  ".*",
+				Targets:  []string{"REQUEST_URI"},
+				Phase:    1,
+				Score:    5,
+				Action:   "block",
+				Operator: "soundsLike",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Unknown Target",
+			rule: Rule{
+				ID:      "test",
+				Pattern: ".*",
+				Targets: []string{"REQUEST_COOKIE"},
+				Phase:   1,
+				Score:   5,
+				Action:  "block",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid Paranoia Level",
+			rule: Rule{
+				ID:            "test",
+				Pattern:       ".*",
+				Targets:       []string{"ARGS"},
+				Phase:         1,
+				Score:         5,
+				ParanoiaLevel: 5,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Invalid Chain Condition",
+			rule: Rule{
+				ID:      "test",
+				Pattern: ".*",
+				Targets: []string{"METHOD"},
+				Phase:   1,
+				Score:   5,
+				Action:  "block",
+				Chain:   []RuleCondition{{Targets: []string{"PATH"}}},
+			},
+			wantErr: true,
+		},
 		{
 			name: "Valid Rule",
 			rule: Rule{
@@ -94,6 +163,41 @@ func TestValidateRule(t *testing.T) {
 	}
 }
 
+func TestValidateRule_Actions(t *testing.T) {
+	base := Rule{ID: "test", Pattern: ".*", Targets: []string{"URI"}, Phase: 1}
+	tests := []struct {
+		name    string
+		change  func(rule *Rule)
+		wantErr string
+	}{
+		{"deny with status", func(r *Rule) { r.Action, r.Status = ActionDeny, 406 }, ""},
+		{"redirect", func(r *Rule) { r.Action, r.RedirectURL, r.Status = ActionRedirect, "/login", 303 }, ""},
+		{"tarpit with delay", func(r *Rule) { r.Action, r.TarpitDelay = ActionTarpit, "2s" }, ""},
+		{"allow, drop and pass", func(r *Rule) { r.Action = ActionAllow }, ""},
+		{"unknown action", func(r *Rule) { r.Action = "reject" }, "Valid actions are: block, deny, log, pass, allow, redirect, drop, tarpit"},
+		{"redirect without URL", func(r *Rule) { r.Action = ActionRedirect }, "requires a redirect_url"},
+		{"redirect with 4xx status", func(r *Rule) { r.Action, r.RedirectURL, r.Status = ActionRedirect, "/", 403 }, "must be 3xx"},
+		{"deny with 2xx status", func(r *Rule) { r.Action, r.Status = ActionDeny, 200 }, "must be 4xx or 5xx"},
+		{"status without disruptive action", func(r *Rule) { r.Action, r.Status = ActionLog, 403 }, "status is only used"},
+		{"redirect_url without redirect", func(r *Rule) { r.Action, r.RedirectURL = ActionDeny, "/" }, "redirect_url is only used"},
+		{"tarpit_delay without tarpit", func(r *Rule) { r.Action, r.TarpitDelay = ActionDeny, "1s" }, "tarpit_delay is only used"},
+		{"tarpit_delay too long", func(r *Rule) { r.Action, r.TarpitDelay = ActionTarpit, "2m" }, "tarpit_delay must be between"},
+		{"invalid tarpit_delay", func(r *Rule) { r.Action, r.TarpitDelay = ActionTarpit, "soon" }, "invalid tarpit_delay"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := base
+			tt.change(&rule)
+			err := validateRule(&rule)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestProcessRuleMatch(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 
@@ -162,7 +266,7 @@ func TestProcessRuleMatch(t *testing.T) {
 				ResponseWritten: tt.responseWritten,
 			}
 
-			result := m.processRuleMatch(w, r, &tt.rule, "test-value", state)
+			result := m.processRuleMatch(w, r, &tt.rule, "ARGS", "test-value", state)
 			if result == tt.wantBlock {
 				t.Errorf("processRuleMatch() returned %v, want %v", result, !tt.wantBlock)
 			}
@@ -170,6 +274,98 @@ func TestProcessRuleMatch(t *testing.T) {
 	}
 }
 
+func TestProcessRuleMatch_ShadowRule(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 10}
+	r := httptest.NewRequest("GET", "/test", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ContextKeyLogId("logID"), "test-log-id"))
+
+	tests := []struct {
+		name           string
+		rule           Rule
+		wantWouldBlock bool
+	}{
+		{"below threshold", Rule{ID: "shadow-low", Phase: 2, Score: 4, Shadow: true}, false},
+		{"shadow and total scores reach threshold", Rule{ID: "shadow-score", Phase: 2, Score: 4, Shadow: true}, true},
+		{"block action", Rule{ID: "shadow-block", Phase: 2, Action: "block", Shadow: true}, true},
+	}
+
+	state := &WAFState{TotalScore: 2, InboundScore: 2}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			assert.True(t, m.processRuleMatch(w, r, &tt.rule, "ARGS:q", "value", state))
+			assert.Equal(t, tt.wantWouldBlock, state.WouldBlock)
+			assert.False(t, state.Blocked)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+
+	assert.Equal(t, 2, state.TotalScore, "shadow matches must not change the anomaly score")
+	assert.Equal(t, 8, state.ShadowScore)
+	assert.Equal(t, int64(1), m.wouldBlockRequests)
+	assert.Equal(t, map[string]int64{"shadow-low": 1, "shadow-score": 1, "shadow-block": 1}, m.shadowRuleHits)
+	assert.Equal(t, int64(3), m.ruleHitsByPhase[2])
+}
+
+func TestProcessRuleMatch_DetectionOnly(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 5, Mode: ModeDetectionOnly}
+	r := httptest.NewRequest("GET", "/test", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ContextKeyLogId("logID"), "test-log-id"))
+	w := httptest.NewRecorder()
+	state := &WAFState{}
+
+	// Matches keep being scored after the threshold is crossed
+	for _, rule := range []Rule{{ID: "a", Score: 5}, {ID: "b", Score: 3}, {ID: "c", Action: "block"}} {
+		assert.True(t, m.processRuleMatch(w, r, &rule, "ARGS:q", "value", state))
+	}
+	assert.False(t, state.Blocked)
+	assert.True(t, state.WouldBlock)
+	assert.Equal(t, 8, state.TotalScore)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), m.wouldBlockRequests)
+}
+
+func TestProcessRuleMatch_DirectionThresholds(t *testing.T) {
+	m := &Middleware{logger: zap.NewNop(), AnomalyThreshold: 5, InboundAnomalyThreshold: 10}
+	r := httptest.NewRequest("GET", "/test", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ContextKeyLogId("logID"), "test-log-id"))
+	state := &WAFState{}
+
+	sqli := Rule{ID: "sqli", Phase: 2, Score: 5, Tags: []string{"attack-sqli", "OWASP_CRS"}}
+	xss := Rule{ID: "xss", Phase: 1, Score: 3, Tags: []string{"attack-xss"}}
+	leak := Rule{ID: "leak", Phase: 4, Score: 4, Tags: []string{"data-leakage"}}
+	errors := Rule{ID: "errors", Phase: 3, Score: 1}
+
+	// 8 is below the inbound threshold even though it exceeds anomaly_threshold
+	assert.True(t, m.processRuleMatch(httptest.NewRecorder(), r, &sqli, "ARGS:q", "x", state))
+	assert.True(t, m.processRuleMatch(httptest.NewRecorder(), r, &xss, "ARGS:q", "x", state))
+	// Outbound rules start from their own score and use anomaly_threshold
+	assert.True(t, m.processRuleMatch(httptest.NewRecorder(), r, &leak, "RESPONSE_BODY", "x", state))
+	w := httptest.NewRecorder()
+	assert.False(t, m.processRuleMatch(w, r, &errors, "RESPONSE_BODY", "x", state))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	assert.Equal(t, 13, state.TotalScore)
+	assert.Equal(t, 8, state.InboundScore)
+	assert.Equal(t, 5, state.OutboundScore)
+	assert.Equal(t, map[int]int{1: 3, 2: 5, 3: 1, 4: 4}, state.PhaseScores)
+	assert.Equal(t, map[string]int{"sqli": 5, "xss": 3, "data-leakage": 4, "other": 1}, state.CategoryScores)
+	assert.Equal(t, map[int]int64{1: 3, 2: 5, 3: 1, 4: 4}, m.scoreByPhase)
+	assert.Equal(t, map[string]int64{"sqli": 5, "xss": 3, "data-leakage": 4, "other": 1}, m.scoreByCategory)
+}
+
+func TestAnomalyThreshold(t *testing.T) {
+	m := &Middleware{AnomalyThreshold: 5}
+	for phase := 1; phase <= 4; phase++ {
+		assert.Equal(t, 5, m.anomalyThreshold(phase))
+	}
+	m.InboundAnomalyThreshold, m.OutboundAnomalyThreshold = 10, 4
+	assert.Equal(t, 10, m.anomalyThreshold(1))
+	assert.Equal(t, 10, m.anomalyThreshold(2))
+	assert.Equal(t, 4, m.anomalyThreshold(3))
+	assert.Equal(t, 4, m.anomalyThreshold(4))
+}
+
 func TestLoadRules(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 
@@ -243,3 +439,315 @@ func TestLoadRules(t *testing.T) {
 		})
 	}
 }
+
+func TestIncrementRuleHitsByVariableMetric_Bounded(t *testing.T) {
+	middleware := &Middleware{logger: zap.NewNop()}
+	for i := 0; i < maxVariableMetricKeys+10; i++ {
+		middleware.incrementRuleHitsByVariableMetric(fmt.Sprintf("ARGS:p%d", i))
+	}
+	middleware.incrementRuleHitsByVariableMetric("ARGS:p0")
+
+	assert.Len(t, middleware.ruleHitsByVariable, maxVariableMetricKeys+1)
+	assert.Equal(t, int64(10), middleware.ruleHitsByVariable["other"])
+	assert.Equal(t, int64(2), middleware.ruleHitsByVariable["ARGS:p0"])
+}
+
+func TestLoadRules_StrictSchemaReport(t *testing.T) {
+	tmpDir := t.TempDir()
+	ruleFile := filepath.Join(tmpDir, "rules.json")
+	rules := `[
+		{"id": "good", "phase": 1, "pattern": "x", "targets": ["URI"], "score": 5, "action": "block"},
+		{"id": "typo", "phase": 1, "pattern": "x", "targets": ["URI"], "score": 5, "acton": "block"},
+		{"id": "bad-target", "phase": 1, "pattern": "x", "targets": ["REQUEST_COOKIE"], "score": 5},
+		{"id": "bad-severity", "phase": 1, "pattern": "x", "targets": ["URI"], "severity": "SEVERE"}
+	]`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(rules), 0644))
+	brokenFile := filepath.Join(tmpDir, "broken.json")
+	assert.NoError(t, os.WriteFile(brokenFile, []byte(`[{"id": "x",`), 0644))
+
+	m := &Middleware{logger: zap.NewNop(), mu: sync.RWMutex{}, ruleCache: NewRuleCache()}
+	assert.NoError(t, m.loadRules([]string{ruleFile, brokenFile}))
+
+	assert.Len(t, m.Rules[1], 1)
+	assert.Equal(t, "block", m.Rules[1][0].Action)
+
+	assert.Len(t, m.ruleLoadReport, 2)
+	report := m.ruleLoadReport[0]
+	assert.Equal(t, ruleFile, report.File)
+	assert.Equal(t, 1, report.Loaded)
+	assert.Equal(t, 3, report.Skipped)
+	assert.Len(t, report.Reasons, 3)
+	assert.Contains(t, report.Reasons[0], `unknown field "acton"`)
+	assert.Contains(t, report.Reasons[1], "unknown target 'REQUEST_COOKIE'")
+	assert.Contains(t, report.Reasons[2], "invalid severity")
+
+	assert.Equal(t, brokenFile, m.ruleLoadReport[1].File)
+	assert.NotEmpty(t, m.ruleLoadReport[1].Error)
+}
+
+func TestLoadRules_ReportsFileIndexAfterPrioritySort(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"id": "first", "phase": 1, "pattern": "x", "targets": ["URI"], "score": 5},
+		{"id": "dup", "phase": 1, "pattern": "x", "targets": ["URI"], "score": 5},
+		{"id": "bad-target", "phase": 1, "pattern": "x", "targets": ["REQUEST_COOKIE"], "score": 5, "priority": 10},
+		{"id": "dup", "phase": 1, "pattern": "y", "targets": ["URI"], "score": 5, "priority": 5}
+	]`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(rules), 0644))
+
+	m := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+	_, report, err := m.loadRulesFromFile(ruleFile, map[string]bool{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"Rule at index 2: rule 'bad-target' has an invalid target: unknown target 'REQUEST_COOKIE'",
+		"Duplicate rule ID 'dup' at index 1",
+	}, report.Reasons)
+}
+
+func TestLoadRules_ReportsFileIndexAcrossRuleSets(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.yaml")
+	content := `
+- id: first
+  phase: 1
+  pattern: x
+  targets: [URI]
+- id: second
+  phase: 1
+  pattern: x
+  targets: [URI]
+---
+- id: bad-target
+  phase: 1
+  pattern: x
+  targets: [REQUEST_COOKIE]
+- id: typo
+  phase: 1
+  pattern: x
+  targets: [URI]
+  acton: block
+`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(content), 0644))
+
+	m := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+	rules, report, err := m.loadRulesFromFile(ruleFile, map[string]bool{})
+	assert.NoError(t, err)
+	assert.Len(t, rules[1], 2)
+	if assert.Len(t, report.Reasons, 2) {
+		assert.True(t, strings.HasPrefix(report.Reasons[0], "Rule at index 3: "), report.Reasons[0])
+		assert.True(t, strings.HasPrefix(report.Reasons[1], "Rule at index 2: "), report.Reasons[1])
+	}
+}
+
+func TestRuleSchema_CoversRuleFields(t *testing.T) {
+	content, err := os.ReadFile("rules.schema.json")
+	assert.NoError(t, err)
+
+	var schema struct {
+		Defs map[string]struct {
+			AdditionalProperties bool                   `json:"additionalProperties"`
+			Properties           map[string]interface{} `json:"properties"`
+		} `json:"$defs"`
+	}
+	assert.NoError(t, json.Unmarshal(content, &schema))
+
+	// Every decodable field must be documented, and nothing else may be allowed
+	for def, typ := range map[string]reflect.Type{
+		"rule": reflect.TypeOf(Rule{}), "condition": reflect.TypeOf(RuleCondition{}), "ruleset": reflect.TypeOf(RuleSet{}),
+	} {
+		var fields []string
+		for i := 0; i < typ.NumField(); i++ {
+			if name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+				fields = append(fields, name)
+			}
+		}
+		var properties []string
+		for name := range schema.Defs[def].Properties {
+			properties = append(properties, name)
+		}
+		assert.ElementsMatch(t, fields, properties, "schema definition %q", def)
+		assert.False(t, schema.Defs[def].AdditionalProperties, "schema definition %q must reject unknown fields", def)
+	}
+}
+
+func TestLoadRules_BundledRuleFiles(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("rules", "*.json"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+
+	for _, file := range append(files, "rules.json") {
+		t.Run(file, func(t *testing.T) {
+			m := &Middleware{logger: zap.NewNop(), ruleCache: NewRuleCache()}
+			rules, _, err := m.loadRulesFromFile(file, map[string]bool{})
+			assert.NoError(t, err)
+			assert.NotEmpty(t, rules, "bundled rule file should load at least one rule")
+		})
+	}
+}
+
+func TestLoadRules_YAMLRuleSets(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "sqli.yaml")
+	content := `
+name: sqli
+version: 1.2.0
+phase: 2
+severity: HIGH
+tags: [attack-sqli, OWASP_CRS]
+rules:
+  - id: sqli-union
+    pattern: (?i)union\s+select
+    targets: [ARGS:*]
+    score: 5
+    action: block
+  - id: sqli-comment
+    phase: 1
+    severity: LOW
+    pattern: "--"
+    targets: [URI]
+    tags: [owasp_crs, comment]
+---
+- id: plain-list
+  phase: 1
+  pattern: x
+  targets: [PATH]
+`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(content), 0644))
+
+	m := &Middleware{logger: zap.NewNop(), mu: sync.RWMutex{}, ruleCache: NewRuleCache()}
+	assert.NoError(t, m.loadRules([]string{ruleFile}))
+
+	assert.Len(t, m.Rules[2], 1)
+	union := m.Rules[2][0]
+	assert.Equal(t, "sqli-union", union.ID)
+	assert.Equal(t, "HIGH", union.Severity)
+	assert.Equal(t, "block", union.Action)
+	assert.Equal(t, []string{"attack-sqli", "OWASP_CRS"}, union.Tags)
+
+	assert.Len(t, m.Rules[1], 2)
+	comment := m.Rules[1][0]
+	assert.Equal(t, "sqli-comment", comment.ID)
+	assert.Equal(t, "LOW", comment.Severity, "rule fields override rule set defaults")
+	assert.Equal(t, []string{"attack-sqli", "OWASP_CRS", "comment"}, comment.Tags)
+	assert.Equal(t, "plain-list", m.Rules[1][1].ID)
+
+	assert.Equal(t, []RuleFileReport{{File: ruleFile, Rulesets: []string{"sqli 1.2.0"}, Loaded: 3}}, m.ruleLoadReport)
+}
+
+func TestDecodeRuleSets_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		content string
+	}{
+		{"unknown rule set field", "rules.json", `{"name": "x", "rule": []}`},
+		{"scalar document", "rules.json", `"rules"`},
+		{"invalid yaml", "rules.yaml", "rules: [\n"},
+		{"non-string yaml keys", "rules.yml", "1: x\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeRuleSets(tt.path, []byte(tt.content))
+			assert.Error(t, err)
+		})
+	}
+
+	// Concatenated JSON documents are accepted
+	sets, err := decodeRuleSets("rules.json", []byte(`[{"id": "a"}] {"name": "b", "rules": []}`))
+	assert.NoError(t, err)
+	assert.Len(t, sets, 2)
+}
+
+func TestExpandRulePath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.yaml", "a.json", "c.yml", "README.md"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("[]"), 0644))
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "nested.json"), 0755))
+
+	files, err := expandRulePath(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "a.json"), filepath.Join(dir, "b.yaml"), filepath.Join(dir, "c.yml")}, files)
+
+	files, err = expandRulePath(filepath.Join(dir, "*.y*ml"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "b.yaml"), filepath.Join(dir, "c.yml")}, files)
+
+	files, err = expandRulePath(filepath.Join(dir, "missing.json"))
+	assert.NoError(t, err, "plain paths are returned as-is and reported when read")
+	assert.Equal(t, []string{filepath.Join(dir, "missing.json")}, files)
+
+	_, err = expandRulePath(filepath.Join(dir, "*.conf"))
+	assert.Error(t, err)
+
+	_, err = expandRulePath(t.TempDir())
+	assert.Error(t, err, "empty rule directory")
+}
+
+func TestLoadRules_DirectoryAndGlobOrdering(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, id string) string {
+		path := filepath.Join(dir, name)
+		rule := fmt.Sprintf(`[{"id": "%s", "phase": 1, "pattern": "x", "targets": ["URI"]}]`, id)
+		assert.NoError(t, os.WriteFile(path, []byte(rule), 0644))
+		return path
+	}
+	second := write("20-second.json", "second")
+	write("10-first.json", "first")
+
+	// The explicit file is listed first; the directory must not load it a second time
+	m := &Middleware{logger: zap.NewNop(), mu: sync.RWMutex{}, ruleCache: NewRuleCache()}
+	assert.NoError(t, m.loadRules([]string{second, dir}))
+
+	var ids []string
+	for _, rule := range m.Rules[1] {
+		ids = append(ids, rule.ID)
+	}
+	assert.Equal(t, []string{"second", "first"}, ids)
+	assert.Len(t, m.ruleLoadReport, 2)
+}
+
+func TestLoadRules_RuleSelection(t *testing.T) {
+	ruleFile := filepath.Join(t.TempDir(), "rules.yaml")
+	rules := `
+name: selection
+phase: 2
+rules:
+  - {id: "942100", pattern: "a", targets: [ARGS], score: 5, tags: [attack-sqli, OWASP_CRS]}
+  - {id: "942200", pattern: "b", targets: [ARGS], score: 5, tags: [attack-sqli, OWASP_CRS], paranoia_level: 2}
+  - {id: "941100", pattern: "c", targets: [ARGS], score: 5, tags: [attack-xss, OWASP_CRS]}
+  - {id: "log4j", pattern: "d", targets: [HEADERS], score: 5, tags: [cve-2021-44228]}
+  - {id: "pl4-only", pattern: "e", targets: [ARGS], score: 5, paranoia_level: 4}
+`
+	assert.NoError(t, os.WriteFile(ruleFile, []byte(rules), 0644))
+
+	tests := []struct {
+		name         string
+		middleware   *Middleware
+		wantIDs      []string
+		wantDisabled int
+	}{
+		{"default paranoia level 1", &Middleware{}, []string{"942100", "941100", "log4j"}, 2},
+		{"paranoia level 2", &Middleware{ParanoiaLevel: 2}, []string{"942100", "942200", "941100", "log4j"}, 1},
+		{"paranoia level 4", &Middleware{ParanoiaLevel: 4}, []string{"942100", "942200", "941100", "log4j", "pl4-only"}, 0},
+		{"enable tags", &Middleware{EnableTags: []string{"ATTACK-SQLI", "cve-2021-44228"}}, []string{"942100", "log4j"}, 3},
+		{"disable tags", &Middleware{DisableTags: []string{"attack-xss"}}, []string{"942100", "log4j"}, 3},
+		{"disable tags wins over enable tags", &Middleware{EnableTags: []string{"OWASP_CRS"}, DisableTags: []string{"attack-sqli"}}, []string{"941100"}, 4},
+		{"disable rule by id and range", &Middleware{ParanoiaLevel: 2, DisableRules: []string{"log4j", "942000-942199"}}, []string{"942200", "941100"}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.middleware
+			m.logger = zap.NewNop()
+			m.ruleCache = NewRuleCache()
+			assert.NoError(t, m.loadRules([]string{ruleFile}))
+
+			var ids []string
+			for _, rule := range m.Rules[2] {
+				ids = append(ids, rule.ID)
+			}
+			assert.Equal(t, tt.wantIDs, ids)
+			assert.Equal(t, tt.wantDisabled, m.ruleLoadReport[0].Disabled)
+			assert.Equal(t, len(tt.wantIDs), m.ruleLoadReport[0].Loaded)
+		})
+	}
+}
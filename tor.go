@@ -2,11 +2,6 @@ package caddywaf
 
 import (
 	"fmt" // Import fmt for improved error formatting
-	"io"
-	"net/http"
-	"os"
-	"sort"
-	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -15,9 +10,12 @@ import (
 
 var torExitNodeURL = "https://check.torproject.org/torbulkexitlist"
 
+// torFeedName is the name of the preconfigured feed of Tor exit nodes.
+const torFeedName = "tor"
+
 type TorConfig struct {
 	Enabled            bool   `json:"enabled,omitempty"`
-	TORIPBlacklistFile string `json:"tor_ip_blacklist_file,omitempty"`
+	TORIPBlacklistFile string `json:"tor_ip_blacklist_file,omitempty"` // Cache of the exit node list
 	UpdateInterval     string `json:"update_interval,omitempty"`
 	RetryOnFailure     bool   `json:"retry_on_failure,omitempty"` // Enable/disable retries
 	RetryInterval      string `json:"retry_interval,omitempty"`   // Retry interval (e.g., "5m")
@@ -25,114 +23,63 @@ type TorConfig struct {
 	logger             *zap.Logger
 }
 
-// Provision sets up the Tor blocking configuration.
+// Provision sets up the Tor blocking configuration. The exit node list is fetched by the tor feed,
+// which the middleware starts along with the other feeds.
 func (t *TorConfig) Provision(ctx caddy.Context) error {
 	t.logger = ctx.Logger()
 	if t.Enabled {
-		if err := t.updateTorExitNodes(); err != nil {
+		if _, err := t.feed(); err != nil {
 			return fmt.Errorf("provisioning tor: %w", err) // Improved error wrapping
 		}
-		go t.scheduleUpdates()
 	}
 	return nil
 }
 
-// updateTorExitNodes fetches the latest Tor exit nodes and updates the IP blacklist.
-func (t *TorConfig) updateTorExitNodes() error {
-	t.logger.Debug("Updating Tor exit nodes...") // Debug log at start of update
-
-	resp, err := http.Get(torExitNodeURL)
-	if err != nil {
-		return fmt.Errorf("http get failed for %s: %w", torExitNodeURL, err) // Improved error message with URL
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http get returned status %s for %s", resp.Status, torExitNodeURL) // Check for non-200 status
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body from %s: %w", torExitNodeURL, err) // Improved error message with URL
+// feed returns the feed of Tor exit nodes: a plain list of IPs, cached in tor_ip_blacklist_file.
+func (t *TorConfig) feed() (Feed, error) {
+	feed := Feed{
+		Name:      torFeedName,
+		URL:       torExitNodeURL,
+		Type:      FeedTypeIP,
+		Format:    FeedFormatPlain,
+		Retries:   -1,
+		CacheFile: t.TORIPBlacklistFile,
 	}
-
-	torIPs := strings.Split(string(data), "\n")
-	existingIPs, err := t.readExistingBlacklist()
-	if err != nil {
-		return fmt.Errorf("failed to read existing blacklist file %s: %w", t.TORIPBlacklistFile, err) // Improved error message with filename
-	}
-
-	// Merge and deduplicate IPs
-	allIPs := append(existingIPs, torIPs...)
-	sort.Strings(allIPs)
-	uniqueIPs := unique(allIPs)
-
-	// Write updated blacklist to file
-	if err := t.writeBlacklist(uniqueIPs); err != nil {
-		return fmt.Errorf("failed to write updated blacklist to file %s: %w", t.TORIPBlacklistFile, err) // Improved error message with filename
-	}
-
-	t.lastUpdated = time.Now()
-	t.logger.Info("Tor exit nodes updated", zap.Int("count", len(uniqueIPs))) // Improved log message
-	t.logger.Debug("Tor exit node update completed successfully")             // Debug log at end of update
-	return nil
-}
-
-// scheduleUpdates periodically updates the Tor exit node list.
-func (t *TorConfig) scheduleUpdates() {
-	interval, err := time.ParseDuration(t.UpdateInterval)
-	if err != nil {
-		t.logger.Error("Invalid update interval", zap.String("interval", t.UpdateInterval), zap.Error(err))
-		return
-	}
-
-	var retryInterval time.Duration
-	if t.RetryOnFailure {
-		retryInterval, err = time.ParseDuration(t.RetryInterval)
+	if t.UpdateInterval != "" {
+		interval, err := time.ParseDuration(t.UpdateInterval)
 		if err != nil {
-			t.logger.Error("Invalid retry interval, disabling retries", zap.String("retry_interval", t.RetryInterval), zap.Error(err))
-			t.RetryOnFailure = false // Disable retries if the interval is invalid
+			return Feed{}, fmt.Errorf("invalid tor update_interval '%s': %w", t.UpdateInterval, err)
 		}
+		feed.RefreshInterval = interval
 	}
-
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	// Use for range to iterate over the ticker channel
-	for range ticker.C {
-		if updateErr := t.updateTorExitNodes(); updateErr != nil { // Renamed err to updateErr for clarity
-			if t.RetryOnFailure {
-				t.logger.Error("Failed to update Tor exit nodes, retrying shortly", zap.Error(updateErr)) // Use updateErr
-				time.Sleep(retryInterval)
-				continue
-			} else {
-				t.logger.Error("Failed to update Tor exit nodes, will retry at next scheduled interval", zap.Error(updateErr)) // Use updateErr
+	if t.RetryOnFailure {
+		feed.Retries = defaultFeedRetries
+		if t.RetryInterval != "" {
+			retryInterval, err := time.ParseDuration(t.RetryInterval)
+			if err != nil {
+				return Feed{}, fmt.Errorf("invalid tor retry_interval '%s': %w", t.RetryInterval, err)
 			}
+			feed.RetryBackoff = retryInterval
 		}
 	}
+	return feed, nil
 }
 
-// readExistingBlacklist reads the current IP blacklist file.
-func (t *TorConfig) readExistingBlacklist() ([]string, error) {
-	data, err := os.ReadFile(t.TORIPBlacklistFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			t.logger.Debug("Blacklist file does not exist, assuming empty list", zap.String("path", t.TORIPBlacklistFile)) // Debug log for non-existent file
-			return nil, nil
-		}
-		return nil, fmt.Errorf("failed to read IP blacklist file %s: %w", t.TORIPBlacklistFile, err) // Improved error message with filename
-	}
-	return strings.Split(string(data), "\n"), nil
-}
+// updateTorExitNodes fetches the latest Tor exit nodes once and writes them to tor_ip_blacklist_file.
+func (t *TorConfig) updateTorExitNodes() error {
+	t.logger.Debug("Updating Tor exit nodes...") // Debug log at start of update
 
-// writeBlacklist writes the updated IP blacklist to the file.
-func (t *TorConfig) writeBlacklist(ips []string) error {
-	data := strings.Join(ips, "\n")
-	err := os.WriteFile(t.TORIPBlacklistFile, []byte(data), 0644)
+	config, err := t.feed()
 	if err != nil {
-		return fmt.Errorf("failed to write IP blacklist file %s: %w", t.TORIPBlacklistFile, err) // Improved error message with filename
+		return err
+	}
+	feed := newRemoteFeed(config.withDefaults(), t.logger)
+	if err := feed.fetch(); err != nil {
+		return err
 	}
-	t.logger.Debug("Blacklist file updated", zap.String("path", t.TORIPBlacklistFile), zap.Int("entry_count", len(ips))) // Debug log for file update
+
+	t.lastUpdated = time.Now()
+	t.logger.Info("Tor exit nodes updated", zap.Int("count", feed.getStats().Entries)) // Improved log message
 	return nil
 }
 
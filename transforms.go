@@ -0,0 +1,186 @@
+package caddywaf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// transformFunc rewrites a target value before it is matched against a rule pattern.
+type transformFunc func(string) string
+
+// transformFuncs maps lowercased transform names (as used in a rule's "transforms" array) to their implementation.
+var transformFuncs = map[string]transformFunc{
+	"none":               func(s string) string { return s },
+	"lowercase":          strings.ToLower,
+	"uppercase":          strings.ToUpper,
+	"trim":               strings.TrimSpace,
+	"urldecode":          transformURLDecode,
+	"urldecodeuni":       transformURLDecodeUni,
+	"htmlentitydecode":   html.UnescapeString,
+	"removenulls":        transformRemoveNulls,
+	"removewhitespace":   transformRemoveWhitespace,
+	"compresswhitespace": transformCompressWhitespace,
+	"base64decode":       transformBase64Decode,
+	"normalizepath":      transformNormalizePath,
+	"normalizepathwin":   transformNormalizePathWin,
+	"length":             func(s string) string { return strconv.Itoa(len(s)) }, // For numeric operators
+}
+
+// validateTransforms checks that every transform name is known.
+func validateTransforms(transforms []string) error {
+	for _, name := range transforms {
+		if _, ok := transformFuncs[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("unknown transform '%s'", name)
+		}
+	}
+	return nil
+}
+
+// applyTransforms runs value through the transformation chain in order.
+// Results are cached in the request state so that rules sharing a chain don't recompute it.
+func applyTransforms(transforms []string, value string, state *WAFState) string {
+	if len(transforms) == 0 {
+		return value
+	}
+
+	chainKey := strings.ToLower(strings.Join(transforms, ","))
+	if state != nil {
+		if cached, ok := state.transformCache[chainKey][value]; ok {
+			return cached
+		}
+	}
+
+	transformed := value
+	for _, name := range transforms {
+		if fn, ok := transformFuncs[strings.ToLower(name)]; ok {
+			transformed = fn(transformed)
+		}
+	}
+
+	if state != nil {
+		if state.transformCache == nil {
+			state.transformCache = make(map[string]map[string]string)
+		}
+		if state.transformCache[chainKey] == nil {
+			state.transformCache[chainKey] = make(map[string]string)
+		}
+		state.transformCache[chainKey][value] = transformed
+	}
+	return transformed
+}
+
+// transformURLDecode decodes %XX sequences and '+' leniently, leaving invalid sequences untouched.
+func transformURLDecode(s string) string {
+	return urlDecode(s, false)
+}
+
+// transformURLDecodeUni is like transformURLDecode but also decodes IIS-style %uXXXX sequences.
+func transformURLDecodeUni(s string) string {
+	return urlDecode(s, true)
+}
+
+func urlDecode(s string, unicode bool) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && unicode && i+5 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U'):
+			if r, err := strconv.ParseUint(s[i+2:i+6], 16, 16); err == nil {
+				b.WriteRune(rune(r))
+				i += 5
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '%' && i+2 < len(s):
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+			} else {
+				b.WriteByte(c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func transformRemoveNulls(s string) string {
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+// isTransformSpace reports whether r counts as whitespace for the whitespace transforms, including NBSP.
+func isTransformSpace(r rune) bool {
+	switch r {
+	case ' ', '\t', '\n', '\r', '\f', '\v', '\u00a0':
+		return true
+	}
+	return false
+}
+
+func transformRemoveWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isTransformSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func transformCompressWhitespace(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inSpace := false
+	for _, r := range s {
+		if isTransformSpace(r) {
+			if !inSpace {
+				b.WriteByte(' ')
+			}
+			inSpace = true
+			continue
+		}
+		inSpace = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// transformBase64Decode decodes standard or URL-safe base64, with or without padding.
+// Values that are not valid base64 are returned unchanged.
+func transformBase64Decode(s string) string {
+	trimmed := strings.TrimSpace(s)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(trimmed); err == nil && utf8.Valid(decoded) {
+			return string(decoded)
+		}
+	}
+	return s
+}
+
+// transformNormalizePath collapses repeated slashes and resolves "." and ".." segments.
+func transformNormalizePath(s string) string {
+	if s == "" {
+		return s
+	}
+	cleaned := path.Clean(s)
+	if strings.HasSuffix(s, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// transformNormalizePathWin converts backslashes to slashes before normalizing the path.
+func transformNormalizePathWin(s string) string {
+	return transformNormalizePath(strings.ReplaceAll(s, "\\", "/"))
+}
@@ -0,0 +1,77 @@
+package caddywaf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransformFuncs(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform string
+		input     string
+		expected  string
+	}{
+		{"lowercase", "lowercase", "SeLeCt", "select"},
+		{"urlDecode", "urlDecode", "%27%20OR%201=1", "' OR 1=1"},
+		{"urlDecode plus", "urlDecode", "a+b", "a b"},
+		{"urlDecode invalid sequence", "urlDecode", "100%zz", "100%zz"},
+		{"urlDecode truncated sequence", "urlDecode", "abc%2", "abc%2"},
+		{"urlDecodeUni", "urlDecodeUni", "%u003cscript%u003e", "<script>"},
+		{"urlDecodeUni plain", "urlDecodeUni", "%3Cscript%3E", "<script>"},
+		{"htmlEntityDecode named", "htmlEntityDecode", "&lt;script&gt;", "<script>"},
+		{"htmlEntityDecode numeric", "htmlEntityDecode", "&#60;&#x3c;", "<<"},
+		{"removeNulls", "removeNulls", "sel\x00ect", "select"},
+		{"removeWhitespace", "removeWhitespace", "un ion\tsel\nect", "unionselect"},
+		{"compressWhitespace", "compressWhitespace", "union \t\n  select", "union select"},
+		{"base64Decode", "base64Decode", "PHNjcmlwdD4=", "<script>"},
+		{"base64Decode unpadded", "base64Decode", "PHNjcmlwdD4", "<script>"},
+		{"base64Decode invalid", "base64Decode", "not base64!", "not base64!"},
+		{"normalizePath", "normalizePath", "/a//b/./c/../../etc/passwd", "/a/etc/passwd"},
+		{"normalizePath trailing slash", "normalizePath", "/admin//", "/admin/"},
+		{"normalizePathWin", "normalizePathWin", "\\windows\\..\\boot.ini", "/boot.ini"},
+		{"trim", "trim", "  x  ", "x"},
+		{"length", "length", "héllo", "6"},
+		{"length empty", "length", "", "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, applyTransforms([]string{tt.transform}, tt.input, nil))
+		})
+	}
+}
+
+func TestApplyTransforms_Chain(t *testing.T) {
+	// Double-encoded HTML entity, upper case: url decode -> html decode -> lowercase
+	value := "%26lt%3BSCRIPT%26gt%3B"
+	result := applyTransforms([]string{"urlDecodeUni", "htmlEntityDecode", "lowercase"}, value, nil)
+	assert.Equal(t, "<script>", result)
+
+	// No transforms leaves the value untouched
+	assert.Equal(t, value, applyTransforms(nil, value, nil))
+}
+
+func TestApplyTransforms_Cache(t *testing.T) {
+	state := &WAFState{}
+	chain := []string{"urlDecode", "lowercase"}
+
+	first := applyTransforms(chain, "%41B", state)
+	assert.Equal(t, "ab", first)
+	assert.Len(t, state.transformCache, 1)
+
+	// Seed the cache with a sentinel to prove the second call is served from it
+	state.transformCache["urldecode,lowercase"]["%41B"] = "cached"
+	assert.Equal(t, "cached", applyTransforms([]string{"URLDecode", "LowerCase"}, "%41B", state))
+
+	// A different chain is cached separately
+	assert.Equal(t, "%41b", applyTransforms([]string{"lowercase"}, "%41B", state))
+	assert.Len(t, state.transformCache, 2)
+}
+
+func TestValidateTransforms(t *testing.T) {
+	assert.NoError(t, validateTransforms([]string{"urlDecodeUni", "HTMLENTITYDECODE", "lowercase"}))
+	assert.NoError(t, validateTransforms(nil))
+	assert.Error(t, validateTransforms([]string{"lowercase", "rot13"}))
+}
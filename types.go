@@ -1,10 +1,13 @@
 package caddywaf
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -33,6 +36,13 @@ type HitCount int
 type TrieNode struct {
 	children map[byte]*TrieNode
 	isLeaf   bool
+	entry    *BlacklistEntry // Metadata of the list entry, nil if it has none
+}
+
+// matches reports whether the node ends a network that is listed at now: expired entries stop matching
+// without a reload.
+func (n *TrieNode) matches(now time.Time) bool {
+	return n.isLeaf && (n.entry == nil || !n.entry.expired(now))
 }
 
 func NewTrieNode() *TrieNode {
@@ -66,13 +76,97 @@ func (t *CIDRTrie) Insert(cidr string) error {
 
 	if ip.To4() != nil {
 		// IPv4
-		return t.insertIPv4(ipNet)
+		return t.insertIPv4(ipNet, nil)
 	} else {
 		// IPv6
-		return t.insertIPv6(ipNet)
+		return t.insertIPv6(ipNet, nil)
 	}
 }
 
+// InsertAddress adds a CIDR, or a single IP address as a /32 or /128 network.
+func (t *CIDRTrie) InsertAddress(entry string) error {
+	cidr, err := addressCIDR(entry)
+	if err != nil {
+		return err
+	}
+	return t.Insert(cidr)
+}
+
+// InsertEntry adds an IP or CIDR along with its metadata, which Lookup returns.
+func (t *CIDRTrie) InsertEntry(entry BlacklistEntry) error {
+	cidr, err := addressCIDR(entry.Value)
+	if err != nil {
+		return err
+	}
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ip.To4() != nil {
+		return t.insertIPv4(ipNet, &entry)
+	}
+	return t.insertIPv6(ipNet, &entry)
+}
+
+// addressCIDR returns a CIDR as is, and a single IP address as a /32 or /128 network.
+func addressCIDR(entry string) (string, error) {
+	if strings.Contains(entry, "/") {
+		return entry, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address '%s'", entry)
+	}
+	if ip.To4() != nil {
+		return entry + "/32", nil
+	}
+	return entry + "/128", nil
+}
+
+// Lookup returns the entry of the most specific network that holds the IP, skipping expired entries.
+// Entries inserted without metadata are returned with their network as the only field set.
+func (t *CIDRTrie) Lookup(ipStr string) (BlacklistEntry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return BlacklistEntry{}, false
+	}
+	root, bits := t.ipv6Root, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, root, bits = ip4, t.ipv4Root, 32
+	} else {
+		ip = ip.To16()
+	}
+
+	var match *TrieNode
+	matchBits := 0
+	node := root
+	now := time.Now()
+	for i := 0; i < bits; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			break
+		}
+		node = node.children[bit]
+		if node.matches(now) {
+			match, matchBits = node, i+1
+		}
+	}
+	if match == nil {
+		return BlacklistEntry{}, false
+	}
+	if match.entry != nil {
+		return *match.entry, true
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(matchBits, bits)), Mask: net.CIDRMask(matchBits, bits)}
+	return BlacklistEntry{Value: network.String()}, true
+}
+
 func (t *CIDRTrie) Contains(ipStr string) bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
@@ -114,16 +208,64 @@ type GeoIPRecord struct {
 
 // Rule struct
 type Rule struct {
-	ID          string   `json:"id"`
-	Phase       int      `json:"phase"`
-	Pattern     string   `json:"pattern"`
-	Targets     []string `json:"targets"`
-	Severity    string   `json:"severity"` // Used for logging only
-	Score       int      `json:"score"`
-	Action      string   `json:"mode"` // Determines the action (block/log)
-	Description string   `json:"description"`
-	regex       *regexp.Regexp
-	Priority    int // New field for rule priority
+	ID            string          `json:"id"`
+	Phase         int             `json:"phase"`
+	Pattern       string          `json:"pattern"`
+	Targets       []string        `json:"targets"`
+	Severity      string          `json:"severity"` // Used for logging only
+	Score         int             `json:"score"`
+	Action        string          `json:"action"` // block, deny, allow, redirect, drop, tarpit, log or pass; empty only scores
+	Description   string          `json:"description"`
+	Tags          []string        `json:"tags,omitempty"`           // Free-form labels; file-level tags are added on load
+	Transforms    []string        `json:"transforms,omitempty"`     // Applied in order to each target value before matching
+	Operator      string          `json:"operator,omitempty"`       // How Pattern is applied (rx, contains, pm, gt, ipMatch, ...); defaults to rx
+	Negate        bool            `json:"negate,omitempty"`         // Invert the operator result
+	Chain         []RuleCondition `json:"chain,omitempty"`          // Extra conditions that must all match (AND) before the rule fires
+	RemoveRules   []string        `json:"remove_rules,omitempty"`   // Rule IDs or "first-last" ranges skipped for the rest of the request once this rule matches
+	ParanoiaLevel int             `json:"paranoia_level,omitempty"` // 1-4; the rule only applies when the site's paranoia_level is at least this. 0 applies at every level
+	Shadow        bool            `json:"shadow,omitempty"`         // Matches are scored and logged separately but never block
+	Status        int             `json:"status,omitempty"`         // Response status for deny, block and tarpit (default 403) or redirect (default 302)
+	RedirectURL   string          `json:"redirect_url,omitempty"`   // Location for the redirect action
+	TarpitDelay   string          `json:"tarpit_delay,omitempty"`   // How long the tarpit action holds the request before denying it (default 5s)
+	regex         *regexp.Regexp
+	matcher       operatorMatcher // Compiled operator; nil falls back to regex
+	Priority      int             `json:"priority,omitempty"` // Higher priority rules are evaluated first
+}
+
+// RuleCondition is one link of a chained rule. It matches when any of its targets satisfies the operator.
+type RuleCondition struct {
+	Targets    []string `json:"targets"`
+	Operator   string   `json:"operator,omitempty"`
+	Pattern    string   `json:"pattern"`
+	Transforms []string `json:"transforms,omitempty"`
+	Negate     bool     `json:"negate,omitempty"`
+	matcher    operatorMatcher
+}
+
+// RuleSet is the object form of a rule file document. Its metadata is inherited by every rule
+// that does not set the corresponding field itself; a plain JSON/YAML array of rules is also accepted.
+type RuleSet struct {
+	Name          string            `json:"name,omitempty"`
+	Version       string            `json:"version,omitempty"`
+	Phase         int               `json:"phase,omitempty"`          // Default phase
+	Severity      string            `json:"severity,omitempty"`       // Default severity
+	Tags          []string          `json:"tags,omitempty"`           // Added to the tags of every rule
+	ParanoiaLevel int               `json:"paranoia_level,omitempty"` // Default paranoia level
+	Shadow        bool              `json:"shadow,omitempty"`         // Run every rule of the set in shadow mode
+	Rules         []json.RawMessage `json:"rules"`
+}
+
+// RuleFileReport summarizes how one rule file was loaded. It is logged and exposed on the metrics endpoint.
+type RuleFileReport struct {
+	File     string   `json:"file"`
+	Rulesets []string `json:"rulesets,omitempty"` // "name version" of each named rule set in the file
+	Loaded   int      `json:"loaded"`
+	Skipped  int      `json:"skipped"`
+	Reasons  []string `json:"reasons,omitempty"`  // One entry per skipped rule
+	Disabled int      `json:"disabled,omitempty"` // Valid rules left out by paranoia_level, enable_tags, disable_tags or disable_rule
+	Warnings []string `json:"warnings,omitempty"` // Parts of imported ModSecurity rules that were dropped or approximated
+	Removed  []string `json:"removed,omitempty"`  // Rule IDs removed from the whole rule set (SecRuleRemoveById)
+	Error    string   `json:"error,omitempty"`    // Set when the whole file could not be read or parsed
 }
 
 // CustomBlockResponse struct
@@ -139,8 +281,42 @@ type WAFState struct {
 	Blocked         bool
 	StatusCode      int
 	ResponseWritten bool
+	WouldBlock      bool           // Set when a shadow rule or detection_only mode would have blocked the request
+	ShadowScore     int            // Score of matched shadow rules, kept apart from TotalScore
+	InboundScore    int            // Score of rules matched in the request phases (1 and 2)
+	OutboundScore   int            // Score of rules matched in the response phases (3 and 4)
+	PhaseScores     map[int]int    // Phase -> score
+	CategoryScores  map[string]int // Rule category (e.g. sqli, from the attack-sqli tag) -> score
+	Allowed         bool           // Set by an allow rule; the remaining rules are skipped
+	IPAllowlisted   bool           // The client IP is allowlisted with the ip_checks scope; IP-based checks are skipped
+
+	action              string                       // Disruptive rule action that ended the request
+	banned              bool                         // The request was rejected by the dynamic ban list
+	transformCache      map[string]map[string]string // Transform chain -> raw value -> transformed value
+	removedRules        []string                     // Rule IDs removed for this request by matched rules (ctl:ruleRemoveById)
+	exclusions          []*RuleExclusion             // Exclusions matching this request
+	exclusionsEvaluated bool
 }
 
+// Rule actions. Actions other than log, pass and allow stop the request when the rule matches;
+// rules without an action only add their score to the anomaly score.
+const (
+	ActionBlock    = "block"    // Deny with the rule's status (default 403)
+	ActionDeny     = "deny"     // Same as block
+	ActionLog      = "log"      // Log the match and continue
+	ActionPass     = "pass"     // Score only, like an empty action
+	ActionAllow    = "allow"    // Stop evaluating rules and let the request through
+	ActionRedirect = "redirect" // Redirect to RedirectURL with the rule's status (default 302)
+	ActionDrop     = "drop"     // Close the connection without a response
+	ActionTarpit   = "tarpit"   // Hold the request for TarpitDelay, then deny it
+)
+
+// Modes of the middleware. In detection_only mode requests are evaluated, scored and logged but never blocked.
+const (
+	ModeBlocking      = "blocking"
+	ModeDetectionOnly = "detection_only"
+)
+
 // Middleware struct
 type Middleware struct {
 	mu sync.RWMutex
@@ -149,6 +325,12 @@ type Middleware struct {
 	IPBlacklistFile  string              `json:"ip_blacklist_file"`
 	DNSBlacklistFile string              `json:"dns_blacklist_file"`
 	AnomalyThreshold int                 `json:"anomaly_threshold"`
+	Mode             string              `json:"mode,omitempty"`           // blocking (default) or detection_only
+	ParanoiaLevel    int                 `json:"paranoia_level,omitempty"` // 1-4, defaults to 1
+	EnableTags       []string            `json:"enable_tags,omitempty"`    // When set, only rules with one of these tags apply
+	DisableTags      []string            `json:"disable_tags,omitempty"`
+	DisableRules     []string            `json:"disable_rules,omitempty"` // Rule IDs or "first-last" ranges
+	Exclusions       []RuleExclusion     `json:"exclusions,omitempty"`    // Request-scoped rule, tag and target exclusions
 	CountryBlock     CountryAccessFilter `json:"country_block"`
 	CountryWhitelist CountryAccessFilter `json:"country_whitelist"`
 	Rules            map[int][]Rule      `json:"-"`
@@ -160,6 +342,36 @@ type Middleware struct {
 	logLevel         zapcore.Level
 	isShuttingDown   bool
 
+	// Anomaly thresholds per direction; 0 falls back to anomaly_threshold
+	InboundAnomalyThreshold  int `json:"inbound_anomaly_threshold,omitempty"`  // Phases 1-2
+	OutboundAnomalyThreshold int `json:"outbound_anomaly_threshold,omitempty"` // Phases 3-4
+
+	// Request body limits, in bytes; 0 uses the defaults (see defaultRequestBodyLimit and friends)
+	RequestBodyLimit         int64  `json:"request_body_limit,omitempty"`           // Whole body, including uploaded files
+	RequestBodyNoFilesLimit  int64  `json:"request_body_no_files_limit,omitempty"`  // Body without the content of uploaded files
+	RequestBodyInMemoryLimit int64  `json:"request_body_in_memory_limit,omitempty"` // Larger bodies are spooled to a temporary file
+	RequestBodyLimitAction   string `json:"request_body_limit_action,omitempty"`    // process_partial (default) or reject
+
+	// Response body inspection; zero values use the defaults (see defaultResponseBodyLimit)
+	ResponseBodyLimit     int64    `json:"response_body_limit,omitempty"`      // Bytes buffered for, or the window inspected by, the phase 4 rules
+	ResponseBodyMIMETypes []string `json:"response_body_mime_types,omitempty"` // Content types whose body is inspected
+	ResponseBodyMode      string   `json:"response_body_mode,omitempty"`       // buffer (default) or stream
+
+	// Guards for decoding compressed bodies; 0 uses the defaults (see defaultDecompressedBodyLimit)
+	DecompressedBodyLimit   int64 `json:"decompressed_body_limit,omitempty"`   // Decoded bytes inspected
+	DecompressionRatioLimit int   `json:"decompression_ratio_limit,omitempty"` // Decoded bytes allowed per compressed byte
+
+	// Client IP resolution behind proxies
+	TrustedProxies  []string `json:"trusted_proxies,omitempty"`   // CIDRs, IPs or private_ranges whose client_ip_headers are believed
+	ClientIPHeaders []string `json:"client_ip_headers,omitempty"` // Headers holding the client IP, tried in order (default X-Forwarded-For)
+	trustedProxies  *ipMatcher
+
+	// IP allowlist
+	IPWhitelistFile string   `json:"ip_whitelist_file,omitempty"` // IPs and CIDRs, one per line, reloaded when the file changes
+	AllowIPs        []string `json:"allow_ips,omitempty"`         // Inline IPs and CIDRs
+	AllowlistScope  string   `json:"allowlist_scope,omitempty"`   // all (default) or ip_checks
+	ipWhitelist     *CIDRTrie
+
 	geoIPCacheTTL               time.Duration
 	geoIPLookupFallbackBehavior string
 
@@ -179,24 +391,43 @@ type Middleware struct {
 	RateLimit   RateLimit
 	rateLimiter *RateLimiter
 
-	totalRequests   int64
-	blockedRequests int64
-	allowedRequests int64
-	ruleHitsByPhase map[int]int64
-	geoIPStats      map[string]int64 // Key: country code, Value: count
-	muMetrics       sync.RWMutex     // Mutex for metrics synchronization
+	AutoBan        AutoBan `json:"auto_ban,omitempty"` // Bans clients that get too many requests blocked
+	banList        *BanList
+	banListRelease sync.Once // Releases the ban list once, on Cleanup or Shutdown
+
+	Feeds []Feed `json:"feeds,omitempty"` // Remote IP and DNS blocklists
+	feeds []*remoteFeed
+
+	totalRequests      int64
+	blockedRequests    int64
+	allowedRequests    int64
+	ruleHitsByPhase    map[int]int64
+	ruleHitsByVariable map[string]int64 // Key: matched variable (e.g. ARGS:username), bounded by maxVariableMetricKeys
+	exclusionHits      map[string]int64 // Key: exclusion name, Value: requests it applied to
+	shadowRuleHits     map[string]int64 // Key: shadow rule ID, Value: match count
+	scoreByPhase       map[int]int64    // Key: phase, Value: anomaly score added by matched rules
+	scoreByCategory    map[string]int64 // Key: rule category, Value: anomaly score added by matched rules
+	wouldBlockRequests int64            // Requests that detection_only mode or shadow rules would have blocked
+	geoIPStats         map[string]int64 // Key: country code, Value: count
+	muMetrics          sync.RWMutex     // Mutex for metrics synchronization
 
 	rateLimiterBlockedRequests int64        // Add rate limiter blocked requests metric
 	muRateLimiterMetrics       sync.RWMutex // Mutex to protect rate limiter metrics
 
 	geoIPBlocked int
 
+	requestBodyLimitExceeded int64 // Requests whose body exceeded request_body_limit or request_body_no_files_limit
+	ipWhitelistHits          int64 // Requests from allowlisted client IPs
+
 	Tor TorConfig `json:"tor,omitempty"`
 
 	logChan chan LogEntry // Buffered channel for log entries
 	logDone chan struct{} // Signal to stop the logging worker
+	logMu   sync.RWMutex  // Guards logChan: sends hold the read lock, StopLogWorker closes it under the write lock
 
-	ruleCache *RuleCache // New field for RuleCache
+	ruleCache        *RuleCache       // New field for RuleCache
+	ruleLoadReport   []RuleFileReport // Outcome of the last rule load, per file
+	requestBodyRules atomic.Bool      // A loaded rule reads the request body, so it is read and its limits checked
 
 	IPBlacklistBlockCount  int64 `json:"ip_blacklist_hits"`
 	muIPBlacklistMetrics   sync.Mutex
@@ -230,7 +461,7 @@ func (rc *RuleCache) Set(ruleID string, regex *regexp.Regexp) {
 	rc.rules[ruleID] = regex
 }
 
-func (t *CIDRTrie) insertIPv4(ipNet *net.IPNet) error {
+func (t *CIDRTrie) insertIPv4(ipNet *net.IPNet, entry *BlacklistEntry) error {
 	ip := ipNet.IP.To4()
 	if ip == nil {
 		return fmt.Errorf("invalid IPv4 address")
@@ -248,10 +479,11 @@ func (t *CIDRTrie) insertIPv4(ipNet *net.IPNet) error {
 	}
 
 	node.isLeaf = true
+	node.entry = entry
 	return nil
 }
 
-func (t *CIDRTrie) insertIPv6(ipNet *net.IPNet) error {
+func (t *CIDRTrie) insertIPv6(ipNet *net.IPNet, entry *BlacklistEntry) error {
 	ip := ipNet.IP.To16()
 	if ip == nil {
 		return fmt.Errorf("invalid IPv6 address")
@@ -269,6 +501,7 @@ func (t *CIDRTrie) insertIPv6(ipNet *net.IPNet) error {
 	}
 
 	node.isLeaf = true
+	node.entry = entry
 	return nil
 }
 
@@ -279,17 +512,18 @@ func (t *CIDRTrie) containsIPv4(ip net.IP) bool {
 	}
 
 	node := t.ipv4Root
+	now := time.Now()
 	for i := 0; i < len(ip)*8; i++ {
 		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
 		if node.children[bit] == nil {
 			return false
 		}
 		node = node.children[bit]
-		if node.isLeaf {
+		if node.matches(now) {
 			return true
 		}
 	}
-	return node.isLeaf
+	return false
 }
 
 func (t *CIDRTrie) containsIPv6(ip net.IP) bool {
@@ -304,13 +538,14 @@ func (t *CIDRTrie) containsIPv6(ip net.IP) bool {
 	}
 
 	node := t.ipv6Root
+	now := time.Now()
 	for i := 0; i < len(ip)*8; i++ {
 		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
 		if node.children[bit] == nil {
 			return false
 		}
 		node = node.children[bit]
-		if node.isLeaf {
+		if node.matches(now) {
 			return true
 		}
 	}